@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// abrDefaultMaxBitrate caps the downlink without -opus-bitrate, plenty
+	// for mono speech
+	abrDefaultMaxBitrate = 32000
+	// abrLossHigh and abrLossLow are the reported loss fractions above
+	// which the bitrate is lowered and below which it is raised again
+	abrLossHigh = 0.1
+	abrLossLow  = 0.02
+	// abrIncrease is how much the bitrate grows per abrIncreaseInterval
+	// while the link is clean, recovering slower than it backs off
+	abrIncrease         = 1.08
+	abrIncreaseInterval = 2 * time.Second
+)
+
+// downlinkBitrate adapts the bitrate the bridge encodes the downlink of a
+// session at to the loss the device reports with -adaptive-bitrate. Fewer
+// bits per frame keep speech continuous where the full bitrate turns into
+// lost packets.
+type downlinkBitrate struct {
+	mu        sync.Mutex
+	bitrate   int
+	min, max  int
+	changedAt time.Time
+	// estimate is the bandwidth estimate with -twcc, zero without
+	estimate int
+}
+
+func newDownlinkBitrate() *downlinkBitrate {
+	maxBitrate := opusBitrate
+	if maxBitrate == 0 {
+		maxBitrate = abrDefaultMaxBitrate
+	}
+	return &downlinkBitrate{
+		bitrate: maxBitrate,
+		min:     min(adaptiveBitrateMin, maxBitrate),
+		max:     maxBitrate,
+	}
+}
+
+// report folds the fraction lost of a receiver report received at now in
+// and returns the bitrate to encode at.
+func (b *downlinkBitrate) report(fractionLost uint8, now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	loss := float64(fractionLost) / 256
+	bitrate := b.bitrate
+	switch {
+	case loss > abrLossHigh:
+		// Back off in proportion to the loss, as the loss based
+		// controller of GCC does
+		bitrate = int(float64(bitrate) * (1 - loss/2))
+	case loss < abrLossLow && now.Sub(b.changedAt) >= abrIncreaseInterval:
+		bitrate = int(float64(bitrate) * abrIncrease)
+	}
+	b.setLocked(bitrate, now)
+	return b.bitrate
+}
+
+// setEstimate caps the bitrate at the bandwidth estimate and returns the
+// bitrate to encode at.
+func (b *downlinkBitrate) setEstimate(estimate int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.estimate = estimate
+	b.setLocked(b.bitrate, time.Now())
+	return b.bitrate
+}
+
+func (b *downlinkBitrate) setLocked(bitrate int, now time.Time) {
+	if b.estimate > 0 {
+		bitrate = min(bitrate, b.estimate)
+	}
+	bitrate = min(max(bitrate, b.min), b.max)
+
+	if bitrate != b.bitrate {
+		log.Debugw("Adapted downlink bitrate", "bitrate", bitrate, "previous", b.bitrate, "estimate", b.estimate)
+		b.bitrate, b.changedAt = bitrate, now
+	}
+}
+
+// adaptDownlink applies a receiver report of the device to the encoders of
+// its downlink.
+func (s *session) adaptDownlink(fractionLost uint8, now time.Time) {
+	if s.bitrate != nil {
+		s.applyDownlinkBitrate(s.bitrate.report(fractionLost, now))
+	}
+}
+
+// applyDownlinkBitrate has the mixer of the participant and the
+// announcements of the session encode at bitrate.
+func (s *session) applyDownlinkBitrate(bitrate int) {
+	p := s.currentParticipant()
+	if p.mixer != nil && s.slots == nil && s.selector == nil {
+		p.mixer.setBitrate(s.id, bitrate)
+	}
+	if s.player != nil {
+		s.player.setBitrate(bitrate)
+	}
+}
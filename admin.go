@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/livekit/protocol/auth"
+)
+
+// authorizeAdmin enforces -admin-token on the operator API. The API is
+// only routed when a token is configured.
+func (app *App) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="livekit-microcontroller-bridge admin"`)
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+type claimRequest struct {
+	Name string `json:"name"`
+	deviceAssignment
+}
+
+// claimsHandler creates a claim code for pairing a new device.
+func (app *App) claimsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	var req claimRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	c, err := app.registry.newClaim(req.Name, req.deviceAssignment, claimTTL)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Infow("Created claim code", "name", c.Name, "deviceID", c.DeviceID, "expiresAt", c.ExpiresAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
+
+// deviceInfo is a paired device in the devices resource, without its
+// credential hash.
+type deviceInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	deviceAssignment
+	ClaimedAt time.Time `json:"claimed_at"`
+}
+
+func newDeviceInfo(device registeredDevice) deviceInfo {
+	return deviceInfo{ID: device.ID, Name: device.Name, deviceAssignment: device.deviceAssignment, ClaimedAt: device.ClaimedAt}
+}
+
+// devicesHandler lists the paired devices.
+func (app *App) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	devices := []deviceInfo{}
+	for _, device := range app.registry.list() {
+		devices = append(devices, newDeviceInfo(device))
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(devices); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
+
+// deviceHandler reads, reassigns or revokes a paired device. A new room,
+// identity or grants apply from the next session of the device on.
+func (app *App) deviceHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	id := r.PathValue("id")
+	device, ok := app.registry.get(id)
+	if !ok {
+		writeError(w, r, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var assignment deviceAssignment
+		if err := json.NewDecoder(r.Body).Decode(&assignment); err != nil {
+			writeError(w, r, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		if device, err = app.registry.assign(id, assignment); errors.Is(err, errTargetTaken) {
+			writeError(w, r, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Errorw("Failed to save registry", err)
+			writeError(w, r, "Failed to save registry", http.StatusInternalServerError)
+			return
+		}
+		room, participantIdentity := device.target()
+		log.Infow("Device reassigned", "deviceID", id, "room", room, "identity", participantIdentity)
+	case http.MethodDelete:
+		if err := app.registry.revoke(id); err != nil {
+			log.Errorw("Failed to save registry", err)
+			writeError(w, r, "Failed to save registry", http.StatusInternalServerError)
+			return
+		}
+		log.Infow("Device revoked", "deviceID", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(newDeviceInfo(*device)); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
+
+// viewerToken is the body of the token resource.
+type viewerToken struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	Room      string    `json:"room"`
+	Identity  string    `json:"identity"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// tokenHandler mints a token for an operator joining the room of a device
+// from a browser, without handing out the API secret. Tokens are listen
+// only, operators can talk to the device with talk=true.
+func (app *App) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	room, identity := query.Get("room"), query.Get("identity")
+	if room == "" {
+		room = roomName
+	}
+	if identity == "" {
+		writeError(w, r, "identity is required", http.StatusBadRequest)
+		return
+	}
+	talk := false
+	if raw := query.Get("talk"); raw != "" {
+		var err error
+		if talk, err = strconv.ParseBool(raw); err != nil {
+			writeError(w, r, "talk must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Joining as a bridged participant would disconnect it
+	app.participantsMu.Lock()
+	_, bridged := app.participants[participantKey(room, identity)]
+	app.participantsMu.Unlock()
+	if bridged {
+		writeError(w, r, "Identity is used by a device", http.StatusConflict)
+		return
+	}
+
+	grant := &auth.VideoGrant{RoomJoin: true, Room: room}
+	grant.SetCanPublish(talk)
+	grant.SetCanPublishData(talk)
+	grant.SetCanSubscribe(true)
+	at := auth.NewAccessToken(apiKey, apiSecret)
+	at.SetVideoGrant(grant).
+		SetIdentity(identity).
+		SetValidFor(viewerTokenTTL)
+	token, err := at.ToJWT()
+	if err != nil {
+		log.Errorw("Failed to create viewer token", err)
+		writeError(w, r, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+	log.Infow("Created viewer token", "room", room, "identity", identity, "talk", talk)
+
+	w.Header().Set("Content-Type", jsonContentType)
+	res := viewerToken{Token: token, URL: host, Room: room, Identity: identity, ExpiresAt: time.Now().Add(viewerTokenTTL)}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
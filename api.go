@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// apiPrefix is the versioned HTTP API. The unversioned routes are kept as
+// aliases for firmware already in the field and keep plain text errors.
+const apiPrefix = "/v1"
+
+// apiError is the body of every error response under apiPrefix.
+type apiError struct {
+	// Code is a stable machine readable identifier, e.g. invalid_offer
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"`
+}
+
+// handle registers h on the legacy pattern, when not empty, and on the
+// versioned pattern.
+func handle(mux *http.ServeMux, legacy, versioned string, h http.HandlerFunc) {
+	if legacy != "" {
+		mux.HandleFunc(legacy, h)
+	}
+	mux.HandleFunc(versioned, h)
+}
+
+func isVersioned(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiPrefix+"/")
+}
+
+// sessionLocation is the session resource URL in the API version the
+// request was made with.
+func sessionLocation(r *http.Request, id string) string {
+	if isVersioned(r) {
+		return apiPrefix + "/sessions/" + id
+	}
+	return sessionPath + id
+}
+
+// writeError is http.Error for the API, the code is derived from the
+// status.
+func writeError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	writeAPIError(w, r, status, statusCode(status), message, "")
+}
+
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, code, message, details string) {
+	if !isVersioned(r) {
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(apiError{Code: code, Message: message, Details: details}); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
+
+// statusCode turns an HTTP status into an error code, 404 is not_found.
+func statusCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
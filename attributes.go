@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"strconv"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// attributesDataChannel is the label of a data channel carrying
+	// attribute updates from the device as JSON
+	attributesDataChannel = "attributes"
+	// attributesInterval is how often changed attributes are sent to
+	// LiveKit, updates in between are coalesced
+	attributesInterval = 5 * time.Second
+)
+
+// deviceAttributes are reported by the device at /connect and on the
+// attributes data channel, and set as attributes of its participant.
+// Fields left out keep their last value.
+type deviceAttributes struct {
+	Firmware string `json:"firmware,omitempty"`
+	// Battery is the charge in percent
+	Battery *float64 `json:"battery,omitempty"`
+	// RSSI is the Wi-Fi signal strength in dBm
+	RSSI  *int   `json:"rssi,omitempty"`
+	Model string `json:"model,omitempty"`
+}
+
+func (a deviceAttributes) values() map[string]string {
+	values := map[string]string{}
+	if a.Firmware != "" {
+		values["firmware"] = a.Firmware
+	}
+	if a.Battery != nil {
+		values["battery"] = strconv.FormatFloat(*a.Battery, 'f', -1, 64)
+	}
+	if a.RSSI != nil {
+		values["rssi"] = strconv.Itoa(*a.RSSI)
+	}
+	if a.Model != "" {
+		values["model"] = a.Model
+	}
+	return values
+}
+
+// updateAttributes merges what the device reported, it is sent to LiveKit
+// with the next publishAttributes.
+func (s *session) updateAttributes(a deviceAttributes) {
+	values := a.values()
+	if len(values) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.attributes == nil {
+		s.attributes = map[string]string{}
+	}
+	for key, value := range values {
+		if s.attributes[key] != value {
+			s.attributes[key] = value
+			s.attributesChanged = true
+		}
+	}
+}
+
+// resendAttributes sends the attributes again with the next
+// publishAttributes, e.g. after the session moved to another participant.
+func (s *session) resendAttributes() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributesChanged = len(s.attributes) > 0
+}
+
+// clearAttributes removes the attributes of the session from p.
+func (s *session) clearAttributes(p *participant) {
+	s.mu.Lock()
+	cleared := map[string]string{}
+	for key := range s.attributes {
+		cleared[key] = ""
+	}
+	s.mu.Unlock()
+
+	if len(cleared) > 0 {
+		p.room.LocalParticipant.SetAttributes(cleared)
+	}
+}
+
+// publishAttributes sends changed device attributes to LiveKit every
+// attributesInterval until the app is shut down.
+func (app *App) publishAttributes() {
+	ticker := time.NewTicker(attributesInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, s := range app.sessionList() {
+			s.mu.Lock()
+			if !s.attributesChanged {
+				s.mu.Unlock()
+				continue
+			}
+			s.attributesChanged = false
+			attributes := maps.Clone(s.attributes)
+			p := s.participant
+			s.mu.Unlock()
+
+			p.room.LocalParticipant.SetAttributes(attributes)
+			log.Debugw("Updated participant attributes", "sessionID", s.id, "attributes", attributes)
+		}
+	}
+}
+
+// onAttributesDataChannel applies the attribute updates the device sends.
+func (app *App) onAttributesDataChannel(s *session, dc *webrtc.DataChannel) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var update deviceAttributes
+		if err := json.Unmarshal(msg.Data, &update); err != nil {
+			log.Errorw("Failed to decode attributes", err, "sessionID", s.id)
+			return
+		}
+		s.updateAttributes(update)
+	})
+}
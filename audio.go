@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/pion/rtp"
+)
+
+// rms returns the root mean square amplitude of pcm.
+func rms(pcm []int16) float64 {
+	if len(pcm) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, sample := range pcm {
+		sum += float64(sample) * float64(sample)
+	}
+	return math.Sqrt(sum / float64(len(pcm)))
+}
+
+// audioLevel returns the RFC 6464 level of pcm, from 0 (loudest) to 127
+// -dBov.
+func audioLevel(pcm []int16) uint8 {
+	level := rms(pcm)
+	if level == 0 {
+		return 127
+	}
+	return uint8(min(127, max(0, math.Round(-20*math.Log10(level/math.MaxInt16)))))
+}
+
+// setAudioLevel records the level of the audio the session published
+// last, it is sent to LiveKit for active speaker detection.
+func (s *session) setAudioLevel(level uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.level = &level
+}
+
+// audioLevel returns the last level set, nil when the session audio isn't
+// measured.
+func (s *session) audioLevel() *uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.level
+}
+
+// opusWriter processes Opus from the device before it is published. It is
+// passed through untouched unless noise suppression, normalization, stereo
+// downmixing, concealment, a gain, -vad or -audio-levels needs the audio
+// decoded. Changed audio is encoded again under the original RTP header of
+// each packet.
+func opusWriter(s *session, write func(*rtp.Packet) error) (func(*rtp.Packet) error, error) {
+	var (
+		decoder opusDecoder
+		encoder opusEncoder
+		v       *voiceDetector
+		failed  bool
+	)
+	suppressor := newNoiseSuppressor(opusClockRate)
+	normalizer := newSessionNormalizer(s, opusClockRate)
+	// A mono decoder mixes stereo down
+	reencode := suppressor != nil || normalizer != nil || s.stereo == stereoDownmix || s.plc
+	if vadEnabled || audioLevels || reencode {
+		var err error
+		if decoder, err = newOpusDecoder(opusClockRate, 1); err != nil {
+			return nil, err
+		}
+	}
+	if reencode {
+		var err error
+		if encoder, err = newTunedOpusEncoder(opusClockRate, s.encoder); err != nil {
+			return nil, err
+		}
+	}
+	if vadEnabled {
+		v = newVoiceDetector()
+	}
+	// 120ms, the longest frame Opus decodes
+	pcm := make([]int16, opusClockRate*120/1000)
+	buf := make([]byte, maxOpusPacketSize)
+
+	// process runs a decoded frame through the pipeline and writes p, or
+	// a packet encoded from the frame in its place
+	process := func(p *rtp.Packet, frame []int16, gainDB float64) error {
+		if suppressor != nil {
+			suppressor.process(frame)
+		}
+
+		if v != nil {
+			wasActive := v.active()
+			v.update(frame, opusClockRate)
+			logVoiceChange(s, wasActive, v.active())
+			if !v.active() {
+				return nil
+			}
+		}
+		if normalizer != nil {
+			normalizer.process(frame)
+		}
+
+		if gainDB != 0 || reencode {
+			size, err := encoder.Encode(applyGain(frame, gainDB), buf)
+			if err != nil {
+				return fmt.Errorf("failed to encode Opus: %w", err)
+			}
+			scaled := *p
+			scaled.Payload = append([]byte(nil), buf[:size]...)
+			p = &scaled
+		}
+
+		if audioLevels {
+			s.setAudioLevel(audioLevel(frame))
+		}
+		return write(p)
+	}
+
+	var (
+		lastSequence  uint16
+		lastTimestamp uint32
+		lastFrame     int
+	)
+	return func(p *rtp.Packet) error {
+		gainDB := s.gain()
+		if failed || (decoder == nil && gainDB == 0) {
+			return write(p)
+		}
+
+		if gainDB != 0 && encoder == nil {
+			var err error
+			if decoder == nil {
+				decoder, err = newOpusDecoder(opusClockRate, 1)
+			}
+			if err == nil {
+				encoder, err = newTunedOpusEncoder(opusClockRate, s.encoder)
+			}
+			if err != nil {
+				// Keep the audio flowing unchanged rather than
+				// dropping the track
+				log.Errorw("Failed to apply gain", err, "sessionID", s.id)
+				failed = true
+				return write(p)
+			}
+		}
+
+		if s.plc && lastFrame != 0 {
+			// A late packet was concealed already
+			if int16(p.SequenceNumber-lastSequence) <= 0 {
+				return nil
+			}
+			if err := conceal(decoder, lastSequence, lastTimestamp, lastFrame, p, pcm, func(lost *rtp.Packet, frame []int16) error {
+				return process(lost, frame, gainDB)
+			}); err != nil {
+				return err
+			}
+		}
+
+		n, err := decoder.Decode(p.Payload, pcm)
+		if err != nil {
+			return fmt.Errorf("failed to decode Opus: %w", err)
+		}
+		lastSequence, lastTimestamp, lastFrame = p.SequenceNumber, p.Timestamp, n
+		return process(p, pcm[:n], gainDB)
+	}, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+)
+
+// tokenValidator checks the Bearer token of a signaling request. Every
+// source of credentials is one, static tokens and the device registry for
+// now, the first that accepts a token authorizes the request.
+type tokenValidator interface {
+	// validate returns who the token belongs to, for the logs
+	validate(token string) (string, bool)
+}
+
+// tokenConfig is a static signaling token in the config file.
+type tokenConfig struct {
+	// Name tells in the logs who connected, the token itself is never
+	// logged
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+}
+
+// staticTokens are the tokens of -bearer-token and the config file, keyed
+// by name.
+type staticTokens map[string]string
+
+func (t staticTokens) validate(token string) (string, bool) {
+	valid := ""
+	for name, expected := range t {
+		// Compare against all of them, the time taken doesn't tell
+		// which one matched
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			valid = name
+		}
+	}
+	return valid, valid != ""
+}
+
+func (r *deviceRegistry) validate(token string) (string, bool) {
+	device, ok := r.authenticate(token)
+	if !ok {
+		return "", false
+	}
+	return device.ID, true
+}
+
+// pairedDevice returns the device token was issued to, nil for the static
+// tokens.
+func (app *App) pairedDevice(token string) *registeredDevice {
+	device, _ := app.registry.authenticate(token)
+	return device
+}
+
+// newTokenValidators returns the validators of the configured credentials.
+// The registry is always one, devices paired without -registry are only
+// kept in memory but need their credential all the same.
+func (app *App) newTokenValidators() []tokenValidator {
+	var validators []tokenValidator
+	tokens := staticTokens{}
+	if bearerToken != "" {
+		tokens["bearer-token"] = bearerToken
+	}
+	for _, token := range cfg.Tokens {
+		tokens[token.Name] = token.Token
+	}
+	if len(tokens) > 0 {
+		validators = append(validators, tokens)
+	}
+	return append(validators, app.registry)
+}
+
+func validateTokens(tokens []tokenConfig) error {
+	names := make(map[string]bool, len(tokens))
+	for i, token := range tokens {
+		if token.Name == "" || token.Token == "" {
+			return fmt.Errorf("invalid token %d: name and token are required", i+1)
+		}
+		if token.Name == "bearer-token" || names[token.Name] {
+			return fmt.Errorf("invalid token %d: duplicate name %q", i+1, token.Name)
+		}
+		names[token.Name] = true
+	}
+	return nil
+}
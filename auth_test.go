@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeSession(t *testing.T) {
+	registry, err := loadRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{registry: registry}
+	pair := func(name string) (*registeredDevice, string) {
+		t.Helper()
+		c, err := registry.newClaim(name, deviceAssignment{}, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		device, credential, err := registry.redeem(c.Code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return device, credential
+	}
+	kitchen, kitchenCredential := pair("kitchen")
+	_, doorCredential := pair("door")
+
+	for _, test := range []struct {
+		name     string
+		deviceID string
+		token    string
+		want     bool
+	}{
+		{name: "own session", deviceID: kitchen.ID, token: kitchenCredential, want: true},
+		{name: "other device", deviceID: kitchen.ID, token: doorCredential},
+		{name: "session of a static token", token: doorCredential},
+		{name: "static token", deviceID: kitchen.ID, token: "static", want: true},
+		{name: "no token", deviceID: kitchen.ID, want: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodDelete, "/session/id", nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+
+			if got := app.authorizeSession(w, r, &session{deviceID: test.deviceID}); got != test.want {
+				t.Fatalf("authorizeSession() = %v, want %v", got, test.want)
+			}
+			if !test.want && w.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
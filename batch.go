@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// maxBatchOffers bounds how many sessions one batch request can create.
+const maxBatchOffers = 32
+
+type batchRequest struct {
+	Offers []sessionRequest `json:"offers"`
+}
+
+// batchAnswer is the result for the offer at the same index, either the
+// answer or the error that offer failed with.
+type batchAnswer struct {
+	Answer    string    `json:"sdp,omitempty"`
+	SessionID string    `json:"session_id,omitempty"`
+	Location  string    `json:"location,omitempty"`
+	Error     *apiError `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Answers []batchAnswer `json:"answers"`
+}
+
+// batchConnectHandler creates one session per offer for gateways that
+// aggregate several devices behind one connection. Sessions are
+// negotiated concurrently so the gateway waits for one ICE gathering
+// instead of N.
+func (app *App) batchConnectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorize(w, r) {
+		return
+	}
+	device := app.pairedDevice(requestToken(r))
+
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Errorw("Failed to decode batch request", err)
+		writeError(w, r, "Invalid JSON batch", http.StatusBadRequest)
+		return
+	}
+	if len(req.Offers) == 0 || len(req.Offers) > maxBatchOffers {
+		writeError(w, r, fmt.Sprintf("Batch must contain between 1 and %d offers", maxBatchOffers), http.StatusBadRequest)
+		return
+	}
+
+	res := batchResponse{Answers: make([]batchAnswer, len(req.Offers))}
+	var wg sync.WaitGroup
+	for i, offer := range req.Offers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			offer.device = device
+			s, err := app.createSession(offer)
+			if err != nil {
+				log.Errorw("Failed to create batch session", err, "index", i)
+				status, code, message := negotiationErrorStatus(err)
+				if message == "" {
+					message = "Failed to create session"
+				}
+				res.Answers[i].Error = &apiError{Code: code, Message: message}
+				if status < http.StatusInternalServerError {
+					res.Answers[i].Error.Details = err.Error()
+				}
+				return
+			}
+
+			res.Answers[i] = batchAnswer{
+				Answer:    s.answer(),
+				SessionID: s.id,
+				Location:  sessionLocation(r, s.id),
+			}
+		}()
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+
+	log.Infow("Successfully handled batch connect request", "offers", len(req.Offers))
+}
@@ -0,0 +1,115 @@
+//go:build linux || windows
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"tinygo.org/x/bluetooth"
+)
+
+var (
+	bleServiceUUID  = mustParseUUID("6c6b0001-8e1e-4b39-9d7a-0d2f3b8c5e01")
+	bleURLUUID      = mustParseUUID("6c6b0002-8e1e-4b39-9d7a-0d2f3b8c5e01")
+	bleSSIDUUID     = mustParseUUID("6c6b0003-8e1e-4b39-9d7a-0d2f3b8c5e01")
+	blePasswordUUID = mustParseUUID("6c6b0004-8e1e-4b39-9d7a-0d2f3b8c5e01")
+)
+
+// bleProvisioning is a GATT service on the bridge host. A phone app writes
+// the Wi-Fi credentials, headless devices read them along with the bridge
+// URL and then connect over the normal signaling path.
+type bleProvisioning struct {
+	advertisement *bluetooth.Advertisement
+}
+
+func (app *App) startBLE() error {
+	adapter := bluetooth.DefaultAdapter
+	if err := adapter.Enable(); err != nil {
+		return fmt.Errorf("failed to enable bluetooth adapter: %w", err)
+	}
+
+	var ssid, password bluetooth.Characteristic
+	if err := adapter.AddService(&bluetooth.Service{
+		UUID: bleServiceUUID,
+		Characteristics: []bluetooth.CharacteristicConfig{
+			{
+				UUID:  bleURLUUID,
+				Value: []byte(localSignalingURL()),
+				Flags: bluetooth.CharacteristicReadPermission,
+			},
+			{
+				Handle:     &ssid,
+				UUID:       bleSSIDUUID,
+				Flags:      bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
+				WriteEvent: bleValue(&ssid, "ssid"),
+			},
+			{
+				Handle:     &password,
+				UUID:       blePasswordUUID,
+				Flags:      bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
+				WriteEvent: bleValue(&password, "password"),
+			},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to add GATT service: %w", err)
+	}
+
+	advertisement := adapter.DefaultAdvertisement()
+	if err := advertisement.Configure(bluetooth.AdvertisementOptions{
+		LocalName:    bleName,
+		ServiceUUIDs: []bluetooth.UUID{bleServiceUUID},
+	}); err != nil {
+		return fmt.Errorf("failed to configure advertisement: %w", err)
+	}
+	if err := advertisement.Start(); err != nil {
+		return fmt.Errorf("failed to start advertisement: %w", err)
+	}
+
+	app.ble = &bleProvisioning{advertisement: advertisement}
+	log.Infow("BLE provisioning started", "name", bleName, "service", bleServiceUUID.String())
+	return nil
+}
+
+func (b *bleProvisioning) stop() error {
+	return b.advertisement.Stop()
+}
+
+// bleValue assembles (possibly long, offset) writes to a characteristic
+// and stores the result as its value so devices can read it back. Storing
+// the value fires the write event again with the full value, which is a
+// no-op.
+func bleValue(c *bluetooth.Characteristic, name string) bluetooth.WriteEvent {
+	var (
+		mu    sync.Mutex
+		value []byte
+	)
+	return func(_ bluetooth.Connection, offset int, data []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if offset > len(value) {
+			return
+		}
+		updated := append(append([]byte{}, value[:offset]...), data...)
+		if string(updated) == string(value) {
+			return
+		}
+		value = updated
+
+		log.Infow("BLE provisioning value written", "characteristic", name)
+		go func() {
+			if _, err := c.Write(updated); err != nil {
+				log.Errorw("Failed to store BLE characteristic value", err, "characteristic", name)
+			}
+		}()
+	}
+}
+
+func mustParseUUID(s string) bluetooth.UUID {
+	uuid, err := bluetooth.ParseUUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return uuid
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !windows
+
+package main
+
+import "errors"
+
+type bleProvisioning struct{}
+
+func (app *App) startBLE() error {
+	return errors.New("BLE provisioning is only supported on Linux and Windows")
+}
+
+func (b *bleProvisioning) stop() error {
+	return nil
+}
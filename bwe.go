@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// twccInitialBitrate and twccMinBitrate bound the estimate of GCC on
+	// the device leg, the maximum is -twcc-max-bitrate
+	twccInitialBitrate = 100_000
+	twccMinBitrate     = 10_000
+)
+
+// estimators hands the bandwidth estimator of a PeerConnection to whoever
+// created it, pion builds the interceptors within NewPeerConnection without
+// telling which PeerConnection they are for.
+var estimators struct {
+	mu     sync.Mutex
+	latest cc.BandwidthEstimator
+}
+
+// configureTWCC has PeerConnections number the packets they send with the
+// transport-wide sequence number and estimate the bandwidth to the peer
+// from its feedback, pacing what they send to the estimate.
+func configureTWCC(mediaEngine *webrtc.MediaEngine, interceptors *interceptor.Registry) error {
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		estimator, err := gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(min(twccInitialBitrate, twccMaxBitrate)),
+			gcc.SendSideBWEMinBitrate(twccMinBitrate),
+			gcc.SendSideBWEMaxBitrate(twccMaxBitrate),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return twccEstimator{estimator}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create congestion controller: %w", err)
+	}
+	congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		estimators.latest = estimator
+	})
+	// Added first, the sequence number is only set by the interceptors
+	// after it
+	interceptors.Add(congestionController)
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, interceptors); err != nil {
+		return fmt.Errorf("failed to register TWCC header extension: %w", err)
+	}
+	return nil
+}
+
+// twccEstimator leaves out the streams of devices that didn't negotiate the
+// transport-wide sequence number, GCC drops their packets otherwise.
+type twccEstimator struct {
+	cc.BandwidthEstimator
+}
+
+func (e twccEstimator) AddStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	for _, extension := range info.RTPHeaderExtensions {
+		if extension.URI == sdp.TransportCCURI {
+			return e.BandwidthEstimator.AddStream(info, writer)
+		}
+	}
+	return writer
+}
+
+// newPeerConnection creates a PeerConnection with api, returning its
+// bandwidth estimator with -twcc.
+func newPeerConnection(api *webrtc.API, config webrtc.Configuration) (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	estimators.mu.Lock()
+	defer estimators.mu.Unlock()
+
+	estimators.latest = nil
+	pc, err := api.NewPeerConnection(config)
+	return pc, estimators.latest, err
+}
+
+// followEstimate caps the downlink bitrate of the session at the bandwidth
+// estimate of its PeerConnection.
+func (s *session) followEstimate() {
+	if s.estimator == nil {
+		return
+	}
+	s.estimator.OnTargetBitrateChange(func(bitrate int) {
+		log.Debugw("Bandwidth estimate changed", "sessionID", s.id, "bitrate", bitrate)
+		if s.bitrate != nil {
+			s.applyDownlinkBitrate(s.bitrate.setEstimate(bitrate))
+		}
+	})
+}
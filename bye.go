@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"slices"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// goodbyeReason is the reason of the BYE the bridge sends when it closes a
+// session.
+const goodbyeReason = "session closed"
+
+// isGoodbye returns true when packets carry a BYE of the device.
+func isGoodbye(packets []rtcp.Packet) bool {
+	return slices.ContainsFunc(packets, func(packet rtcp.Packet) bool {
+		_, ok := packet.(*rtcp.Goodbye)
+		return ok
+	})
+}
+
+// readUplinkReports reads the RTCP the device sends along with the media of
+// receiver, returning true once it sent BYE.
+func (s *session) readUplinkReports(receiver *webrtc.RTPReceiver) bool {
+	for {
+		packets, _, err := receiver.ReadRTCP()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Debugw("Stopped reading uplink RTCP", "sessionID", s.id, "error", err)
+			}
+			return false
+		}
+		if isGoodbye(packets) {
+			return true
+		}
+	}
+}
+
+// goodbye closes the session of a device that sent BYE, without waiting for
+// ICE to time out.
+func (app *App) goodbye(s *session) {
+	log.Infow("Device sent BYE", "sessionID", s.id)
+	app.closeSession(s.id)
+}
+
+// sendGoodbye sends BYE for the streams the bridge sends to the device, so
+// its firmware stops playout as the session closes.
+func (s *session) sendGoodbye() {
+	var sources []uint32
+	for _, sender := range s.pc.GetSenders() {
+		if sender.Track() == nil {
+			continue
+		}
+		for _, encoding := range sender.GetParameters().Encodings {
+			sources = append(sources, uint32(encoding.SSRC))
+		}
+	}
+	if len(sources) == 0 {
+		return
+	}
+
+	if err := s.pc.WriteRTCP([]rtcp.Packet{&rtcp.Goodbye{Sources: sources, Reason: goodbyeReason}}); err != nil {
+		log.Debugw("Failed to send BYE", "sessionID", s.id, "error", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// certificateValidity is how long a generated DTLS certificate is valid,
+// devices pin its fingerprint so it should outlive them.
+const certificateValidity = 10 * 365 * 24 * time.Hour
+
+// newCertificate generates the DTLS certificate shared by every
+// PeerConnection, so devices can pin its fingerprint.
+func newCertificate() (*webrtc.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DTLS key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DTLS certificate serial: %w", err)
+	}
+
+	// pion's own certificates expire after a month, PeerConnections
+	// can't be created with an expired one
+	now := time.Now()
+	certificate, err := webrtc.NewCertificate(key, x509.Certificate{
+		Issuer:       pkix.Name{CommonName: "livekit-microcontroller-bridge"},
+		Subject:      pkix.Name{CommonName: "livekit-microcontroller-bridge"},
+		NotBefore:    now.AddDate(0, 0, -1),
+		NotAfter:     now.Add(certificateValidity),
+		SerialNumber: serial,
+		Version:      2,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DTLS certificate: %w", err)
+	}
+	return certificate, nil
+}
+
+// loadCertificate reads the DTLS certificate from path, generating and
+// saving one first if there is none, so the fingerprint survives restarts.
+func loadCertificate(path string) (*webrtc.Certificate, error) {
+	if path == "" {
+		return newCertificate()
+	}
+
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		certificate, err := webrtc.CertificateFromPEM(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse DTLS certificate: %w", err)
+		}
+		if certificate.Expires().Before(time.Now()) {
+			return nil, fmt.Errorf("DTLS certificate %s expired on %s", path, certificate.Expires().Format(time.DateOnly))
+		}
+		return certificate, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read DTLS certificate: %w", err)
+	}
+
+	certificate, err := newCertificate()
+	if err != nil {
+		return nil, err
+	}
+	pem, err := certificate.PEM()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode DTLS certificate: %w", err)
+	}
+
+	// The file holds the private key, writeFileAtomic keeps it private
+	if err := writeFileAtomic(path, []byte(pem)); err != nil {
+		return nil, fmt.Errorf("failed to write DTLS certificate: %w", err)
+	}
+	log.Infow("Generated DTLS certificate", "path", path)
+	return certificate, nil
+}
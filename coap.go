@@ -0,0 +1,741 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal CoAP (RFC 7252) server so devices without an HTTP/TLS stack can
+// still signal. Only what the bridge needs is implemented: confirmable and
+// non-confirmable requests, separate responses and blockwise transfers
+// (RFC 7959) in both directions.
+
+const (
+	coapVersion = 1
+
+	coapTypeCON = 0
+	coapTypeNON = 1
+	coapTypeACK = 2
+	coapTypeRST = 3
+
+	coapPayloadMarker = 0xff
+)
+
+const (
+	coapCodeEmpty  = 0x00
+	coapCodePOST   = 0x02
+	coapCodeDELETE = 0x04
+
+	coapCodeCreated                 = 0x41 // 2.01
+	coapCodeDeleted                 = 0x42 // 2.02
+	coapCodeContinue                = 0x5f // 2.31
+	coapCodeBadRequest              = 0x80 // 4.00
+	coapCodeUnauthorized            = 0x81 // 4.01
+	coapCodeForbidden               = 0x83 // 4.03
+	coapCodeNotFound                = 0x84 // 4.04
+	coapCodeRequestEntityIncomplete = 0x88 // 4.08
+	coapCodeRequestEntityTooLarge   = 0x8d // 4.13
+	coapCodeInternalServerError     = 0xa0 // 5.00
+	coapCodeServiceUnavailable      = 0xa3 // 5.03
+)
+
+const (
+	coapMaxBodySize           = 64 * 1024
+	coapExchangeLifetime      = 247 * time.Second
+	coapAckTimeout            = 2 * time.Second
+	coapMaxRetransmit         = 4
+	coapBlockTransferLifetime = 2 * time.Minute
+	// coapMaxHandlers bounds the requests handled at once, creating a
+	// session waits for ICE gathering
+	coapMaxHandlers = 64
+
+	// Block size exponents, the size of a block is 2^(szx+4)
+	coapMaxBlockSizeExponent  = 6
+	coapBERTBlockSizeExponent = 7
+)
+
+const (
+	coapOptionLocationPath = 8
+	coapOptionURIPath      = 11
+	coapOptionURIQuery     = 15
+	coapOptionBlock2       = 23
+	coapOptionBlock1       = 27
+	coapOptionSize2        = 28
+	coapOptionSize1        = 60
+)
+
+var errCoAPMessageFormat = errors.New("malformed coap message")
+
+type coapOption struct {
+	number uint16
+	value  []byte
+}
+
+type coapMessage struct {
+	typ       uint8
+	code      uint8
+	messageID uint16
+	token     []byte
+	options   []coapOption
+	payload   []byte
+}
+
+func parseCoAPMessage(b []byte) (*coapMessage, error) {
+	if len(b) < 4 || b[0]>>6 != coapVersion {
+		return nil, errCoAPMessageFormat
+	}
+
+	m := &coapMessage{
+		typ:       (b[0] >> 4) & 0x3,
+		code:      b[1],
+		messageID: binary.BigEndian.Uint16(b[2:4]),
+	}
+
+	tokenLength := int(b[0] & 0xf)
+	if tokenLength > 8 || len(b) < 4+tokenLength {
+		return nil, errCoAPMessageFormat
+	}
+	m.token = append([]byte{}, b[4:4+tokenLength]...)
+	b = b[4+tokenLength:]
+
+	number := uint16(0)
+	for len(b) > 0 {
+		if b[0] == coapPayloadMarker {
+			if len(b) == 1 {
+				return nil, errCoAPMessageFormat
+			}
+			m.payload = append([]byte{}, b[1:]...)
+			break
+		}
+
+		delta, length := int(b[0]>>4), int(b[0]&0xf)
+		b = b[1:]
+
+		var err error
+		if delta, b, err = coapOptionExtension(delta, b); err != nil {
+			return nil, err
+		}
+		if length, b, err = coapOptionExtension(length, b); err != nil {
+			return nil, err
+		}
+		if len(b) < length {
+			return nil, errCoAPMessageFormat
+		}
+
+		number += uint16(delta)
+		m.options = append(m.options, coapOption{number: number, value: append([]byte{}, b[:length]...)})
+		b = b[length:]
+	}
+
+	return m, nil
+}
+
+// coapOptionExtension decodes the extended delta/length forms of an option header.
+func coapOptionExtension(v int, b []byte) (int, []byte, error) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errCoAPMessageFormat
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errCoAPMessageFormat
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errCoAPMessageFormat
+	}
+	return v, b, nil
+}
+
+func (m *coapMessage) marshal() []byte {
+	b := []byte{coapVersion<<6 | m.typ<<4 | uint8(len(m.token)), m.code, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], m.messageID)
+	b = append(b, m.token...)
+
+	// Options are already kept sorted by addOption
+	number := uint16(0)
+	for _, o := range m.options {
+		delta, length := int(o.number-number), len(o.value)
+		header := len(b)
+		b = append(b, 0)
+
+		var deltaNibble, lengthNibble uint8
+		deltaNibble, b = coapOptionNibble(delta, b)
+		lengthNibble, b = coapOptionNibble(length, b)
+		b[header] = deltaNibble<<4 | lengthNibble
+
+		b = append(b, o.value...)
+		number = o.number
+	}
+
+	if len(m.payload) != 0 {
+		b = append(b, coapPayloadMarker)
+		b = append(b, m.payload...)
+	}
+	return b
+}
+
+func coapOptionNibble(v int, b []byte) (uint8, []byte) {
+	switch {
+	case v < 13:
+		return uint8(v), b
+	case v < 269:
+		return 13, append(b, uint8(v-13))
+	default:
+		return 14, binary.BigEndian.AppendUint16(b, uint16(v-269))
+	}
+}
+
+func (m *coapMessage) addOption(number uint16, value []byte) {
+	i := len(m.options)
+	for i > 0 && m.options[i-1].number > number {
+		i--
+	}
+	m.options = append(m.options, coapOption{})
+	copy(m.options[i+1:], m.options[i:])
+	m.options[i] = coapOption{number: number, value: value}
+}
+
+func (m *coapMessage) addUintOption(number uint16, v uint32) {
+	value := binary.BigEndian.AppendUint32(nil, v)
+	for len(value) > 0 && value[0] == 0 {
+		value = value[1:]
+	}
+	m.addOption(number, value)
+}
+
+func (m *coapMessage) uintOption(number uint16) (uint32, bool) {
+	for _, o := range m.options {
+		if o.number == number && len(o.value) <= 4 {
+			v := uint32(0)
+			for _, b := range o.value {
+				v = v<<8 | uint32(b)
+			}
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+func (m *coapMessage) stringOptions(number uint16) (values []string) {
+	for _, o := range m.options {
+		if o.number == number {
+			values = append(values, string(o.value))
+		}
+	}
+	return values
+}
+
+func (m *coapMessage) path() string {
+	return "/" + strings.Join(m.stringOptions(coapOptionURIPath), "/")
+}
+
+func (m *coapMessage) query(key string) string {
+	for _, q := range m.stringOptions(coapOptionURIQuery) {
+		if k, v, _ := strings.Cut(q, "="); k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// coapBlock is the value of a Block1 or Block2 option.
+type coapBlock struct {
+	num  uint32
+	more bool
+	szx  uint8
+}
+
+func (m *coapMessage) block(number uint16) (coapBlock, bool, error) {
+	v, ok := m.uintOption(number)
+	if !ok {
+		return coapBlock{}, false, nil
+	}
+
+	b := coapBlock{num: v >> 4, more: v&0x8 != 0, szx: uint8(v & 0x7)}
+	if b.szx == coapBERTBlockSizeExponent {
+		return coapBlock{}, true, errCoAPMessageFormat
+	}
+	return b, true, nil
+}
+
+func (b coapBlock) size() int {
+	return 1 << (b.szx + 4)
+}
+
+func (b coapBlock) value() uint32 {
+	v := b.num<<4 | uint32(b.szx)
+	if b.more {
+		v |= 0x8
+	}
+	return v
+}
+
+type coapTransfer struct {
+	body    []byte
+	updated time.Time
+}
+
+type coapDedupEntry struct {
+	response []byte
+	created  time.Time
+}
+
+type coapServer struct {
+	app  *App
+	conn net.PacketConn
+	szx  uint8
+
+	mu            sync.Mutex
+	uploads       map[string]*coapTransfer
+	downloads     map[string]*coapTransfer
+	dedup         map[string]*coapDedupEntry
+	awaitingACK   map[string]chan struct{}
+	nextMessageID uint16
+
+	// handlers holds a slot for every request being handled, wg tracks
+	// them and the expiry loop until serve returns
+	handlers chan struct{}
+	wg       sync.WaitGroup
+	done     chan struct{}
+}
+
+func newCoAPServer(app *App, conn net.PacketConn, blockSize int) (*coapServer, error) {
+	szx := uint8(0)
+	for ; szx <= coapMaxBlockSizeExponent; szx++ {
+		if 1<<(szx+4) == blockSize {
+			break
+		}
+	}
+	if szx > coapMaxBlockSizeExponent {
+		return nil, fmt.Errorf("coap block size must be a power of two between 16 and 1024, got %d", blockSize)
+	}
+
+	return &coapServer{
+		app:           app,
+		conn:          conn,
+		szx:           szx,
+		uploads:       make(map[string]*coapTransfer),
+		downloads:     make(map[string]*coapTransfer),
+		dedup:         make(map[string]*coapDedupEntry),
+		awaitingACK:   make(map[string]chan struct{}),
+		nextMessageID: uint16(time.Now().UnixNano()),
+		handlers:      make(chan struct{}, coapMaxHandlers),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// serve reads requests until the connection is closed.
+func (c *coapServer) serve() error {
+	defer func() {
+		close(c.done)
+		c.wg.Wait()
+	}()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.expireLoop()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		m, err := parseCoAPMessage(buf[:n])
+		if err != nil {
+			log.Debugw("Dropping malformed CoAP message", "addr", addr, "error", err)
+			continue
+		}
+		c.handleMessage(addr, m)
+	}
+}
+
+func (c *coapServer) handleMessage(addr net.Addr, m *coapMessage) {
+	switch m.typ {
+	case coapTypeACK, coapTypeRST:
+		c.mu.Lock()
+		if ch, ok := c.awaitingACK[c.exchangeKey(addr, m.messageID)]; ok {
+			close(ch)
+			delete(c.awaitingACK, c.exchangeKey(addr, m.messageID))
+		}
+		c.mu.Unlock()
+		return
+	}
+
+	if m.code == coapCodeEmpty {
+		// CoAP ping, answer with a reset
+		c.write(addr, &coapMessage{typ: coapTypeRST, messageID: m.messageID})
+		return
+	}
+
+	if m.typ == coapTypeCON {
+		// Reserve the exchange so retransmissions that arrive while the
+		// request is still being handled are not processed twice
+		c.mu.Lock()
+		key := c.exchangeKey(addr, m.messageID)
+		entry, duplicate := c.dedup[key]
+		if !duplicate {
+			c.dedup[key] = &coapDedupEntry{created: time.Now()}
+		}
+		c.mu.Unlock()
+		if duplicate {
+			if entry.response != nil {
+				c.writeRaw(addr, entry.response)
+			}
+			return
+		}
+	}
+
+	// A busy bridge asks the device to retry rather than piling up
+	// handlers for whoever floods the port
+	select {
+	case c.handlers <- struct{}{}:
+	default:
+		c.respond(addr, m, &coapMessage{code: coapCodeServiceUnavailable})
+		return
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer func() { <-c.handlers }()
+		c.handleRequest(addr, m)
+	}()
+}
+
+func (c *coapServer) handleRequest(addr net.Addr, req *coapMessage) {
+	if c.app.authRequired() && !c.app.validToken(req.query("token")) {
+		c.respond(addr, req, &coapMessage{code: coapCodeUnauthorized})
+		return
+	}
+
+	switch {
+	case req.path() == "/connect" && req.code == coapCodePOST:
+		c.handleConnect(addr, req)
+	case strings.HasPrefix(req.path(), sessionPath) && req.code == coapCodeDELETE:
+		id := strings.TrimPrefix(req.path(), sessionPath)
+		s, ok := c.app.getSession(id)
+		if !ok {
+			c.respond(addr, req, &coapMessage{code: coapCodeNotFound})
+			return
+		}
+		if !s.ownedBy(c.app.pairedDevice(req.query("token"))) {
+			c.respond(addr, req, &coapMessage{code: coapCodeForbidden})
+			return
+		}
+		c.app.closeSession(id)
+		c.respond(addr, req, &coapMessage{code: coapCodeDeleted})
+	default:
+		c.respond(addr, req, &coapMessage{code: coapCodeNotFound})
+	}
+}
+
+func (c *coapServer) handleConnect(addr net.Addr, req *coapMessage) {
+	key := addr.String() + req.path()
+
+	// A request carrying Block2 asks for the next block of an answer we already created
+	if block2, ok, err := req.block(coapOptionBlock2); err != nil {
+		c.respond(addr, req, &coapMessage{code: coapCodeBadRequest})
+		return
+	} else if ok && block2.num > 0 {
+		c.mu.Lock()
+		download, exists := c.downloads[key]
+		c.mu.Unlock()
+		if !exists {
+			c.respond(addr, req, &coapMessage{code: coapCodeRequestEntityIncomplete})
+			return
+		}
+		c.respond(addr, req, c.blockResponse(coapCodeCreated, download.body, &block2, nil))
+		return
+	}
+
+	offer, complete, errCode := c.receiveBlock(addr, key, req)
+	if errCode != 0 {
+		c.respond(addr, req, &coapMessage{code: errCode})
+		return
+	} else if !complete {
+		return
+	}
+
+	// Creating the session waits for ICE gathering, acknowledge now and send a separate response
+	if req.typ == coapTypeCON {
+		c.ackEmpty(addr, req)
+	}
+
+	s, err := c.app.createSession(sessionRequest{
+		Offer:    string(offer),
+		Room:     req.query("room"),
+		Identity: req.query("identity"),
+		MAC:      req.query("mac"),
+		Serial:   req.query("serial"),
+		device:   c.app.pairedDevice(req.query("token")),
+	})
+	if err != nil {
+		log.Errorw("Failed to create session over CoAP", err, "addr", addr)
+		code := uint8(coapCodeInternalServerError)
+		switch {
+		case errors.Is(err, errInvalidOffer):
+			code = coapCodeBadRequest
+		case errors.Is(err, errTargetNotAllowed):
+			code = coapCodeForbidden
+		case errors.Is(err, errShuttingDown):
+			code = coapCodeServiceUnavailable
+		}
+		c.sendSeparate(addr, req, &coapMessage{code: code})
+		return
+	}
+
+	answer := []byte(s.answer())
+	c.mu.Lock()
+	c.downloads[key] = &coapTransfer{body: answer, updated: time.Now()}
+	c.mu.Unlock()
+
+	var requested *coapBlock
+	if block2, ok, _ := req.block(coapOptionBlock2); ok {
+		requested = &block2
+	}
+	res := c.blockResponse(coapCodeCreated, answer, requested, func(m *coapMessage) {
+		m.addOption(coapOptionLocationPath, []byte(strings.Trim(sessionPath, "/")))
+		m.addOption(coapOptionLocationPath, []byte(s.id))
+		if block1, ok, _ := req.block(coapOptionBlock1); ok {
+			m.addUintOption(coapOptionBlock1, block1.value())
+		}
+	})
+	c.sendSeparate(addr, req, res)
+
+	log.Infow("Successfully handled CoAP connect request", "sessionID", s.id, "addr", addr)
+}
+
+// receiveBlock accumulates a Block1 upload. It returns the full body once the
+// last block arrives, replying 2.31 Continue for the blocks before it.
+func (c *coapServer) receiveBlock(addr net.Addr, key string, req *coapMessage) (body []byte, complete bool, errCode uint8) {
+	block1, ok, err := req.block(coapOptionBlock1)
+	if err != nil {
+		return nil, false, coapCodeBadRequest
+	} else if !ok {
+		return req.payload, true, 0
+	}
+
+	if size, ok := req.uintOption(coapOptionSize1); ok && size > coapMaxBodySize {
+		return nil, false, coapCodeRequestEntityTooLarge
+	}
+
+	c.mu.Lock()
+	upload, exists := c.uploads[key]
+	switch {
+	case block1.num == 0:
+		upload = &coapTransfer{}
+		c.uploads[key] = upload
+	case !exists || len(upload.body) != int(block1.num)*block1.size():
+		c.mu.Unlock()
+		return nil, false, coapCodeRequestEntityIncomplete
+	}
+
+	upload.body = append(upload.body, req.payload...)
+	upload.updated = time.Now()
+	if len(upload.body) > coapMaxBodySize {
+		delete(c.uploads, key)
+		c.mu.Unlock()
+		return nil, false, coapCodeRequestEntityTooLarge
+	}
+	if !block1.more {
+		delete(c.uploads, key)
+	}
+	c.mu.Unlock()
+
+	if block1.more {
+		res := &coapMessage{code: coapCodeContinue}
+		res.addUintOption(coapOptionBlock1, block1.value())
+		c.respond(addr, req, res)
+		return nil, false, 0
+	}
+	return upload.body, true, 0
+}
+
+// blockResponse returns the requested block of body. The block size is the
+// smaller of the configured size and the one the client asked for.
+func (c *coapServer) blockResponse(code uint8, body []byte, requested *coapBlock, decorate func(*coapMessage)) *coapMessage {
+	block := coapBlock{szx: c.szx}
+	if requested != nil {
+		if requested.szx < block.szx {
+			block.szx = requested.szx
+			block.num = requested.num
+		} else {
+			block.num = requested.num * uint32(requested.size()/block.size())
+		}
+	}
+
+	start := int(block.num) * block.size()
+	if start > len(body) {
+		return &coapMessage{code: coapCodeBadRequest}
+	}
+
+	res := &coapMessage{code: code}
+	if decorate != nil {
+		decorate(res)
+	}
+	if block.num == 0 && len(body) <= block.size() {
+		res.payload = body
+		return res
+	}
+
+	end := min(start+block.size(), len(body))
+	block.more = end < len(body)
+	res.payload = body[start:end]
+	res.addUintOption(coapOptionBlock2, block.value())
+	if block.num == 0 {
+		res.addUintOption(coapOptionSize2, uint32(len(body)))
+	}
+	return res
+}
+
+// respond sends res piggybacked on the ACK for confirmable requests.
+func (c *coapServer) respond(addr net.Addr, req, res *coapMessage) {
+	res.token = req.token
+	if req.typ == coapTypeCON {
+		res.typ = coapTypeACK
+		res.messageID = req.messageID
+	} else {
+		res.typ = coapTypeNON
+		res.messageID = c.messageID()
+	}
+
+	raw := res.marshal()
+	if req.typ == coapTypeCON {
+		c.remember(addr, req.messageID, raw)
+	}
+	c.writeRaw(addr, raw)
+}
+
+func (c *coapServer) ackEmpty(addr net.Addr, req *coapMessage) {
+	ack := &coapMessage{typ: coapTypeACK, messageID: req.messageID}
+	raw := ack.marshal()
+	c.remember(addr, req.messageID, raw)
+	c.writeRaw(addr, raw)
+}
+
+// sendSeparate delivers a response after an empty ACK, retransmitting it
+// until the client acknowledges it.
+func (c *coapServer) sendSeparate(addr net.Addr, req, res *coapMessage) {
+	if req.typ != coapTypeCON {
+		c.respond(addr, req, res)
+		return
+	}
+
+	res.typ = coapTypeCON
+	res.token = req.token
+	res.messageID = c.messageID()
+	raw := res.marshal()
+
+	acked := make(chan struct{})
+	key := c.exchangeKey(addr, res.messageID)
+	c.mu.Lock()
+	c.awaitingACK[key] = acked
+	c.mu.Unlock()
+
+	timeout := coapAckTimeout
+	for attempt := 0; attempt <= coapMaxRetransmit; attempt++ {
+		c.writeRaw(addr, raw)
+		select {
+		case <-acked:
+			return
+		case <-c.app.ctx.Done():
+			return
+		case <-time.After(timeout):
+			timeout *= 2
+		}
+	}
+
+	c.mu.Lock()
+	delete(c.awaitingACK, key)
+	c.mu.Unlock()
+	log.Infow("CoAP separate response was not acknowledged", "addr", addr)
+}
+
+func (c *coapServer) remember(addr net.Addr, messageID uint16, raw []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dedup[c.exchangeKey(addr, messageID)] = &coapDedupEntry{response: raw, created: time.Now()}
+}
+
+func (c *coapServer) messageID() uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextMessageID++
+	return c.nextMessageID
+}
+
+func (c *coapServer) exchangeKey(addr net.Addr, messageID uint16) string {
+	return fmt.Sprintf("%s/%d", addr, messageID)
+}
+
+func (c *coapServer) write(addr net.Addr, m *coapMessage) {
+	c.writeRaw(addr, m.marshal())
+}
+
+func (c *coapServer) writeRaw(addr net.Addr, raw []byte) {
+	if _, err := c.conn.WriteTo(raw, addr); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Errorw("Failed to write CoAP message", err, "addr", addr)
+	}
+}
+
+// expireLoop drops dedup entries and abandoned block transfers.
+func (c *coapServer) expireLoop() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.app.ctx.Done():
+			return
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			for key, entry := range c.dedup {
+				if now.Sub(entry.created) > coapExchangeLifetime {
+					delete(c.dedup, key)
+				}
+			}
+			for _, transfers := range []map[string]*coapTransfer{c.uploads, c.downloads} {
+				for key, transfer := range transfers {
+					if now.Sub(transfer.updated) > coapBlockTransferLifetime {
+						delete(transfers, key)
+					}
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// listenCoAP binds the CoAP signaling socket configured by -coap-addr.
+func (app *App) listenCoAP() error {
+	conn, err := net.ListenPacket(familyNetwork("udp"), coapAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", coapAddr, err)
+	}
+
+	if app.coap, err = newCoAPServer(app, conn, coapBlockSize); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	log.Infow("CoAP server listening", "addr", conn.LocalAddr())
+	return nil
+}
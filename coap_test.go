@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseCoAPMessage(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		raw  []byte
+		want *coapMessage
+		err  error
+	}{
+		{
+			name: "empty ack",
+			raw:  []byte{0x60, 0x00, 0x12, 0x34},
+			want: &coapMessage{typ: coapTypeACK, messageID: 0x1234, token: []byte{}},
+		},
+		{
+			name: "token options and payload",
+			raw: []byte{
+				0x42, coapCodePOST, 0x00, 0x01, 0xaa, 0xbb,
+				0xb4, 'w', 'h', 'i', 'p',
+				0x43, 'r', '=', 'a',
+				0xff, 'h', 'i',
+			},
+			want: &coapMessage{
+				typ: coapTypeCON, code: coapCodePOST, messageID: 1, token: []byte{0xaa, 0xbb},
+				options: []coapOption{
+					{number: coapOptionURIPath, value: []byte("whip")},
+					{number: coapOptionURIQuery, value: []byte("r=a")},
+				},
+				payload: []byte("hi"),
+			},
+		},
+		{
+			name: "one byte extensions",
+			raw:  append([]byte{0x50, 0x02, 0x00, 0x02, 0xdd, coapOptionSize1 - 13, 0x00}, bytes.Repeat([]byte{'x'}, 13)...),
+			want: &coapMessage{
+				typ: coapTypeNON, code: coapCodePOST, messageID: 2, token: []byte{},
+				options: []coapOption{{number: coapOptionSize1, value: bytes.Repeat([]byte{'x'}, 13)}},
+			},
+		},
+		{
+			name: "two byte extensions",
+			raw:  append([]byte{0x50, 0x02, 0x00, 0x03, 0xee, 0x00, 0x01, 0x00, 0x00}, bytes.Repeat([]byte{'y'}, 269)...),
+			want: &coapMessage{
+				typ: coapTypeNON, code: coapCodePOST, messageID: 3, token: []byte{},
+				options: []coapOption{{number: 270, value: bytes.Repeat([]byte{'y'}, 269)}},
+			},
+		},
+		{name: "short header", raw: []byte{0x40, 0x01, 0x00}, err: errCoAPMessageFormat},
+		{name: "bad version", raw: []byte{0x80, 0x01, 0x00, 0x01}, err: errCoAPMessageFormat},
+		{name: "token too long", raw: append([]byte{0x49, 0x01, 0x00, 0x01}, make([]byte, 9)...), err: errCoAPMessageFormat},
+		{name: "truncated token", raw: []byte{0x44, 0x01, 0x00, 0x01, 0xaa}, err: errCoAPMessageFormat},
+		{name: "payload marker without payload", raw: []byte{0x40, 0x01, 0x00, 0x01, 0xff}, err: errCoAPMessageFormat},
+		{name: "reserved delta", raw: []byte{0x40, 0x01, 0x00, 0x01, 0xf0}, err: errCoAPMessageFormat},
+		{name: "reserved length", raw: []byte{0x40, 0x01, 0x00, 0x01, 0x1f}, err: errCoAPMessageFormat},
+		{name: "truncated extension", raw: []byte{0x40, 0x01, 0x00, 0x01, 0xe0, 0x01}, err: errCoAPMessageFormat},
+		{name: "truncated value", raw: []byte{0x40, 0x01, 0x00, 0x01, 0xb4, 'w', 'h'}, err: errCoAPMessageFormat},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := parseCoAPMessage(test.raw)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("parseCoAPMessage() error = %v, want %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+			assertCoAPMessage(t, m, test.want)
+			if raw := m.marshal(); !bytes.Equal(raw, test.raw) {
+				t.Errorf("marshal() = %x, want %x", raw, test.raw)
+			}
+		})
+	}
+}
+
+func TestCoAPMessageRoundTrip(t *testing.T) {
+	m := &coapMessage{typ: coapTypeCON, code: coapCodePOST, messageID: 0xbeef, token: []byte{1, 2, 3, 4}}
+	m.addOption(coapOptionURIQuery, []byte("room=lobby"))
+	m.addOption(coapOptionURIPath, []byte("whip"))
+	m.addUintOption(coapOptionBlock1, coapBlock{num: 3, more: true, szx: 6}.value())
+	m.addUintOption(coapOptionSize1, 70000)
+	m.payload = []byte("offer")
+
+	parsed, err := parseCoAPMessage(m.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := parsed.path(); path != "/whip" {
+		t.Errorf("path() = %q, want /whip", path)
+	}
+	if room := parsed.query("room"); room != "lobby" {
+		t.Errorf("query(room) = %q, want lobby", room)
+	}
+	if size, _ := parsed.uintOption(coapOptionSize1); size != 70000 {
+		t.Errorf("Size1 = %d, want 70000", size)
+	}
+	block, ok, err := parsed.block(coapOptionBlock1)
+	if err != nil || !ok || block != (coapBlock{num: 3, more: true, szx: 6}) {
+		t.Errorf("block() = %+v, %v, %v", block, ok, err)
+	}
+	if !bytes.Equal(parsed.payload, m.payload) {
+		t.Errorf("payload = %q, want %q", parsed.payload, m.payload)
+	}
+}
+
+func TestCoAPBlockBERT(t *testing.T) {
+	m := &coapMessage{}
+	m.addUintOption(coapOptionBlock1, coapBERTBlockSizeExponent)
+	if _, ok, err := m.block(coapOptionBlock1); !ok || !errors.Is(err, errCoAPMessageFormat) {
+		t.Errorf("block() = %v, %v, want BERT to be rejected", ok, err)
+	}
+}
+
+func TestCoAPReceiveBlock(t *testing.T) {
+	type block struct {
+		noBlock bool
+		num     uint32
+		more    bool
+		size1   uint32
+		payload string
+
+		body     string
+		complete bool
+		errCode  uint8
+	}
+
+	for _, test := range []struct {
+		name   string
+		blocks []block
+	}{
+		{
+			name:   "single message",
+			blocks: []block{{noBlock: true, payload: "whole", complete: true, body: "whole"}},
+		},
+		{
+			name: "in order",
+			blocks: []block{
+				{num: 0, more: true, payload: "0123456789abcdef"},
+				{num: 1, more: true, payload: "0123456789abcdef"},
+				{num: 2, payload: "end", complete: true, body: "0123456789abcdef0123456789abcdefend"},
+			},
+		},
+		{
+			name: "restarted",
+			blocks: []block{
+				{num: 0, more: true, payload: "aaaaaaaaaaaaaaaa"},
+				{num: 0, more: true, payload: "bbbbbbbbbbbbbbbb"},
+				{num: 1, payload: "c", complete: true, body: "bbbbbbbbbbbbbbbbc"},
+			},
+		},
+		{
+			name: "lost block",
+			blocks: []block{
+				{num: 0, more: true, payload: "0123456789abcdef"},
+				{num: 2, payload: "end", errCode: coapCodeRequestEntityIncomplete},
+			},
+		},
+		{
+			name:   "never started",
+			blocks: []block{{num: 1, payload: "end", errCode: coapCodeRequestEntityIncomplete}},
+		},
+		{
+			name:   "announced too large",
+			blocks: []block{{num: 0, more: true, size1: coapMaxBodySize + 1, payload: "0123456789abcdef", errCode: coapCodeRequestEntityTooLarge}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, client := newTestCoAPServer(t)
+			for i, b := range test.blocks {
+				req := &coapMessage{typ: coapTypeCON, code: coapCodePOST, messageID: uint16(i), token: []byte{7}, payload: []byte(b.payload)}
+				if !b.noBlock {
+					req.addUintOption(coapOptionBlock1, coapBlock{num: b.num, more: b.more, szx: 0}.value())
+				}
+				if b.size1 != 0 {
+					req.addUintOption(coapOptionSize1, b.size1)
+				}
+
+				body, complete, errCode := c.receiveBlock(client.LocalAddr(), "upload", req)
+				if complete != b.complete || errCode != b.errCode || string(body) != b.body {
+					t.Fatalf("block %d: receiveBlock() = %q, %v, %#x, want %q, %v, %#x", i, body, complete, errCode, b.body, b.complete, b.errCode)
+				}
+				if b.more && errCode == 0 {
+					assertCoAPContinue(t, client, req)
+				}
+			}
+		})
+	}
+}
+
+func TestCoAPReceiveBlockTooLarge(t *testing.T) {
+	c, client := newTestCoAPServer(t)
+	chunk := bytes.Repeat([]byte{'x'}, 1024)
+	for num := uint32(0); ; num++ {
+		req := &coapMessage{typ: coapTypeNON, code: coapCodePOST, payload: chunk}
+		req.addUintOption(coapOptionBlock1, coapBlock{num: num, more: true, szx: 6}.value())
+
+		_, _, errCode := c.receiveBlock(client.LocalAddr(), "upload", req)
+		if errCode == coapCodeRequestEntityTooLarge {
+			if int(num+1)*len(chunk) <= coapMaxBodySize {
+				t.Fatalf("rejected after %d bytes", int(num+1)*len(chunk))
+			}
+			break
+		} else if errCode != 0 {
+			t.Fatalf("block %d: unexpected code %#x", num, errCode)
+		}
+		assertCoAPContinue(t, client, req)
+	}
+
+	if len(c.uploads) != 0 {
+		t.Errorf("upload was kept after it was rejected")
+	}
+}
+
+func TestCoAPBlockResponse(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 150)
+
+	for _, test := range []struct {
+		name      string
+		blockSize int
+		body      []byte
+		requested *coapBlock
+		want      []byte
+		block     *coapBlock
+		code      uint8
+	}{
+		{name: "fits", blockSize: 1024, body: []byte("small"), want: []byte("small"), code: coapCodeCreated},
+		{name: "first block", blockSize: 1024, body: body, want: body[:1024], block: &coapBlock{num: 0, more: true, szx: 6}, code: coapCodeCreated},
+		{name: "last block", blockSize: 1024, body: body, requested: &coapBlock{num: 1, szx: 6}, want: body[1024:], block: &coapBlock{num: 1, szx: 6}, code: coapCodeCreated},
+		{name: "client asks smaller", blockSize: 1024, body: body, requested: &coapBlock{num: 2, szx: 2}, want: body[128:192], block: &coapBlock{num: 2, more: true, szx: 2}, code: coapCodeCreated},
+		{name: "client asks larger", blockSize: 256, body: body, requested: &coapBlock{num: 1, szx: 6}, want: body[1024:1280], block: &coapBlock{num: 4, more: true, szx: 4}, code: coapCodeCreated},
+		{name: "past the end", blockSize: 1024, body: body, requested: &coapBlock{num: 5, szx: 6}, code: coapCodeBadRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := newCoAPServer(nil, nil, test.blockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := c.blockResponse(coapCodeCreated, test.body, test.requested, nil)
+			if res.code != test.code {
+				t.Fatalf("code = %#x, want %#x", res.code, test.code)
+			}
+			if !bytes.Equal(res.payload, test.want) {
+				t.Errorf("payload = %q, want %q", res.payload, test.want)
+			}
+
+			block, ok, err := res.block(coapOptionBlock2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case test.block == nil && ok:
+				t.Errorf("unexpected Block2 %+v", block)
+			case test.block != nil && block != *test.block:
+				t.Errorf("Block2 = %+v, want %+v", block, *test.block)
+			}
+
+			size2, ok := res.uintOption(coapOptionSize2)
+			if wantSize2 := test.block != nil && test.block.num == 0; ok != wantSize2 || (ok && int(size2) != len(test.body)) {
+				t.Errorf("Size2 = %d, %v", size2, ok)
+			}
+		})
+	}
+}
+
+func newTestCoAPServer(t *testing.T) (*coapServer, net.PacketConn) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	c, err := newCoAPServer(nil, conn, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, client
+}
+
+func assertCoAPContinue(t *testing.T, client net.PacketConn, req *coapMessage) {
+	t.Helper()
+	buf := make([]byte, 1500)
+	if err := client.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := parseCoAPMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.code != coapCodeContinue || !bytes.Equal(res.token, req.token) {
+		t.Fatalf("got code %#x token %x, want 2.31 Continue", res.code, res.token)
+	}
+	want, _, _ := req.block(coapOptionBlock1)
+	if got, _, _ := res.block(coapOptionBlock1); got != want {
+		t.Errorf("Block1 = %+v, want %+v", got, want)
+	}
+}
+
+func assertCoAPMessage(t *testing.T, got, want *coapMessage) {
+	t.Helper()
+	if got.typ != want.typ || got.code != want.code || got.messageID != want.messageID {
+		t.Errorf("header = %d %#x %d, want %d %#x %d", got.typ, got.code, got.messageID, want.typ, want.code, want.messageID)
+	}
+	if !bytes.Equal(got.token, want.token) {
+		t.Errorf("token = %x, want %x", got.token, want.token)
+	}
+	if len(got.options) != len(want.options) {
+		t.Fatalf("options = %+v, want %+v", got.options, want.options)
+	}
+	for i := range got.options {
+		if got.options[i].number != want.options[i].number || !bytes.Equal(got.options[i].value, want.options[i].value) {
+			t.Errorf("option %d = %+v, want %+v", i, got.options[i], want.options[i])
+		}
+	}
+	if !bytes.Equal(got.payload, want.payload) {
+		t.Errorf("payload = %q, want %q", got.payload, want.payload)
+	}
+}
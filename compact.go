@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pion/sdp/v3"
+)
+
+// Compact signaling lets a device exchange only the parameters that vary
+// between sessions instead of a full SDP. The descriptor is CBOR with
+// integer keys so an offer/answer fits in a couple hundred bytes.
+
+const cborContentType = "application/cbor"
+
+const defaultFingerprintAlgorithm = "sha-256"
+
+var errInvalidCompactDescription = errors.New("invalid compact description")
+
+type compactCodec struct {
+	PayloadType uint8  `cbor:"1,keyasint"`
+	Name        string `cbor:"2,keyasint"`
+	ClockRate   uint32 `cbor:"3,keyasint"`
+	Channels    uint8  `cbor:"4,keyasint,omitempty"`
+	Fmtp        string `cbor:"5,keyasint,omitempty"`
+}
+
+type compactDescription struct {
+	Ufrag string `cbor:"1,keyasint"`
+	Pwd   string `cbor:"2,keyasint"`
+	// Fingerprint is the raw certificate hash, not the colon separated hex form
+	Fingerprint          []byte         `cbor:"3,keyasint"`
+	FingerprintAlgorithm string         `cbor:"4,keyasint,omitempty"`
+	Setup                string         `cbor:"5,keyasint,omitempty"`
+	Codecs               []compactCodec `cbor:"6,keyasint"`
+	Candidates           []string       `cbor:"7,keyasint,omitempty"`
+}
+
+// compactOfferToSDP expands a CBOR offer descriptor into a single audio
+// section SDP offer.
+func compactOfferToSDP(body []byte) (string, error) {
+	var offer compactDescription
+	if err := cbor.Unmarshal(body, &offer); err != nil {
+		return "", fmt.Errorf("%w: %w", errInvalidCompactDescription, err)
+	}
+	if offer.Ufrag == "" || offer.Pwd == "" || len(offer.Fingerprint) == 0 || len(offer.Codecs) == 0 {
+		return "", fmt.Errorf("%w: ufrag, pwd, fingerprint and codecs are required", errInvalidCompactDescription)
+	}
+
+	algorithm := offer.FingerprintAlgorithm
+	if algorithm == "" {
+		algorithm = defaultFingerprintAlgorithm
+	}
+	setup := offer.Setup
+	if setup == "" {
+		setup = "actpass"
+	}
+
+	payloadTypes := make([]string, 0, len(offer.Codecs))
+	for _, codec := range offer.Codecs {
+		payloadTypes = append(payloadTypes, strconv.Itoa(int(codec.PayloadType)))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\no=- %d 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\na=group:BUNDLE 0\r\n", time.Now().UnixNano())
+	fmt.Fprintf(&b, "m=audio 9 UDP/TLS/RTP/SAVPF %s\r\nc=IN IP4 0.0.0.0\r\n", strings.Join(payloadTypes, " "))
+	fmt.Fprintf(&b, "a=ice-ufrag:%s\r\na=ice-pwd:%s\r\n", offer.Ufrag, offer.Pwd)
+	fmt.Fprintf(&b, "a=fingerprint:%s %s\r\na=setup:%s\r\n", algorithm, formatFingerprint(offer.Fingerprint), setup)
+	b.WriteString("a=mid:0\r\na=sendrecv\r\na=rtcp-mux\r\n")
+	for _, codec := range offer.Codecs {
+		fmt.Fprintf(&b, "a=rtpmap:%d %s/%d", codec.PayloadType, codec.Name, codec.ClockRate)
+		if codec.Channels > 1 {
+			fmt.Fprintf(&b, "/%d", codec.Channels)
+		}
+		b.WriteString("\r\n")
+		if codec.Fmtp != "" {
+			fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", codec.PayloadType, codec.Fmtp)
+		}
+	}
+	for _, candidate := range offer.Candidates {
+		fmt.Fprintf(&b, "a=%s\r\n", strings.TrimPrefix(candidate, "a="))
+	}
+
+	return b.String(), nil
+}
+
+// sdpToCompactAnswer reduces an SDP answer to its CBOR descriptor. Only the
+// first audio section is described.
+func sdpToCompactAnswer(answer string) ([]byte, error) {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.UnmarshalString(answer); err != nil {
+		return nil, fmt.Errorf("failed to parse answer: %w", err)
+	}
+
+	var media *sdp.MediaDescription
+	for _, m := range parsed.MediaDescriptions {
+		if m.MediaName.Media == "audio" {
+			media = m
+			break
+		}
+	}
+	if media == nil {
+		return nil, errors.New("answer has no audio section")
+	}
+
+	// Attributes may be at either the session or media level
+	attribute := func(key string) string {
+		if value, ok := media.Attribute(key); ok {
+			return value
+		}
+		value, _ := parsed.Attribute(key)
+		return value
+	}
+
+	desc := compactDescription{
+		Ufrag: attribute("ice-ufrag"),
+		Pwd:   attribute("ice-pwd"),
+		Setup: attribute("setup"),
+	}
+
+	algorithm, fingerprint, _ := strings.Cut(attribute("fingerprint"), " ")
+	if algorithm != defaultFingerprintAlgorithm {
+		desc.FingerprintAlgorithm = algorithm
+	}
+	var err error
+	if desc.Fingerprint, err = hex.DecodeString(strings.ReplaceAll(fingerprint, ":", "")); err != nil {
+		return nil, fmt.Errorf("failed to decode fingerprint: %w", err)
+	}
+
+	fmtps := map[string]string{}
+	for _, a := range media.Attributes {
+		switch a.Key {
+		case "fmtp":
+			if pt, params, ok := strings.Cut(a.Value, " "); ok {
+				fmtps[pt] = params
+			}
+		case "candidate":
+			// RTCP is always muxed, the RTCP component candidates are redundant
+			if fields := strings.Fields(a.Value); len(fields) > 1 && fields[1] != "1" {
+				continue
+			}
+			desc.Candidates = append(desc.Candidates, "candidate:"+a.Value)
+		}
+	}
+	for _, a := range media.Attributes {
+		if a.Key != "rtpmap" {
+			continue
+		}
+
+		codec, err := parseRTPMap(a.Value)
+		if err != nil {
+			return nil, err
+		}
+		codec.Fmtp = fmtps[strconv.Itoa(int(codec.PayloadType))]
+		desc.Codecs = append(desc.Codecs, codec)
+	}
+
+	return cbor.Marshal(desc)
+}
+
+// parseRTPMap parses the value of an a=rtpmap attribute, e.g. "111 opus/48000/2".
+func parseRTPMap(value string) (compactCodec, error) {
+	pt, encoding, ok := strings.Cut(value, " ")
+	if !ok {
+		return compactCodec{}, fmt.Errorf("invalid rtpmap %q", value)
+	}
+
+	payloadType, err := strconv.ParseUint(pt, 10, 8)
+	if err != nil {
+		return compactCodec{}, fmt.Errorf("invalid rtpmap payload type %q: %w", value, err)
+	}
+
+	parts := strings.Split(encoding, "/")
+	if len(parts) < 2 {
+		return compactCodec{}, fmt.Errorf("invalid rtpmap encoding %q", value)
+	}
+	clockRate, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return compactCodec{}, fmt.Errorf("invalid rtpmap clock rate %q: %w", value, err)
+	}
+
+	codec := compactCodec{PayloadType: uint8(payloadType), Name: parts[0], ClockRate: uint32(clockRate)}
+	if len(parts) > 2 {
+		channels, err := strconv.ParseUint(parts[2], 10, 8)
+		if err != nil {
+			return compactCodec{}, fmt.Errorf("invalid rtpmap channels %q: %w", value, err)
+		}
+		codec.Channels = uint8(channels)
+	}
+	return codec, nil
+}
+
+func formatFingerprint(hash []byte) string {
+	parts := make([]string, len(hash))
+	for i, b := range hash {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
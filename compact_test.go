@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pion/sdp/v3"
+)
+
+var testFingerprint = []byte{
+	0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef,
+	0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef,
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		desc compactDescription
+		want compactDescription
+	}{
+		{
+			name: "defaults",
+			desc: compactDescription{
+				Ufrag:       "abcd",
+				Pwd:         "0123456789abcdefghijkl",
+				Fingerprint: testFingerprint,
+				Codecs:      []compactCodec{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}},
+			},
+			want: compactDescription{
+				Ufrag:       "abcd",
+				Pwd:         "0123456789abcdefghijkl",
+				Fingerprint: testFingerprint,
+				Setup:       "actpass",
+				Codecs:      []compactCodec{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}},
+			},
+		},
+		{
+			name: "everything",
+			desc: compactDescription{
+				Ufrag:                "wxyz",
+				Pwd:                  "lkjihgfedcba9876543210",
+				Fingerprint:          testFingerprint[:20],
+				FingerprintAlgorithm: "sha-1",
+				Setup:                "active",
+				Codecs: []compactCodec{
+					{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2, Fmtp: "minptime=10;useinbandfec=1"},
+					{PayloadType: 8, Name: "PCMA", ClockRate: 8000},
+					{PayloadType: 101, Name: "telephone-event", ClockRate: 8000, Fmtp: "0-15"},
+				},
+				Candidates: []string{
+					"candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host",
+					"a=candidate:2 1 udp 1694498815 203.0.113.7 6000 typ srflx raddr 192.168.1.2 rport 5000",
+				},
+			},
+			want: compactDescription{
+				Ufrag:                "wxyz",
+				Pwd:                  "lkjihgfedcba9876543210",
+				Fingerprint:          testFingerprint[:20],
+				FingerprintAlgorithm: "sha-1",
+				Setup:                "active",
+				Codecs: []compactCodec{
+					{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2, Fmtp: "minptime=10;useinbandfec=1"},
+					{PayloadType: 8, Name: "PCMA", ClockRate: 8000},
+					{PayloadType: 101, Name: "telephone-event", ClockRate: 8000, Fmtp: "0-15"},
+				},
+				Candidates: []string{
+					"candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host",
+					"candidate:2 1 udp 1694498815 203.0.113.7 6000 typ srflx raddr 192.168.1.2 rport 5000",
+				},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			body, err := cbor.Marshal(test.desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			offer, err := compactOfferToSDP(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := (&sdp.SessionDescription{}).UnmarshalString(offer); err != nil {
+				t.Fatalf("offer is not valid SDP: %v\n%s", err, offer)
+			}
+
+			compact, err := sdpToCompactAnswer(offer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got compactDescription
+			if err := cbor.Unmarshal(compact, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("round trip = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompactOfferToSDPInvalid(t *testing.T) {
+	valid := compactDescription{
+		Ufrag:       "abcd",
+		Pwd:         "0123456789abcdefghijkl",
+		Fingerprint: testFingerprint,
+		Codecs:      []compactCodec{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}},
+	}
+
+	for _, test := range []struct {
+		name  string
+		strip func(*compactDescription)
+	}{
+		{name: "no ufrag", strip: func(d *compactDescription) { d.Ufrag = "" }},
+		{name: "no pwd", strip: func(d *compactDescription) { d.Pwd = "" }},
+		{name: "no fingerprint", strip: func(d *compactDescription) { d.Fingerprint = nil }},
+		{name: "no codecs", strip: func(d *compactDescription) { d.Codecs = nil }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			desc := valid
+			test.strip(&desc)
+			body, err := cbor.Marshal(desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := compactOfferToSDP(body); !errors.Is(err, errInvalidCompactDescription) {
+				t.Errorf("compactOfferToSDP() error = %v, want %v", err, errInvalidCompactDescription)
+			}
+		})
+	}
+
+	if _, err := compactOfferToSDP([]byte{0xff, 0x00}); !errors.Is(err, errInvalidCompactDescription) {
+		t.Errorf("compactOfferToSDP(garbage) error = %v, want %v", err, errInvalidCompactDescription)
+	}
+}
+
+func TestSDPToCompactAnswer(t *testing.T) {
+	answer := "v=0\r\n" +
+		"o=- 1 2 IN IP4 127.0.0.1\r\n" +
+		"s=-\r\n" +
+		"t=0 0\r\n" +
+		"a=fingerprint:sha-256 01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF\r\n" +
+		"a=ice-ufrag:sess\r\n" +
+		"a=ice-pwd:sessionlevelpassword00\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"a=mid:0\r\n" +
+		"a=rtpmap:96 VP8/90000\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111 0\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"a=ice-ufrag:media\r\n" +
+		"a=setup:passive\r\n" +
+		"a=mid:1\r\n" +
+		"a=rtpmap:111 opus/48000/2\r\n" +
+		"a=fmtp:111 minptime=10;useinbandfec=1\r\n" +
+		"a=rtpmap:0 PCMU/8000\r\n" +
+		"a=candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host\r\n" +
+		"a=candidate:1 2 udp 2130706430 192.168.1.2 5001 typ host\r\n"
+
+	compact, err := sdpToCompactAnswer(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got compactDescription
+	if err := cbor.Unmarshal(compact, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := compactDescription{
+		Ufrag:       "media",
+		Pwd:         "sessionlevelpassword00",
+		Fingerprint: testFingerprint,
+		Setup:       "passive",
+		Codecs: []compactCodec{
+			{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2, Fmtp: "minptime=10;useinbandfec=1"},
+			{PayloadType: 0, Name: "PCMU", ClockRate: 8000},
+		},
+		Candidates: []string{"candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sdpToCompactAnswer() = %+v, want %+v", got, want)
+	}
+}
+
+func TestSDPToCompactAnswerInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		answer string
+	}{
+		{name: "unparsable", answer: "not sdp"},
+		{name: "no audio", answer: "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=rtpmap:96 VP8/90000\r\n"},
+		{name: "bad fingerprint", answer: "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=fingerprint:sha-256 ZZ:ZZ\r\na=rtpmap:0 PCMU/8000\r\n"},
+		{name: "bad rtpmap", answer: "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=rtpmap:0 PCMU\r\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := sdpToCompactAnswer(test.answer); err == nil {
+				t.Error("sdpToCompactAnswer() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestParseRTPMap(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  compactCodec
+		err   bool
+	}{
+		{value: "111 opus/48000/2", want: compactCodec{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2}},
+		{value: "0 PCMU/8000", want: compactCodec{PayloadType: 0, Name: "PCMU", ClockRate: 8000}},
+		{value: "PCMU/8000", err: true},
+		{value: "256 PCMU/8000", err: true},
+		{value: "0 PCMU", err: true},
+		{value: "0 PCMU/fast", err: true},
+		{value: "111 opus/48000/stereo", err: true},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := parseRTPMap(test.value)
+			if (err != nil) != test.err {
+				t.Fatalf("parseRTPMap() error = %v, want error %v", err, test.err)
+			}
+			if got != test.want {
+				t.Errorf("parseRTPMap() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/livekit/protocol/auth"
+	"github.com/pion/webrtc/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the optional file passed with -config for settings that don't
+// fit on the command line.
+type config struct {
+	// Devices is keyed by MAC address
+	Devices map[string]deviceConfig `yaml:"devices"`
+	// Rooms maps the room and identity a device asks for to the room it
+	// joins, the first matching rule wins
+	Rooms []roomRule `yaml:"rooms"`
+	// Grants are the token grants of devices by group, applied in the
+	// order of the device's groups
+	Grants map[string]tokenGrants `yaml:"grants"`
+	// ICEServers are added to -ice-servers, for credentials that should
+	// not be on the command line
+	ICEServers []iceServerConfig `yaml:"ice_servers"`
+	// Tokens are accepted as Bearer tokens on signaling requests along
+	// with -bearer-token
+	Tokens []tokenConfig `yaml:"tokens"`
+}
+
+// iceServerConfig is a STUN or TURN server in the config file.
+type iceServerConfig struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username"`
+	Credential string   `yaml:"credential"`
+}
+
+// tokenGrants overrides the grants of the token a device joins with,
+// unset ones keep their default. Everything but RoomAdmin is allowed by
+// default.
+type tokenGrants struct {
+	CanPublish           *bool `yaml:"can_publish" json:"can_publish,omitempty"`
+	CanSubscribe         *bool `yaml:"can_subscribe" json:"can_subscribe,omitempty"`
+	CanPublishData       *bool `yaml:"can_publish_data" json:"can_publish_data,omitempty"`
+	CanUpdateOwnMetadata *bool `yaml:"can_update_own_metadata" json:"can_update_own_metadata,omitempty"`
+	RoomAdmin            *bool `yaml:"room_admin" json:"room_admin,omitempty"`
+}
+
+// roomRule sends devices whose requested room and identity match the glob
+// patterns to Target. Empty patterns match anything. Target may use
+// {room}, {identity} and {1}, {2}, ... for what the *s of Identity
+// matched.
+type roomRule struct {
+	Room     string `yaml:"room"`
+	Identity string `yaml:"identity"`
+	Target   string `yaml:"target"`
+
+	// identity is Identity compiled to capture its *s
+	identity *regexp.Regexp
+}
+
+var roomTemplateVariable = regexp.MustCompile(`\{([^}]*)\}`)
+
+// deviceConfig is what an individual device is assigned when it
+// provisions itself.
+type deviceConfig struct {
+	Room     string      `yaml:"room"`
+	Identity string      `yaml:"identity"`
+	Audio    audioConfig `yaml:"audio"`
+	// OpusFmtp overrides -opus-fmtp for the device
+	OpusFmtp string `yaml:"opus_fmtp"`
+	// GainDB is the initial gain of the device audio
+	GainDB float64 `yaml:"gain_db"`
+	// Stereo overrides -stereo for the device
+	Stereo string `yaml:"stereo"`
+	// PLC conceals packets lost from the device in all its sessions
+	PLC bool `yaml:"plc"`
+	// Groups are the announcement groups the device belongs to
+	Groups []string `yaml:"groups"`
+	// FanOut are rooms the device audio is published to besides Room
+	FanOut []string `yaml:"fan_out"`
+	// TrackName, TrackSource and Metadata override -track-name,
+	// -track-source and -participant-metadata for the device
+	TrackName   string `yaml:"track_name"`
+	TrackSource string `yaml:"track_source"`
+	Metadata    string `yaml:"metadata"`
+	// Subscribe picks the remote participant the device hears
+	Subscribe *subscriptionSelector `yaml:"subscribe"`
+	// DataTopics overrides -data-topics for the device
+	DataTopics string `yaml:"data_topics"`
+	// Agent overrides -agent-name for the device
+	Agent string `yaml:"agent"`
+	// Grants override the grants of its groups for the device
+	Grants tokenGrants `yaml:"grants"`
+	// Hidden joins the room as a hidden participant, left out of
+	// participant lists while still publishing
+	Hidden bool `yaml:"hidden"`
+	// DSCP overrides -dscp for the device, e.g. af41 for cameras
+	DSCP string `yaml:"dscp"`
+}
+
+type audioConfig struct {
+	SampleRate int `yaml:"sample_rate" json:"sample_rate"`
+	Channels   int `yaml:"channels" json:"channels"`
+	// Ptime is the packet duration in milliseconds
+	Ptime int `yaml:"ptime" json:"ptime"`
+}
+
+func loadConfig(path string) (*config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	c := &config{}
+	if err := yaml.Unmarshal(raw, c); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	// Index devices by their canonical MAC so lookups don't depend on
+	// how the operator wrote it
+	devices := make(map[string]deviceConfig, len(c.Devices))
+	for mac, device := range c.Devices {
+		canonical, err := canonicalMAC(mac)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device %q: %w", mac, err)
+		}
+		if _, err := parseFmtp(device.OpusFmtp); err != nil {
+			return nil, fmt.Errorf("invalid device %q: %w", mac, err)
+		}
+		if err := validateGain(device.GainDB); err != nil {
+			return nil, fmt.Errorf("invalid device %q: %w", mac, err)
+		}
+		if err := validateStereo(device.Stereo); err != nil {
+			return nil, fmt.Errorf("invalid device %q: %w", mac, err)
+		}
+		if device.TrackSource != "" {
+			if _, err := parseTrackSource(device.TrackSource); err != nil {
+				return nil, fmt.Errorf("invalid device %q: %w", mac, err)
+			}
+		}
+		if err := validateMetadata(device.Metadata); err != nil {
+			return nil, fmt.Errorf("invalid device %q: %w", mac, err)
+		}
+		if err := device.Subscribe.validate(); err != nil {
+			return nil, fmt.Errorf("invalid device %q: %w", mac, err)
+		}
+		if _, err := parseDSCP(device.DSCP); err != nil {
+			return nil, fmt.Errorf("invalid device %q: %w", mac, err)
+		}
+		if device.GainDB != 0 && !opusAvailable() {
+			return nil, fmt.Errorf("invalid device %q: gain_db needs the bridge built with -tags opus", mac)
+		}
+		if device.PLC && !opusAvailable() {
+			return nil, fmt.Errorf("invalid device %q: plc needs the bridge built with -tags opus", mac)
+		}
+		devices[canonical] = device
+	}
+	c.Devices = devices
+
+	for i := range c.Rooms {
+		if err := c.Rooms[i].compile(); err != nil {
+			return nil, fmt.Errorf("invalid room rule %d: %w", i+1, err)
+		}
+	}
+
+	for i, server := range c.ICEServers {
+		if len(server.URLs) == 0 {
+			return nil, fmt.Errorf("invalid ice server %d: urls are required", i+1)
+		}
+		for _, url := range server.URLs {
+			if err := validateICEServerURL(url); err != nil {
+				return nil, fmt.Errorf("invalid ice server %d: %w", i+1, err)
+			}
+		}
+	}
+
+	if err := validateTokens(c.Tokens); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// iceServers returns the ICE servers of the config file.
+func (c *config) iceServers() []webrtc.ICEServer {
+	servers := make([]webrtc.ICEServer, 0, len(c.ICEServers))
+	for _, server := range c.ICEServers {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return servers
+}
+
+func (r *roomRule) compile() error {
+	for _, pattern := range []string{r.Room, r.Identity} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	if r.Identity != "" {
+		var err error
+		if r.identity, err = globRegexp(r.Identity); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", r.Identity, err)
+		}
+	}
+	if r.Target == "" {
+		return fmt.Errorf("target is required")
+	}
+
+	wildcards := strings.Count(r.Identity, "*")
+	for _, match := range roomTemplateVariable.FindAllStringSubmatch(r.Target, -1) {
+		switch name := match[1]; name {
+		case "room", "identity":
+		default:
+			if n, err := strconv.Atoi(name); err != nil || n < 1 || n > wildcards {
+				return fmt.Errorf("unknown variable %q in target", match[0])
+			}
+		}
+	}
+	return nil
+}
+
+// room returns the room a device asking for requestedRoom as identity is
+// sent to by the first matching rule.
+func (c *config) room(requestedRoom, identity string) (string, bool) {
+	for _, rule := range c.Rooms {
+		if rule.Room != "" {
+			if ok, _ := path.Match(rule.Room, requestedRoom); !ok {
+				continue
+			}
+		}
+		var captures []string
+		if rule.identity != nil {
+			if captures = rule.identity.FindStringSubmatch(identity); captures == nil {
+				continue
+			}
+		}
+
+		room := roomTemplateVariable.ReplaceAllStringFunc(rule.Target, func(variable string) string {
+			switch name := variable[1 : len(variable)-1]; name {
+			case "room":
+				return requestedRoom
+			case "identity":
+				return identity
+			default:
+				n, _ := strconv.Atoi(name)
+				return captures[n]
+			}
+		})
+		if room != "" {
+			return room, true
+		}
+	}
+	return "", false
+}
+
+// assigned reports if a device in the config is assigned room and identity.
+func (c *config) assigned(room, identity string) bool {
+	_, ok := c.device(room, identity)
+	return ok
+}
+
+// device returns the device assigned room and identity.
+func (c *config) device(room, identity string) (deviceConfig, bool) {
+	for _, device := range c.Devices {
+		if device.Room == room && device.Identity == identity {
+			return device, true
+		}
+	}
+	return deviceConfig{}, false
+}
+
+// dispatchesAgents reports if a device in the config has an agent.
+func (c *config) dispatchesAgents() bool {
+	for _, device := range c.Devices {
+		if device.Agent != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// grants returns the token grants of device, its groups' overridden by
+// its own.
+func (c *config) grants(device deviceConfig) tokenGrants {
+	var grants tokenGrants
+	for _, group := range device.Groups {
+		grants = grants.merge(c.Grants[group])
+	}
+	return grants.merge(device.Grants)
+}
+
+// merge returns g with the grants set in other replacing its own.
+func (g tokenGrants) merge(other tokenGrants) tokenGrants {
+	if other.CanPublish != nil {
+		g.CanPublish = other.CanPublish
+	}
+	if other.CanSubscribe != nil {
+		g.CanSubscribe = other.CanSubscribe
+	}
+	if other.CanPublishData != nil {
+		g.CanPublishData = other.CanPublishData
+	}
+	if other.CanUpdateOwnMetadata != nil {
+		g.CanUpdateOwnMetadata = other.CanUpdateOwnMetadata
+	}
+	if other.RoomAdmin != nil {
+		g.RoomAdmin = other.RoomAdmin
+	}
+	return g
+}
+
+// apply sets the overridden grants on grant.
+func (g tokenGrants) apply(grant *auth.VideoGrant) {
+	if g.CanPublish != nil {
+		grant.SetCanPublish(*g.CanPublish)
+	}
+	if g.CanSubscribe != nil {
+		grant.SetCanSubscribe(*g.CanSubscribe)
+	}
+	if g.CanPublishData != nil {
+		grant.SetCanPublishData(*g.CanPublishData)
+	}
+	if g.CanUpdateOwnMetadata != nil {
+		grant.SetCanUpdateOwnMetadata(*g.CanUpdateOwnMetadata)
+	}
+	if g.RoomAdmin != nil {
+		grant.RoomAdmin = *g.RoomAdmin
+	}
+}
+
+// hidden reports if the device joins as a hidden participant, by its own
+// setting or being in one of -hidden-groups.
+func (d deviceConfig) hidden() bool {
+	if d.Hidden {
+		return true
+	}
+	for _, group := range strings.Split(hiddenGroups, ",") {
+		if group = strings.TrimSpace(group); group != "" && slices.Contains(d.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalMAC returns mac in lower case colon separated form.
+func canonicalMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", err
+	}
+	return hw.String(), nil
+}
+
+// globRegexp converts a glob pattern valid for path.Match to a regexp
+// capturing what each * matches. Patterns path.Match lets through but the
+// conversion can't express are returned as an error.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			expr.WriteString("([^/]*)")
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			expr.WriteString("[")
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				expr.WriteString("^")
+				i++
+			}
+			// Escaped characters in a class are literal in the glob, in a
+			// regexp only punctuation can be escaped
+			for i++; i < len(pattern) && pattern[i] != ']'; i++ {
+				b, escaped := pattern[i], false
+				if b == '\\' {
+					if i++; i == len(pattern) {
+						return nil, path.ErrBadPattern
+					}
+					b, escaped = pattern[i], true
+				}
+				if b == '[' || escaped && isASCIIPunct(b) {
+					expr.WriteByte('\\')
+				}
+				expr.WriteByte(b)
+			}
+			if i == len(pattern) {
+				return nil, path.ErrBadPattern
+			}
+			expr.WriteString("]")
+		case '\\':
+			if i++; i == len(pattern) {
+				return nil, path.ErrBadPattern
+			}
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+func isASCIIPunct(b byte) bool {
+	return b < 0x80 && !('a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9')
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	for _, test := range []struct {
+		pattern  string
+		name     string
+		captures []string
+	}{
+		{pattern: "", name: ""},
+		{pattern: "", name: "x"},
+		{pattern: "kitchen", name: "kitchen"},
+		{pattern: "kitchen", name: "kitchen-2"},
+		{pattern: "*", name: "anything", captures: []string{"anything"}},
+		{pattern: "*", name: "a/b"},
+		{pattern: "esp32-*", name: "esp32-aabbcc", captures: []string{"aabbcc"}},
+		{pattern: "esp32-*", name: "esp8266-aabbcc"},
+		{pattern: "*-*", name: "floor1-kitchen", captures: []string{"floor1", "kitchen"}},
+		{pattern: "site/*/dev-*", name: "site/north/dev-7", captures: []string{"north", "7"}},
+		{pattern: "dev-?", name: "dev-7"},
+		{pattern: "dev-?", name: "dev-77"},
+		{pattern: "dev-?", name: "dev-/"},
+		{pattern: "dev-[0-9]", name: "dev-5"},
+		{pattern: "dev-[0-9]", name: "dev-a"},
+		{pattern: "dev-[^0-9]", name: "dev-a"},
+		{pattern: "dev-[^0-9]", name: "dev-5"},
+		{pattern: "dev-[^0-9]", name: "dev-/"},
+		{pattern: `dev-[\-a]`, name: "dev--"},
+		{pattern: `dev-[\-a]`, name: "dev-b"},
+		{pattern: `dev-[\]]`, name: "dev-]"},
+		{pattern: `dev-[\\]`, name: `dev-\`},
+		{pattern: `dev-[\a]`, name: "dev-a"},
+		{pattern: `dev-[[]`, name: "dev-["},
+		{pattern: `dev\*`, name: "dev*"},
+		{pattern: `dev\*`, name: "devices"},
+		{pattern: "a.b+c(d)", name: "a.b+c(d)"},
+		{pattern: "a.b+c(d)", name: "aXbbc(d)"},
+		{pattern: "ünïcode-*", name: "ünïcode-ß", captures: []string{"ß"}},
+	} {
+		t.Run(test.pattern+" "+test.name, func(t *testing.T) {
+			re, err := globRegexp(test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := path.Match(test.pattern, test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			match := re.FindStringSubmatch(test.name)
+			if (match != nil) != want {
+				t.Fatalf("%s matches %q = %v, path.Match says %v", re, test.name, match != nil, want)
+			}
+			if match != nil && !reflect.DeepEqual(match[1:], append([]string{}, test.captures...)) {
+				t.Errorf("captures = %q, want %q", match[1:], test.captures)
+			}
+		})
+	}
+}
+
+func TestGlobRegexpBadPattern(t *testing.T) {
+	for _, pattern := range []string{"[", "dev-[0-9", `dev-\`, `dev-[\`, `dev-[a\]`} {
+		t.Run(pattern, func(t *testing.T) {
+			if _, err := globRegexp(pattern); !errors.Is(err, path.ErrBadPattern) {
+				t.Errorf("globRegexp() error = %v, want %v", err, path.ErrBadPattern)
+			}
+		})
+	}
+}
+
+func TestConfigRoom(t *testing.T) {
+	c := loadTestConfig(t, `
+rooms:
+  - room: lobby
+    identity: "guest-*"
+    target: "guests-{1}"
+  - room: "floor-?"
+    target: "{room}-{identity}"
+  - identity: "site/*/dev-*"
+    target: "{1}-devices-{2}"
+  - room: empty
+    target: "{identity}"
+  - room: "*"
+    target: "default"
+`)
+
+	for _, test := range []struct {
+		room, identity string
+		want           string
+		ok             bool
+	}{
+		{room: "lobby", identity: "guest-alice", want: "guests-alice", ok: true},
+		{room: "lobby", identity: "staff-bob", want: "default", ok: true},
+		{room: "floor-1", identity: "desk", want: "floor-1-desk", ok: true},
+		{room: "floor-12", identity: "desk", want: "default", ok: true},
+		{room: "anything", identity: "site/north/dev-7", want: "north-devices-7", ok: true},
+		{room: "empty", identity: "", want: "default", ok: true},
+		{room: "a/b", identity: "x"},
+	} {
+		t.Run(test.room+" "+test.identity, func(t *testing.T) {
+			got, ok := c.room(test.room, test.identity)
+			if got != test.want || ok != test.ok {
+				t.Errorf("room() = %q, %v, want %q, %v", got, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestConfigRoomRuleInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		rule string
+		err  string
+	}{
+		{name: "bad room pattern", rule: `{room: "lobby-[", target: x}`, err: "invalid pattern"},
+		{name: "bad identity pattern", rule: `{identity: 'dev-\', target: x}`, err: "invalid pattern"},
+		{name: "no target", rule: `{room: lobby}`, err: "target is required"},
+		{name: "unknown variable", rule: `{room: lobby, target: "{mac}"}`, err: "unknown variable"},
+		{name: "capture out of range", rule: `{identity: "dev-*", target: "{2}"}`, err: "unknown variable"},
+		{name: "capture without identity", rule: `{room: "*", target: "{1}"}`, err: "unknown variable"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, "rooms:\n  - "+test.rule+"\n"))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("loadConfig() error = %v, want it to mention %q", err, test.err)
+			}
+		})
+	}
+}
+
+func loadTestConfig(t *testing.T, raw string) *config {
+	t.Helper()
+	c, err := loadConfig(writeTestConfig(t, raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func writeTestConfig(t *testing.T, raw string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(name, []byte(raw), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
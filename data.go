@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// rawFraming sends the payload of data messages from LiveKit as is,
+	// topicFraming prefixes it with its topic, one length byte followed
+	// by the topic
+	rawFraming   = "raw"
+	topicFraming = "topic"
+)
+
+// rateLimiter is a token bucket for the data messages a device publishes.
+type rateLimiter struct {
+	rate, burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows rate messages a second with bursts of up to a
+// second worth, nil for no limit.
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Ceil(rate)
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst}
+}
+
+func (l *rateLimiter) allow() bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// dataOnlyOffer reports if offer only contains application sections, such
+// devices exchange telemetry and commands but no audio.
+func dataOnlyOffer(offer string) bool {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.UnmarshalString(offer); err != nil || len(parsed.MediaDescriptions) == 0 {
+		return false
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "application" {
+			return false
+		}
+	}
+	return true
+}
+
+// onDataChannel bridges a data channel opened by the device to LiveKit
+// data packets. Messages are published with -telemetry-topic or the
+// channel label as topic, reliably unless the channel allows dropping
+// messages, and dropped beyond -data-rate.
+func (app *App) onDataChannel(s *session, dc *webrtc.DataChannel) {
+	log.Infow("Data channel received from peer connection", "sessionID", s.id, "label", dc.Label())
+
+	switch dc.Label() {
+	case pcmDataChannel:
+		app.onPCMDataChannel(s, dc)
+		return
+	case attributesDataChannel:
+		app.onAttributesDataChannel(s, dc)
+		return
+	case pttDataChannel:
+		app.onPTTDataChannel(s, dc)
+		return
+	case rpcDataChannel:
+		if rpcMethods != "" {
+			app.onRPCDataChannel(s, dc)
+			return
+		}
+	case mjpegDataChannel:
+		if mjpegEncoder != "" {
+			app.onMJPEGDataChannel(s, dc)
+			return
+		}
+	}
+
+	reliable := dc.MaxRetransmits() == nil && dc.MaxPacketLifeTime() == nil
+	topic := dc.Label()
+	if telemetryTopic != "" {
+		topic = telemetryTopic
+	}
+
+	dc.OnOpen(func() {
+		s.mu.Lock()
+		s.dataChannels = append(s.dataChannels, dc)
+		s.mu.Unlock()
+	})
+
+	dc.OnClose(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for i, existing := range s.dataChannels {
+			if existing == dc {
+				s.dataChannels = append(s.dataChannels[:i], s.dataChannels[i+1:]...)
+				break
+			}
+		}
+	})
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if !s.dataLimiter.allow() {
+			log.Debugw("Dropped data channel message over the rate limit", "sessionID", s.id, "label", dc.Label())
+			return
+		}
+		if err := s.currentParticipant().room.LocalParticipant.PublishDataPacket(
+			lksdk.UserData(msg.Data),
+			lksdk.WithDataPublishTopic(topic),
+			lksdk.WithDataPublishReliable(reliable),
+		); err != nil {
+			log.Errorw("Failed to publish data packet", err, "sessionID", s.id, "label", dc.Label())
+		}
+	})
+}
+
+// onDataPacket forwards user data published in the room to the open data
+// channels of every session using p whose topic filter it passes. With
+// -dtmf-downlink DTMF messages are also played to the devices as
+// telephone-events.
+func (app *App) onDataPacket(p *participant, data lksdk.DataPacket, params lksdk.DataReceiveParams) {
+	packet, ok := data.(*lksdk.UserDataPacket)
+	if !ok {
+		return
+	}
+	if dtmfDownlink && packet.Topic == dtmfTopic {
+		app.sendDTMF(p, packet.Payload)
+	}
+
+	app.sessionsMu.RLock()
+	var channels []*webrtc.DataChannel
+	for _, s := range app.sessions {
+		if s.currentParticipant() != p {
+			continue
+		}
+		if s.dataTopics != "" && !matchesAny(s.dataTopics, packet.Topic) {
+			continue
+		}
+		s.mu.Lock()
+		channels = append(channels, s.dataChannels...)
+		s.mu.Unlock()
+	}
+	app.sessionsMu.RUnlock()
+
+	if len(channels) == 0 {
+		return
+	}
+	message, err := frameData(packet.Topic, packet.Payload)
+	if err != nil {
+		log.Debugw("Dropped data packet", "topic", packet.Topic, "participant", params.SenderIdentity, "error", err)
+		return
+	}
+
+	for _, dc := range channels {
+		if err := dc.Send(message); err != nil {
+			log.Errorw("Failed to send data channel message", err, "label", dc.Label(), "participant", params.SenderIdentity)
+		}
+	}
+}
+
+// frameData returns the data channel message for a data packet on topic
+// with -data-framing.
+func frameData(topic string, payload []byte) ([]byte, error) {
+	if dataFraming != topicFraming {
+		return payload, nil
+	}
+	if len(topic) > 255 {
+		return nil, fmt.Errorf("topic is longer than 255 bytes")
+	}
+
+	message := make([]byte, 0, 1+len(topic)+len(payload))
+	message = append(message, byte(len(topic)))
+	message = append(message, topic...)
+	return append(message, payload...), nil
+}
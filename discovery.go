@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/mdns"
+)
+
+const (
+	mdnsService = "_lk-bridge._tcp"
+
+	ssdpAddr = "239.255.255.250:1900"
+	// ssdpSearchTarget is the ST devices search for, ssdp:all is
+	// answered as well
+	ssdpSearchTarget = "urn:livekit:service:bridge:1"
+)
+
+// startMDNS advertises the bridge as a DNS-SD service so devices don't need
+// its address hard-coded. The TXT records describe how to reach it.
+func (app *App) startMDNS() error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname: %w", err)
+	}
+	hostname = strings.Split(hostname, ".")[0]
+
+	instance := mdnsInstance
+	if instance == "" {
+		instance = hostname
+	}
+
+	service, err := mdns.NewMDNSService(instance, mdnsService, "", hostname+".local.", httpPort, localIPs(), app.discoveryTXT())
+	if err != nil {
+		return fmt.Errorf("failed to create mDNS service: %w", err)
+	}
+
+	app.mdns, err = mdns.NewServer(&mdns.Config{
+		Zone:   service,
+		Logger: stdlog.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start mDNS server: %w", err)
+	}
+
+	log.Infow("Advertising over mDNS", "service", mdnsService, "instance", instance)
+	return nil
+}
+
+// discoveryTXT describes the signaling endpoints of the bridge.
+func (app *App) discoveryTXT() []string {
+	txt := []string{
+		"path=" + apiPrefix + "/connect",
+		"formats=" + strings.Join([]string{"sdp", "cbor", "json", "protobuf"}, ","),
+		"ws=" + apiPrefix + "/ws",
+	}
+	if app.authRequired() {
+		txt = append(txt, "auth=bearer")
+	}
+	if minifyAnswers {
+		txt = append(txt, "minify=1")
+	}
+	if coapAddr != "" {
+		if _, port, err := net.SplitHostPort(coapAddr); err == nil {
+			txt = append(txt, "coap="+port)
+		}
+	}
+	return txt
+}
+
+// localIPs returns the unicast addresses the bridge is reachable on, on the
+// interfaces candidates are gathered on.
+func localIPs() []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Errorw("Failed to list interfaces", err)
+		return nil
+	}
+
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if !interfaceAllowed(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			log.Errorw("Failed to list interface addresses", err, "interface", iface.Name)
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() || !familyAllowed(ipNet.IP) {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+
+	// IPv4 first unless IPv6 is preferred, mDNS answers A and AAAA
+	// records in this order
+	ipv6 := preferIPFamily == "ipv6"
+	rank := func(ip net.IP) int {
+		if (ip.To4() == nil) == ipv6 {
+			return 0
+		}
+		return 1
+	}
+	slices.SortStableFunc(ips, func(a, b net.IP) int {
+		return cmp.Compare(rank(a), rank(b))
+	})
+	return ips
+}
+
+// localSignalingURL is the WHIP endpoint on the first address of the host,
+// for discovery mechanisms that can't see which address a device reaches
+// the bridge on.
+func localSignalingURL() string {
+	address := "localhost"
+	if ips := localIPs(); len(ips) > 0 {
+		address = ips[0].String()
+	}
+	return fmt.Sprintf("http://%s%s/connect", net.JoinHostPort(address, fmt.Sprint(httpPort)), apiPrefix)
+}
+
+// ssdpResponder answers SSDP M-SEARCH queries with the signaling URL for
+// Wi-Fi SDKs that ship SSDP but no mDNS client.
+type ssdpResponder struct {
+	conn *net.UDPConn
+	usn  string
+}
+
+func (app *App) listenSSDP() error {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve SSDP address: %w", err)
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for SSDP: %w", err)
+	}
+
+	// Stable across restarts so devices can cache the bridge
+	hostname, _ := os.Hostname()
+	app.ssdp = &ssdpResponder{
+		conn: conn,
+		usn:  "uuid:" + uuid.NewSHA1(uuid.NameSpaceDNS, []byte(hostname)).String(),
+	}
+	log.Infow("Answering SSDP searches", "searchTarget", ssdpSearchTarget)
+	return nil
+}
+
+func (r *ssdpResponder) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || strings.Trim(req.Header.Get("MAN"), `"`) != "ssdp:discover" {
+			continue
+		}
+
+		st := req.Header.Get("ST")
+		if st != ssdpSearchTarget && st != "ssdp:all" {
+			continue
+		}
+
+		if err := r.respond(from); err != nil {
+			log.Errorw("Failed to answer SSDP search", err, "from", from)
+		}
+	}
+}
+
+// respond sends the search response unicast to the device, the LOCATION
+// uses the local address the device's packets arrive on.
+func (r *ssdpResponder) respond(to *net.UDPAddr) error {
+	route, err := net.DialUDP("udp4", nil, to)
+	if err != nil {
+		return err
+	}
+	localIP := route.LocalAddr().(*net.UDPAddr).IP
+	_ = route.Close()
+
+	response := strings.Join([]string{
+		"HTTP/1.1 200 OK",
+		"CACHE-CONTROL: max-age=1800",
+		"EXT:",
+		fmt.Sprintf("LOCATION: http://%s%s/connect", net.JoinHostPort(localIP.String(), fmt.Sprint(httpPort)), apiPrefix),
+		"SERVER: livekit-microcontroller-bridge",
+		"ST: " + ssdpSearchTarget,
+		"USN: " + r.usn + "::" + ssdpSearchTarget,
+		"", "",
+	}, "\r\n")
+
+	_, err = r.conn.WriteToUDP([]byte(response), to)
+	return err
+}
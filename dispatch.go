@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/livekit/protocol/livekit"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+)
+
+// dispatchTimeout bounds the agent dispatch API calls.
+const dispatchTimeout = 5 * time.Second
+
+// agentDispatcher dispatches an agent into the rooms of devices, once per
+// room and agent however many devices share it, removing the dispatch
+// when the last of them leaves.
+type agentDispatcher struct {
+	client *lksdk.AgentDispatchClient
+
+	mu         sync.Mutex
+	dispatches map[string]*agentDispatch
+}
+
+type agentDispatch struct {
+	id       string
+	sessions int
+}
+
+func newAgentDispatcher() *agentDispatcher {
+	return &agentDispatcher{
+		client:     lksdk.NewAgentDispatchServiceClient(host, apiKey, apiSecret),
+		dispatches: make(map[string]*agentDispatch),
+	}
+}
+
+func dispatchKey(room, agent string) string {
+	return room + "/" + agent
+}
+
+// acquire dispatches agent into room unless a device there already did.
+func (d *agentDispatcher) acquire(room, agent string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := dispatchKey(room, agent)
+	if dispatch, ok := d.dispatches[key]; ok {
+		dispatch.sessions++
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dispatchTimeout)
+	defer cancel()
+
+	dispatch, err := d.client.CreateDispatch(ctx, &livekit.CreateAgentDispatchRequest{
+		AgentName: agent,
+		Room:      room,
+		Metadata:  agentMetadata,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dispatch agent: %w", err)
+	}
+
+	d.dispatches[key] = &agentDispatch{id: dispatch.Id, sessions: 1}
+	log.Infow("Dispatched agent", "room", room, "agent", agent, "dispatchID", dispatch.Id)
+	return nil
+}
+
+// release removes the dispatch of agent into room once no device uses it.
+func (d *agentDispatcher) release(room, agent string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := dispatchKey(room, agent)
+	dispatch, ok := d.dispatches[key]
+	if !ok {
+		return
+	}
+	if dispatch.sessions--; dispatch.sessions > 0 {
+		return
+	}
+	delete(d.dispatches, key)
+
+	// Deleted in the background, release runs from PeerConnection
+	// callbacks
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dispatchTimeout)
+		defer cancel()
+
+		if _, err := d.client.DeleteDispatch(ctx, &livekit.DeleteAgentDispatchRequest{DispatchId: dispatch.id, Room: room}); err != nil {
+			log.Errorw("Failed to delete agent dispatch", err, "room", room, "agent", agent, "dispatchID", dispatch.id)
+			return
+		}
+		log.Infow("Deleted agent dispatch", "room", room, "agent", agent, "dispatchID", dispatch.id)
+	}()
+}
+
+// dispatchAgent dispatches the agent of the session into its room, failing
+// dispatches are logged as the device works without the agent.
+func (app *App) dispatchAgent(s *session) {
+	if app.dispatcher == nil || s.agent == "" {
+		return
+	}
+
+	s.mu.Lock()
+	resumed := s.agentRoom != ""
+	s.mu.Unlock()
+	if resumed {
+		return
+	}
+
+	room := s.currentParticipant().roomName
+	if err := app.dispatcher.acquire(room, s.agent); err != nil {
+		log.Errorw("Failed to dispatch agent", err, "sessionID", s.id, "room", room, "agent", s.agent)
+		return
+	}
+
+	s.mu.Lock()
+	closed := s.agentClosed
+	if !closed {
+		s.agentRoom = room
+	}
+	s.mu.Unlock()
+
+	// The session closed while dispatching
+	if closed {
+		app.dispatcher.release(room, s.agent)
+	}
+}
+
+// redispatchAgent moves the agent dispatch of the session to its new room.
+func (app *App) redispatchAgent(s *session) {
+	if app.dispatcher == nil || s.agent == "" {
+		return
+	}
+
+	s.mu.Lock()
+	room := s.agentRoom
+	s.agentRoom = ""
+	s.mu.Unlock()
+
+	if room != "" {
+		app.dispatcher.release(room, s.agent)
+	}
+	app.dispatchAgent(s)
+}
+
+// undispatchAgent releases the agent dispatched for a closing session.
+func (app *App) undispatchAgent(s *session) {
+	s.mu.Lock()
+	room := s.agentRoom
+	s.agentRoom, s.agentClosed = "", true
+	s.mu.Unlock()
+
+	if room != "" {
+		app.dispatcher.release(room, s.agent)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// driftWindow is how long the lowest transit of the device audio is
+	// taken over, filtering out the network jitter, and driftWindows how
+	// many of them the drift is fitted to
+	driftWindow  = 10 * time.Second
+	driftWindows = 30
+	// driftMinWindows are needed before the drift is estimated
+	driftMinWindows = 6
+	// driftMaxPPM bounds the estimate, crystals are off by tens of ppm
+	driftMaxPPM = 1000
+	// driftMaxJump is the longest gap in the timestamps taken as the same
+	// stream, e.g. DTX, anything longer restarts the estimate
+	driftMaxJump = time.Minute
+)
+
+// clockDrift estimates how far the clock of a device runs off the wall
+// clock of the bridge from the timestamps of its primary audio. With
+// -drift-compensation it drops a frame whenever the device got a frame
+// ahead and conceals one whenever it fell a frame behind, so anything
+// playing it out live, the intercom or other devices, doesn't slowly build
+// up latency or run dry over hours.
+type clockDrift struct {
+	mu sync.Mutex
+
+	clockRate     float64
+	ssrc          uint32
+	started       bool
+	start         time.Time
+	lastTimestamp uint32
+	// samples is the unwrapped timestamp since start
+	samples int64
+
+	windowStart time.Time
+	windowMin   float64
+	windowAny   bool
+	points      []driftPoint
+	ppm         float64
+	estimated   bool
+
+	// pending is how many samples the device is ahead of the bridge and
+	// not corrected yet, seqOffset and tsOffset rewrite the stream past
+	// the corrections
+	pending     float64
+	seqOffset   uint16
+	tsOffset    uint32
+	corrections int
+}
+
+// driftPoint is the lowest transit, arrival minus timestamp in seconds, of
+// a window starting at seconds since start.
+type driftPoint struct {
+	seconds, transit float64
+}
+
+// compensate records a packet of the device arriving at now and returns the
+// packets to forward in its place, none when a frame is dropped and a
+// concealed one before it when a frame is inserted.
+func (d *clockDrift) compensate(codec webrtc.RTPCodecParameters, p *rtp.Packet, now time.Time) []*rtp.Packet {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	duration, ok := d.observeLocked(float64(codec.ClockRate), p, now)
+
+	out := *p
+	out.SequenceNumber += d.seqOffset
+	out.Timestamp += d.tsOffset
+	if !driftCompensation || !d.estimated || !ok {
+		return []*rtp.Packet{&out}
+	}
+
+	d.pending += d.ppm / 1e6 * float64(duration)
+	switch {
+	case d.pending >= float64(duration):
+		// The device got a frame ahead, drop this one
+		d.pending -= float64(duration)
+		d.seqOffset--
+		d.tsOffset -= duration
+		d.corrections++
+		log.Debugw("Dropped a frame of device audio for clock drift", "ppm", d.ppm)
+		return nil
+	case d.pending <= -float64(duration):
+		// The device fell a frame behind, conceal one before this
+		d.pending += float64(duration)
+		concealed := out
+		concealed.Payload = concealment(codec, p.Payload)
+		d.seqOffset++
+		d.tsOffset += duration
+		out.SequenceNumber++
+		out.Timestamp += duration
+		out.Marker = false
+		d.corrections++
+		log.Debugw("Inserted a frame of device audio for clock drift", "ppm", d.ppm)
+		return []*rtp.Packet{&concealed, &out}
+	}
+	return []*rtp.Packet{&out}
+}
+
+// concealment is the payload of an inserted frame. An Opus packet of only
+// its TOC byte has the decoder conceal it, other codecs repeat the frame.
+func concealment(codec webrtc.RTPCodecParameters, payload []byte) []byte {
+	if strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) && len(payload) > 0 {
+		return []byte{payload[0]}
+	}
+	return append([]byte(nil), payload...)
+}
+
+// observeLocked folds the transit of p into the estimate and returns the
+// samples it advanced the stream by, false for the first packet of a stream
+// and packets out of order.
+func (d *clockDrift) observeLocked(clockRate float64, p *rtp.Packet, now time.Time) (uint32, bool) {
+	if !d.started || p.SSRC != d.ssrc || clockRate != d.clockRate {
+		d.restartLocked(clockRate, p, now)
+		return 0, false
+	}
+
+	delta := int32(p.Timestamp - d.lastTimestamp)
+	if delta <= 0 {
+		return 0, false
+	}
+	if float64(delta) > driftMaxJump.Seconds()*clockRate {
+		d.restartLocked(clockRate, p, now)
+		return 0, false
+	}
+	d.lastTimestamp = p.Timestamp
+	d.samples += int64(delta)
+
+	transit := now.Sub(d.start).Seconds() - float64(d.samples)/clockRate
+	if !d.windowAny || transit < d.windowMin {
+		d.windowMin, d.windowAny = transit, true
+	}
+	if now.Sub(d.windowStart) >= driftWindow {
+		d.points = append(d.points, driftPoint{seconds: d.windowStart.Sub(d.start).Seconds(), transit: d.windowMin})
+		if len(d.points) > driftWindows {
+			d.points = d.points[1:]
+		}
+		d.windowStart, d.windowAny = now, false
+		d.fitLocked()
+	}
+	return uint32(delta), true
+}
+
+func (d *clockDrift) restartLocked(clockRate float64, p *rtp.Packet, now time.Time) {
+	d.clockRate, d.ssrc, d.started = clockRate, p.SSRC, true
+	d.start, d.windowStart = now, now
+	d.lastTimestamp, d.samples = p.Timestamp, 0
+	d.windowAny, d.points, d.estimated, d.pending = false, nil, false, 0
+}
+
+// fitLocked estimates the drift as the least squares slope of the lowest
+// transits. The transit of a fast device shrinks as its timestamps run
+// ahead, a positive drift.
+func (d *clockDrift) fitLocked() {
+	n := float64(len(d.points))
+	if len(d.points) < driftMinWindows {
+		return
+	}
+	var sumX, sumY, sumXX, sumXY float64
+	for _, point := range d.points {
+		sumX += point.seconds
+		sumY += point.transit
+		sumXX += point.seconds * point.seconds
+		sumXY += point.seconds * point.transit
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	d.ppm = min(max(-slope*1e6, -driftMaxPPM), driftMaxPPM)
+	d.estimated = true
+}
+
+// estimate returns the drift in ppm, positive when the device clock runs
+// fast, and the frames dropped or inserted so far.
+func (d *clockDrift) estimate() (float64, bool, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.ppm, d.estimated, d.corrections
+}
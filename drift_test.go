@@ -0,0 +1,184 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/livekit/protocol/logger"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+var testOpusParameters = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: opusClockRate, Channels: 2},
+	PayloadType:        111,
+}
+
+// driftTestDevice sends 20ms Opus frames from a clock running ppm off the
+// wall clock, with up to 12ms of network jitter.
+type driftTestDevice struct {
+	ppm   float64
+	start time.Time
+	ssrc  uint32
+	frame int
+	// jump is added to the timestamps
+	jump uint32
+}
+
+func (d *driftTestDevice) next() (*rtp.Packet, time.Time) {
+	frame := d.frame
+	d.frame++
+	sent := time.Duration(float64(frame) * float64(20*time.Millisecond) / (1 + d.ppm/1e6))
+	jitter := time.Duration(frame*7919%13) * time.Millisecond
+	return &rtp.Packet{
+		Header:  rtp.Header{SSRC: d.ssrc, SequenceNumber: uint16(100 + frame), Timestamp: uint32(5000+frame*960) + d.jump},
+		Payload: []byte{0xfc, byte(frame), 0xaa},
+	}, d.start.Add(sent + jitter)
+}
+
+func TestClockDriftEstimate(t *testing.T) {
+	defer func(enabled bool) { driftCompensation = enabled }(driftCompensation)
+	driftCompensation = false
+
+	for _, ppm := range []float64{0, 200, -150, 40} {
+		t.Run(strconv.FormatFloat(ppm, 'f', -1, 64)+"ppm", func(t *testing.T) {
+			d := &clockDrift{}
+			device := &driftTestDevice{ppm: ppm, start: time.Now(), ssrc: 1}
+
+			// Too few windows to estimate yet
+			for range int(driftWindow/(20*time.Millisecond)) * (driftMinWindows - 1) {
+				p, now := device.next()
+				if out := d.compensate(testOpusParameters, p, now); len(out) != 1 {
+					t.Fatalf("compensate() returned %d packets without -drift-compensation", len(out))
+				}
+			}
+			if _, estimated, _ := d.estimate(); estimated {
+				t.Fatal("estimated before enough windows passed")
+			}
+
+			for range int(driftWindow/(20*time.Millisecond)) * 4 {
+				p, now := device.next()
+				d.compensate(testOpusParameters, p, now)
+			}
+			got, estimated, corrections := d.estimate()
+			if !estimated || math.Abs(got-ppm) > 5 {
+				t.Errorf("estimate() = %.1f, %v, want %.1f", got, estimated, ppm)
+			}
+			if corrections != 0 {
+				t.Errorf("%d corrections without -drift-compensation", corrections)
+			}
+		})
+	}
+}
+
+func TestClockDriftCompensate(t *testing.T) {
+	defer func(enabled bool) { driftCompensation = enabled }(driftCompensation)
+	driftCompensation = true
+	log = logger.GetLogger()
+
+	for _, test := range []struct {
+		name   string
+		ppm    float64
+		longer func(sent, forwarded int) bool
+	}{
+		{name: "fast device", ppm: 500, longer: func(sent, forwarded int) bool { return forwarded < sent }},
+		{name: "slow device", ppm: -500, longer: func(sent, forwarded int) bool { return forwarded > sent }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			d := &clockDrift{}
+			device := &driftTestDevice{ppm: test.ppm, start: time.Now(), ssrc: 1}
+
+			var last *rtp.Packet
+			sent, forwarded := 0, 0
+			for range int(5 * time.Minute / (20 * time.Millisecond)) {
+				p, now := device.next()
+				sent++
+				for _, out := range d.compensate(testOpusParameters, p, now) {
+					forwarded++
+					if last != nil && (out.SequenceNumber != last.SequenceNumber+1 || out.Timestamp != last.Timestamp+960) {
+						t.Fatalf("forwarded %d/%d after %d/%d", out.SequenceNumber, out.Timestamp, last.SequenceNumber, last.Timestamp)
+					}
+					if len(out.Payload) == 1 && out.Payload[0] != 0xfc {
+						t.Fatalf("concealed frame has payload %x, want the TOC byte", out.Payload)
+					}
+					last = out
+				}
+			}
+
+			_, _, corrections := d.estimate()
+			if corrections == 0 || !test.longer(sent, forwarded) || int(math.Abs(float64(sent-forwarded))) != corrections {
+				t.Errorf("sent %d, forwarded %d with %d corrections", sent, forwarded, corrections)
+			}
+			// 5 minutes at 500ppm is 7.5 frames, the first minute is spent
+			// estimating
+			if corrections < 4 || corrections > 8 {
+				t.Errorf("%d corrections, want about 6", corrections)
+			}
+		})
+	}
+}
+
+func TestClockDriftRestart(t *testing.T) {
+	defer func(enabled bool) { driftCompensation = enabled }(driftCompensation)
+	driftCompensation = false
+
+	d := &clockDrift{}
+	device := &driftTestDevice{ppm: 300, start: time.Now(), ssrc: 1}
+	for range int(driftWindow/(20*time.Millisecond)) * (driftMinWindows + 2) {
+		p, now := device.next()
+		d.compensate(testOpusParameters, p, now)
+	}
+	if _, estimated, _ := d.estimate(); !estimated {
+		t.Fatal("no estimate")
+	}
+
+	// Out of order packets are forwarded but don't restart the estimate
+	p, now := device.next()
+	p.Timestamp -= 5 * 960
+	if out := d.compensate(testOpusParameters, p, now); len(out) != 1 || out[0].Timestamp != p.Timestamp {
+		t.Errorf("out of order packet forwarded as %v", out)
+	}
+	if _, estimated, _ := d.estimate(); !estimated {
+		t.Error("out of order packet restarted the estimate")
+	}
+
+	for _, restart := range []struct {
+		name   string
+		modify func(*driftTestDevice)
+	}{
+		{name: "timestamp jump", modify: func(d *driftTestDevice) { d.jump += uint32(2 * driftMaxJump.Seconds() * opusClockRate) }},
+		{name: "new ssrc", modify: func(d *driftTestDevice) { d.ssrc++ }},
+	} {
+		restart.modify(device)
+		p, now := device.next()
+		d.compensate(testOpusParameters, p, now)
+		if _, estimated, _ := d.estimate(); estimated {
+			t.Errorf("%s kept the estimate", restart.name)
+		}
+
+		for range int(driftWindow/(20*time.Millisecond)) * (driftMinWindows + 2) {
+			p, now := device.next()
+			d.compensate(testOpusParameters, p, now)
+		}
+		if ppm, estimated, _ := d.estimate(); !estimated || math.Abs(ppm-device.ppm) > 5 {
+			t.Errorf("estimate() after %s = %.1f, %v, want %.1f", restart.name, ppm, estimated, device.ppm)
+		}
+	}
+}
+
+func TestConcealment(t *testing.T) {
+	if got := concealment(testOpusParameters, []byte{0xfc, 1, 2}); string(got) != "\xfc" {
+		t.Errorf("Opus concealment = %x, want the TOC byte", got)
+	}
+	pcmu := webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}}
+	payload := []byte{1, 2, 3}
+	got := concealment(pcmu, payload)
+	if string(got) != string(payload) {
+		t.Errorf("PCMU concealment = %x, want the frame repeated", got)
+	}
+	if got[0] = 9; payload[0] != 1 {
+		t.Error("concealment shares the payload of the frame")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/transport/v3"
+	"github.com/pion/transport/v3/stdnet"
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// dscpNames are the DiffServ code points commonly used for media, RFC 4594
+// recommends EF for audio and AF41 for interactive video.
+var dscpNames = map[string]int{
+	"ef":   46,
+	"af41": 34,
+	"af42": 36,
+	"af43": 38,
+	"af31": 26,
+	"af32": 28,
+	"af33": 30,
+	"af21": 18,
+	"af22": 20,
+	"af23": 22,
+	"af11": 10,
+	"af12": 12,
+	"af13": 14,
+}
+
+// parseDSCP parses a code point name such as ef or af41, csN or a number,
+// -1 for empty.
+func parseDSCP(value string) (int, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return -1, nil
+	}
+	if dscp, ok := dscpNames[value]; ok {
+		return dscp, nil
+	}
+	if class, ok := strings.CutPrefix(value, "cs"); ok {
+		if n, err := strconv.Atoi(class); err == nil && n >= 0 && n <= 7 {
+			return n * 8, nil
+		}
+	}
+	if dscp, err := strconv.Atoi(value); err == nil && dscp >= 0 && dscp <= 63 {
+		return dscp, nil
+	}
+	return 0, fmt.Errorf("invalid DSCP %q, must be a name such as ef or af41 or 0-63", value)
+}
+
+// setDSCP marks the packets sent on conn, as IPv4 TOS and IPv6 traffic
+// class so dual-stack sockets are marked for both.
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	if dscp < 0 {
+		return nil
+	}
+	err4 := ipv4.NewConn(conn).SetTOS(dscp << 2)
+	err6 := ipv6.NewConn(conn).SetTrafficClass(dscp << 2)
+	if err4 != nil && err6 != nil {
+		return fmt.Errorf("failed to set DSCP: %w", errors.Join(err4, err6))
+	}
+	return nil
+}
+
+// dscpNet marks the UDP sockets ICE gathers on with a DSCP.
+type dscpNet struct {
+	*stdnet.Net
+	dscp int
+}
+
+func (n *dscpNet) ListenUDP(network string, locAddr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.ListenUDP(network, locAddr)
+	if err != nil {
+		return nil, err
+	}
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		if err := setDSCP(udpConn, n.dscp); err != nil {
+			log.Errorw("Failed to mark media socket", err, "dscp", n.dscp)
+		}
+	}
+	return conn, nil
+}
+
+// withDSCP has PeerConnections of settingEngine send on sockets marked
+// with dscp. Sockets of -udp-port are shared and marked with -dscp.
+func withDSCP(settingEngine webrtc.SettingEngine, dscp int) (webrtc.SettingEngine, error) {
+	if dscp < 0 {
+		return settingEngine, nil
+	}
+	stdNet, err := stdnet.NewNet()
+	if err != nil {
+		return settingEngine, fmt.Errorf("failed to create network: %w", err)
+	}
+	settingEngine.SetNet(&dscpNet{Net: stdNet, dscp: dscp})
+	return settingEngine, nil
+}
+
+// apiFor returns the API for PeerConnections marked with dscp, the shared
+// one for -dscp.
+func (app *App) apiFor(dscp string) (*webrtc.API, error) {
+	if dscp == "" || dscp == dscpMarking {
+		return app.api, nil
+	}
+	value, err := parseDSCP(dscp)
+	if err != nil {
+		return nil, err
+	}
+
+	app.apisMu.Lock()
+	defer app.apisMu.Unlock()
+
+	if api, ok := app.apis[value]; ok {
+		return api, nil
+	}
+	settingEngine, err := withDSCP(app.settingEngine, value)
+	if err != nil {
+		return nil, err
+	}
+	api, err := newWebRTCAPI(settingEngine)
+	if err != nil {
+		return nil, err
+	}
+	app.apis[value] = api
+	return api, nil
+}
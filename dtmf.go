@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	mimeTypeTelephoneEvent = "audio/telephone-event"
+	// dtmfTopic is the LiveKit data topic DTMF is published and received
+	// on
+	dtmfTopic = "dtmf"
+	// dtmfDigits are the RFC 4733 DTMF events 0 to 15
+	dtmfDigits = "0123456789*#ABCD"
+
+	// dtmfPacketInterval and dtmfPackets shape synthesized tones, 100ms
+	// followed by the end of the event sent three times for loss
+	dtmfPacketInterval = 20 * time.Millisecond
+	dtmfPackets        = 5
+	dtmfEndPackets     = 3
+	dtmfPause          = 50 * time.Millisecond
+	dtmfVolume         = 10
+)
+
+// telephoneEventClockRates match the clock rates of the audio codecs the
+// bridge accepts, RFC 4733 events use the clock of the audio they go with.
+var telephoneEventClockRates = []uint32{48000, 8000, 16000}
+
+// dtmfMessage is the data message DTMF is exchanged as with the room.
+type dtmfMessage struct {
+	DTMF string `json:"dtmf"`
+}
+
+func isTelephoneEvent(mimeType string) bool {
+	return strings.EqualFold(mimeType, mimeTypeTelephoneEvent)
+}
+
+// dtmfDetector reports each DTMF event of a telephone-event stream once.
+// The packets of an event share its timestamp.
+type dtmfDetector struct {
+	seen      bool
+	timestamp uint32
+}
+
+func (d *dtmfDetector) detect(p *rtp.Packet) (string, bool) {
+	if len(p.Payload) < 4 || int(p.Payload[0]) >= len(dtmfDigits) {
+		return "", false
+	}
+	if d.seen && p.Timestamp == d.timestamp {
+		return "", false
+	}
+
+	d.seen, d.timestamp = true, p.Timestamp
+	return dtmfDigits[p.Payload[0] : p.Payload[0]+1], true
+}
+
+// forwardDTMF publishes a digit pressed on the device to the room.
+func forwardDTMF(s *session, digit string) {
+	payload, err := json.Marshal(dtmfMessage{DTMF: digit})
+	if err != nil {
+		log.Errorw("Failed to encode DTMF", err, "sessionID", s.id)
+		return
+	}
+
+	log.Infow("DTMF received from device", "sessionID", s.id, "digit", digit)
+	if err := s.currentParticipant().room.LocalParticipant.PublishDataPacket(
+		lksdk.UserData(payload),
+		lksdk.WithDataPublishTopic(dtmfTopic),
+		lksdk.WithDataPublishReliable(true),
+	); err != nil {
+		log.Errorw("Failed to publish DTMF", err, "sessionID", s.id)
+	}
+}
+
+// eventTrack is a TrackLocalStaticRTP that can send telephone-events and
+// packets generated by the bridge in between its audio. Sequence numbers
+// are shifted past the packets it inserted, gaps in the audio are kept.
+// When the stream written to it switches, e.g. to another remote
+// participant, it is rewritten to continue the one stream the peer sees.
+type eventTrack struct {
+	*webrtc.TrackLocalStaticRTP
+
+	mu       sync.Mutex
+	bindings map[string]eventBinding
+	// seqOffset and tsOffset map the stream written to what is sent,
+	// source and lastSequence are the SSRC and sequence number written
+	// last
+	seqOffset    uint16
+	tsOffset     uint32
+	source       uint32
+	lastSequence uint16
+	started      bool
+	// sequence is the sequence number sent last, timestamp the timestamp
+	// written last and writtenAt when
+	sequence  uint16
+	timestamp uint32
+	writtenAt time.Time
+	queue     []byte
+	sending   bool
+}
+
+type eventBinding struct {
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	writeStream webrtc.TrackLocalWriter
+}
+
+func newEventTrack(codec webrtc.RTPCodecCapability, id, streamID string) (*eventTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, id, streamID)
+	if err != nil {
+		return nil, err
+	}
+	return &eventTrack{TrackLocalStaticRTP: track, bindings: make(map[string]eventBinding)}, nil
+}
+
+// Bind also records the telephone-event payload type of the peer, if it
+// negotiated one at the audio clock rate.
+func (t *eventTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if err != nil {
+		return codec, err
+	}
+
+	for _, parameters := range ctx.CodecParameters() {
+		if isTelephoneEvent(parameters.MimeType) && parameters.ClockRate == codec.ClockRate {
+			t.mu.Lock()
+			t.bindings[ctx.ID()] = eventBinding{
+				ssrc:        ctx.SSRC(),
+				payloadType: parameters.PayloadType,
+				writeStream: ctx.WriteStream(),
+			}
+			t.mu.Unlock()
+			break
+		}
+	}
+	return codec, nil
+}
+
+func (t *eventTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mu.Lock()
+	delete(t.bindings, ctx.ID())
+	t.mu.Unlock()
+	return t.TrackLocalStaticRTP.Unbind(ctx)
+}
+
+func (t *eventTrack) WriteRTP(p *rtp.Packet) error {
+	now := time.Now()
+
+	t.mu.Lock()
+	shifted := *p
+	switched := t.switchedLocked(p)
+	if switched {
+		t.rebaseLocked(p, now)
+		shifted.Marker = true
+	}
+	shifted.SequenceNumber += t.seqOffset
+	shifted.Timestamp += t.tsOffset
+	// Reordered packets don't move the stream back, what follows them
+	// continues after the newest packet
+	if !t.started || switched || int16(p.SequenceNumber-t.lastSequence) > 0 {
+		t.source, t.lastSequence, t.started = p.SSRC, p.SequenceNumber, true
+		t.sequence, t.timestamp, t.writtenAt = shifted.SequenceNumber, p.Timestamp, now
+	}
+	t.mu.Unlock()
+
+	return t.TrackLocalStaticRTP.WriteRTP(&shifted)
+}
+
+// insertRTP writes a packet generated by the bridge after the audio sent
+// last.
+func (t *eventTrack) insertRTP(p *rtp.Packet) error {
+	t.mu.Lock()
+	t.seqOffset++
+	t.sequence++
+	inserted := *p
+	inserted.SequenceNumber = t.sequence
+	inserted.Timestamp += t.tsOffset
+	t.timestamp, t.writtenAt, t.started = p.Timestamp, time.Now(), true
+	t.mu.Unlock()
+
+	return t.TrackLocalStaticRTP.WriteRTP(&inserted)
+}
+
+// lastTimestamp is the timestamp of the packet written last, before it was
+// rewritten.
+func (t *eventTrack) lastTimestamp() uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.timestamp
+}
+
+// sendDigits queues DTMF for the peers that negotiated telephone-event,
+// digits are sent in order in the background.
+func (t *eventTrack) sendDigits(digits string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.queue = append(t.queue, digits...)
+	if !t.sending {
+		t.sending = true
+		go t.drain()
+	}
+}
+
+func (t *eventTrack) drain() {
+	for {
+		t.mu.Lock()
+		if len(t.queue) == 0 {
+			t.sending = false
+			t.mu.Unlock()
+			return
+		}
+		digit := t.queue[0]
+		t.queue = t.queue[1:]
+		t.mu.Unlock()
+
+		t.sendEvent(byte(strings.IndexByte(dtmfDigits, digit)))
+		time.Sleep(dtmfPause)
+	}
+}
+
+// sendEvent sends a single RFC 4733 event, starting at the timestamp of
+// the audio sent last.
+func (t *eventTrack) sendEvent(event byte) {
+	t.mu.Lock()
+	timestamp := t.timestamp
+	t.mu.Unlock()
+
+	step := uint16(t.Codec().ClockRate * uint32(dtmfPacketInterval/time.Millisecond) / 1000)
+	for i := range dtmfPackets + dtmfEndPackets {
+		end := i >= dtmfPackets
+		duration := step * uint16(min(i+1, dtmfPackets))
+
+		payload := make([]byte, 4)
+		payload[0] = event
+		payload[1] = dtmfVolume
+		if end {
+			payload[1] |= 0x80
+		}
+		binary.BigEndian.PutUint16(payload[2:], duration)
+
+		t.writeEvent(rtp.Header{Marker: i == 0, Timestamp: timestamp}, payload)
+		if i < dtmfPackets {
+			time.Sleep(dtmfPacketInterval)
+		}
+	}
+}
+
+func (t *eventTrack) writeEvent(header rtp.Header, payload []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.seqOffset++
+	t.sequence++
+	header.Version = 2
+	header.SequenceNumber = t.sequence
+	header.Timestamp += t.tsOffset
+	for _, b := range t.bindings {
+		header.SSRC = uint32(b.ssrc)
+		header.PayloadType = uint8(b.payloadType)
+		if _, err := b.writeStream.WriteRTP(&header, payload); err != nil {
+			log.Errorw("Failed to write telephone-event", err)
+		}
+	}
+}
+
+// parseDTMF returns the digits of a DTMF data message from the room.
+func parseDTMF(payload []byte) (string, error) {
+	var msg dtmfMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return "", fmt.Errorf("invalid DTMF message: %w", err)
+	}
+
+	digits := strings.ToUpper(msg.DTMF)
+	for _, digit := range digits {
+		if !strings.ContainsRune(dtmfDigits, digit) {
+			return "", fmt.Errorf("invalid DTMF digit %q", digit)
+		}
+	}
+	return digits, nil
+}
+
+// sendDTMF plays DTMF from the room to every device using p.
+func (app *App) sendDTMF(p *participant, payload []byte) {
+	digits, err := parseDTMF(payload)
+	if err != nil {
+		log.Errorw("Failed to parse DTMF", err, "participant", p.identity)
+		return
+	}
+
+	tracks := map[*eventTrack]struct{}{}
+	app.sessionsMu.RLock()
+	for _, s := range app.sessions {
+		if s.currentParticipant() == p && s.downlink != nil {
+			tracks[s.downlink] = struct{}{}
+		}
+	}
+	app.sessionsMu.RUnlock()
+
+	for track := range tracks {
+		track.sendDigits(digits)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// dtxFrameDuration is how often a DTX gap is filled, in time and
+	// units of the Opus clock
+	dtxFrameDuration = 20 * time.Millisecond
+	dtxFrameSamples  = opusClockRate * 20 / 1000
+	// maxDTXPayload is the size of Opus packets sent during DTX, a TOC
+	// byte without audio
+	maxDTXPayload = 2
+	// maxDTXFill stops filling when the remote stopped sending
+	// altogether. Senders refresh DTX every 400ms.
+	maxDTXFill = time.Second
+)
+
+// dtxFiller forwards Opus from LiveKit and fills the gaps a remote
+// participant using DTX leaves. Its last DTX packet is repeated every 20ms
+// until audio resumes, the Opus decoder of the device then keeps playing
+// comfort noise instead of dropping out.
+type dtxFiller struct {
+	mu    sync.Mutex
+	write func(p *rtp.Packet, filled bool) error
+	last  *rtp.Packet
+	// generation invalidates fill timers that fire after a packet
+	// arrived
+	generation int
+	filled     int
+	timer      *time.Timer
+}
+
+func newDTXFiller(write func(p *rtp.Packet, filled bool) error) *dtxFiller {
+	return &dtxFiller{write: write}
+}
+
+func isDTX(p *rtp.Packet) bool {
+	return len(p.Payload) <= maxDTXPayload
+}
+
+// forward writes a packet from LiveKit.
+func (f *dtxFiller) forward(p *rtp.Packet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopLocked()
+	if err := f.write(p, false); err != nil {
+		return err
+	}
+
+	if isDTX(p) {
+		f.last, f.filled = p, 0
+		f.scheduleLocked()
+	}
+	return nil
+}
+
+func (f *dtxFiller) scheduleLocked() {
+	generation := f.generation
+	f.timer = time.AfterFunc(dtxFrameDuration, func() {
+		f.fill(generation)
+	})
+}
+
+func (f *dtxFiller) fill(generation int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if generation != f.generation || f.last == nil {
+		return
+	}
+	f.filled++
+	if time.Duration(f.filled)*dtxFrameDuration > maxDTXFill {
+		return
+	}
+
+	repeated := *f.last
+	repeated.Marker = false
+	repeated.Timestamp += uint32(f.filled * dtxFrameSamples)
+	repeated.Payload = append([]byte(nil), f.last.Payload...)
+	if err := f.write(&repeated, true); err != nil {
+		log.Errorw("Failed to fill DTX gap", err)
+		return
+	}
+	f.scheduleLocked()
+}
+
+// stop cancels filling, e.g. when the track ended.
+func (f *dtxFiller) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopLocked()
+}
+
+func (f *dtxFiller) stopLocked() {
+	f.generation++
+	f.last = nil
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+}
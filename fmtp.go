@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// fmtpParam is a single key=value of an fmtp line.
+type fmtpParam struct {
+	key, value string
+}
+
+// parseFmtp parses the parameters of an fmtp line, e.g.
+// maxplaybackrate=16000;useinbandfec=1.
+func parseFmtp(line string) ([]fmtpParam, error) {
+	var params []fmtpParam
+	for _, field := range strings.Split(line, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" || strings.ContainsAny(field, " \r\n") {
+			return nil, fmt.Errorf("invalid fmtp parameter %q", field)
+		}
+		params = append(params, fmtpParam{key: key, value: value})
+	}
+	return params, nil
+}
+
+// mergeFmtp returns line with the parameters in overrides replaced or
+// appended.
+func mergeFmtp(line, overrides string) (string, error) {
+	params, err := parseFmtp(line)
+	if err != nil {
+		return "", err
+	}
+	extra, err := parseFmtp(overrides)
+	if err != nil {
+		return "", err
+	}
+
+	for _, override := range extra {
+		replaced := false
+		for i := range params {
+			if strings.EqualFold(params[i].key, override.key) {
+				params[i].value = override.value
+				replaced = true
+			}
+		}
+		if !replaced {
+			params = append(params, override)
+		}
+	}
+
+	fields := make([]string, len(params))
+	for i, param := range params {
+		fields[i] = param.key + "=" + param.value
+	}
+	return strings.Join(fields, ";"), nil
+}
+
+// applyOpusFmtp merges params into the fmtp line of every Opus codec in
+// answer, telling the device what Opus the bridge wants to receive.
+func applyOpusFmtp(answer, params string) (string, error) {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.UnmarshalString(answer); err != nil {
+		return "", fmt.Errorf("failed to parse answer: %w", err)
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "audio" {
+			continue
+		}
+
+		for _, attr := range media.Attributes {
+			if attr.Key != "rtpmap" {
+				continue
+			}
+			payloadType, codec, _ := strings.Cut(attr.Value, " ")
+			if !strings.HasPrefix(strings.ToLower(codec), "opus/") {
+				continue
+			}
+
+			found := false
+			for i, fmtpAttr := range media.Attributes {
+				current, ok := strings.CutPrefix(fmtpAttr.Value, payloadType+" ")
+				if fmtpAttr.Key != "fmtp" || !ok {
+					continue
+				}
+				merged, err := mergeFmtp(current, params)
+				if err != nil {
+					return "", err
+				}
+				media.Attributes[i].Value = payloadType + " " + merged
+				found = true
+			}
+			if !found {
+				merged, err := mergeFmtp("", params)
+				if err != nil {
+					return "", err
+				}
+				media.WithValueAttribute("fmtp", payloadType+" "+merged)
+			}
+		}
+	}
+
+	raw, err := parsed.Marshal()
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal answer: %w", err)
+	}
+	return string(raw), nil
+}
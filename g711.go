@@ -0,0 +1,126 @@
+package main
+
+import "github.com/pion/webrtc/v4"
+
+// G.711 companding as in the ITU reference implementation. Samples are
+// 16 bit linear PCM.
+
+func isG711(mimeType string) bool {
+	return mimeType == webrtc.MimeTypePCMU || mimeType == webrtc.MimeTypePCMA
+}
+
+func decodeG711(mimeType string, payload []byte) []int16 {
+	decode := ulawDecode
+	if mimeType == webrtc.MimeTypePCMA {
+		decode = alawDecode
+	}
+
+	pcm := make([]int16, len(payload))
+	for i, b := range payload {
+		pcm[i] = decode(b)
+	}
+	return pcm
+}
+
+func encodeG711(mimeType string, pcm []int16) []byte {
+	encode := ulawEncode
+	if mimeType == webrtc.MimeTypePCMA {
+		encode = alawEncode
+	}
+
+	payload := make([]byte, len(pcm))
+	for i, s := range pcm {
+		payload[i] = encode(s)
+	}
+	return payload
+}
+
+// g711Segment returns the segment of a companded value, 8 if it is out
+// of range.
+func g711Segment(value int, ends [8]int) int {
+	for i, end := range ends {
+		if value <= end {
+			return i
+		}
+	}
+	return len(ends)
+}
+
+var (
+	ulawSegmentEnds = [8]int{0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF, 0x1FFF}
+	alawSegmentEnds = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+)
+
+const (
+	ulawBias = 0x84
+	ulawClip = 8159
+)
+
+func ulawEncode(sample int16) byte {
+	value := int(sample) >> 2
+	mask := byte(0xFF)
+	if value < 0 {
+		value = -value
+		mask = 0x7F
+	}
+	if value > ulawClip {
+		value = ulawClip
+	}
+	value += ulawBias >> 2
+
+	segment := g711Segment(value, ulawSegmentEnds)
+	if segment >= 8 {
+		return 0x7F ^ mask
+	}
+	return byte(segment<<4|(value>>(segment+1))&0x0F) ^ mask
+}
+
+func ulawDecode(b byte) int16 {
+	b = ^b
+	value := (int(b&0x0F) << 3) + ulawBias
+	value <<= (b & 0x70) >> 4
+	if b&0x80 != 0 {
+		return int16(ulawBias - value)
+	}
+	return int16(value - ulawBias)
+}
+
+func alawEncode(sample int16) byte {
+	value := int(sample) >> 3
+	mask := byte(0xD5)
+	if value < 0 {
+		value = -value - 1
+		mask = 0x55
+	}
+
+	segment := g711Segment(value, alawSegmentEnds)
+	if segment >= 8 {
+		return 0x7F ^ mask
+	}
+
+	encoded := segment << 4
+	if segment < 2 {
+		encoded |= (value >> 1) & 0x0F
+	} else {
+		encoded |= (value >> segment) & 0x0F
+	}
+	return byte(encoded) ^ mask
+}
+
+func alawDecode(b byte) int16 {
+	b ^= 0x55
+	value := int(b&0x0F) << 4
+	switch segment := int(b&0x70) >> 4; segment {
+	case 0:
+		value += 8
+	case 1:
+		value += 0x108
+	default:
+		value += 0x108
+		value <<= segment - 1
+	}
+	if b&0x80 != 0 {
+		return int16(value)
+	}
+	return int16(-value)
+}
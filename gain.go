@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+const (
+	minGainDB = -60
+	maxGainDB = 30
+)
+
+// gainRequest is the body of the gain resource, GET returns the same.
+type gainRequest struct {
+	GainDB float64 `json:"gain_db"`
+}
+
+func validateGain(gainDB float64) error {
+	if math.IsNaN(gainDB) || gainDB < minGainDB || gainDB > maxGainDB {
+		return fmt.Errorf("gain_db must be between %d and %d, got %v", minGainDB, maxGainDB, gainDB)
+	}
+	return nil
+}
+
+// gain returns the gain applied to the session audio in dB.
+func (s *session) gain() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gainDB
+}
+
+func (s *session) setGain(gainDB float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gainDB = gainDB
+}
+
+// applyGain scales pcm in place by gainDB, clipping samples that
+// overflow.
+func applyGain(pcm []int16, gainDB float64) []int16 {
+	if gainDB == 0 {
+		return pcm
+	}
+
+	factor := math.Pow(10, gainDB/20)
+	for i, sample := range pcm {
+		pcm[i] = int16(max(math.MinInt16, min(math.MaxInt16, math.Round(float64(sample)*factor))))
+	}
+	return pcm
+}
+
+// gainHandler reads and adjusts the gain of a session, e.g. to level out
+// microphones that differ between hardware revisions.
+func (app *App) gainHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req gainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := validateGain(req.GainDB); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.GainDB != 0 && !opusAvailable() {
+			writeError(w, r, "Gain needs the bridge built with -tags opus", http.StatusNotImplemented)
+			return
+		}
+
+		s.setGain(req.GainDB)
+		log.Infow("Session gain changed", "sessionID", s.id, "gainDB", req.GainDB)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(gainRequest{GainDB: s.gain()}); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
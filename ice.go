@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// iceTCPReadBuffer is the number of packets buffered per ICE-TCP connection.
+const iceTCPReadBuffer = 8
+
+// newSettingEngine configures how device PeerConnections gather candidates
+// and connect, from the ICE flags. Listeners it opens are closed on
+// shutdown.
+func (app *App) newSettingEngine() (webrtc.SettingEngine, error) {
+	settingEngine := webrtc.SettingEngine{}
+	switch ipFamily {
+	case "ipv4":
+		settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeTCP4})
+	case "ipv6":
+		settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP6, webrtc.NetworkTypeTCP6})
+	}
+
+	if interfaces != "" || excludeInterfaces != "" {
+		settingEngine.SetInterfaceFilter(interfaceAllowed)
+	}
+	if !localCIDRs.empty() {
+		settingEngine.SetIPFilter(localCIDRs.allowed)
+	}
+
+	// Hardware AES-GCM makes the AEAD profiles cheapest on most devices,
+	// CTR/HMAC stays as the fallback for stacks without them
+	profiles, err := parseSRTPProfiles(srtpProfiles)
+	if err != nil {
+		return settingEngine, err
+	}
+	settingEngine.SetSRTPProtectionProfiles(profiles...)
+
+	// The bridge always answers, so as an ICE-lite agent it is controlled
+	// and leaves the connectivity checks to the device
+	settingEngine.SetLite(iceLite)
+
+	// Passive TCP candidates for networks blocking UDP
+	if iceTCPPort != 0 {
+		listener, err := net.ListenTCP(familyNetwork("tcp"), &net.TCPAddr{Port: iceTCPPort})
+		if err != nil {
+			return settingEngine, fmt.Errorf("failed to listen for ICE-TCP: %w", err)
+		}
+		app.iceTCP = listener
+		settingEngine.SetICETCPMux(webrtc.NewICETCPMux(nil, listener, iceTCPReadBuffer))
+		log.Infow("Listening for ICE-TCP", "addr", listener.Addr())
+	}
+
+	// Every PeerConnection on one UDP port, which also answers the STUN
+	// binding requests of devices
+	if udpPort != 0 {
+		mux, err := listenUDPMux()
+		if err != nil {
+			return settingEngine, err
+		}
+		app.udpMux = mux
+		settingEngine.SetICEUDPMux(mux)
+	}
+
+	// A bounded range of ephemeral ports otherwise
+	if udpPortMin != 0 || udpPortMax != 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(uint16(udpPortMin), uint16(udpPortMax)); err != nil {
+			return settingEngine, fmt.Errorf("invalid UDP port range: %w", err)
+		}
+	}
+
+	// Public addresses of a bridge behind 1:1 NAT, replacing the private
+	// host candidates or added as server reflexive ones
+	if ips := splitList(nat1To1IPs); len(ips) > 0 {
+		candidateType := webrtc.ICECandidateTypeHost
+		if nat1To1CandidateType == "srflx" {
+			candidateType = webrtc.ICECandidateTypeSrflx
+		}
+		settingEngine.SetNAT1To1IPs(ips, candidateType)
+	}
+
+	return settingEngine, nil
+}
+
+// validateNAT1To1 checks -nat-1to1-ips, public addresses optionally mapped
+// to the local one as public/local.
+func validateNAT1To1() error {
+	for _, mapping := range splitList(nat1To1IPs) {
+		for _, ip := range strings.Split(mapping, "/") {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("invalid nat-1to1-ips entry %q", mapping)
+			}
+		}
+	}
+	switch nat1To1CandidateType {
+	case "host":
+	case "srflx":
+		if iceLite {
+			return fmt.Errorf("ice-lite only has host candidates, use nat-1to1-candidate-type host")
+		}
+	default:
+		return fmt.Errorf("nat-1to1-candidate-type must be host or srflx")
+	}
+	return nil
+}
+
+// listenUDPMux binds -udp-port for every PeerConnection. The mux of an
+// unspecified address gathers on every interface, with an interface or
+// CIDR filter the port is bound on the allowed addresses instead.
+func listenUDPMux() (ice.UDPMux, error) {
+	listen := func(ip net.IP) (ice.UDPMux, error) {
+		conn, err := net.ListenUDP(familyNetwork("udp"), &net.UDPAddr{IP: ip, Port: udpPort})
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for ICE: %w", err)
+		}
+		dscp, _ := parseDSCP(dscpMarking)
+		if err := setDSCP(conn, dscp); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		log.Infow("Listening for ICE", "addr", conn.LocalAddr())
+		return ice.NewUDPMuxDefault(ice.UDPMuxParams{UDPConn: &stunMuxConn{conn}}), nil
+	}
+
+	if interfaces == "" && excludeInterfaces == "" && localCIDRs.empty() {
+		return listen(nil)
+	}
+
+	var muxes []ice.UDPMux
+	for _, ip := range localIPs() {
+		if !localCIDRs.allowed(ip) {
+			continue
+		}
+		mux, err := listen(ip)
+		if err != nil {
+			for _, mux := range muxes {
+				_ = mux.Close()
+			}
+			return nil, err
+		}
+		muxes = append(muxes, mux)
+	}
+	if len(muxes) == 0 {
+		return nil, fmt.Errorf("no addresses to listen for ICE on")
+	}
+	return ice.NewMultiUDPMuxDefault(muxes...), nil
+}
+
+// interfaceAllowed reports if candidates are gathered on the interface,
+// it matches -interfaces when set and not -exclude-interfaces.
+func interfaceAllowed(name string) bool {
+	if interfaces != "" && !matchesAny(interfaces, name) {
+		return false
+	}
+	return !matchesAny(excludeInterfaces, name)
+}
+
+// validateInterfaces checks the glob patterns of -interfaces and
+// -exclude-interfaces.
+func validateInterfaces() error {
+	for _, pattern := range append(splitList(interfaces), splitList(excludeInterfaces)...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid interface pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// cidrFilter limits candidates to addresses in allow, when set, and not in
+// deny.
+type cidrFilter struct {
+	allow, deny []*net.IPNet
+}
+
+func parseCIDRFilter(allow, deny string) (cidrFilter, error) {
+	var f cidrFilter
+	for _, list := range []struct {
+		value string
+		nets  *[]*net.IPNet
+	}{{allow, &f.allow}, {deny, &f.deny}} {
+		for _, cidr := range splitList(list.value) {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return f, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+			}
+			*list.nets = append(*list.nets, ipNet)
+		}
+	}
+	return f, nil
+}
+
+func (f cidrFilter) empty() bool {
+	return len(f.allow) == 0 && len(f.deny) == 0
+}
+
+func (f cidrFilter) allowed(ip net.IP) bool {
+	contains := func(nets []*net.IPNet) bool {
+		return slices.ContainsFunc(nets, func(ipNet *net.IPNet) bool {
+			return ipNet.Contains(ip)
+		})
+	}
+	return (len(f.allow) == 0 || contains(f.allow)) && !contains(f.deny)
+}
+
+// allowedCandidate reports if a remote candidate passes -remote-cidrs. The
+// address of mDNS candidates can't be checked, they only pass without an
+// allow list.
+func allowedCandidate(candidate string) bool {
+	if remoteCIDRs.empty() {
+		return true
+	}
+	fields := strings.Fields(strings.TrimPrefix(candidate, "a="))
+	if len(fields) < 5 {
+		return false
+	}
+	if ip := net.ParseIP(fields[4]); ip != nil {
+		return remoteCIDRs.allowed(ip)
+	}
+	return len(remoteCIDRs.allow) == 0
+}
+
+// filterRemoteCandidates drops the candidates of an offer outside
+// -remote-cidrs.
+func filterRemoteCandidates(offer string) string {
+	if remoteCIDRs.empty() {
+		return offer
+	}
+	lines := strings.Split(offer, "\r\n")
+	return strings.Join(slices.DeleteFunc(lines, func(line string) bool {
+		return strings.HasPrefix(line, "a=candidate:") && !allowedCandidate(line)
+	}), "\r\n")
+}
+
+// addRemoteCandidate adds a trickled candidate of the device, ignoring it
+// outside -remote-cidrs.
+func (s *session) addRemoteCandidate(candidate webrtc.ICECandidateInit) error {
+	if !allowedCandidate(candidate.Candidate) {
+		log.Debugw("Ignored remote candidate", "sessionID", s.id, "candidate", candidate.Candidate)
+		return nil
+	}
+	return s.pc.AddICECandidate(candidate)
+}
+
+// familyNetwork restricts network, tcp or udp, to -ip-family.
+func familyNetwork(network string) string {
+	switch ipFamily {
+	case "ipv4":
+		return network + "4"
+	case "ipv6":
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+// familyAllowed reports if ip is of a family the bridge uses.
+func familyAllowed(ip net.IP) bool {
+	switch ipFamily {
+	case "ipv4":
+		return ip.To4() != nil
+	case "ipv6":
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// preferredFamily reports if ip is of -prefer-ip-family, tiny ICE agents
+// try candidates in the order of the answer.
+func preferredFamily(ip net.IP) bool {
+	switch preferIPFamily {
+	case "ipv4":
+		return ip.To4() != nil
+	case "ipv6":
+		return ip.To4() == nil
+	default:
+		return false
+	}
+}
+
+// orderCandidates moves the candidates of the preferred family to the front
+// of each media section of sdp.
+func orderCandidates(sdp string) string {
+	if preferIPFamily == "" {
+		return sdp
+	}
+
+	lines := strings.Split(sdp, "\r\n")
+	var ordered, preferred, others []string
+	flush := func() {
+		ordered = append(append(ordered, preferred...), others...)
+		preferred, others = nil, nil
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			flush()
+			ordered = append(ordered, line)
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) > 4 && preferredFamily(net.ParseIP(fields[4])) {
+			preferred = append(preferred, line)
+		} else {
+			others = append(others, line)
+		}
+	}
+	flush()
+	return strings.Join(ordered, "\r\n")
+}
+
+// validateIPFamily checks -ip-family and -prefer-ip-family.
+func validateIPFamily() error {
+	switch ipFamily {
+	case "dual", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("ip-family must be dual, ipv4 or ipv6")
+	}
+	switch preferIPFamily {
+	case "", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("prefer-ip-family must be ipv4 or ipv6")
+	}
+	if preferIPFamily != "" && ipFamily != "dual" {
+		return fmt.Errorf("prefer-ip-family needs ip-family dual")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// intercomFloorTimeout is how long a device keeps the floor after its last
+// packet, with DTX a quiet talker stops sending and frees it.
+const intercomFloorTimeout = 500 * time.Millisecond
+
+// intercomRoom patches the devices in one room to each other with
+// -intercom, forwarding the Opus of one talker at a time to the rest.
+type intercomRoom struct {
+	mu      sync.Mutex
+	members map[string]*session
+	// floor is the session whose audio is forwarded, until it is quiet
+	// for intercomFloorTimeout
+	floor     string
+	floorLast time.Time
+}
+
+// standalone reports if the bridge runs without LiveKit, as a local
+// intercom only.
+func standalone() bool {
+	return intercom && host == ""
+}
+
+// joinIntercom adds the session to the intercom of its room.
+func (app *App) joinIntercom(s *session) {
+	if !intercom {
+		return
+	}
+	room := s.currentParticipant().roomName
+
+	app.intercomsMu.Lock()
+	defer app.intercomsMu.Unlock()
+
+	ic, ok := app.intercoms[room]
+	if !ok {
+		ic = &intercomRoom{members: make(map[string]*session)}
+		app.intercoms[room] = ic
+	}
+	ic.mu.Lock()
+	ic.members[s.id] = s
+	ic.mu.Unlock()
+
+	s.mu.Lock()
+	s.intercomRoom = room
+	s.mu.Unlock()
+}
+
+// leaveIntercom removes the session from the intercom it is in.
+func (app *App) leaveIntercom(s *session) {
+	s.mu.Lock()
+	room := s.intercomRoom
+	s.intercomRoom = ""
+	s.mu.Unlock()
+	if room == "" {
+		return
+	}
+
+	app.intercomsMu.Lock()
+	defer app.intercomsMu.Unlock()
+
+	ic, ok := app.intercoms[room]
+	if !ok {
+		return
+	}
+	ic.mu.Lock()
+	delete(ic.members, s.id)
+	if ic.floor == s.id {
+		ic.floor = ""
+	}
+	empty := len(ic.members) == 0
+	ic.mu.Unlock()
+	if empty {
+		delete(app.intercoms, room)
+	}
+}
+
+// forwardIntercom sends a packet of the session's primary audio to the
+// other devices in its intercom, unless another one has the floor.
+func (app *App) forwardIntercom(s *session, p *rtp.Packet) {
+	s.mu.Lock()
+	room := s.intercomRoom
+	s.mu.Unlock()
+	if room == "" {
+		return
+	}
+
+	app.intercomsMu.Lock()
+	ic := app.intercoms[room]
+	app.intercomsMu.Unlock()
+	if ic == nil {
+		return
+	}
+
+	ic.mu.Lock()
+	now := time.Now()
+	if ic.floor != s.id && ic.floor != "" && now.Sub(ic.floorLast) < intercomFloorTimeout {
+		ic.mu.Unlock()
+		return
+	}
+	if ic.floor != s.id {
+		log.Debugw("Intercom floor taken", "sessionID", s.id, "room", room)
+	}
+	ic.floor, ic.floorLast = s.id, now
+	var sinks []func(p *rtp.Packet, inserted bool)
+	for id, member := range ic.members {
+		if id == s.id {
+			continue
+		}
+		if member.pager != nil {
+			sinks = append(sinks, member.pager.forward)
+		} else if member.downlinkSink != nil {
+			sinks = append(sinks, member.downlinkSink)
+		}
+	}
+	ic.mu.Unlock()
+
+	for _, sink := range sinks {
+		sink(p, false)
+	}
+}
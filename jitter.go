@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// jitterTick is how often the jitter buffer releases due packets
+	jitterTick = 5 * time.Millisecond
+	// jitterDelayFactor is how many times the measured jitter the delay
+	// grows to, and maxJitterDelayFactor caps it at a multiple of
+	// -jitter-buffer
+	jitterDelayFactor    = 3
+	maxJitterDelayFactor = 4
+	// jitterResync is how far a packet may be from its playout time before
+	// the buffer assumes the stream restarted, e.g. when the remote
+	// participant changed
+	jitterResync = time.Second
+)
+
+// jitterBuffer holds downlink packets for a session and releases them
+// paced by their timestamps, so devices with little buffering of their own
+// don't see the bursts LiveKit delivers in. The delay starts at
+// -jitter-buffer and grows with the measured jitter.
+type jitterBuffer struct {
+	clockRate float64
+	write     func(p *rtp.Packet, inserted bool)
+
+	mu      sync.Mutex
+	packets []jitterPacket
+	// base maps RTP timestamps to playout times
+	base          time.Time
+	baseTimestamp uint32
+	synced        bool
+	// released is the timestamp of the packet released last, packets at
+	// or before it are late
+	released       uint32
+	releasedAny    bool
+	releasedSeq    uint16
+	releasedSeqAny bool
+	// jitter is the RFC 3550 interarrival jitter in seconds
+	jitter         float64
+	lastArrival    time.Time
+	lastTimestamp  uint32
+	delay          time.Duration
+	received, late int
+	lost           int
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type jitterPacket struct {
+	packet   *rtp.Packet
+	inserted bool
+	due      time.Time
+	// stale packets are what was buffered of a stream before a resync,
+	// they are played out without counting towards the new one
+	stale bool
+}
+
+// jitterStats is the body of the jitter resource of a session.
+type jitterStats struct {
+	DelayMs  float64 `json:"delay_ms"`
+	DepthMs  float64 `json:"depth_ms"`
+	JitterMs float64 `json:"jitter_ms"`
+	Packets  int     `json:"packets"`
+	Late     int     `json:"late"`
+	Lost     int     `json:"lost"`
+}
+
+func newJitterBuffer(clockRate uint32, write func(p *rtp.Packet, inserted bool)) *jitterBuffer {
+	return &jitterBuffer{
+		clockRate: float64(clockRate),
+		write:     write,
+		delay:     jitterDelay,
+		stop:      make(chan struct{}),
+	}
+}
+
+// timestampAfter reports if RTP timestamp a is later than b.
+func timestampAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func (j *jitterBuffer) since(timestamp, base uint32) time.Duration {
+	return time.Duration(float64(int32(timestamp-base)) / j.clockRate * float64(time.Second))
+}
+
+// push buffers a packet from LiveKit, inserted packets are generated by
+// the bridge.
+func (j *jitterBuffer) push(p *rtp.Packet, inserted bool) {
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.received++
+	j.measure(p.Timestamp, now)
+
+	copied := *p
+	copied.Payload = append([]byte(nil), p.Payload...)
+	due := j.base.Add(j.since(p.Timestamp, j.baseTimestamp) + j.delay)
+	if !j.synced || due.Sub(now) > jitterResync || now.Sub(due) > jitterResync {
+		// Play what is buffered of the old stream right away, the new
+		// one follows it
+		for i := range j.packets {
+			j.packets[i].due, j.packets[i].stale = now, true
+		}
+		j.base, j.baseTimestamp, j.synced = now, p.Timestamp, true
+		j.releasedAny, j.releasedSeqAny = false, false
+		j.packets = append(j.packets, jitterPacket{packet: &copied, inserted: inserted, due: now.Add(j.delay)})
+		return
+	}
+	if j.releasedAny && !timestampAfter(p.Timestamp, j.released) {
+		j.late++
+		return
+	}
+
+	// Stale packets lead the buffer and don't share the timestamps of
+	// the current stream
+	start := 0
+	for start < len(j.packets) && j.packets[start].stale {
+		start++
+	}
+	i := start + sort.Search(len(j.packets)-start, func(i int) bool {
+		return timestampAfter(j.packets[start+i].packet.Timestamp, p.Timestamp)
+	})
+	if i > start && j.packets[i-1].packet.Timestamp == p.Timestamp {
+		// Duplicate
+		return
+	}
+	j.packets = append(j.packets, jitterPacket{})
+	copy(j.packets[i+1:], j.packets[i:])
+	j.packets[i] = jitterPacket{packet: &copied, inserted: inserted, due: due}
+}
+
+// measure updates the jitter estimate and the delay it calls for.
+func (j *jitterBuffer) measure(timestamp uint32, now time.Time) {
+	if !j.lastArrival.IsZero() {
+		transit := now.Sub(j.lastArrival) - j.since(timestamp, j.lastTimestamp)
+		j.jitter += (max(transit, -transit).Seconds() - j.jitter) / 16
+	}
+	j.lastArrival, j.lastTimestamp = now, timestamp
+
+	measured := time.Duration(j.jitter * jitterDelayFactor * float64(time.Second))
+	j.delay = min(max(jitterDelay, measured), maxJitterDelayFactor*jitterDelay)
+}
+
+// run releases due packets until close is called.
+func (j *jitterBuffer) run() {
+	ticker := time.NewTicker(jitterTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case now := <-ticker.C:
+			for _, p := range j.due(now) {
+				j.write(p.packet, p.inserted)
+			}
+		}
+	}
+}
+
+func (j *jitterBuffer) due(now time.Time) []jitterPacket {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	n := 0
+	for n < len(j.packets) && !j.packets[n].due.After(now) {
+		p := j.packets[n]
+		n++
+		if p.stale {
+			continue
+		}
+		if !p.inserted {
+			if j.releasedSeqAny {
+				j.lost += max(0, int(int16(p.packet.SequenceNumber-j.releasedSeq))-1)
+			}
+			j.releasedSeq, j.releasedSeqAny = p.packet.SequenceNumber, true
+		}
+		j.released, j.releasedAny = p.packet.Timestamp, true
+	}
+	due := append([]jitterPacket(nil), j.packets[:n]...)
+	j.packets = j.packets[n:]
+	return due
+}
+
+func (j *jitterBuffer) close() {
+	j.closeOnce.Do(func() { close(j.stop) })
+}
+
+func (j *jitterBuffer) stats() jitterStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var depth time.Duration
+	if len(j.packets) > 0 {
+		depth = j.since(j.packets[len(j.packets)-1].packet.Timestamp, j.packets[0].packet.Timestamp)
+	}
+	return jitterStats{
+		DelayMs:  float64(j.delay) / float64(time.Millisecond),
+		DepthMs:  float64(depth) / float64(time.Millisecond),
+		JitterMs: j.jitter * 1000,
+		Packets:  j.received,
+		Late:     j.late,
+		Lost:     j.lost,
+	}
+}
+
+// jitterHandler returns the downlink jitter buffer stats of a session.
+func (app *App) jitterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+	if s.jitter == nil {
+		writeError(w, r, "Jitter buffer is disabled, start the bridge with -jitter-buffer", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(s.jitter.stats()); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
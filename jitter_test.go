@@ -0,0 +1,181 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// jitterTestPacket is pushed to the buffer, timestamps are in 20ms frames
+// after the first packet.
+type jitterTestPacket struct {
+	seq      uint16
+	frame    int
+	inserted bool
+}
+
+func TestJitterBuffer(t *testing.T) {
+	defer func(delay time.Duration) { jitterDelay = delay }(jitterDelay)
+	jitterDelay = 40 * time.Millisecond
+
+	for _, test := range []struct {
+		name   string
+		pushed []jitterTestPacket
+		want   []uint16
+		lost   int
+	}{
+		{
+			name:   "in order",
+			pushed: []jitterTestPacket{{seq: 1, frame: 0}, {seq: 2, frame: 1}, {seq: 3, frame: 2}},
+			want:   []uint16{1, 2, 3},
+		},
+		{
+			name:   "reordered",
+			pushed: []jitterTestPacket{{seq: 1, frame: 0}, {seq: 4, frame: 3}, {seq: 2, frame: 1}, {seq: 5, frame: 4}, {seq: 3, frame: 2}},
+			want:   []uint16{1, 2, 3, 4, 5},
+		},
+		{
+			name:   "duplicates",
+			pushed: []jitterTestPacket{{seq: 1, frame: 0}, {seq: 2, frame: 1}, {seq: 2, frame: 1}, {seq: 3, frame: 2}, {seq: 3, frame: 2}},
+			want:   []uint16{1, 2, 3},
+		},
+		{
+			name:   "lost",
+			pushed: []jitterTestPacket{{seq: 1, frame: 0}, {seq: 2, frame: 1}, {seq: 5, frame: 4}, {seq: 7, frame: 6}},
+			want:   []uint16{1, 2, 5, 7},
+			lost:   3,
+		},
+		{
+			name:   "sequence wrap",
+			pushed: []jitterTestPacket{{seq: 65534, frame: 0}, {seq: 1, frame: 3}, {seq: 65535, frame: 1}},
+			want:   []uint16{65534, 65535, 1},
+			lost:   1,
+		},
+		{
+			name:   "inserted packets are not counted",
+			pushed: []jitterTestPacket{{seq: 1, frame: 0}, {seq: 100, frame: 1, inserted: true}, {seq: 2, frame: 2}},
+			want:   []uint16{1, 100, 2},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j := newJitterBuffer(opusClockRate, nil)
+			for _, p := range test.pushed {
+				j.push(jitterTestRTP(p), p.inserted)
+			}
+
+			if got := jitterReleased(j, time.Now().Add(time.Second)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("released %v, want %v", got, test.want)
+			}
+			if stats := j.stats(); stats.Lost != test.lost || stats.Packets != len(test.pushed) {
+				t.Errorf("stats = %+v, want %d lost of %d", stats, test.lost, len(test.pushed))
+			}
+		})
+	}
+}
+
+func TestJitterBufferLate(t *testing.T) {
+	defer func(delay time.Duration) { jitterDelay = delay }(jitterDelay)
+	jitterDelay = 40 * time.Millisecond
+
+	j := newJitterBuffer(opusClockRate, nil)
+	j.push(jitterTestRTP(jitterTestPacket{seq: 1, frame: 0}), false)
+	j.push(jitterTestRTP(jitterTestPacket{seq: 3, frame: 2}), false)
+	if got := jitterReleased(j, time.Now().Add(time.Second)); !reflect.DeepEqual(got, []uint16{1, 3}) {
+		t.Fatalf("released %v, want [1 3]", got)
+	}
+
+	// seq 2 arrives after seq 3 was played out
+	j.push(jitterTestRTP(jitterTestPacket{seq: 2, frame: 1}), false)
+	j.push(jitterTestRTP(jitterTestPacket{seq: 4, frame: 3}), false)
+	if got := jitterReleased(j, time.Now().Add(time.Second)); !reflect.DeepEqual(got, []uint16{4}) {
+		t.Errorf("released %v, want [4]", got)
+	}
+	if stats := j.stats(); stats.Late != 1 || stats.Lost != 1 {
+		t.Errorf("stats = %+v, want 1 late and 1 lost", stats)
+	}
+}
+
+func TestJitterBufferPacing(t *testing.T) {
+	defer func(delay time.Duration) { jitterDelay = delay }(jitterDelay)
+	jitterDelay = 40 * time.Millisecond
+
+	j := newJitterBuffer(opusClockRate, nil)
+	start := time.Now()
+	for i := range 5 {
+		j.push(jitterTestRTP(jitterTestPacket{seq: uint16(i), frame: i}), false)
+	}
+
+	if got := jitterReleased(j, start); len(got) != 0 {
+		t.Errorf("released %v before the delay passed", got)
+	}
+	delay := time.Duration(j.stats().DelayMs * float64(time.Millisecond))
+	if delay < jitterDelay || delay > maxJitterDelayFactor*jitterDelay {
+		t.Fatalf("delay = %s, want it between %s and %s", delay, jitterDelay, maxJitterDelayFactor*jitterDelay)
+	}
+	// Each packet is due one frame after the one before it
+	if got := jitterReleased(j, start.Add(delay+45*time.Millisecond)); len(got) == 0 || len(got) == 5 {
+		t.Errorf("released %v %s after the delay, want the first frames only", got, 45*time.Millisecond)
+	}
+}
+
+func TestJitterBufferResync(t *testing.T) {
+	defer func(delay time.Duration) { jitterDelay = delay }(jitterDelay)
+	jitterDelay = 40 * time.Millisecond
+
+	j := newJitterBuffer(opusClockRate, nil)
+	j.push(jitterTestRTP(jitterTestPacket{seq: 1, frame: 0}), false)
+	j.push(jitterTestRTP(jitterTestPacket{seq: 2, frame: 1}), false)
+	// A new stream with unrelated sequence numbers and timestamps
+	j.push(jitterTestRTP(jitterTestPacket{seq: 30000, frame: 1000}), false)
+	j.push(jitterTestRTP(jitterTestPacket{seq: 30001, frame: 1001}), false)
+
+	if got := jitterReleased(j, time.Now()); !reflect.DeepEqual(got, []uint16{1, 2}) {
+		t.Errorf("released %v, want the old stream right away", got)
+	}
+	if got := jitterReleased(j, time.Now().Add(time.Second)); !reflect.DeepEqual(got, []uint16{30000, 30001}) {
+		t.Errorf("released %v, want the new stream after it", got)
+	}
+	if stats := j.stats(); stats.Lost != 0 {
+		t.Errorf("stats = %+v, want nothing lost across the resync", stats)
+	}
+}
+
+func TestJitterBufferResyncBackwards(t *testing.T) {
+	defer func(delay time.Duration) { jitterDelay = delay }(jitterDelay)
+	jitterDelay = 40 * time.Millisecond
+
+	j := newJitterBuffer(opusClockRate, nil)
+	j.push(jitterTestRTP(jitterTestPacket{seq: 500, frame: 1000}), false)
+	j.push(jitterTestRTP(jitterTestPacket{seq: 501, frame: 1001}), false)
+	// The new stream starts at earlier timestamps than the old one
+	j.push(jitterTestRTP(jitterTestPacket{seq: 10, frame: 0}), false)
+	if got := jitterReleased(j, time.Now()); !reflect.DeepEqual(got, []uint16{500, 501}) {
+		t.Errorf("released %v, want the old stream right away", got)
+	}
+	j.push(jitterTestRTP(jitterTestPacket{seq: 12, frame: 2}), false)
+	j.push(jitterTestRTP(jitterTestPacket{seq: 11, frame: 1}), false)
+
+	if got := jitterReleased(j, time.Now().Add(time.Second)); !reflect.DeepEqual(got, []uint16{10, 11, 12}) {
+		t.Errorf("released %v, want the new stream in order", got)
+	}
+	if stats := j.stats(); stats.Lost != 0 || stats.Late != 0 {
+		t.Errorf("stats = %+v, want nothing lost or late across the resync", stats)
+	}
+}
+
+func jitterTestRTP(p jitterTestPacket) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{SequenceNumber: p.seq, Timestamp: 1_000_000 + uint32(p.frame)*opusClockRate/50},
+		Payload: []byte{byte(p.seq)},
+	}
+}
+
+func jitterReleased(j *jitterBuffer, now time.Time) []uint16 {
+	var seqs []uint16
+	for _, p := range j.due(now) {
+		seqs = append(seqs, p.packet.SequenceNumber)
+	}
+	return seqs
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// minKeyframeInterval keeps a room of subscribers joining at once from
+// making the device send nothing but keyframes.
+const minKeyframeInterval = 500 * time.Millisecond
+
+// keyframeMessage is sent on the -keyframe-channel data channel along with
+// the RTCP, for firmware that can't read RTCP.
+type keyframeMessage struct {
+	// Keyframe is the request LiveKit sent, pli or fir
+	Keyframe string `json:"keyframe"`
+}
+
+// keyframeForwarder relays PLI and FIR from LiveKit to the device for one
+// of its video tracks. Video is passed through as is so only the device
+// can produce a keyframe for a subscriber that joined mid-stream.
+type keyframeForwarder struct {
+	s     *session
+	track *webrtc.TrackRemote
+
+	mu   sync.Mutex
+	last time.Time
+	// firSequence numbers FIRs as RFC 5104 requires, repeated FIRs with
+	// the same number are retransmissions
+	firSequence uint8
+}
+
+func newKeyframeForwarder(s *session, track *webrtc.TrackRemote) *keyframeForwarder {
+	return &keyframeForwarder{s: s, track: track}
+}
+
+func (f *keyframeForwarder) forward(packet rtcp.Packet) {
+	var kind string
+	switch packet.(type) {
+	case *rtcp.PictureLossIndication:
+		kind = "pli"
+	case *rtcp.FullIntraRequest:
+		kind = "fir"
+	default:
+		return
+	}
+
+	f.mu.Lock()
+	if time.Since(f.last) < minKeyframeInterval {
+		f.mu.Unlock()
+		return
+	}
+	f.last = time.Now()
+	request := rtcp.Packet(&rtcp.PictureLossIndication{MediaSSRC: uint32(f.track.SSRC())})
+	if kind == "fir" {
+		f.firSequence++
+		request = &rtcp.FullIntraRequest{
+			MediaSSRC: uint32(f.track.SSRC()),
+			FIR:       []rtcp.FIREntry{{SSRC: uint32(f.track.SSRC()), SequenceNumber: f.firSequence}},
+		}
+	}
+	f.mu.Unlock()
+
+	if err := f.s.pc.WriteRTCP([]rtcp.Packet{request}); err != nil {
+		log.Errorw("Failed to forward keyframe request", err, "sessionID", f.s.id, "type", kind)
+	}
+	if keyframeChannel != "" {
+		f.s.sendKeyframeMessage(kind)
+	}
+}
+
+// sendKeyframeMessage asks the device for a keyframe on its open data
+// channel labeled -keyframe-channel.
+func (s *session) sendKeyframeMessage(kind string) {
+	payload, err := json.Marshal(keyframeMessage{Keyframe: kind})
+	if err != nil {
+		log.Errorw("Failed to encode keyframe request", err, "sessionID", s.id)
+		return
+	}
+
+	s.mu.Lock()
+	var channels []*webrtc.DataChannel
+	for _, dc := range s.dataChannels {
+		if dc.Label() == keyframeChannel {
+			channels = append(channels, dc)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, dc := range channels {
+		if err := dc.Send(payload); err != nil {
+			log.Errorw("Failed to send keyframe request", err, "sessionID", s.id, "label", dc.Label())
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// ntpEpochOffset is the seconds from the NTP epoch (1900) to the Unix one.
+const ntpEpochOffset = 2208988800
+
+// loopback sends the audio of a device straight back to it instead of
+// the audio from LiveKit, so mic, speaker and network can be checked
+// without anyone in the room. While looped back the device audio isn't
+// published.
+type loopback struct {
+	sessionID string
+	track     *eventTrack
+	write     func(p *rtp.Packet, inserted bool)
+
+	mu      sync.Mutex
+	enabled bool
+	// started is set by the first packet looped back after enabling,
+	// offset maps its timestamps after the downlink sent last
+	started bool
+	offset  uint32
+	packets uint64
+	// rtt is the round trip time to the device from its receiver
+	// reports
+	rtt time.Duration
+}
+
+// loopbackStatus is the body of the loopback resource.
+type loopbackStatus struct {
+	Enabled bool   `json:"enabled"`
+	Packets uint64 `json:"packets"`
+	// RTTMs is the network round trip, the audio looped back reaches the
+	// speaker this much plus the device's own buffering after the mic
+	RTTMs float64 `json:"rtt_ms"`
+}
+
+func newLoopback(sessionID string, track *eventTrack, write func(p *rtp.Packet, inserted bool)) *loopback {
+	return &loopback{sessionID: sessionID, track: track, write: write}
+}
+
+// forward passes a downlink packet to the session unless the device is
+// looped back.
+func (l *loopback) forward(p *rtp.Packet, inserted bool) {
+	l.mu.Lock()
+	enabled := l.enabled
+	l.mu.Unlock()
+
+	if !enabled {
+		l.write(p, inserted)
+	}
+}
+
+// echo sends a packet from the device back to it, returning false when
+// loopback is off and the packet should be published as usual.
+func (l *loopback) echo(codec webrtc.RTPCodecParameters, p *rtp.Packet) bool {
+	l.mu.Lock()
+	if !l.enabled {
+		l.mu.Unlock()
+		return false
+	}
+
+	downlink := l.track.Codec()
+	if !strings.EqualFold(codec.MimeType, downlink.MimeType) || codec.ClockRate != downlink.ClockRate {
+		l.mu.Unlock()
+		log.Debugw("Dropped loopback packet, device sends a different codec than it receives", "sessionID", l.sessionID, "codec", codec.MimeType)
+		return true
+	}
+
+	echoed := *p
+	if !l.started {
+		l.started = true
+		l.offset = l.track.lastTimestamp() + codec.ClockRate/50 - p.Timestamp
+		echoed.Marker = true
+	}
+	echoed.Timestamp += l.offset
+	l.packets++
+	l.mu.Unlock()
+
+	if err := l.track.insertRTP(&echoed); err != nil {
+		log.Errorw("Failed to write RTP packet to loopback", err, "sessionID", l.sessionID)
+	}
+	return true
+}
+
+func (l *loopback) setEnabled(enabled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.enabled == enabled {
+		return
+	}
+	l.enabled, l.started = enabled, false
+	if enabled {
+		l.packets = 0
+		log.Infow("Loopback started", "sessionID", l.sessionID)
+	} else {
+		log.Infow("Loopback stopped", "sessionID", l.sessionID, "packets", l.packets, "rtt", l.rtt)
+	}
+}
+
+func (l *loopback) status() loopbackStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return loopbackStatus{
+		Enabled: l.enabled,
+		Packets: l.packets,
+		RTTMs:   float64(l.rtt) / float64(time.Millisecond),
+	}
+}
+
+// setRTT keeps the round trip time from a receiver report of the device.
+func (l *loopback) setRTT(rtt time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rtt = rtt
+}
+
+// roundTripTime computes the RTT of RFC 3550 section 6.4.1 from a report
+// block received at now.
+func roundTripTime(now time.Time, block rtcp.ReceptionReport) (time.Duration, bool) {
+	if block.LastSenderReport == 0 {
+		return 0, false
+	}
+
+	// The middle 32 bits of the NTP time, in 1/65536 seconds
+	middle := uint32(ntpTime(now) >> 16)
+
+	rtt := middle - block.LastSenderReport - block.Delay
+	if int32(rtt) < 0 {
+		return 0, false
+	}
+	return time.Duration(rtt) * time.Second / 65536, true
+}
+
+// ntpTime is t as a 64 bit NTP timestamp.
+func ntpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// loopbackHandler turns loopback of the session on or off and reports the
+// measured delay.
+func (app *App) loopbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+	if s.loopback == nil {
+		writeError(w, r, "Loopback is disabled, start the bridge with -loopback", http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req loopbackStatus
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		s.loopback.setEnabled(req.Enabled)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(s.loopback.status()); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+const (
+	// loudnessStepMs is the hop between 400ms gating blocks, as in
+	// ITU-R BS.1770
+	loudnessStepMs = 100
+	loudnessBlocks = 4
+	// loudnessAbsoluteGate and loudnessRelativeGate leave silence and
+	// pauses out of the measurement
+	loudnessAbsoluteGate = -70
+	loudnessRelativeGate = -10
+	// loudnessWindow is how many seconds of audio the measurement spans
+	loudnessWindow = 3
+	// maxNormalizeGainDB keeps quiet devices from having their noise
+	// floor boosted into the room
+	maxNormalizeGainDB = 20
+	// normalizeHeadroom is the peak the normalizer lets through, the rest
+	// is left to the encoder
+	normalizeHeadroom = 0.9 * math.MaxInt16
+)
+
+// biquad is a second order IIR filter in direct form I.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) filter(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting returns the BS.1770 K-weighting filters for sampleRate, a
+// high shelf modelling the head followed by a high pass.
+func kWeighting(sampleRate int) (shelf, highPass *biquad) {
+	rate := float64(sampleRate)
+
+	k := math.Tan(math.Pi * 1681.974450955533 / rate)
+	q := 0.7071752369554196
+	vh := math.Pow(10, 3.999843853973347/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf = &biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	k = math.Tan(math.Pi * 38.13547087602444 / rate)
+	q = 0.5003270373238773
+	a0 = 1 + k/q + k*k
+	highPass = &biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	return shelf, highPass
+}
+
+// loudnessNormalizer moves the gain of device audio towards a target
+// loudness in LUFS. The loudness is measured like BS.1770 integrated
+// loudness, but over the last few seconds so the gain follows a device
+// whose level changes.
+type loudnessNormalizer struct {
+	target           func() float64
+	shelf, highPass  *biquad
+	stepSize, filled int
+	stepEnergy       float64
+	steps            []float64
+	// meanSquare is the gated K-weighted power, zero until the device
+	// was first heard
+	meanSquare float64
+	// blockWeight is how much a gating block moves meanSquare
+	blockWeight float64
+	gain        float64
+}
+
+func newLoudnessNormalizer(sampleRate int, target func() float64) *loudnessNormalizer {
+	shelf, highPass := kWeighting(sampleRate)
+	return &loudnessNormalizer{
+		target:      target,
+		shelf:       shelf,
+		highPass:    highPass,
+		stepSize:    sampleRate * loudnessStepMs / 1000,
+		blockWeight: float64(loudnessStepMs) / (loudnessWindow * 1000),
+		gain:        1,
+	}
+}
+
+func loudness(meanSquare float64) float64 {
+	return -0.691 + 10*math.Log10(meanSquare)
+}
+
+func (n *loudnessNormalizer) process(pcm []int16) {
+	for _, sample := range pcm {
+		weighted := n.highPass.filter(n.shelf.filter(float64(sample) / math.MaxInt16))
+		n.stepEnergy += weighted * weighted
+		if n.filled++; n.filled == n.stepSize {
+			n.addStep(n.stepEnergy / float64(n.stepSize))
+			n.stepEnergy, n.filled = 0, 0
+		}
+	}
+
+	gain := n.gain
+	if n.meanSquare > 0 {
+		gainDB := min(maxNormalizeGainDB, n.target()-loudness(n.meanSquare))
+		gain = math.Pow(10, gainDB/20)
+	}
+
+	// Take the gain down at once if the frame would clip, and ramp
+	// towards it otherwise so it doesn't click
+	var peak float64
+	for _, sample := range pcm {
+		peak = max(peak, math.Abs(float64(sample)))
+	}
+	if peak*gain > normalizeHeadroom {
+		gain = normalizeHeadroom / peak
+		n.gain = min(n.gain, gain)
+	}
+
+	for i, sample := range pcm {
+		step := n.gain + (gain-n.gain)*float64(i+1)/float64(len(pcm))
+		pcm[i] = int16(max(math.MinInt16, min(math.MaxInt16, math.Round(float64(sample)*step))))
+	}
+	n.gain = gain
+}
+
+// addStep adds 100ms of K-weighted power and gates the 400ms block ending
+// with it.
+func (n *loudnessNormalizer) addStep(meanSquare float64) {
+	n.steps = append(n.steps, meanSquare)
+	if len(n.steps) < loudnessBlocks {
+		return
+	}
+	n.steps = n.steps[len(n.steps)-loudnessBlocks:]
+
+	var block float64
+	for _, step := range n.steps {
+		block += step / loudnessBlocks
+	}
+	if block == 0 || loudness(block) < loudnessAbsoluteGate {
+		return
+	}
+
+	if n.meanSquare == 0 {
+		n.meanSquare = block
+		return
+	}
+	if loudness(block) < loudness(n.meanSquare)+loudnessRelativeGate {
+		return
+	}
+	n.meanSquare += n.blockWeight * (block - n.meanSquare)
+}
+
+// newSessionNormalizer returns the -normalize stage for the session at
+// sampleRate, nil when it is disabled.
+func newSessionNormalizer(s *session, sampleRate int) audioProcessor {
+	if !normalizeLoudness {
+		return nil
+	}
+	return newLoudnessNormalizer(sampleRate, s.loudnessTarget)
+}
+
+// loudnessTarget returns the loudness the session is normalized to in
+// LUFS.
+func (s *session) loudnessTarget() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.targetLUFS != nil {
+		return *s.targetLUFS
+	}
+	return loudnessTarget
+}
+
+// loudnessRequest is the body of the loudness resource. A null target
+// resets the session to -loudness-target.
+type loudnessRequest struct {
+	TargetLUFS *float64 `json:"target_lufs"`
+}
+
+func validateLoudnessTarget(target float64) error {
+	if math.IsNaN(target) || target < -60 || target > 0 {
+		return fmt.Errorf("target_lufs must be between -60 and 0, got %v", target)
+	}
+	return nil
+}
+
+// loudnessHandler reads and overrides the loudness a session is
+// normalized to.
+func (app *App) loudnessHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !normalizeLoudness {
+			writeError(w, r, "Loudness normalization is disabled, start the bridge with -normalize", http.StatusConflict)
+			return
+		}
+
+		var req loudnessRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.TargetLUFS != nil {
+			if err := validateLoudnessTarget(*req.TargetLUFS); err != nil {
+				writeError(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		s.mu.Lock()
+		s.targetLUFS = req.TargetLUFS
+		s.mu.Unlock()
+		log.Infow("Session loudness target changed", "sessionID", s.id, "targetLUFS", s.loudnessTarget())
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	target := s.loudnessTarget()
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(loudnessRequest{TargetLUFS: &target}); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
@@ -2,52 +2,274 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/hashicorp/mdns"
 	"github.com/livekit/protocol/auth"
 	"github.com/livekit/protocol/logger"
 	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/ice/v4"
+	"github.com/pion/turn/v4"
 	"github.com/pion/webrtc/v4"
+	"github.com/quic-go/quic-go/http3"
 )
 
 var (
 	host, apiKey, apiSecret, roomName, identity string
-	livekitTrack                                *webrtc.TrackLocalStaticRTP
-	embeddedTrack                               *lksdk.LocalTrack
+	listenAddrs, listenUnix                     string
+	h2Addr, h3Addr, tlsCert, tlsKey             string
+	dtlsCertFile                                string
+	tlsCertificate                              tls.Certificate
+	bearerToken, iceServersFlag                 string
+	coapAddr                                    string
+	turnAddr, turnRelayIP, turnRealm            string
+	turnSecret, stunAddr                        string
+	turnTTL                                     time.Duration
+	coapBlockSize, iceTCPPort, udpPort          int
+	udpPortMin, udpPortMax, mtu                 int
+	serialPort                                  string
+	serialBaud                                  int
+	mdnsEnabled, ssdpEnabled                    bool
+	mdnsInstance, bleName                       string
+	bleEnabled                                  bool
+	configFile, provisionSecret                 string
+	adminToken, registryFile, mixRulesFile      string
+	claimTTL, viewerTokenTTL, resumeWindow      time.Duration
+	cfg                                         = &config{}
+	minifyAnswers, earlyAnswers                 bool
+	opusBitrate, opusComplexity, opusFrameMs    int
+	opusVBR, opusFEC, resampleAudio             bool
+	adaptiveBitrate, twcc, nack                 bool
+	driftCompensation                           bool
+	adaptiveBitrateMin, twccMaxBitrate          int
+	opusFmtp, stereoMode                        string
+	vadEnabled, audioLevels                     bool
+	noiseSuppression, mjpegEncoder              string
+	keyframeChannel, ttsURL, ttsToken           string
+	dtmfDownlink, dtxFill, mixDownlink          bool
+	announcements, loopbackTest, multiDownlink  bool
+	normalizeLoudness                           bool
+	loudnessTarget, duckDB, announcementDuckDB  float64
+	vadThreshold                                float64
+	vadHangover, jitterDelay, staleTimeout      time.Duration
+	senderReportInterval                        time.Duration
+	allowedRooms, allowedIdentities             string
+	identityTemplate                            string
+	trackName, trackSource, participantMetadata string
+	hiddenGroups, subscribeTracks               string
+	dataTopics, dataFraming, telemetryTopic     string
+	dataRate                                    float64
+	rpcMethods, agentName, agentMetadata        string
+	createRooms, muteOnLoss, intercom, paging   bool
+	hostOnly, iceLite                           bool
+	dscpMarking, srtpProfiles                   string
+	roomEmptyTimeout, deleteRoomsAfter          time.Duration
+	roomMaxParticipants                         int
+	roomMetadata                                string
+	nat1To1IPs, nat1To1CandidateType            string
+	ipFamily, preferIPFamily                    string
+	interfaces, excludeInterfaces               string
+	localCIDRsFlag, excludeLocalCIDRs           string
+	remoteCIDRsFlag, excludeRemoteCIDRs         string
+	localCIDRs, remoteCIDRs                     cidrFilter
+	iceServers                                  []webrtc.ICEServer
 	log                                         logger.Logger
 )
 
+// httpPort is the port of the first TCP listener, advertised by the
+// discovery mechanisms
+var httpPort int
+
 type App struct {
-	room       *lksdk.Room
-	server     *http.Server
-	ctx        context.Context
-	cancel     context.CancelFunc
-	wg         sync.WaitGroup
-	peerConns  map[string]*webrtc.PeerConnection
-	peerConnMu sync.RWMutex
+	server         *http.Server
+	h3             *http3.Server
+	ctx            context.Context
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
+	coap           *coapServer
+	turn           *turn.Server
+	stun           *stunResponder
+	iceTCP         *net.TCPListener
+	udpMux         ice.UDPMux
+	serial         *serialSignaling
+	mdns           *mdns.Server
+	ssdp           *ssdpResponder
+	ble            *bleProvisioning
+	sessions       map[string]*session
+	sessionsMu     sync.RWMutex
+	participants   map[string]*participant
+	participantsMu sync.Mutex
+	certificate    *webrtc.Certificate
+	api            *webrtc.API
+	registry       *deviceRegistry
+	validators     []tokenValidator
+	mixRules       *mixRules
+	dispatcher     *agentDispatcher
+	roomService    *lksdk.RoomServiceClient
+	// roomCleanups delete rooms left empty with -delete-rooms-after,
+	// guarded by participantsMu
+	roomCleanups map[string]*time.Timer
+	// joins are the rooms being joined by participant key, guarded by
+	// participantsMu
+	joins map[string]*participantJoin
+	// reservedIdentities are the templated identities picked for
+	// sessions being created, keyed by room and identity and guarded by
+	// sessionsMu
+	reservedIdentities map[string]bool
+	// parked are the sessions waiting for their device to reconnect,
+	// keyed by room and identity
+	parked   map[string]*parkedSession
+	parkedMu sync.Mutex
+	// intercoms are the rooms patched together with -intercom
+	intercoms   map[string]*intercomRoom
+	intercomsMu sync.Mutex
+	// pages are the sources of the groups paged with -paging
+	pages   map[string]*pageSource
+	pagesMu sync.Mutex
+	// settingEngine is what apis are created from, the APIs of sessions
+	// whose DSCP differs from -dscp keyed by its value
+	settingEngine webrtc.SettingEngine
+	apis          map[int]*webrtc.API
+	apisMu        sync.Mutex
 }
 
 func init() {
+	flag.StringVar(&listenAddrs, "listen", ":8080", "comma separated TCP addresses to serve HTTP signaling on")
+	flag.StringVar(&listenUnix, "listen-unix", "", "Unix socket path to serve HTTP signaling on")
+	flag.StringVar(&h2Addr, "h2-addr", "", "TCP address for HTTPS signaling with HTTP/2, e.g. :8443 (disabled when empty)")
+	flag.StringVar(&h3Addr, "h3-addr", "", "UDP address for HTTP/3 signaling over QUIC, e.g. :8443 (disabled when empty)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file for -h2-addr and -h3-addr")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file for -h2-addr and -h3-addr")
+	flag.StringVar(&dtlsCertFile, "dtls-cert", "", "PEM file with the DTLS certificate and key of device PeerConnections, generated when missing")
 	flag.StringVar(&host, "host", "", "livekit server host")
 	flag.StringVar(&apiKey, "api-key", "", "livekit api key")
 	flag.StringVar(&apiSecret, "api-secret", "", "livekit api secret")
 	flag.StringVar(&roomName, "room-name", "embedded", "room name")
 	flag.StringVar(&identity, "identity", "", "participant identity")
+	flag.StringVar(&trackName, "track-name", "embedded", "name of the audio track published for a device")
+	flag.StringVar(&trackSource, "track-source", "microphone", "source of the audio track published for a device, microphone or screen_share_audio")
+	flag.StringVar(&participantMetadata, "participant-metadata", "", "JSON metadata of the participants the bridge joins as")
+	flag.StringVar(&subscribeTracks, "subscribe-tracks", "", "comma separated glob patterns of track names forwarded to devices, all tracks when empty")
+	flag.StringVar(&hiddenGroups, "hidden-groups", "", "comma separated device groups from -config joining rooms as hidden participants")
+	flag.StringVar(&identityTemplate, "identity-template", "", "identity of devices sending their MAC or serial number, e.g. mcu-{mac} or door-{serial}")
+	flag.StringVar(&bearerToken, "bearer-token", "", "require this Bearer token on WHIP requests")
+	flag.StringVar(&iceServersFlag, "ice-servers", "", "comma separated ICE server URLs used by the bridge and advertised to devices")
+	flag.StringVar(&turnAddr, "turn-addr", "", "UDP address of the embedded TURN server, e.g. :3478 (disabled when empty)")
+	flag.StringVar(&turnRelayIP, "turn-relay-ip", "", "public IPv4 address of the embedded TURN server, used for its URL and relayed candidates")
+	flag.StringVar(&turnSecret, "turn-secret", "", "shared secret the TURN credentials of devices are minted with (random when empty)")
+	flag.StringVar(&turnRealm, "turn-realm", "livekit-microcontroller-bridge", "realm of the embedded TURN server")
+	flag.DurationVar(&turnTTL, "turn-ttl", 24*time.Hour, "validity of the TURN credentials minted for devices")
+	flag.StringVar(&stunAddr, "stun-addr", "", "UDP address of the STUN binding responder, e.g. :3479 (disabled when empty)")
+	flag.IntVar(&iceTCPPort, "ice-tcp-port", 0, "TCP port for passive ICE-TCP candidates, for networks blocking UDP (disabled when 0)")
+	flag.IntVar(&udpPort, "udp-port", 0, "UDP port shared by the media of every device, ephemeral ports per session when 0")
+	flag.StringVar(&interfaces, "interfaces", "", "comma separated glob patterns of the network interfaces candidates are gathered on, all when empty")
+	flag.StringVar(&excludeInterfaces, "exclude-interfaces", "", "comma separated glob patterns of network interfaces never gathered on, e.g. docker*,tun*")
+	flag.StringVar(&localCIDRsFlag, "local-cidrs", "", "comma separated CIDRs the bridge gathers candidates in, all when empty")
+	flag.StringVar(&excludeLocalCIDRs, "exclude-local-cidrs", "", "comma separated CIDRs the bridge never gathers candidates in")
+	flag.StringVar(&remoteCIDRsFlag, "remote-cidrs", "", "comma separated CIDRs device candidates are accepted from, all when empty")
+	flag.StringVar(&excludeRemoteCIDRs, "exclude-remote-cidrs", "", "comma separated CIDRs device candidates are never accepted from")
+	flag.StringVar(&ipFamily, "ip-family", "dual", "IP family for media, signaling and discovery, dual, ipv4 or ipv6")
+	flag.StringVar(&preferIPFamily, "prefer-ip-family", "", "IP family whose candidates are listed first in answers and advertised first, ipv4 or ipv6")
+	flag.StringVar(&nat1To1IPs, "nat-1to1-ips", "", "comma separated public IPs of the bridge behind 1:1 NAT, as public or public/local")
+	flag.StringVar(&nat1To1CandidateType, "nat-1to1-candidate-type", "host", "candidate type the nat-1to1-ips are advertised as, host or srflx")
+	flag.IntVar(&mtu, "mtu", 1200, "largest UDP payload of the RTP the bridge packetizes for devices, for stacks dropping fragmented UDP")
+	flag.StringVar(&srtpProfiles, "srtp-profiles", "aead_aes_128_gcm,aead_aes_256_gcm,aes128_cm_hmac_sha1_80", "comma separated SRTP protection profiles offered to devices, most preferred first")
+	flag.StringVar(&dscpMarking, "dscp", "", "DSCP media sent to devices is marked with, e.g. ef or af41 (unmarked when empty)")
+	flag.BoolVar(&iceLite, "ice-lite", false, "run ICE-lite, the bridge only has host candidates and devices do the connectivity checks")
+	flag.BoolVar(&hostOnly, "host-only", false, "gather only host candidates, for devices on the same LAN as the bridge")
+	flag.IntVar(&udpPortMin, "udp-port-min", 0, "lowest ephemeral UDP port used for device media without -udp-port")
+	flag.IntVar(&udpPortMax, "udp-port-max", 0, "highest ephemeral UDP port used for device media without -udp-port")
+	flag.StringVar(&coapAddr, "coap-addr", "", "UDP address for CoAP signaling, e.g. :5683 (disabled when empty)")
+	flag.IntVar(&coapBlockSize, "coap-block-size", 512, "CoAP blockwise transfer size in bytes")
+	flag.StringVar(&serialPort, "serial-port", "", "serial port to read offers from, e.g. /dev/ttyUSB0 (disabled when empty)")
+	flag.IntVar(&serialBaud, "serial-baud", 115200, "serial port baud rate")
+	flag.BoolVar(&mdnsEnabled, "mdns", true, "advertise the bridge as "+mdnsService+" over mDNS")
+	flag.StringVar(&mdnsInstance, "mdns-instance", "", "mDNS service instance name (defaults to the hostname)")
+	flag.BoolVar(&bleEnabled, "ble", false, "run a BLE GATT service handing Wi-Fi credentials and the bridge URL to devices")
+	flag.StringVar(&bleName, "ble-name", "lk-bridge", "BLE local name to advertise")
+	flag.StringVar(&configFile, "config", "", "YAML file with per-device settings")
+	flag.StringVar(&provisionSecret, "provision-secret", "", "HMAC key signing provisioning bundles, enables /provision")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token for the operator API (disabled when empty)")
+	flag.StringVar(&registryFile, "registry", "", "JSON file of paired devices, which join with the room, identity and grants registered for them")
+	flag.DurationVar(&claimTTL, "claim-ttl", 10*time.Minute, "how long a claim code is valid")
+	flag.BoolVar(&ssdpEnabled, "ssdp", true, "answer SSDP M-SEARCH queries for "+ssdpSearchTarget)
+	flag.StringVar(&allowedRooms, "allowed-rooms", "", "comma separated glob patterns of rooms devices may request")
+	flag.StringVar(&allowedIdentities, "allowed-identities", "", "comma separated glob patterns of identities devices may request")
+	flag.BoolVar(&minifyAnswers, "minify-answer", false, "strip unused codecs, header extensions and ssrc lines from SDP answers")
+	flag.BoolVar(&earlyAnswers, "early-answer", false, "answer before ICE gathering completes, devices poll the remaining candidates")
+	flag.IntVar(&opusBitrate, "opus-bitrate", 0, "Opus bitrate in bits per second when the bridge encodes device audio (0 keeps the libopus default)")
+	flag.IntVar(&opusComplexity, "opus-complexity", -1, "Opus encoder complexity from 0 to 10 (-1 keeps the libopus default)")
+	flag.IntVar(&opusFrameMs, "opus-frame-ms", 20, "Opus frame size in milliseconds, 10, 20, 40 or 60")
+	flag.BoolVar(&opusVBR, "opus-vbr", true, "encode Opus with a variable bitrate, false for constant bitrate")
+	flag.BoolVar(&opusFEC, "opus-fec", false, "force Opus in-band FEC, useinbandfec=1 in answers and FEC when the bridge encodes")
+	flag.BoolVar(&resampleAudio, "resample", false, "resample 8 and 16kHz device audio to 48kHz on the bridge instead of encoding it at the device rate")
+	flag.BoolVar(&vadEnabled, "vad", false, "stop forwarding device audio to LiveKit while it is silent")
+	flag.Float64Var(&vadThreshold, "vad-threshold", -50, "level in dBFS below which device audio is silent")
+	flag.DurationVar(&vadHangover, "vad-hangover", 500*time.Millisecond, "how long audio is still forwarded after the device goes silent")
+	flag.BoolVar(&audioLevels, "audio-levels", false, "decode Opus from devices to send audio levels to LiveKit for speaking indicators")
+	flag.StringVar(&noiseSuppression, "noise-suppression", "", "noise suppressor applied to device audio, one of "+strings.Join(audioProcessorNames(), ", ")+" (disabled when empty)")
+	flag.BoolVar(&normalizeLoudness, "normalize", false, "normalize the loudness of device audio to -loudness-target")
+	flag.Float64Var(&loudnessTarget, "loudness-target", -23, "loudness in LUFS device audio is normalized to")
+	flag.BoolVar(&dtxFill, "dtx-fill", true, "repeat DTX frames from LiveKit during gaps so devices play comfort noise instead of dropping out")
+	flag.BoolVar(&adaptiveBitrate, "adaptive-bitrate", false, "lower the bitrate of the Opus the bridge encodes for devices with -mix or -announcements while they report loss")
+	flag.IntVar(&adaptiveBitrateMin, "adaptive-bitrate-min", 12000, "lowest bitrate in bits per second -adaptive-bitrate goes down to")
+	flag.BoolVar(&twcc, "twcc", false, "estimate the bandwidth to devices from transport-wide congestion control feedback and pace the downlink to it")
+	flag.IntVar(&twccMaxBitrate, "twcc-max-bitrate", 1_000_000, "highest bandwidth estimate in bits per second -twcc goes up to")
+	flag.BoolVar(&driftCompensation, "drift-compensation", false, "drop or conceal a frame of device audio whenever the device clock drifted a frame off the bridge's, so latency doesn't build up over hours")
+	flag.BoolVar(&nack, "nack", false, "retransmit the downlink audio devices report lost with NACK")
+	flag.BoolVar(&mixDownlink, "mix", false, "mix the audio of every subscribed track into one Opus stream for devices")
+	flag.StringVar(&mixRulesFile, "mix-rules", "", "JSON file the per room mix rules set through the admin API are kept in")
+	flag.Float64Var(&duckDB, "duck", 12, "dB by which -mix ducks participants while one of higher priority is heard")
+	flag.DurationVar(&jitterDelay, "jitter-buffer", 0, "target delay of a jitter buffer pacing LiveKit audio to each device, grows with the measured jitter (disabled when 0)")
+	flag.StringVar(&mjpegEncoder, "mjpeg-encoder", "", "command reading MJPEG on stdin and writing H.264 Annex B to stdout, transcodes camera boards sending MJPEG (disabled when empty)")
+	flag.StringVar(&dataTopics, "data-topics", "", "comma separated glob patterns of the data message topics sent to device data channels, all topics when empty")
+	flag.StringVar(&dataFraming, "data-framing", rawFraming, "framing of data messages sent to devices, raw for the payload or topic to prefix it with its topic")
+	flag.StringVar(&telemetryTopic, "telemetry-topic", "", "topic of the data messages devices publish, e.g. device-telemetry (the data channel label when empty)")
+	flag.Float64Var(&dataRate, "data-rate", 0, "data messages a second a device may publish, more are dropped (unlimited when 0)")
+	flag.StringVar(&rpcMethods, "rpc-methods", "", "comma separated RPC methods registered on device participants and answered by the device on its rpc data channel, e.g. set_volume,reboot")
+	flag.BoolVar(&createRooms, "create-rooms", false, "create rooms devices join through the RoomService API with the -room-* options when they don't exist")
+	flag.DurationVar(&roomEmptyTimeout, "room-empty-timeout", 0, "how long a room created with -create-rooms stays open once empty (server default when 0)")
+	flag.IntVar(&roomMaxParticipants, "room-max-participants", 0, "participant limit of rooms created with -create-rooms (unlimited when 0)")
+	flag.StringVar(&roomMetadata, "room-metadata", "", "metadata of rooms created with -create-rooms")
+	flag.DurationVar(&deleteRoomsAfter, "delete-rooms-after", 0, "delete rooms through the RoomService API once the last device left them this long ago and nobody else is in them (disabled when 0)")
+	flag.DurationVar(&viewerTokenTTL, "viewer-token-ttl", time.Hour, "validity of the tokens minted for operators by the token endpoint")
+	flag.DurationVar(&senderReportInterval, "sender-report-interval", time.Second, "how often RTCP sender reports are sent for the streams toward devices, and once each stream starts")
+	flag.DurationVar(&staleTimeout, "stale-timeout", 0, "close sessions whose device sent no RTP or STUN this long, e.g. after a brownout (disabled when 0)")
+	flag.DurationVar(&resumeWindow, "resume-window", 0, "keep the participant and tracks of a device whose connection failed this long, so a reconnect resumes them (disabled when 0)")
+	flag.BoolVar(&muteOnLoss, "mute-on-loss", false, "mark the tracks of a device whose connection failed muted during -resume-window, they are unpublished once it passes")
+	flag.BoolVar(&intercom, "intercom", false, "patch devices in the same room directly to each other through the bridge, without LiveKit when -host is empty")
+	flag.BoolVar(&paging, "paging", false, "let the admin API page groups of devices with the audio of one device or LiveKit participant")
+	flag.StringVar(&agentName, "agent-name", "", "LiveKit agent dispatched into the room of every device session, e.g. a voice assistant (disabled when empty)")
+	flag.StringVar(&agentMetadata, "agent-metadata", "", "metadata passed to the agent dispatched with -agent-name")
+	flag.StringVar(&keyframeChannel, "keyframe-channel", "", "also send keyframe requests from LiveKit as JSON on the device data channel with this label (disabled when empty)")
+	flag.BoolVar(&announcements, "announcements", false, "give every session its own downlink track so announcements can be played to it through the admin API")
+	flag.BoolVar(&multiDownlink, "multi-downlink", false, "forward every remote participant on its own track to devices offering more than one audio m-line")
+	flag.BoolVar(&loopbackTest, "loopback", false, "give every session its own downlink track so it can be switched to sending the device audio back as a self-test")
+	flag.Float64Var(&announcementDuckDB, "announcement-duck", 12, "dB by which audio from LiveKit is ducked under an announcement played with mode=mix")
+	flag.StringVar(&ttsURL, "tts-url", "", "text-to-speech backend the bridge posts announcement text to as JSON, answering with WAV or Ogg Opus")
+	flag.StringVar(&ttsToken, "tts-token", "", "bearer token sent to -tts-url")
+	flag.BoolVar(&dtmfDownlink, "dtmf-downlink", false, "send DTMF data messages from the room to devices as telephone-events")
+	flag.StringVar(&stereoMode, "stereo", "", "negotiate stereo Opus with devices and publish it as passthrough, downmix (to mono) or split (left and right tracks), mono when empty")
+	flag.StringVar(&opusFmtp, "opus-fmtp", "", "Opus fmtp parameters merged into answers, e.g. maxplaybackrate=16000;useinbandfec=0")
 }
 
 func main() {
 	logger.InitFromConfig(&logger.Config{Level: "debug"}, "livekit-embedded-bridge")
 	log = logger.GetLogger()
 	lksdk.SetLogger(log)
-	
+
 	flag.Parse()
 	if err := validateFlags(); err != nil {
 		log.Errorw("invalid arguments", err)
@@ -55,7 +277,15 @@ func main() {
 	}
 
 	app := &App{
-		peerConns: make(map[string]*webrtc.PeerConnection),
+		sessions:           make(map[string]*session),
+		participants:       make(map[string]*participant),
+		roomCleanups:       make(map[string]*time.Timer),
+		joins:              make(map[string]*participantJoin),
+		reservedIdentities: make(map[string]bool),
+		parked:             make(map[string]*parkedSession),
+		intercoms:          make(map[string]*intercomRoom),
+		pages:              make(map[string]*pageSource),
+		apis:               make(map[int]*webrtc.API),
 	}
 	app.ctx, app.cancel = context.WithCancel(context.Background())
 
@@ -69,32 +299,131 @@ func main() {
 	}
 
 	// Start HTTP server in a goroutine
+	if err := app.startServer(); err != nil {
+		log.Errorw("failed to start HTTP server", err)
+		os.Exit(1)
+	}
+
+	// Start TURN server for devices that can't reach the bridge directly
+	if turnAddr != "" {
+		if err := app.listenTURN(); err != nil {
+			log.Errorw("failed to start TURN server", err)
+			os.Exit(1)
+		}
+	}
+
+	// Answer STUN binding requests of LAN devices
+	if stunAddr != "" {
+		if err := app.listenSTUN(); err != nil {
+			log.Errorw("failed to start STUN responder", err)
+			os.Exit(1)
+		}
+
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			app.stun.serve()
+		}()
+	}
+
+	// Start CoAP listener for constrained devices
+	if coapAddr != "" {
+		if err := app.listenCoAP(); err != nil {
+			log.Errorw("failed to start CoAP listener", err)
+			os.Exit(1)
+		}
+
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			if err := app.coap.serve(); err != nil {
+				log.Errorw("CoAP server error", err)
+			}
+		}()
+	}
+
+	// Start serial signaling for boards without a network at boot
+	if serialPort != "" {
+		if err := app.openSerial(); err != nil {
+			log.Errorw("failed to open serial port", err)
+			os.Exit(1)
+		}
+
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			app.serial.serve()
+		}()
+	}
+
+	// Advertise the bridge on the LAN, devices work without it so
+	// failures aren't fatal
+	if mdnsEnabled {
+		if err := app.startMDNS(); err != nil {
+			log.Errorw("failed to start mDNS advertisement", err)
+		}
+	}
+	if bleEnabled {
+		if err := app.startBLE(); err != nil {
+			log.Errorw("failed to start BLE provisioning", err)
+		}
+	}
+	if ssdpEnabled {
+		if err := app.listenSSDP(); err != nil {
+			log.Errorw("failed to start SSDP responder", err)
+		} else {
+			app.wg.Add(1)
+			go func() {
+				defer app.wg.Done()
+				app.ssdp.serve()
+			}()
+		}
+	}
+
 	app.wg.Add(1)
 	go func() {
 		defer app.wg.Done()
-		if err := app.startServer(); err != nil && err != http.ErrServerClosed {
-			log.Errorw("HTTP server error", err)
-		}
+		app.publishAttributes()
+	}()
+
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		app.scoreSessions()
 	}()
 
-	log.Infow("Application started successfully", "port", "8080")
+	if staleTimeout > 0 {
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			app.closeStaleSessions()
+		}()
+	}
+
+	log.Infow("Application started successfully")
 
 	// Wait for shutdown signal
 	<-sigChan
 	log.Infow("Shutdown signal received, starting graceful shutdown...")
-	
+
 	app.shutdown()
 }
 
 func validateFlags() error {
-	if host == "" {
-		return fmt.Errorf("host is required")
-	}
-	if apiKey == "" {
-		return fmt.Errorf("api-key is required")
-	}
-	if apiSecret == "" {
-		return fmt.Errorf("api-secret is required")
+	if standalone() {
+		if createRooms || deleteRoomsAfter > 0 || agentName != "" || rpcMethods != "" {
+			return fmt.Errorf("create-rooms, delete-rooms-after, agent-name and rpc-methods need -host")
+		}
+	} else {
+		if host == "" {
+			return fmt.Errorf("host is required")
+		}
+		if apiKey == "" {
+			return fmt.Errorf("api-key is required")
+		}
+		if apiSecret == "" {
+			return fmt.Errorf("api-secret is required")
+		}
 	}
 	if roomName == "" {
 		return fmt.Errorf("room-name is required")
@@ -102,262 +431,362 @@ func validateFlags() error {
 	if identity == "" {
 		return fmt.Errorf("identity is required")
 	}
+
+	var err error
+	if iceServers, err = parseICEServers(iceServersFlag); err != nil {
+		return fmt.Errorf("invalid ice-servers: %w", err)
+	}
+	if err := validateTURN(); err != nil {
+		return err
+	}
+	if iceTCPPort < 0 || iceTCPPort > 65535 {
+		return fmt.Errorf("invalid ice-tcp-port %d", iceTCPPort)
+	}
+	if udpPort < 0 || udpPort > 65535 {
+		return fmt.Errorf("invalid udp-port %d", udpPort)
+	}
+	if err := validateInterfaces(); err != nil {
+		return err
+	}
+	if localCIDRs, err = parseCIDRFilter(localCIDRsFlag, excludeLocalCIDRs); err != nil {
+		return fmt.Errorf("invalid local-cidrs: %w", err)
+	}
+	if remoteCIDRs, err = parseCIDRFilter(remoteCIDRsFlag, excludeRemoteCIDRs); err != nil {
+		return fmt.Errorf("invalid remote-cidrs: %w", err)
+	}
+	if mtu < 576 || mtu > 1500 {
+		return fmt.Errorf("mtu must be between 576 and 1500")
+	}
+	if _, err := parseDSCP(dscpMarking); err != nil {
+		return err
+	}
+	if _, err := parseSRTPProfiles(srtpProfiles); err != nil {
+		return err
+	}
+	if err := validateIPFamily(); err != nil {
+		return err
+	}
+	if err := validateNAT1To1(); err != nil {
+		return err
+	}
+	if udpPortMin != 0 || udpPortMax != 0 {
+		if udpPort != 0 {
+			return fmt.Errorf("udp-port-min and udp-port-max can't be used with udp-port")
+		}
+		if udpPortMin < 1 || udpPortMax > 65535 || udpPortMin > udpPortMax {
+			return fmt.Errorf("invalid UDP port range %d-%d", udpPortMin, udpPortMax)
+		}
+	}
+	if addrs := splitList(listenAddrs); len(addrs) > 0 {
+		_, port, err := net.SplitHostPort(addrs[0])
+		if err == nil {
+			httpPort, err = strconv.Atoi(port)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid listen address %q: %w", addrs[0], err)
+		}
+	}
+	if err := (encoderSettings{}).withDefaults().validate(); err != nil {
+		return fmt.Errorf("invalid opus flags: %w", err)
+	}
+	if _, err := parseFmtp(opusFmtp); err != nil {
+		return fmt.Errorf("invalid opus-fmtp: %w", err)
+	}
+	if _, err := parseTrackSource(trackSource); err != nil {
+		return fmt.Errorf("invalid track-source: %w", err)
+	}
+	if dataFraming != rawFraming && dataFraming != topicFraming {
+		return fmt.Errorf("data-framing must be %s or %s", rawFraming, topicFraming)
+	}
+	if roomEmptyTimeout < 0 || roomMaxParticipants < 0 || deleteRoomsAfter < 0 {
+		return fmt.Errorf("room-empty-timeout, room-max-participants and delete-rooms-after must not be negative")
+	}
+	if resumeWindow < 0 {
+		return fmt.Errorf("resume-window must not be negative")
+	}
+	if staleTimeout < 0 {
+		return fmt.Errorf("stale-timeout must not be negative")
+	}
+	if senderReportInterval <= 0 {
+		return fmt.Errorf("sender-report-interval must be positive")
+	}
+	if muteOnLoss && resumeWindow == 0 {
+		return fmt.Errorf("mute-on-loss needs -resume-window")
+	}
+	if viewerTokenTTL <= 0 {
+		return fmt.Errorf("viewer-token-ttl must be positive")
+	}
+	if dataRate < 0 {
+		return fmt.Errorf("data-rate must not be negative")
+	}
+	if err := validateMetadata(participantMetadata); err != nil {
+		return fmt.Errorf("invalid participant-metadata: %w", err)
+	}
+	if err := validateIdentityTemplate(identityTemplate); err != nil {
+		return fmt.Errorf("invalid identity-template: %w", err)
+	}
+	if err := validateStereo(stereoMode); err != nil {
+		return fmt.Errorf("invalid stereo: %w", err)
+	}
+	if noiseSuppression != "" {
+		if _, ok := audioProcessors[noiseSuppression]; !ok {
+			return fmt.Errorf("unknown noise-suppression %q", noiseSuppression)
+		}
+		if !opusAvailable() {
+			return fmt.Errorf("noise-suppression needs the bridge built with -tags opus")
+		}
+	}
+	if normalizeLoudness {
+		if !opusAvailable() {
+			return fmt.Errorf("normalize needs the bridge built with -tags opus")
+		}
+		if err := validateLoudnessTarget(loudnessTarget); err != nil {
+			return fmt.Errorf("invalid loudness-target: %w", err)
+		}
+	}
+	if announcements && !opusAvailable() {
+		return fmt.Errorf("announcements needs the bridge built with -tags opus")
+	}
+	if err := validateTTSURL(ttsURL); err != nil {
+		return fmt.Errorf("invalid tts-url: %w", err)
+	}
+	if ttsURL != "" && !announcements {
+		return fmt.Errorf("tts-url needs -announcements")
+	}
+	if mixDownlink && !opusAvailable() {
+		return fmt.Errorf("mix needs the bridge built with -tags opus")
+	}
+	if adaptiveBitrate && !mixDownlink && !announcements {
+		return fmt.Errorf("adaptive-bitrate needs -mix or -announcements, the bridge forwards the Opus from LiveKit otherwise")
+	}
+	if adaptiveBitrateMin < 6000 || adaptiveBitrateMin > 510000 {
+		return fmt.Errorf("adaptive-bitrate-min must be between 6000 and 510000")
+	}
+	if twccMaxBitrate < twccMinBitrate {
+		return fmt.Errorf("twcc-max-bitrate must be at least %d", twccMinBitrate)
+	}
+	if err := validateMJPEGEncoder(mjpegEncoder); err != nil {
+		return fmt.Errorf("invalid mjpeg-encoder: %w", err)
+	}
+	if jitterDelay < 0 {
+		return fmt.Errorf("jitter-buffer must not be negative")
+	}
+	if duckDB < 0 || duckDB > -minGainDB {
+		return fmt.Errorf("duck must be between 0 and %d dB", -minGainDB)
+	}
+	if announcementDuckDB < 0 || announcementDuckDB > -minGainDB {
+		return fmt.Errorf("announcement-duck must be between 0 and %d dB", -minGainDB)
+	}
+	if audioLevels && !opusAvailable() {
+		return fmt.Errorf("audio-levels needs the bridge built with -tags opus")
+	}
+	if vadEnabled {
+		if !opusAvailable() {
+			return fmt.Errorf("vad needs the bridge built with -tags opus")
+		}
+		if vadThreshold > 0 {
+			return fmt.Errorf("vad-threshold must be at most 0 dBFS")
+		}
+		if vadHangover < 0 {
+			return fmt.Errorf("vad-hangover must not be negative")
+		}
+	}
+	if h2Addr != "" || h3Addr != "" {
+		if tlsCert == "" || tlsKey == "" {
+			return fmt.Errorf("tls-cert and tls-key are required for h2-addr and h3-addr")
+		}
+		if tlsCertificate, err = tls.LoadX509KeyPair(tlsCert, tlsKey); err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+	}
+	if configFile != "" {
+		if cfg, err = loadConfig(configFile); err != nil {
+			return err
+		}
+		iceServers = append(iceServers, cfg.iceServers()...)
+	}
 	return nil
 }
 
+// initialize joins the room configured by -room-name and -identity, it
+// stays connected for the lifetime of the bridge.
 func (app *App) initialize() error {
-	var err error
-	
-	// Create LiveKit track
-	livekitTrack, err = webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus},
-		"audio", "pion",
-	)
+	certificate, err := loadCertificate(dtlsCertFile)
 	if err != nil {
-		return fmt.Errorf("failed to create LiveKit track: %w", err)
+		return err
 	}
+	app.certificate = certificate
+	log.Infow("DTLS certificate", "fingerprint", app.fingerprint(), "expires", certificate.Expires())
 
-	// Generate access token
-	token, err := newAccessToken(apiKey, apiSecret, roomName, identity)
+	if app.settingEngine, err = app.newSettingEngine(); err != nil {
+		return err
+	}
+	dscp, _ := parseDSCP(dscpMarking)
+	settingEngine, err := withDSCP(app.settingEngine, dscp)
 	if err != nil {
-		return fmt.Errorf("failed to create access token: %w", err)
+		return err
 	}
-
-	// Create room with callbacks
-	app.room = lksdk.NewRoom(&lksdk.RoomCallback{
-		ParticipantCallback: lksdk.ParticipantCallback{
-			OnTrackSubscribed: app.onTrackSubscribed,
-		},
-	})
-
-	// Prepare and join room
-	if err := app.room.PrepareConnection(host, token); err != nil {
-		return fmt.Errorf("failed to prepare room connection: %w", err)
+	if app.api, err = newWebRTCAPI(settingEngine); err != nil {
+		return err
 	}
 
-	if err := app.room.JoinWithToken(host, token); err != nil {
-		return fmt.Errorf("failed to join room: %w", err)
+	if app.registry, err = loadRegistry(registryFile); err != nil {
+		return err
 	}
-
-	// Create embedded track
-	embeddedTrack, err = lksdk.NewLocalTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus})
-	if err != nil {
-		return fmt.Errorf("failed to create embedded track: %w", err)
+	app.validators = app.newTokenValidators()
+	if app.mixRules, err = loadMixRules(mixRulesFile); err != nil {
+		return err
+	}
+	if createRooms || deleteRoomsAfter > 0 {
+		app.roomService = lksdk.NewRoomServiceClient(host, apiKey, apiSecret)
+	}
+	if agentName != "" || cfg.dispatchesAgents() {
+		app.dispatcher = newAgentDispatcher()
 	}
 
-	// Publish track
-	if _, err = app.room.LocalParticipant.PublishTrack(embeddedTrack, &lksdk.TrackPublicationOptions{
-		Name: "embedded",
-	}); err != nil {
-		return fmt.Errorf("failed to publish track: %w", err)
+	p, err := app.joinParticipant(roomName, identity)
+	if err != nil {
+		return err
 	}
 
+	p.persistent = true
+	app.participants[participantKey(roomName, identity)] = p
 	return nil
 }
 
-func (app *App) onTrackSubscribed(track *webrtc.TrackRemote, publication *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
-	log.Infow("Track subscribed", "participant", rp.Identity(), "track", publication.Name())
-	
-	app.wg.Add(1)
-	go func() {
-		defer app.wg.Done()
-		defer log.Infow("Track reading goroutine terminated", "participant", rp.Identity())
-		
-		for {
-			select {
-			case <-app.ctx.Done():
-				log.Infow("Context cancelled, stopping track reading", "participant", rp.Identity())
-				return
-			default:
-				rtpPacket, _, rtpErr := track.ReadRTP()
-				if rtpErr != nil {
-					if rtpErr == io.EOF {
-						log.Infow("Track ended", "participant", rp.Identity())
-					} else {
-						log.Errorw("Failed to read RTP packet", rtpErr, "participant", rp.Identity())
-					}
-					return
-				}
-
-				if rtpErr = livekitTrack.WriteRTP(rtpPacket); rtpErr != nil {
-					log.Errorw("Failed to write RTP packet to LiveKit track", rtpErr)
-					return
-				}
-			}
-		}
-	}()
-}
-
 func (app *App) startServer() error {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/connect", app.connectHandler)
-	
-	app.server = &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
-	}
-	
-	log.Infow("Server listening on :8080")
-	return app.server.ListenAndServe()
-}
-
-func (app *App) connectHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	handle(mux, "/connect", apiPrefix+"/connect", app.connectHandler)
+	handle(mux, "/connect/batch", apiPrefix+"/connect/batch", app.batchConnectHandler)
+	handle(mux, "/ws", apiPrefix+"/ws", app.websocketHandler)
+	handle(mux, sessionPath+"{id}", apiPrefix+"/sessions/{id}", app.sessionHandler)
+	handle(mux, sessionPath+"{id}/candidates", apiPrefix+"/sessions/{id}/candidates", app.candidatesHandler)
+	if mjpegEncoder != "" {
+		handle(mux, sessionPath+"{id}/mjpeg", apiPrefix+"/sessions/{id}/mjpeg", app.mjpegHandler)
 	}
-
-	offer, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Errorw("Failed to read request body", err)
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
+	handle(mux, whepPath+"{id}", apiPrefix+whepPath+"{id}", app.whepHandler)
+	handle(mux, whepPath+"{id}/{viewer}", apiPrefix+whepPath+"{id}/{viewer}", app.whepViewerHandler)
+	if adminToken != "" {
+		handle(mux, "/claims", apiPrefix+"/claims", app.claimsHandler)
+		handle(mux, "", apiPrefix+"/devices", app.devicesHandler)
+		handle(mux, "", apiPrefix+"/devices/{id}", app.deviceHandler)
+		handle(mux, "/token", apiPrefix+"/token", app.tokenHandler)
+		handle(mux, sessionPath+"{id}/gain", apiPrefix+"/sessions/{id}/gain", app.gainHandler)
+		handle(mux, sessionPath+"{id}/loudness", apiPrefix+"/sessions/{id}/loudness", app.loudnessHandler)
+		handle(mux, sessionPath+"{id}/jitter", apiPrefix+"/sessions/{id}/jitter", app.jitterHandler)
+		handle(mux, sessionPath+"{id}/play", apiPrefix+"/sessions/{id}/play", app.playHandler)
+		handle(mux, sessionPath+"{id}/move", apiPrefix+"/sessions/{id}/move", app.moveHandler)
+		handle(mux, "", apiPrefix+"/sessions", app.sessionsHandler)
+		handle(mux, sessionPath+"{id}/stats", apiPrefix+"/sessions/{id}/stats", app.statsHandler)
+		handle(mux, "", "/metrics", app.metricsHandler)
+		handle(mux, sessionPath+"{id}/loopback", apiPrefix+"/sessions/{id}/loopback", app.loopbackHandler)
+		handle(mux, sessionPath+"{id}/route", apiPrefix+"/sessions/{id}/route", app.routeHandler)
+		if ttsURL != "" {
+			handle(mux, "", apiPrefix+"/announcements", app.announceHandler)
+		}
+		if paging {
+			handle(mux, "", apiPrefix+"/groups/{group}", app.groupHandler)
+			handle(mux, "", apiPrefix+"/groups/{group}/members/{id}", app.groupMemberHandler)
+			handle(mux, "", apiPrefix+"/groups/{group}/source", app.groupSourceHandler)
+		}
+		handle(mux, "", apiPrefix+"/rooms/{room}/mix", app.mixRulesHandler)
+		handle(mux, "", apiPrefix+"/rooms/{room}/mix/{identity}", app.mixRuleHandler)
+	}
+	if provisionSecret != "" {
+		handle(mux, "/provision", apiPrefix+"/provision", app.provisionHandler)
 	}
 
-	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
-	if err != nil {
-		log.Errorw("Failed to create peer connection", err)
-		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
-		return
-	}
-
-	// Store peer connection for cleanup
-	connID := fmt.Sprintf("%p", pc)
-	app.peerConnMu.Lock()
-	app.peerConns[connID] = pc
-	app.peerConnMu.Unlock()
-
-	// Setup track handler
-	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		if track.Kind() == webrtc.RTPCodecTypeAudio {
-			log.Infow("Audio track received from peer connection")
-			
-			app.wg.Add(1)
-			go func() {
-				defer app.wg.Done()
-				defer log.Infow("Peer connection track reading goroutine terminated")
-				
-				for {
-					select {
-					case <-app.ctx.Done():
-						log.Infow("Context cancelled, stopping peer track reading")
-						return
-					default:
-						rtpPacket, _, rtpErr := track.ReadRTP()
-						if rtpErr != nil {
-							if rtpErr == io.EOF {
-								log.Infow("Peer track ended")
-							} else {
-								log.Errorw("Failed to read RTP packet from peer", rtpErr)
-							}
-							return
-						}
-
-						if rtpErr = embeddedTrack.WriteRTP(rtpPacket, nil); rtpErr != nil {
-							log.Errorw("Failed to write RTP packet to embedded track", rtpErr)
-							return
-						}
-					}
-				}
-			}()
+	var handler http.Handler = mux
+	if h3Addr != "" {
+		handler = app.advertiseHTTP3(mux)
+	}
+	app.server = &http.Server{Handler: handler}
+
+	// Bind everything before serving so a bad address fails startup
+	var listeners []net.Listener
+	for _, addr := range splitList(listenAddrs) {
+		l, err := net.Listen(familyNetwork("tcp"), addr)
+		if err != nil {
+			closeListeners(listeners)
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
 		}
-	})
-
-	// Add track to peer connection
-	if _, err = pc.AddTrack(livekitTrack); err != nil {
-		log.Errorw("Failed to add track to peer connection", err)
-		http.Error(w, "Failed to add track", http.StatusInternalServerError)
-		app.cleanupPeerConnection(connID)
-		return
+		listeners = append(listeners, l)
 	}
-
-	// Setup ICE connection state change handler
-	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
-		log.Infow("ICE connection state changed", "state", state)
-		if state == webrtc.ICEConnectionStateFailed || 
-		   state == webrtc.ICEConnectionStateDisconnected ||
-		   state == webrtc.ICEConnectionStateClosed {
-			app.cleanupPeerConnection(connID)
+	if listenUnix != "" {
+		// A socket left behind by a previous run would fail the bind
+		if info, err := os.Stat(listenUnix); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(listenUnix)
 		}
-	})
-
-	// Set remote description
-	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
-		Type: webrtc.SDPTypeOffer, 
-		SDP:  string(offer),
-	}); err != nil {
-		log.Errorw("Failed to set remote description", err)
-		http.Error(w, "Failed to set remote description", http.StatusBadRequest)
-		app.cleanupPeerConnection(connID)
-		return
+		l, err := net.Listen("unix", listenUnix)
+		if err != nil {
+			closeListeners(listeners)
+			return fmt.Errorf("failed to listen on %s: %w", listenUnix, err)
+		}
+		listeners = append(listeners, l)
 	}
-
-	// Create answer
-	answer, err := pc.CreateAnswer(nil)
-	if err != nil {
-		log.Errorw("Failed to create answer", err)
-		http.Error(w, "Failed to create answer", http.StatusInternalServerError)
-		app.cleanupPeerConnection(connID)
-		return
+	if h2Addr != "" {
+		l, err := net.Listen(familyNetwork("tcp"), h2Addr)
+		if err != nil {
+			closeListeners(listeners)
+			return fmt.Errorf("failed to listen on %s: %w", h2Addr, err)
+		}
+		// ALPN picks HTTP/2, older clients fall back to HTTP/1.1
+		listeners = append(listeners, tls.NewListener(l, &tls.Config{
+			Certificates: []tls.Certificate{tlsCertificate},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}))
+	}
+	if len(listeners) == 0 && h3Addr == "" {
+		return errors.New("no listeners configured")
 	}
+	if h3Addr != "" {
+		if err := app.listenHTTP3(handler); err != nil {
+			closeListeners(listeners)
+			return err
+		}
+	}
+
+	for _, l := range listeners {
+		log.Infow("Server listening", "network", l.Addr().Network(), "addr", l.Addr().String())
 
-	// Set local description
-	if err := pc.SetLocalDescription(answer); err != nil {
-		log.Errorw("Failed to set local description", err)
-		http.Error(w, "Failed to set local description", http.StatusInternalServerError)
-		app.cleanupPeerConnection(connID)
-		return
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			if err := app.server.Serve(l); err != nil && err != http.ErrServerClosed {
+				log.Errorw("HTTP server error", err, "addr", l.Addr().String())
+			}
+		}()
 	}
+	return nil
+}
 
-	// Wait for ICE gathering to complete with timeout
-	select {
-	case <-webrtc.GatheringCompletePromise(pc):
-		// ICE gathering completed
-	case <-time.After(10 * time.Second):
-		log.Infow("ICE gathering timeout")
-		http.Error(w, "ICE gathering timeout", http.StatusInternalServerError)
-		app.cleanupPeerConnection(connID)
-		return
-	case <-app.ctx.Done():
-		log.Infow("Context cancelled during ICE gathering")
-		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
-		app.cleanupPeerConnection(connID)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	
-	if _, err := fmt.Fprint(w, pc.LocalDescription().SDP); err != nil {
-		log.Errorw("Failed to write response", err)
-	}
-	
-	log.Infow("Successfully handled connect request")
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		_ = l.Close()
+	}
 }
 
-func (app *App) cleanupPeerConnection(connID string) {
-	app.peerConnMu.Lock()
-	defer app.peerConnMu.Unlock()
-	
-	if pc, exists := app.peerConns[connID]; exists {
-		if err := pc.Close(); err != nil {
-			log.Errorw("Failed to close peer connection", err)
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
-		delete(app.peerConns, connID)
-		log.Infow("Peer connection cleaned up", "connID", connID)
 	}
+	return items
 }
 
 func (app *App) shutdown() {
 	log.Infow("Starting graceful shutdown...")
-	
+
 	// Cancel context to stop all goroutines
 	app.cancel()
-	
+
 	// Shutdown HTTP server with timeout
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer shutdownCancel()
-	
+
 	if app.server != nil {
 		if err := app.server.Shutdown(shutdownCtx); err != nil {
 			log.Errorw("Failed to shutdown HTTP server gracefully", err)
@@ -365,49 +794,118 @@ func (app *App) shutdown() {
 			log.Infow("HTTP server shutdown completed")
 		}
 	}
-	
-	// Close all peer connections
-	app.peerConnMu.Lock()
-	for connID, pc := range app.peerConns {
-		if err := pc.Close(); err != nil {
-			log.Errorw("Failed to close peer connection during shutdown", err, "connID", connID)
+
+	if app.h3 != nil {
+		if err := app.h3.Close(); err != nil {
+			log.Errorw("Failed to close HTTP/3 server", err)
+		}
+	}
+
+	if app.turn != nil {
+		if err := app.turn.Close(); err != nil {
+			log.Errorw("Failed to close TURN server", err)
+		}
+	}
+
+	if app.stun != nil {
+		if err := app.stun.conn.Close(); err != nil {
+			log.Errorw("Failed to close STUN responder", err)
+		}
+	}
+
+	if app.coap != nil {
+		if err := app.coap.conn.Close(); err != nil {
+			log.Errorw("Failed to close CoAP listener", err)
+		}
+	}
+
+	if app.mdns != nil {
+		if err := app.mdns.Shutdown(); err != nil {
+			log.Errorw("Failed to stop mDNS advertisement", err)
+		}
+	}
+
+	if app.ble != nil {
+		if err := app.ble.stop(); err != nil {
+			log.Errorw("Failed to stop BLE advertisement", err)
+		}
+	}
+
+	if app.ssdp != nil {
+		if err := app.ssdp.conn.Close(); err != nil {
+			log.Errorw("Failed to close SSDP responder", err)
+		}
+	}
+
+	if app.serial != nil {
+		if err := app.serial.close(); err != nil {
+			log.Errorw("Failed to close serial port", err)
+		}
+	}
+
+	// Close all sessions
+	app.sessionsMu.RLock()
+	ids := make([]string, 0, len(app.sessions))
+	for id := range app.sessions {
+		ids = append(ids, id)
+	}
+	app.sessionsMu.RUnlock()
+	for _, id := range ids {
+		app.closeSession(id)
+	}
+	log.Infow("All sessions closed")
+
+	// Shared by every PeerConnection, so only closed once they are
+	if app.iceTCP != nil {
+		if err := app.iceTCP.Close(); err != nil {
+			log.Errorw("Failed to close ICE-TCP listener", err)
+		}
+	}
+	if app.udpMux != nil {
+		if err := app.udpMux.Close(); err != nil {
+			log.Errorw("Failed to close ICE UDP mux", err)
 		}
 	}
-	app.peerConnMu.Unlock()
-	log.Infow("All peer connections closed")
-	
-	// Close LiveKit room
-	if app.room != nil {
-		app.room.Disconnect()
-		log.Infow("LiveKit room disconnected")
+
+	// Close LiveKit rooms
+	app.participantsMu.Lock()
+	for _, p := range app.participants {
+		p.disconnect()
 	}
-	
+	app.participantsMu.Unlock()
+	log.Infow("LiveKit rooms disconnected")
+
 	// Wait for all goroutines to finish with timeout
 	done := make(chan struct{})
 	go func() {
 		app.wg.Wait()
 		close(done)
 	}()
-	
+
 	select {
 	case <-done:
 		log.Infow("All goroutines terminated")
 	case <-time.After(15 * time.Second):
 		log.Infow("Timeout waiting for goroutines to terminate")
 	}
-	
+
 	log.Infow("Graceful shutdown completed")
 }
 
-func newAccessToken(apiKey, apiSecret, roomName, pID string) (string, error) {
+func newAccessToken(apiKey, apiSecret, roomName, pID, metadata string, hidden bool, grants tokenGrants) (string, error) {
 	at := auth.NewAccessToken(apiKey, apiSecret)
 	grant := &auth.VideoGrant{
 		RoomJoin: true,
 		Room:     roomName,
+		Hidden:   hidden,
 	}
+	// Device attributes are set on the participant
+	grant.SetCanUpdateOwnMetadata(true)
+	grants.apply(grant)
 	at.SetVideoGrant(grant).
 		SetIdentity(pID).
-		SetName(pID)
+		SetName(pID).
+		SetMetadata(metadata)
 
 	return at.ToJWT()
 }
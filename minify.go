@@ -0,0 +1,135 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// minifyAnswer strips an SDP answer down to what a constrained device needs
+// to establish media. Every media section keeps a single codec (Opus for
+// audio, along with telephone-event for DTMF), header extensions, SSRC
+// signaling and redundant candidates are dropped. The PeerConnection keeps
+// the full answer, only the copy sent to the device is reduced.
+func minifyAnswer(answer string) string {
+	lines := strings.Split(strings.TrimRight(answer, "\r\n"), "\r\n")
+
+	var out []string
+	for i := 0; i < len(lines); {
+		// Collect the next section, the session section runs until the first m=
+		end := i + 1
+		for end < len(lines) && !strings.HasPrefix(lines[end], "m=") {
+			end++
+		}
+
+		if strings.HasPrefix(lines[i], "m=") {
+			out = append(out, minifyMediaSection(lines[i:end])...)
+		} else {
+			for _, line := range lines[i:end] {
+				if keepSessionLine(line) {
+					out = append(out, line)
+				}
+			}
+		}
+		i = end
+	}
+
+	return strings.Join(out, "\r\n") + "\r\n"
+}
+
+func keepSessionLine(line string) bool {
+	switch {
+	case strings.HasPrefix(line, "a=msid-semantic"),
+		strings.HasPrefix(line, "a=extmap-allow-mixed"),
+		strings.HasPrefix(line, "a=ice-options"):
+		return false
+	}
+	return true
+}
+
+func minifyMediaSection(section []string) []string {
+	fields := strings.Fields(section[0])
+	if len(fields) < 4 {
+		return section
+	}
+
+	// Rejected sections are kept as-is so mids still line up with the offer
+	if fields[1] == "0" {
+		return section
+	}
+
+	keep := ""
+	var events []string
+	formats := fields[3:]
+	if fields[0] == "m=audio" {
+		for _, line := range section {
+			if value, ok := strings.CutPrefix(line, "a=rtpmap:"); ok {
+				pt, encoding, _ := strings.Cut(value, " ")
+				switch encoding = strings.ToLower(encoding); {
+				case strings.HasPrefix(encoding, "opus/") && keep == "":
+					keep = pt
+				case strings.HasPrefix(encoding, "telephone-event/"):
+					events = append(events, pt)
+				}
+			}
+		}
+	}
+	if keep == "" && fields[0] != "m=application" {
+		keep = formats[0]
+	}
+
+	out := make([]string, 0, len(section))
+	if keep != "" {
+		out = append(out, strings.Join(append(append(fields[:3:3], keep), events...), " "))
+	} else {
+		out = append(out, section[0])
+	}
+
+	for _, line := range section[1:] {
+		attribute, value, _ := strings.Cut(strings.TrimPrefix(line, "a="), ":")
+		switch {
+		case !strings.HasPrefix(line, "a="):
+			out = append(out, line)
+		case attribute == "rtpmap" || attribute == "fmtp":
+			if pt, _, _ := strings.Cut(value, " "); pt == keep || slices.Contains(events, pt) {
+				out = append(out, line)
+			}
+		case attribute == "rtcp-fb":
+			if pt, feedback, _ := strings.Cut(value, " "); pt == keep && keepFeedback(feedback) {
+				out = append(out, line)
+			}
+		case attribute == "extmap":
+			// -twcc needs the device to echo the sequence numbers back
+			if _, uri, _ := strings.Cut(value, " "); twcc && uri == sdp.TransportCCURI {
+				out = append(out, line)
+			}
+		case attribute == "candidate":
+			// RTCP is always muxed, drop the RTCP component candidates
+			if fields := strings.Fields(value); len(fields) < 2 || fields[1] == "1" {
+				out = append(out, line)
+			}
+		case attribute == "ssrc",
+			attribute == "ssrc-group",
+			attribute == "msid",
+			attribute == "rtcp",
+			attribute == "rtcp-rsize",
+			attribute == "ice-options":
+		default:
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// keepFeedback reports if a minified answer keeps an rtcp-fb type, only
+// those of features the bridge was started with survive.
+func keepFeedback(feedback string) bool {
+	switch feedback {
+	case "nack":
+		return nack
+	case "transport-cc":
+		return twcc
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testFullAnswer = "v=0\r\n" +
+	"o=- 1 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=msid-semantic:WMS *\r\n" +
+	"a=fingerprint:sha-256 01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF\r\n" +
+	"a=extmap-allow-mixed\r\n" +
+	"a=group:BUNDLE 0 1 2\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 0 111 101\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=setup:active\r\n" +
+	"a=mid:0\r\n" +
+	"a=ice-ufrag:abcd\r\n" +
+	"a=ice-pwd:0123456789abcdefghijkl\r\n" +
+	"a=ice-options:trickle\r\n" +
+	"a=rtcp-mux\r\n" +
+	"a=rtcp-rsize\r\n" +
+	"a=rtpmap:0 PCMU/8000\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"a=fmtp:111 minptime=10;useinbandfec=1\r\n" +
+	"a=rtcp-fb:111 transport-cc\r\n" +
+	"a=rtcp-fb:111 nack\r\n" +
+	"a=rtcp-fb:0 nack\r\n" +
+	"a=rtpmap:101 telephone-event/8000\r\n" +
+	"a=fmtp:101 0-15\r\n" +
+	"a=extmap:1 http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01\r\n" +
+	"a=extmap:2 urn:ietf:params:rtp-hdrext:ssrc-audio-level\r\n" +
+	"a=ssrc:1234 cname:bridge\r\n" +
+	"a=msid:bridge audio\r\n" +
+	"a=sendrecv\r\n" +
+	"a=candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host\r\n" +
+	"a=candidate:1 2 udp 2130706430 192.168.1.2 5001 typ host\r\n" +
+	"a=end-of-candidates\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96 97\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:1\r\n" +
+	"a=rtpmap:96 VP8/90000\r\n" +
+	"a=rtcp-fb:96 nack\r\n" +
+	"a=rtpmap:97 rtx/90000\r\n" +
+	"a=fmtp:97 apt=96\r\n" +
+	"a=recvonly\r\n" +
+	"m=video 0 UDP/TLS/RTP/SAVPF 98\r\n" +
+	"a=mid:2\r\n" +
+	"a=rtpmap:98 H264/90000\r\n"
+
+func TestMinifyAnswer(t *testing.T) {
+	defer func(twccEnabled, nackEnabled bool) { twcc, nack = twccEnabled, nackEnabled }(twcc, nack)
+
+	for _, test := range []struct {
+		name       string
+		twcc, nack bool
+		want       string
+	}{
+		{
+			name: "defaults",
+			want: "v=0\r\n" +
+				"o=- 1 2 IN IP4 127.0.0.1\r\n" +
+				"s=-\r\n" +
+				"t=0 0\r\n" +
+				"a=fingerprint:sha-256 01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF\r\n" +
+				"a=group:BUNDLE 0 1 2\r\n" +
+				"m=audio 9 UDP/TLS/RTP/SAVPF 111 101\r\n" +
+				"c=IN IP4 0.0.0.0\r\n" +
+				"a=setup:active\r\n" +
+				"a=mid:0\r\n" +
+				"a=ice-ufrag:abcd\r\n" +
+				"a=ice-pwd:0123456789abcdefghijkl\r\n" +
+				"a=rtcp-mux\r\n" +
+				"a=rtpmap:111 opus/48000/2\r\n" +
+				"a=fmtp:111 minptime=10;useinbandfec=1\r\n" +
+				"a=rtpmap:101 telephone-event/8000\r\n" +
+				"a=fmtp:101 0-15\r\n" +
+				"a=sendrecv\r\n" +
+				"a=candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host\r\n" +
+				"a=end-of-candidates\r\n" +
+				"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+				"c=IN IP4 0.0.0.0\r\n" +
+				"a=mid:1\r\n" +
+				"a=rtpmap:96 VP8/90000\r\n" +
+				"a=recvonly\r\n" +
+				"m=video 0 UDP/TLS/RTP/SAVPF 98\r\n" +
+				"a=mid:2\r\n" +
+				"a=rtpmap:98 H264/90000\r\n",
+		},
+		{
+			name: "twcc and nack",
+			twcc: true,
+			nack: true,
+			want: "v=0\r\n" +
+				"o=- 1 2 IN IP4 127.0.0.1\r\n" +
+				"s=-\r\n" +
+				"t=0 0\r\n" +
+				"a=fingerprint:sha-256 01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF\r\n" +
+				"a=group:BUNDLE 0 1 2\r\n" +
+				"m=audio 9 UDP/TLS/RTP/SAVPF 111 101\r\n" +
+				"c=IN IP4 0.0.0.0\r\n" +
+				"a=setup:active\r\n" +
+				"a=mid:0\r\n" +
+				"a=ice-ufrag:abcd\r\n" +
+				"a=ice-pwd:0123456789abcdefghijkl\r\n" +
+				"a=rtcp-mux\r\n" +
+				"a=rtpmap:111 opus/48000/2\r\n" +
+				"a=fmtp:111 minptime=10;useinbandfec=1\r\n" +
+				"a=rtcp-fb:111 transport-cc\r\n" +
+				"a=rtcp-fb:111 nack\r\n" +
+				"a=rtpmap:101 telephone-event/8000\r\n" +
+				"a=fmtp:101 0-15\r\n" +
+				"a=extmap:1 http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01\r\n" +
+				"a=sendrecv\r\n" +
+				"a=candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host\r\n" +
+				"a=end-of-candidates\r\n" +
+				"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+				"c=IN IP4 0.0.0.0\r\n" +
+				"a=mid:1\r\n" +
+				"a=rtpmap:96 VP8/90000\r\n" +
+				"a=rtcp-fb:96 nack\r\n" +
+				"a=recvonly\r\n" +
+				"m=video 0 UDP/TLS/RTP/SAVPF 98\r\n" +
+				"a=mid:2\r\n" +
+				"a=rtpmap:98 H264/90000\r\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			twcc, nack = test.twcc, test.nack
+			if got := minifyAnswer(testFullAnswer); got != test.want {
+				t.Errorf("minifyAnswer() =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMinifyMediaSection(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		section string
+		want    string
+	}{
+		{
+			name:    "audio without opus keeps the first format",
+			section: "m=audio 9 UDP/TLS/RTP/SAVPF 8 0\na=rtpmap:8 PCMA/8000\na=rtpmap:0 PCMU/8000",
+			want:    "m=audio 9 UDP/TLS/RTP/SAVPF 8\na=rtpmap:8 PCMA/8000",
+		},
+		{
+			name:    "opus matched case insensitively",
+			section: "m=audio 9 UDP/TLS/RTP/SAVPF 0 109\na=rtpmap:0 PCMU/8000\na=rtpmap:109 OPUS/48000/2",
+			want:    "m=audio 9 UDP/TLS/RTP/SAVPF 109\na=rtpmap:109 OPUS/48000/2",
+		},
+		{
+			name:    "data channel",
+			section: "m=application 9 UDP/DTLS/SCTP webrtc-datachannel\na=mid:1\na=sctp-port:5000",
+			want:    "m=application 9 UDP/DTLS/SCTP webrtc-datachannel\na=mid:1\na=sctp-port:5000",
+		},
+		{
+			name:    "malformed m-line",
+			section: "m=audio 9\na=ssrc:1 cname:x",
+			want:    "m=audio 9\na=ssrc:1 cname:x",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := strings.Join(minifyMediaSection(strings.Split(test.section, "\n")), "\n")
+			if got != test.want {
+				t.Errorf("minifyMediaSection() =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
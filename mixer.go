@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// mixFrameDuration is how often the mixer sends a frame, in time and
+	// samples at 48kHz
+	mixFrameDuration = 20 * time.Millisecond
+	mixFrameSamples  = opusClockRate * 20 / 1000
+	// maxMixDelay bounds how much audio of a source is buffered, a
+	// source that runs ahead of the mixer loses its oldest audio
+	maxMixDelay = 5 * mixFrameSamples
+	// mixLimiterRelease is how far the limiter gain recovers per frame
+	// after the sum clipped
+	mixLimiterRelease = 0.05
+	// mixActiveLevel is the level in dBFS above which a source ducks the
+	// sources of lower priority
+	mixActiveLevel = -50
+	// mixDuckHold is how many frames ducking lasts after the source of
+	// higher priority was last heard, so pauses between words don't pump
+	mixDuckHold = 25
+)
+
+// mixer decodes the audio of every track subscribed by a participant and
+// sums it into a single Opus stream, so a device hears everyone in the
+// room instead of the packets of all tracks interleaved.
+type mixer struct {
+	write   func(*rtp.Packet) error
+	rule    func(identity string) mixRule
+	encoder opusEncoder
+
+	mu      sync.Mutex
+	sources map[string]*mixSource
+	// gain is the limiter gain keeping the sum from clipping
+	gain float64
+	// duckPriority is the priority heard within the last mixDuckHold
+	// frames while duckFrames is not zero
+	duckPriority, duckFrames int
+	sequence                 uint16
+	timestamp                uint32
+	silent                   bool
+	// bitrates are the -adaptive-bitrate targets of the sessions hearing
+	// the mix, encoded at the lowest. bitrate is only used by run.
+	bitrates map[string]int
+	bitrate  int
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type mixSource struct {
+	identity string
+	decoder  opusDecoder
+	pcm      []int16
+	pending  []int16
+	// gain is the gain of the last frame, ramped towards the rule and
+	// ducking of the next
+	gain float64
+}
+
+func newMixer(rule func(identity string) mixRule, write func(*rtp.Packet) error) (*mixer, error) {
+	encoder, err := newTunedOpusEncoder(opusClockRate, encoderSettings{}.withDefaults())
+	if err != nil {
+		return nil, err
+	}
+	return &mixer{
+		write:   write,
+		rule:    rule,
+		encoder: encoder,
+		sources: make(map[string]*mixSource),
+		gain:    1,
+		silent:  true,
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// run sends a mixed frame every 20ms until close is called.
+func (m *mixer) run() {
+	ticker := time.NewTicker(mixFrameDuration)
+	defer ticker.Stop()
+
+	buf := make([]byte, maxOpusPacketSize)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			if err := m.mix(buf); err != nil {
+				log.Errorw("Failed to mix downlink audio", err)
+			}
+		}
+	}
+}
+
+func (m *mixer) close() {
+	m.closeOnce.Do(func() { close(m.stop) })
+}
+
+// addSource starts mixing the track id of the remote participant identity.
+func (m *mixer) addSource(id, identity string) error {
+	decoder, err := newOpusDecoder(opusClockRate, 1)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sources[id] = &mixSource{
+		identity: identity,
+		decoder:  decoder,
+		pcm:      make([]int16, opusClockRate*120/1000),
+		gain:     1,
+	}
+	return nil
+}
+
+// setBitrate sets the bitrate the session wants the mix encoded at.
+func (m *mixer) setBitrate(sessionID string, bitrate int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.bitrates == nil {
+		m.bitrates = make(map[string]int)
+	}
+	m.bitrates[sessionID] = bitrate
+}
+
+func (m *mixer) removeBitrate(sessionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.bitrates, sessionID)
+}
+
+func (m *mixer) removeSource(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sources, id)
+}
+
+// push decodes a packet of the track id for the next frames.
+func (m *mixer) push(id string, p *rtp.Packet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	source, ok := m.sources[id]
+	if !ok {
+		return nil
+	}
+	n, err := source.decoder.Decode(p.Payload, source.pcm)
+	if err != nil {
+		return fmt.Errorf("failed to decode Opus: %w", err)
+	}
+	source.pending = append(source.pending, source.pcm[:n]...)
+	if over := len(source.pending) - maxMixDelay; over > 0 {
+		source.pending = source.pending[over:]
+	}
+	return nil
+}
+
+// mix sums a frame of every source that has one and writes it encoded.
+// Each source is scaled by the gain of its rule, and ducked while a source
+// of higher priority is heard. Nothing is sent while no source has audio.
+func (m *mixer) mix(buf []byte) error {
+	type frame struct {
+		source *mixSource
+		rule   mixRule
+		pcm    []int16
+	}
+
+	m.mu.Lock()
+	var frames []frame
+	activeLevel := math.MaxInt16 * math.Pow(10, mixActiveLevel/20)
+	for _, source := range m.sources {
+		if len(source.pending) < mixFrameSamples {
+			continue
+		}
+		f := frame{source: source, rule: m.rule(source.identity), pcm: source.pending[:mixFrameSamples]}
+		source.pending = source.pending[mixFrameSamples:]
+		frames = append(frames, f)
+
+		if rms(f.pcm) >= activeLevel && (m.duckFrames == 0 || f.rule.Priority >= m.duckPriority) {
+			m.duckPriority, m.duckFrames = f.rule.Priority, mixDuckHold+1
+		}
+	}
+	if m.duckFrames > 0 {
+		m.duckFrames--
+	}
+
+	sum := make([]float64, mixFrameSamples)
+	for _, f := range frames {
+		gainDB := f.rule.GainDB
+		if m.duckFrames > 0 && f.rule.Priority < m.duckPriority {
+			gainDB -= duckDB
+		}
+		gain := math.Pow(10, gainDB/20)
+		for i, sample := range f.pcm {
+			step := f.source.gain + (gain-f.source.gain)*float64(i+1)/float64(len(f.pcm))
+			sum[i] += float64(sample) * step
+		}
+		f.source.gain = gain
+	}
+
+	timestamp := m.timestamp
+	m.timestamp += mixFrameSamples
+	if len(frames) == 0 {
+		m.silent = true
+		m.mu.Unlock()
+		return nil
+	}
+
+	var peak float64
+	for _, sample := range sum {
+		peak = max(peak, math.Abs(sample))
+	}
+	gain := min(1, m.gain+mixLimiterRelease)
+	if peak*gain > math.MaxInt16 {
+		gain = math.MaxInt16 / peak
+	}
+	// Clipping takes the gain down at once, it recovers over a few frames
+	pcm := make([]int16, mixFrameSamples)
+	for i, sample := range sum {
+		step := m.gain + (gain-m.gain)*float64(i+1)/float64(len(sum))
+		pcm[i] = int16(max(math.MinInt16, min(math.MaxInt16, math.Round(sample*min(step, gain)))))
+	}
+	m.gain = gain
+
+	m.sequence++
+	packet := &rtp.Packet{Header: rtp.Header{
+		Version:        2,
+		Marker:         m.silent,
+		SequenceNumber: m.sequence,
+		Timestamp:      timestamp,
+	}}
+	m.silent = false
+	bitrate := 0
+	for _, target := range m.bitrates {
+		if bitrate == 0 || target < bitrate {
+			bitrate = target
+		}
+	}
+	m.mu.Unlock()
+
+	if bitrate != 0 && bitrate != m.bitrate {
+		if err := m.encoder.SetBitrate(bitrate); err != nil {
+			return fmt.Errorf("failed to set Opus bitrate: %w", err)
+		}
+		m.bitrate = bitrate
+	}
+	n, err := m.encoder.Encode(pcm, buf)
+	if err != nil {
+		return fmt.Errorf("failed to encode Opus: %w", err)
+	}
+	packet.Payload = append([]byte(nil), buf[:n]...)
+	return m.write(packet)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// mixRule is how the mixer treats the audio of a remote participant. While
+// a participant with a higher priority is heard, the others in the room are
+// ducked by -duck.
+type mixRule struct {
+	GainDB   float64 `json:"gain_db"`
+	Priority int     `json:"priority"`
+}
+
+// mixRules holds the mix rules of every room by participant identity,
+// persisted as JSON to path when one is set so they outlive the
+// participants they apply to.
+type mixRules struct {
+	path string
+
+	mu    sync.Mutex
+	rooms map[string]map[string]mixRule
+}
+
+func loadMixRules(path string) (*mixRules, error) {
+	r := &mixRules{path: path, rooms: make(map[string]map[string]mixRule)}
+	if path == "" {
+		return r, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read mix rules: %w", err)
+	}
+	if err := json.Unmarshal(raw, &r.rooms); err != nil {
+		return nil, fmt.Errorf("failed to parse mix rules: %w", err)
+	}
+	return r, nil
+}
+
+// save writes the rules to path. Callers hold mu.
+func (r *mixRules) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	raw, err := json.MarshalIndent(r.rooms, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode mix rules: %w", err)
+	}
+	if err := writeFileAtomic(r.path, raw); err != nil {
+		return fmt.Errorf("failed to write mix rules: %w", err)
+	}
+	return nil
+}
+
+// rule returns the rule of identity in room, the zero rule mixes it as is.
+func (r *mixRules) rule(room, identity string) mixRule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rooms[room][identity]
+}
+
+func (r *mixRules) room(room string) map[string]mixRule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rules := make(map[string]mixRule, len(r.rooms[room]))
+	for identity, rule := range r.rooms[room] {
+		rules[identity] = rule
+	}
+	return rules
+}
+
+// set and remove only apply the change once it was saved, a rule that
+// failed to persist never takes effect.
+func (r *mixRules) set(room, identity string, rule mixRule) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous, existed := r.rooms[room][identity]
+	if r.rooms[room] == nil {
+		r.rooms[room] = make(map[string]mixRule)
+	}
+	r.rooms[room][identity] = rule
+	if err := r.save(); err != nil {
+		r.restoreLocked(room, identity, previous, existed)
+		return err
+	}
+	return nil
+}
+
+func (r *mixRules) remove(room, identity string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous, existed := r.rooms[room][identity]
+	if !existed {
+		return nil
+	}
+	r.restoreLocked(room, identity, mixRule{}, false)
+	if err := r.save(); err != nil {
+		r.restoreLocked(room, identity, previous, true)
+		return err
+	}
+	return nil
+}
+
+// restoreLocked sets the rule of identity in room back to rule, or removes
+// it when it didn't exist. Callers hold mu.
+func (r *mixRules) restoreLocked(room, identity string, rule mixRule, existed bool) {
+	if !existed {
+		delete(r.rooms[room], identity)
+		if len(r.rooms[room]) == 0 {
+			delete(r.rooms, room)
+		}
+		return
+	}
+	if r.rooms[room] == nil {
+		r.rooms[room] = make(map[string]mixRule)
+	}
+	r.rooms[room][identity] = rule
+}
+
+// mixRulesHandler lists the mix rules of a room.
+func (app *App) mixRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(app.mixRules.room(r.PathValue("room"))); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
+
+// mixRuleHandler reads, sets and removes the mix rule of a participant in
+// a room, e.g. to have announcements duck the conversation.
+func (app *App) mixRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	room, identity := r.PathValue("room"), r.PathValue("identity")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !mixDownlink {
+			writeError(w, r, "Mixing is disabled, start the bridge with -mix", http.StatusConflict)
+			return
+		}
+
+		var rule mixRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			writeError(w, r, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := validateGain(rule.GainDB); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := app.mixRules.set(room, identity, rule); err != nil {
+			log.Errorw("Failed to save mix rules", err)
+			writeError(w, r, "Failed to save mix rules", http.StatusInternalServerError)
+			return
+		}
+		log.Infow("Mix rule changed", "room", room, "identity", identity, "gainDB", rule.GainDB, "priority", rule.Priority)
+	case http.MethodDelete:
+		if err := app.mixRules.remove(room, identity); err != nil {
+			log.Errorw("Failed to save mix rules", err)
+			writeError(w, r, "Failed to save mix rules", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(app.mixRules.rule(room, identity)); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
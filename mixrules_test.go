@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMixRulesPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mix-rules.json")
+	r, err := loadMixRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.set("lobby", "alice", mixRule{GainDB: -6}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.set("lobby", "bob", mixRule{Priority: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.remove("lobby", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadMixRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]mixRule{"bob": {Priority: 1}}; !reflect.DeepEqual(loaded.room("lobby"), want) {
+		t.Errorf("loaded %v, want %v", loaded.room("lobby"), want)
+	}
+}
+
+func TestMixRulesSaveFailure(t *testing.T) {
+	r, err := loadMixRules(filepath.Join(t.TempDir(), "mix-rules.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.set("lobby", "alice", mixRule{GainDB: -6}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saves fail once the directory is gone
+	r.path = filepath.Join(t.TempDir(), "missing", "mix-rules.json")
+	if err := r.set("lobby", "alice", mixRule{GainDB: 3}); err == nil {
+		t.Fatal("set() succeeded")
+	}
+	if err := r.set("kitchen", "bob", mixRule{Priority: 1}); err == nil {
+		t.Fatal("set() succeeded")
+	}
+	if err := r.remove("lobby", "alice"); err == nil {
+		t.Fatal("remove() succeeded")
+	}
+
+	if rule := r.rule("lobby", "alice"); rule != (mixRule{GainDB: -6}) {
+		t.Errorf("rule after failed changes = %+v, want the saved one", rule)
+	}
+	if _, ok := r.rooms["kitchen"]; ok {
+		t.Error("failed set left the new room behind")
+	}
+}
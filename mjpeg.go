@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/livekit/protocol/livekit"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264reader"
+)
+
+const (
+	// mjpegDataChannel is the label of a data channel carrying one JPEG
+	// frame per message
+	mjpegDataChannel = "mjpeg"
+	// mjpegQueue is how many frames wait for the encoder, frames arriving
+	// faster than it encodes are dropped
+	mjpegQueue = 2
+	// maxMJPEGFrame bounds a JPEG frame pushed over HTTP
+	maxMJPEGFrame = 1 << 20
+)
+
+var (
+	annexBStartCode = []byte{0, 0, 0, 1}
+	errMJPEGClosed  = errors.New("mjpeg encoder closed")
+)
+
+// mjpegTranscoder feeds JPEG frames from a camera board to -mjpeg-encoder
+// and publishes the H.264 it produces as the camera track of the session.
+type mjpegTranscoder struct {
+	sessionID string
+	cmd       *exec.Cmd
+	track     *lksdk.LocalTrack
+	frames    chan []byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func validateMJPEGEncoder(command string) error {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath(fields[0]); err != nil {
+		return fmt.Errorf("failed to find %s: %w", fields[0], err)
+	}
+	return nil
+}
+
+// mjpegTranscoder returns the MJPEG transcoder of the session, starting
+// the encoder and publishing the camera track on first use.
+func (app *App) mjpegTranscoder(s *session) (*mjpegTranscoder, error) {
+	s.mjpegMu.Lock()
+	defer s.mjpegMu.Unlock()
+
+	if s.mjpeg != nil {
+		return s.mjpeg, nil
+	}
+
+	fields := strings.Fields(mjpegEncoder)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("mjpeg is disabled, start the bridge with -mjpeg-encoder")
+	}
+
+	cmd := exec.CommandContext(app.ctx, fields[0], fields[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start mjpeg encoder: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start mjpeg encoder: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start mjpeg encoder: %w", err)
+	}
+
+	track, err := publishLocalTrack(s, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, &lksdk.TrackPublicationOptions{
+		Name:   "embedded-camera-" + s.id,
+		Source: livekit.TrackSource_CAMERA,
+	})
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, err
+	}
+
+	t := &mjpegTranscoder{
+		sessionID: s.id,
+		cmd:       cmd,
+		track:     track,
+		frames:    make(chan []byte, mjpegQueue),
+		done:      make(chan struct{}),
+	}
+	s.mjpeg = t
+
+	app.wg.Add(2)
+	go func() {
+		defer app.wg.Done()
+		t.feed(stdin)
+	}()
+	go func() {
+		defer app.wg.Done()
+		defer t.close()
+		t.publish(stdout)
+	}()
+	log.Infow("Transcoding MJPEG to H.264", "sessionID", s.id)
+	return t, nil
+}
+
+// write queues a JPEG frame, dropping it when the encoder is behind.
+func (t *mjpegTranscoder) write(frame []byte) error {
+	select {
+	case <-t.done:
+		return errMJPEGClosed
+	default:
+	}
+
+	select {
+	case t.frames <- frame:
+	default:
+		log.Debugw("Dropped MJPEG frame, encoder is behind", "sessionID", t.sessionID)
+	}
+	return nil
+}
+
+func (t *mjpegTranscoder) feed(stdin io.WriteCloser) {
+	defer stdin.Close()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case frame := <-t.frames:
+			if _, err := stdin.Write(frame); err != nil {
+				log.Errorw("Failed to write MJPEG frame to encoder", err, "sessionID", t.sessionID)
+				t.close()
+				return
+			}
+		}
+	}
+}
+
+// publish writes the H.264 from the encoder to the camera track. NAL units
+// are collected until a slice ends the access unit, which is timestamped
+// with the time it was encoded.
+func (t *mjpegTranscoder) publish(stdout io.Reader) {
+	defer func() {
+		if err := t.cmd.Wait(); err != nil {
+			log.Errorw("MJPEG encoder exited", err, "sessionID", t.sessionID)
+		}
+	}()
+
+	reader, err := h264reader.NewReader(stdout)
+	if err != nil {
+		log.Errorw("Failed to read H.264 from MJPEG encoder", err, "sessionID", t.sessionID)
+		return
+	}
+
+	var accessUnit []byte
+	for {
+		nal, err := reader.NextNAL()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Errorw("Failed to read H.264 from MJPEG encoder", err, "sessionID", t.sessionID)
+			}
+			return
+		}
+
+		accessUnit = append(append(accessUnit, annexBStartCode...), nal.Data...)
+		if nal.UnitType != h264reader.NalUnitTypeCodedSliceNonIdr && nal.UnitType != h264reader.NalUnitTypeCodedSliceIdr {
+			continue
+		}
+		if err := t.track.WriteSample(media.Sample{Data: accessUnit, Timestamp: time.Now()}, nil); err != nil {
+			log.Errorw("Failed to write H.264 to camera track", err, "sessionID", t.sessionID)
+		}
+		accessUnit = nil
+	}
+}
+
+// close stops the encoder, the camera track is unpublished with the other
+// tracks of the session.
+func (t *mjpegTranscoder) close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		_ = t.cmd.Process.Kill()
+	})
+}
+
+// onMJPEGDataChannel transcodes the JPEG frames sent on the mjpeg data
+// channel.
+func (app *App) onMJPEGDataChannel(s *session, dc *webrtc.DataChannel) {
+	t, err := app.mjpegTranscoder(s)
+	if err != nil {
+		log.Errorw("Failed to setup MJPEG data channel", err, "sessionID", s.id)
+		_ = dc.Close()
+		return
+	}
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if err := t.write(msg.Data); err != nil {
+			log.Errorw("Failed to forward MJPEG frame", err, "sessionID", s.id)
+		}
+	})
+}
+
+// mjpegHandler takes JPEG frames pushed by a camera board, one frame per
+// image/jpeg request or a multipart/x-mixed-replace stream of them.
+func (app *App) mjpegHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorize(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+	if !app.authorizeSession(w, r, s) {
+		return
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "image/jpeg" && mediaType != "multipart/x-mixed-replace") {
+		writeError(w, r, "Content-Type must be image/jpeg or multipart/x-mixed-replace", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	t, err := app.mjpegTranscoder(s)
+	if err != nil {
+		log.Errorw("Failed to start MJPEG transcoding", err, "sessionID", s.id)
+		writeError(w, r, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if mediaType == "image/jpeg" {
+		frame, err := io.ReadAll(io.LimitReader(r.Body, maxMJPEGFrame))
+		if err != nil {
+			writeError(w, r, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if err := t.write(frame); err != nil {
+			writeError(w, r, err.Error(), http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			log.Errorw("Failed to read MJPEG stream", err, "sessionID", s.id)
+			writeError(w, r, "Invalid multipart stream", http.StatusBadRequest)
+			return
+		}
+
+		var frame bytes.Buffer
+		if _, err := io.Copy(&frame, io.LimitReader(part, maxMJPEGFrame)); err != nil {
+			log.Errorw("Failed to read MJPEG stream", err, "sessionID", s.id)
+			return
+		}
+		if err := t.write(frame.Bytes()); err != nil {
+			writeError(w, r, err.Error(), http.StatusGone)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+var errFanOutRoom = errors.New("session already fans out to the room")
+
+// moveRequest is the room, and optionally identity, a session moves to.
+type moveRequest struct {
+	Room     string `json:"room"`
+	Identity string `json:"identity,omitempty"`
+}
+
+// move switches the session to the participant joining room as identity.
+// The device keeps its PeerConnection, its tracks are republished in the
+// new room and its downlink is fed by the new participant.
+func (app *App) move(s *session, room, identity string) error {
+	s.negotiationMu.Lock()
+	defer s.negotiationMu.Unlock()
+
+	old := s.participant
+	if old.roomName == room && old.identity == identity {
+		return nil
+	}
+	for _, p := range s.fanOut {
+		if p.roomName == room && p.identity == identity {
+			return fmt.Errorf("%w: room %q", errFanOutRoom, room)
+		}
+	}
+
+	p, err := app.acquireParticipant(room, identity)
+	if err != nil {
+		return err
+	}
+
+	old.removeSink(s.id)
+	if s.downlinkSink != nil || s.slots != nil {
+		s.attachDownlink(p)
+	} else if s.downlinkSender != nil {
+		if err := s.downlinkSender.ReplaceTrack(p.downlink); err != nil {
+			app.releaseParticipant(p)
+			return fmt.Errorf("failed to replace downlink track: %w", err)
+		}
+		s.downlink = p.downlink
+	}
+
+	s.mu.Lock()
+	s.participant = p
+	publications := slices.Clone(s.publications)
+	routeTo := s.routeTo
+	s.mu.Unlock()
+
+	for i, published := range publications {
+		if published.participant != old {
+			continue
+		}
+		if err := old.room.LocalParticipant.UnpublishTrack(published.sid); err != nil {
+			log.Errorw("Failed to unpublish track", err, "sessionID", s.id, "trackSID", published.sid)
+		}
+		old.removeRoute(published.sid)
+		republished, err := p.room.LocalParticipant.PublishTrack(published.track, &published.options)
+		if err != nil {
+			log.Errorw("Failed to republish track", err, "sessionID", s.id, "room", room, "name", published.options.Name)
+			publications[i].participant = nil
+			continue
+		}
+		publications[i].participant, publications[i].sid = p, republished.SID()
+		p.setRoute(republished.SID(), routeTo)
+	}
+
+	s.mu.Lock()
+	if len(s.publications) >= len(publications) {
+		// Keep tracks published in the new room meanwhile
+		publications = append(publications, s.publications[len(publications):]...)
+	}
+	s.publications = slices.DeleteFunc(publications, func(published publication) bool {
+		return published.participant == nil
+	})
+	s.mu.Unlock()
+
+	app.leaveIntercom(s)
+	app.joinIntercom(s)
+	s.clearAttributes(old)
+	s.resendAttributes()
+	app.redispatchAgent(s)
+	app.releaseParticipant(old)
+	log.Infow("Session moved", "sessionID", s.id, "fromRoom", old.roomName, "fromIdentity", old.identity, "room", room, "identity", identity)
+	return nil
+}
+
+// moveHandler moves a session to another room without renegotiating with
+// the device.
+func (app *App) moveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	var req moveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Room == "" {
+		writeError(w, r, "room is required", http.StatusBadRequest)
+		return
+	}
+	if req.Identity == "" {
+		req.Identity = s.currentParticipant().identity
+	}
+
+	if err := app.move(s, req.Room, req.Identity); errors.Is(err, errFanOutRoom) {
+		writeError(w, r, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Errorw("Failed to move session", err, "sessionID", s.id)
+		writeError(w, r, "Failed to move session", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(moveRequest{Room: req.Room, Identity: req.Identity}); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// multiSink feeds the downlink slots of a session with -multi-downlink,
+// every slot carries one subscribed track.
+type multiSink struct {
+	// selector limits the tracks given a slot, nil for all of them
+	selector *subscriptionSelector
+	slots    []*eventTrack
+	// assigned is the SID of the track each slot carries, empty for a
+	// free slot
+	assigned []string
+}
+
+// audioSections counts the audio m-lines of offer.
+func audioSections(offer string) int {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.UnmarshalString(offer); err != nil {
+		return 0
+	}
+
+	count := 0
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media == "audio" {
+			count++
+		}
+	}
+	return count
+}
+
+// addMultiDownlink adds a track per audio m-line of the offer to the
+// session, each forwarding one remote participant so the device can mix
+// them itself.
+func (app *App) addMultiDownlink(s *session, sections int) error {
+	slots := make([]*eventTrack, 0, sections)
+	for i := range sections {
+		track, err := newEventTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, fmt.Sprintf("audio-%d", i), fmt.Sprintf("%s-%d", s.id, i))
+		if err != nil {
+			return fmt.Errorf("failed to create downlink track: %w", err)
+		}
+		if _, err := s.pc.AddTrack(track); err != nil {
+			return fmt.Errorf("failed to add track: %w", err)
+		}
+		slots = append(slots, track)
+	}
+
+	s.downlink, s.slots = slots[0], slots
+	s.attachDownlink(s.currentParticipant())
+	log.Infow("Forwarding remote participants on their own tracks", "sessionID", s.id, "tracks", sections)
+	return nil
+}
+
+func (p *participant) addMultiSink(sessionID string, selector *subscriptionSelector, slots []*eventTrack) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.multi[sessionID] = &multiSink{selector: selector, slots: slots, assigned: make([]string, len(slots))}
+	p.reassignLocked()
+}
+
+// reassignLocked frees the slots of tracks that ended or stopped matching
+// and gives tracks without a slot the free ones, in the order they were
+// subscribed.
+func (p *participant) reassignLocked() {
+	for sessionID, sink := range p.multi {
+		carried := map[string]bool{}
+		for i, sid := range sink.assigned {
+			if sid == "" {
+				continue
+			}
+			if track, ok := p.subscribed(sid); !ok || !sink.accepts(track) {
+				sink.assigned[i] = ""
+				continue
+			}
+			carried[sid] = true
+		}
+
+		for _, track := range p.tracks {
+			if carried[track.sid] || !sink.accepts(track) {
+				continue
+			}
+			for i, sid := range sink.assigned {
+				if sid == "" {
+					sink.assigned[i] = track.sid
+					carried[track.sid] = true
+					log.Infow("Assigned downlink track", "sessionID", sessionID, "room", p.roomName, "participant", track.remote.Identity(), "trackSID", track.sid, "slot", i)
+					break
+				}
+			}
+		}
+	}
+}
+
+func (sink *multiSink) accepts(track subscribedTrack) bool {
+	return sink.selector == nil || sink.selector.matches(track)
+}
+
+func (p *participant) subscribed(sid string) (subscribedTrack, bool) {
+	for _, track := range p.tracks {
+		if track.sid == sid {
+			return track, true
+		}
+	}
+	return subscribedTrack{}, false
+}
+
+// forwardMulti writes a packet of track sid to the slots carrying it.
+func (p *participant) forwardMulti(sid string, rtpPacket *rtp.Packet) {
+	p.mu.Lock()
+	var slots []*eventTrack
+	for _, sink := range p.multi {
+		for i, assigned := range sink.assigned {
+			if assigned == sid {
+				slots = append(slots, sink.slots[i])
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	for _, slot := range slots {
+		if err := slot.WriteRTP(rtpPacket); err != nil {
+			log.Errorw("Failed to write RTP packet to downlink track", err, "room", p.roomName)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/pion/webrtc/v4"
+)
+
+// configureNACK offers NACK feedback for audio. The NACK responder of the
+// default interceptors keeps the last 1024 packets sent on every stream
+// that negotiated it and resends those the device asks for. pion only
+// sends RTX for video, audio is resent on its own SSRC, which SRTP replay
+// protection lets through as the device never received it.
+func configureNACK(mediaEngine *webrtc.MediaEngine) {
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBNACK}, webrtc.RTPCodecTypeAudio)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"sort"
+)
+
+// audioProcessor transforms a stream of mono PCM from a device in place,
+// e.g. to remove noise. It may delay the audio but always returns as many
+// samples as it is given.
+type audioProcessor interface {
+	process(pcm []int16)
+}
+
+// audioProcessors are the uplink stages selectable with -noise-suppression.
+// An implementation wrapping a C library can register itself from an
+// init function in a file behind its own build tag.
+var audioProcessors = map[string]func(sampleRate int) audioProcessor{
+	"gate": newSpectralGate,
+}
+
+func audioProcessorNames() []string {
+	names := make([]string, 0, len(audioProcessors))
+	for name := range audioProcessors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newNoiseSuppressor returns the -noise-suppression stage for audio at
+// sampleRate, nil when it is disabled.
+func newNoiseSuppressor(sampleRate int) audioProcessor {
+	if noiseSuppression == "" {
+		return nil
+	}
+	return audioProcessors[noiseSuppression](sampleRate)
+}
+
+const (
+	// gateFloor is the gain of bins that only hold noise, -20dB
+	gateFloor = 0.1
+	// gateSmoothing averages the power of a bin over about 10 frames
+	gateSmoothing = 0.9
+	// gateNoiseRise is how fast the noise estimate follows a louder
+	// floor per frame, it drops to a quieter one immediately
+	gateNoiseRise = 1.005
+	// gateOverSubtraction makes up for the minimum of the smoothed power
+	// being below the average noise, and removes a bit more to hide the
+	// variance of the estimate
+	gateOverSubtraction = 4
+)
+
+// spectralGate is a noise suppressor in pure Go. It tracks the noise floor
+// of every frequency bin and attenuates bins that don't rise above it,
+// which removes steady noise like wind, fans and traffic hum.
+type spectralGate struct {
+	size, hop int
+	// window is a square root Hann window, applied before and after the
+	// FFT so overlapping frames add up to the input
+	window  []float64
+	pending []float64
+	overlap []float64
+	ready   []int16
+	// power is the smoothed power of every bin, noise the minimum it
+	// recently fell to
+	power    []float64
+	noise    []float64
+	gains    []float64
+	spectrum []complex128
+}
+
+// newSpectralGate analyses frames of about 10ms with 50% overlap.
+func newSpectralGate(sampleRate int) audioProcessor {
+	size := 1
+	for size < sampleRate/100 {
+		size <<= 1
+	}
+	hop := size / 2
+
+	window := make([]float64, size)
+	for i := range window {
+		window[i] = math.Sqrt(0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(size)))
+	}
+
+	gains := make([]float64, size/2+1)
+	for i := range gains {
+		gains[i] = 1
+	}
+
+	return &spectralGate{
+		size:   size,
+		hop:    hop,
+		window: window,
+		// The first frame is processed once a hop of audio arrived, and
+		// a hop of silence is returned until then
+		pending:  make([]float64, size-hop),
+		overlap:  make([]float64, size),
+		ready:    make([]int16, hop),
+		gains:    gains,
+		spectrum: make([]complex128, size),
+	}
+}
+
+func (g *spectralGate) process(pcm []int16) {
+	for _, sample := range pcm {
+		g.pending = append(g.pending, float64(sample))
+	}
+	for len(g.pending) >= g.size {
+		g.processFrame(g.pending[:g.size])
+		g.pending = append(g.pending[:0], g.pending[g.hop:]...)
+	}
+
+	copy(pcm, g.ready)
+	g.ready = append(g.ready[:0], g.ready[len(pcm):]...)
+}
+
+func (g *spectralGate) processFrame(frame []float64) {
+	for i, sample := range frame {
+		g.spectrum[i] = complex(sample*g.window[i], 0)
+	}
+	fft(g.spectrum, false)
+
+	bins := g.size/2 + 1
+	if g.noise == nil {
+		g.power = make([]float64, bins)
+		g.noise = make([]float64, bins)
+		for k := range g.noise {
+			g.power[k] = power(g.spectrum[k])
+			g.noise[k] = g.power[k]
+		}
+	}
+
+	for k := 0; k < bins; k++ {
+		binPower := power(g.spectrum[k])
+		g.power[k] = gateSmoothing*g.power[k] + (1-gateSmoothing)*binPower
+		g.noise[k] = min(g.power[k], g.noise[k]*gateNoiseRise)
+
+		gain := 1.0
+		if binPower > 0 {
+			gain = max(gateFloor, 1-gateOverSubtraction*g.noise[k]/binPower)
+		}
+		// Smooth over time, gains jumping between frames sound like
+		// bubbles
+		g.gains[k] = 0.5*g.gains[k] + 0.5*gain
+
+		g.spectrum[k] *= complex(g.gains[k], 0)
+		if k != 0 && k != g.size/2 {
+			g.spectrum[g.size-k] *= complex(g.gains[k], 0)
+		}
+	}
+
+	fft(g.spectrum, true)
+	for i := range g.overlap {
+		g.overlap[i] += real(g.spectrum[i]) * g.window[i]
+	}
+	for _, sample := range g.overlap[:g.hop] {
+		g.ready = append(g.ready, int16(max(math.MinInt16, min(math.MaxInt16, math.Round(sample)))))
+	}
+	g.overlap = append(g.overlap[:0], g.overlap[g.hop:]...)
+	g.overlap = append(g.overlap, make([]float64, g.hop)...)
+}
+
+func power(c complex128) float64 {
+	return real(c)*real(c) + imag(c)*imag(c)
+}
+
+// fft is an in place radix 2 FFT, len(x) must be a power of two. The
+// inverse is scaled by 1/len(x).
+func fft(x []complex128, inverse bool) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j |= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	sign := -1.0
+	if inverse {
+		sign = 1
+	}
+	for length := 2; length <= n; length <<= 1 {
+		step := cmplx.Rect(1, sign*2*math.Pi/float64(length))
+		for start := 0; start < n; start += length {
+			w := complex(1, 0)
+			for k := 0; k < length/2; k++ {
+				even, odd := x[start+k], x[start+k+length/2]*w
+				x[start+k] = even + odd
+				x[start+k+length/2] = even - odd
+				w *= step
+			}
+		}
+	}
+
+	if inverse {
+		scale := complex(1/float64(n), 0)
+		for i := range x {
+			x[i] *= scale
+		}
+	}
+}
@@ -0,0 +1,137 @@
+//go:build opus
+
+package main
+
+/*
+#cgo pkg-config: opus
+#include <opus.h>
+
+static int encoder_set(OpusEncoder *st, int request, opus_int32 value) {
+	return opus_encoder_ctl(st, request, value);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"runtime"
+	"unsafe"
+)
+
+// libopusEncoder and libopusDecoder encode and decode audio with libopus,
+// encoders are mono. They are freed when garbage collected.
+type libopusEncoder struct {
+	st *C.OpusEncoder
+}
+
+// libopusDecoder decodes to interleaved channels and returns the samples
+// per channel.
+type libopusDecoder struct {
+	st       *C.OpusDecoder
+	channels int
+}
+
+// opusAvailable reports if the bridge was built with libopus.
+func opusAvailable() bool {
+	return true
+}
+
+func opusError(code C.int) error {
+	return errors.New(C.GoString(C.opus_strerror(code)))
+}
+
+func newOpusEncoder(sampleRate int) (opusEncoder, error) {
+	var code C.int
+	st := C.opus_encoder_create(C.opus_int32(sampleRate), 1, C.OPUS_APPLICATION_VOIP, &code)
+	if code != C.OPUS_OK {
+		return nil, opusError(code)
+	}
+
+	e := &libopusEncoder{st: st}
+	runtime.AddCleanup(e, func(st *C.OpusEncoder) { C.opus_encoder_destroy(st) }, st)
+	return e, nil
+}
+
+func (e *libopusEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	n := C.opus_encode(
+		e.st,
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)),
+		(*C.uchar)(unsafe.Pointer(&data[0])), C.opus_int32(len(data)),
+	)
+	runtime.KeepAlive(e)
+	if n < 0 {
+		return 0, opusError(n)
+	}
+	return int(n), nil
+}
+
+func (e *libopusEncoder) set(request C.int, value int) error {
+	code := C.encoder_set(e.st, request, C.opus_int32(value))
+	runtime.KeepAlive(e)
+	if code != C.OPUS_OK {
+		return opusError(code)
+	}
+	return nil
+}
+
+func (e *libopusEncoder) SetBitrate(bitrate int) error {
+	return e.set(C.OPUS_SET_BITRATE_REQUEST, bitrate)
+}
+
+func (e *libopusEncoder) SetComplexity(complexity int) error {
+	return e.set(C.OPUS_SET_COMPLEXITY_REQUEST, complexity)
+}
+
+func (e *libopusEncoder) SetVBR(vbr bool) error {
+	value := 0
+	if vbr {
+		value = 1
+	}
+	return e.set(C.OPUS_SET_VBR_REQUEST, value)
+}
+
+func (e *libopusEncoder) SetInbandFEC(packetLossPerc int) error {
+	if err := e.set(C.OPUS_SET_INBAND_FEC_REQUEST, 1); err != nil {
+		return err
+	}
+	return e.set(C.OPUS_SET_PACKET_LOSS_PERC_REQUEST, packetLossPerc)
+}
+
+func newOpusDecoder(sampleRate, channels int) (opusDecoder, error) {
+	var code C.int
+	st := C.opus_decoder_create(C.opus_int32(sampleRate), C.int(channels), &code)
+	if code != C.OPUS_OK {
+		return nil, opusError(code)
+	}
+
+	d := &libopusDecoder{st: st, channels: channels}
+	runtime.AddCleanup(d, func(st *C.OpusDecoder) { C.opus_decoder_destroy(st) }, st)
+	return d, nil
+}
+
+func (d *libopusDecoder) Decode(data []byte, pcm []int16) (int, error) {
+	return d.decode(data, pcm, C.int(len(pcm)/d.channels), 0)
+}
+
+func (d *libopusDecoder) DecodeFEC(data []byte, pcm []int16) (int, error) {
+	// The lost frame is assumed to be as long as the one carrying it
+	samples := C.opus_decoder_get_nb_samples(d.st, (*C.uchar)(unsafe.Pointer(unsafe.SliceData(data))), C.opus_int32(len(data)))
+	runtime.KeepAlive(d)
+	if samples < 0 {
+		return 0, opusError(samples)
+	}
+	return d.decode(data, pcm, min(samples, C.int(len(pcm)/d.channels)), 1)
+}
+
+func (d *libopusDecoder) decode(data []byte, pcm []int16, frameSize, fec C.int) (int, error) {
+	n := C.opus_decode(
+		d.st,
+		(*C.uchar)(unsafe.Pointer(unsafe.SliceData(data))), C.opus_int32(len(data)),
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])), frameSize, fec,
+	)
+	runtime.KeepAlive(d)
+	if n < 0 {
+		return 0, opusError(n)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,19 @@
+//go:build !opus
+
+package main
+
+import "errors"
+
+var errOpusUnavailable = errors.New("opus unavailable, build the bridge with -tags opus")
+
+func newOpusEncoder(sampleRate int) (opusEncoder, error) {
+	return nil, errOpusUnavailable
+}
+
+func newOpusDecoder(sampleRate, channels int) (opusDecoder, error) {
+	return nil, errOpusUnavailable
+}
+
+func opusAvailable() bool {
+	return false
+}
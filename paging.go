@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// pageHold is how long audio from LiveKit stays muted on a device after
+// the last packet of a page.
+const pageHold = 500 * time.Millisecond
+
+// pageSource is what a group is paged with, a device session or a
+// participant in a LiveKit room.
+type pageSource struct {
+	Session  string `json:"session,omitempty"`
+	Room     string `json:"room,omitempty"`
+	Identity string `json:"identity,omitempty"`
+
+	// listener is the bridge participant receiving a LiveKit source
+	listener *participant
+}
+
+// groupStatus is the body of the group resource.
+type groupStatus struct {
+	Group   string      `json:"group"`
+	Members []string    `json:"members"`
+	Source  *pageSource `json:"source,omitempty"`
+}
+
+// pageGate feeds a downlink with a page instead of the audio from LiveKit
+// while the page lasts.
+type pageGate struct {
+	write func(p *rtp.Packet, inserted bool)
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func newPageGate(write func(p *rtp.Packet, inserted bool)) *pageGate {
+	return &pageGate{write: write}
+}
+
+// forward passes a downlink packet to the session unless it is paged.
+func (g *pageGate) forward(p *rtp.Packet, inserted bool) {
+	g.mu.Lock()
+	paged := time.Since(g.last) < pageHold
+	g.mu.Unlock()
+
+	if !paged {
+		g.write(p, inserted)
+	}
+}
+
+func (g *pageGate) page(p *rtp.Packet) {
+	g.mu.Lock()
+	g.last = time.Now()
+	g.mu.Unlock()
+
+	g.write(p, false)
+}
+
+// inGroup reports if the session is a member of group, by the device
+// config or the admin API.
+func (s *session) inGroup(group string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Contains(s.groups, group)
+}
+
+func (s *session) setGroup(group string, member bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.Index(s.groups, group)
+	if member && i < 0 {
+		s.groups = append(slices.Clip(s.groups), group)
+	} else if !member && i >= 0 {
+		s.groups = slices.Delete(slices.Clone(s.groups), i, i+1)
+	}
+}
+
+// groupMembers returns the sessions in group.
+func (app *App) groupMembers(group string) []*session {
+	app.sessionsMu.RLock()
+	defer app.sessionsMu.RUnlock()
+
+	var members []*session
+	for _, s := range app.sessions {
+		if s.inGroup(group) {
+			members = append(members, s)
+		}
+	}
+	return members
+}
+
+// page sends a packet of a source to the members of its groups, excluding
+// the source itself.
+func (app *App) page(matches func(source *pageSource) bool, from string, p *rtp.Packet) {
+	app.pagesMu.Lock()
+	var groups []string
+	for group, source := range app.pages {
+		if matches(source) {
+			groups = append(groups, group)
+		}
+	}
+	app.pagesMu.Unlock()
+
+	for _, group := range groups {
+		for _, member := range app.groupMembers(group) {
+			if member.id != from && member.pager != nil {
+				member.pager.page(p)
+			}
+		}
+	}
+}
+
+// pageFromSession pages the groups the session is the source of with its
+// primary audio.
+func (app *App) pageFromSession(s *session, p *rtp.Packet) {
+	app.page(func(source *pageSource) bool {
+		return source.Session == s.id
+	}, s.id, p)
+}
+
+// pageFromParticipant pages the groups a remote participant is the source
+// of with its audio.
+func (app *App) pageFromParticipant(room, identity string, p *rtp.Packet) {
+	app.page(func(source *pageSource) bool {
+		return source.Room == room && source.Identity == identity
+	}, "", p)
+}
+
+// stopPage ends paging group, leaving the room of a LiveKit source.
+func (app *App) stopPage(group string) {
+	app.pagesMu.Lock()
+	source, ok := app.pages[group]
+	delete(app.pages, group)
+	app.pagesMu.Unlock()
+
+	if ok && source.listener != nil {
+		app.releaseParticipant(source.listener)
+	}
+}
+
+// stopPagesFrom ends the pages a closing session is the source of.
+func (app *App) stopPagesFrom(sessionID string) {
+	app.pagesMu.Lock()
+	var groups []string
+	for group, source := range app.pages {
+		if source.Session == sessionID {
+			groups = append(groups, group)
+		}
+	}
+	app.pagesMu.Unlock()
+
+	for _, group := range groups {
+		app.stopPage(group)
+	}
+}
+
+// groupHandler returns the members and source of a group, DELETE stops
+// paging it.
+func (app *App) groupHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	group := r.PathValue("group")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		app.stopPage(group)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res := groupStatus{Group: group, Members: []string{}}
+	for _, s := range app.groupMembers(group) {
+		res.Members = append(res.Members, s.id)
+	}
+	slices.Sort(res.Members)
+	app.pagesMu.Lock()
+	if source, ok := app.pages[group]; ok {
+		copied := *source
+		res.Source = &copied
+	}
+	app.pagesMu.Unlock()
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
+
+// groupMemberHandler adds a session to a group with PUT and removes it with
+// DELETE.
+func (app *App) groupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	group := r.PathValue("group")
+	s.setGroup(group, r.Method == http.MethodPut)
+	log.Infow("Updated group membership", "sessionID", s.id, "group", group, "member", r.Method == http.MethodPut)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// groupSourceHandler pages a group with a device session or a LiveKit
+// participant, replacing its previous source.
+func (app *App) groupSourceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	var source pageSource
+	if err := json.NewDecoder(r.Body).Decode(&source); err != nil {
+		writeError(w, r, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if (source.Session == "") == (source.Room == "" || source.Identity == "") {
+		writeError(w, r, "Give either session or room and identity", http.StatusBadRequest)
+		return
+	}
+
+	if source.Session != "" {
+		if _, ok := app.getSession(source.Session); !ok {
+			writeError(w, r, "Session not found", http.StatusNotFound)
+			return
+		}
+	} else {
+		// The bridge hears the participant through one of its own in
+		// that room
+		listener, err := app.acquireParticipant(source.Room, identity)
+		if err != nil {
+			log.Errorw("Failed to join room of page source", err, "room", source.Room)
+			writeError(w, r, "Failed to join room", http.StatusBadGateway)
+			return
+		}
+		source.listener = listener
+	}
+
+	group := r.PathValue("group")
+	app.stopPage(group)
+	app.pagesMu.Lock()
+	app.pages[group] = &source
+	app.pagesMu.Unlock()
+	log.Infow("Paging group", "group", group, "session", source.Session, "room", source.Room, "identity", source.Identity)
+
+	w.WriteHeader(http.StatusNoContent)
+}
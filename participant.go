@@ -0,0 +1,583 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+var errTargetNotAllowed = errors.New("room or identity not allowed")
+
+// participant is the bridge's connection to a LiveKit room under one
+// identity. Every device session targeting the same room and identity
+// shares it.
+type participant struct {
+	roomName string
+	identity string
+	room     *lksdk.Room
+
+	// downlink carries audio subscribed from LiveKit to the devices
+	downlink *eventTrack
+	// mixer sums the subscribed audio for the downlink with -mix
+	mixer *mixer
+
+	// mu guards sinks, selective, multi, tracks and routes
+	mu sync.Mutex
+	// sinks receive the downlink audio for sessions that can't use the
+	// downlink track directly, keyed by session ID. Inserted packets were
+	// generated by the bridge.
+	sinks map[string]func(p *rtp.Packet, inserted bool)
+	// selective are the sinks of sessions with a subscription selector,
+	// fed from one of tracks
+	selective map[string]*selectiveSink
+	// multi are the sinks of sessions with -multi-downlink
+	multi  map[string]*multiSink
+	tracks []subscribedTrack
+	// routes are the identities the published tracks are private to by
+	// SID, empty for tracks open to the room
+	routes map[string]string
+
+	// sessions counts the device sessions using the participant, it is
+	// disconnected when the last one leaves unless persistent
+	sessions   int
+	persistent bool
+}
+
+func participantKey(roomName, identity string) string {
+	return roomName + "/" + identity
+}
+
+// joinParticipant connects to roomName as identity.
+func (app *App) joinParticipant(roomName, identity string) (*participant, error) {
+	p := &participant{
+		roomName:  roomName,
+		identity:  identity,
+		sinks:     make(map[string]func(p *rtp.Packet, inserted bool)),
+		selective: make(map[string]*selectiveSink),
+		multi:     make(map[string]*multiSink),
+		routes:    make(map[string]string),
+	}
+
+	if createRooms {
+		if err := app.ensureRoom(roomName); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+
+	// Create LiveKit track
+	p.downlink, err = newEventTrack(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus},
+		"audio", "pion",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create LiveKit track: %w", err)
+	}
+
+	if mixDownlink {
+		rule := func(identity string) mixRule {
+			return app.mixRules.rule(roomName, identity)
+		}
+		if p.mixer, err = newMixer(rule, func(rtpPacket *rtp.Packet) error {
+			return p.writeDownlink(rtpPacket, false)
+		}); err != nil {
+			return nil, fmt.Errorf("failed to create mixer: %w", err)
+		}
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			p.mixer.run()
+		}()
+	}
+
+	// Create room with callbacks
+	p.room = lksdk.NewRoom(&lksdk.RoomCallback{
+		ParticipantCallback: lksdk.ParticipantCallback{
+			OnTrackSubscribed: func(track *webrtc.TrackRemote, publication *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
+				app.onTrackSubscribed(p, track, publication, rp)
+			},
+			OnDataPacket: func(data lksdk.DataPacket, params lksdk.DataReceiveParams) {
+				app.onDataPacket(p, data, params)
+			},
+			OnAttributesChanged: func(changed map[string]string, _ lksdk.Participant) {
+				p.reselect()
+			},
+		},
+		OnParticipantConnected: func(*lksdk.RemoteParticipant) {
+			p.onParticipantConnected()
+		},
+	})
+
+	// Without LiveKit the room is never connected, publishing to it
+	// fails and nothing is received
+	if standalone() {
+		log.Infow("Joined intercom room without LiveKit", "room", roomName, "identity", identity)
+		return p, nil
+	}
+
+	// Generate access token
+	metadata := participantMetadata
+	device, _ := cfg.device(roomName, identity)
+	if device.Metadata != "" {
+		metadata = device.Metadata
+	}
+	grants := cfg.grants(device)
+	if paired, ok := app.registry.assigned(roomName, identity); ok {
+		grants = grants.merge(paired.Grants)
+	}
+	token, err := newAccessToken(apiKey, apiSecret, roomName, identity, metadata, device.hidden(), grants)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create access token: %w", err)
+	}
+
+	// Prepare and join room
+	if err := p.room.PrepareConnection(host, token); err != nil {
+		p.stopMixer()
+		return nil, fmt.Errorf("failed to prepare room connection: %w", err)
+	}
+
+	if err := p.room.JoinWithToken(host, token); err != nil {
+		p.stopMixer()
+		return nil, fmt.Errorf("failed to join room: %w", err)
+	}
+
+	if err := app.registerRPCMethods(p); err != nil {
+		p.room.Disconnect()
+		p.stopMixer()
+		return nil, err
+	}
+
+	log.Infow("Joined LiveKit room", "room", roomName, "identity", identity)
+	return p, nil
+}
+
+// writeDownlink sends a packet to the devices of the participant, inserted
+// packets are generated by the bridge.
+func (p *participant) writeDownlink(rtpPacket *rtp.Packet, inserted bool) error {
+	for _, sink := range p.downlinkSinks() {
+		sink(rtpPacket, inserted)
+	}
+
+	if inserted {
+		return p.downlink.insertRTP(rtpPacket)
+	}
+	return p.downlink.WriteRTP(rtpPacket)
+}
+
+func (p *participant) stopMixer() {
+	if p.mixer != nil {
+		p.mixer.close()
+	}
+}
+
+// disconnect leaves the room.
+func (p *participant) disconnect() {
+	p.stopMixer()
+	p.room.Disconnect()
+}
+
+func (app *App) onTrackSubscribed(p *participant, track *webrtc.TrackRemote, publication *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
+	log.Infow("Track subscribed", "room", p.roomName, "participant", rp.Identity(), "track", publication.Name())
+	if subscribeTracks != "" && !matchesAny(subscribeTracks, publication.Name()) {
+		log.Infow("Ignoring track not matching -subscribe-tracks", "room", p.roomName, "participant", rp.Identity(), "track", publication.Name())
+		return
+	}
+
+	isOpus := strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeOpus)
+	write := func(rtpPacket *rtp.Packet) error {
+		return p.writeDownlink(rtpPacket, false)
+	}
+	if p.mixer != nil && isOpus {
+		source := publication.SID()
+		if err := p.mixer.addSource(source, rp.Identity()); err != nil {
+			log.Errorw("Failed to mix track", err, "participant", rp.Identity())
+			return
+		}
+		write = func(rtpPacket *rtp.Packet) error {
+			return p.mixer.push(source, rtpPacket)
+		}
+	}
+
+	sid := publication.SID()
+	if isOpus {
+		p.addTrack(sid, publication.Name(), rp)
+	}
+
+	filler := newDTXFiller(p.writeDownlink)
+	fillDTX := dtxFill && isOpus && p.mixer == nil
+
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		defer log.Infow("Track reading goroutine terminated", "participant", rp.Identity())
+		defer filler.stop()
+		if p.mixer != nil && isOpus {
+			defer p.mixer.removeSource(publication.SID())
+		}
+		if isOpus {
+			defer p.removeTrack(sid)
+		}
+
+		for {
+			select {
+			case <-app.ctx.Done():
+				log.Infow("Context cancelled, stopping track reading", "participant", rp.Identity())
+				return
+			default:
+				rtpPacket, _, rtpErr := track.ReadRTP()
+				if rtpErr != nil {
+					if rtpErr == io.EOF {
+						log.Infow("Track ended", "participant", rp.Identity())
+					} else {
+						log.Errorw("Failed to read RTP packet", rtpErr, "participant", rp.Identity())
+					}
+					return
+				}
+
+				if isOpus {
+					p.forwardSelected(sid, rtpPacket)
+					p.forwardMulti(sid, rtpPacket)
+					if paging {
+						app.pageFromParticipant(p.roomName, rp.Identity(), rtpPacket)
+					}
+				}
+				if fillDTX {
+					rtpErr = filler.forward(rtpPacket)
+				} else {
+					rtpErr = write(rtpPacket)
+				}
+				if rtpErr != nil {
+					log.Errorw("Failed to write RTP packet to LiveKit track", rtpErr)
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (p *participant) addSink(sessionID string, sink func(p *rtp.Packet, inserted bool)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sinks[sessionID] = sink
+}
+
+func (p *participant) removeSink(sessionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.sinks, sessionID)
+	delete(p.selective, sessionID)
+	delete(p.multi, sessionID)
+	if p.mixer != nil {
+		p.mixer.removeBitrate(sessionID)
+	}
+}
+
+func (p *participant) downlinkSinks() []func(p *rtp.Packet, inserted bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sinks := make([]func(p *rtp.Packet, inserted bool), 0, len(p.sinks))
+	for _, sink := range p.sinks {
+		sinks = append(sinks, sink)
+	}
+	return sinks
+}
+
+// participantJoin is a room being joined outside participantsMu. Sessions
+// acquiring the same participant meanwhile wait for it rather than joining
+// a second time.
+type participantJoin struct {
+	roomName string
+	done     chan struct{}
+	err      error
+}
+
+// acquireParticipant returns the participant for roomName and identity,
+// joining the room if no session is using it yet. Joining is a round trip
+// to LiveKit, it doesn't hold up sessions of other participants.
+func (app *App) acquireParticipant(roomName, identity string) (*participant, error) {
+	key := participantKey(roomName, identity)
+	for {
+		app.participantsMu.Lock()
+		if p, ok := app.participants[key]; ok {
+			p.sessions++
+			app.participantsMu.Unlock()
+			return p, nil
+		}
+		join, joining := app.joins[key]
+		if !joining {
+			break
+		}
+		app.participantsMu.Unlock()
+
+		// The participant may be gone again by the time this session
+		// looks, it is then joined anew
+		<-join.done
+		if join.err != nil {
+			return nil, join.err
+		}
+	}
+
+	join := &participantJoin{roomName: roomName, done: make(chan struct{})}
+	app.joins[key] = join
+	app.cancelRoomCleanup(roomName)
+	app.participantsMu.Unlock()
+
+	p, err := app.joinParticipant(roomName, identity)
+
+	app.participantsMu.Lock()
+	delete(app.joins, key)
+	switch {
+	case err != nil:
+		app.scheduleRoomCleanup(roomName)
+	case app.ctx.Err() != nil:
+		// Shutdown disconnected the participants while this one joined
+		p.disconnect()
+		err = errShuttingDown
+	default:
+		app.participants[key] = p
+		p.sessions++
+	}
+	app.participantsMu.Unlock()
+
+	join.err = err
+	close(join.done)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// releaseParticipant is called when a session using p closes.
+func (app *App) releaseParticipant(p *participant) {
+	app.participantsMu.Lock()
+	defer app.participantsMu.Unlock()
+
+	p.sessions--
+	if p.sessions > 0 || p.persistent {
+		return
+	}
+
+	delete(app.participants, participantKey(p.roomName, p.identity))
+	p.disconnect()
+	log.Infow("Left LiveKit room", "room", p.roomName, "identity", p.identity)
+	app.scheduleRoomCleanup(p.roomName)
+}
+
+// acquireFanOut joins rooms as identity for publishing the audio of one
+// session to all of them.
+func (app *App) acquireFanOut(rooms []string, identity string) ([]*participant, error) {
+	var fanOut []*participant
+	for _, room := range rooms {
+		p, err := app.acquireParticipant(room, identity)
+		if err != nil {
+			app.releaseParticipants(fanOut)
+			return nil, err
+		}
+		fanOut = append(fanOut, p)
+	}
+	return fanOut, nil
+}
+
+func (app *App) releaseParticipants(participants []*participant) {
+	for _, p := range participants {
+		app.releaseParticipant(p)
+	}
+}
+
+// sessionTarget returns the room and identity of a new session. Paired
+// devices join where the registry puts them, and other devices can't ask
+// for their place. A templated identity is reserved until the caller
+// releases the reservation, after adding the session.
+func (app *App) sessionTarget(req sessionRequest) (string, string, identityReservation, error) {
+	if req.device != nil {
+		room, participantIdentity := req.device.target()
+		return room, participantIdentity, identityReservation{}, nil
+	}
+
+	defaultIdentity, templated := templateIdentity(req.MAC, req.Serial)
+	targetRoom, targetIdentity, err := resolveTarget(req.Room, req.Identity, defaultIdentity)
+	if err != nil {
+		return "", "", identityReservation{}, err
+	}
+	var reservation identityReservation
+	if templated && targetIdentity == defaultIdentity {
+		reservation = app.reserveIdentity(targetRoom, targetIdentity)
+		targetIdentity = reservation.identity
+	}
+	if _, ok := app.registry.assigned(targetRoom, targetIdentity); ok {
+		reservation.release()
+		return "", "", identityReservation{}, fmt.Errorf("%w: identity %q belongs to a paired device", errTargetNotAllowed, targetIdentity)
+	}
+	return targetRoom, targetIdentity, reservation, nil
+}
+
+// resolveTarget applies the defaults from -room-name and defaultIdentity
+// and checks a device supplied room and identity against the allowlists. A
+// room and identity assigned to a device in -config are always allowed, a
+// room rule in -config picks the room instead of the device.
+func resolveTarget(requestedRoom, requestedIdentity, defaultIdentity string) (string, string, error) {
+	if requestedRoom != "" && requestedIdentity != "" && cfg.assigned(requestedRoom, requestedIdentity) {
+		return requestedRoom, requestedIdentity, nil
+	}
+
+	room, participantIdentity := roomName, defaultIdentity
+	if requestedIdentity != "" && requestedIdentity != identity {
+		if !matchesAny(allowedIdentities, requestedIdentity) {
+			return "", "", fmt.Errorf("%w: identity %q", errTargetNotAllowed, requestedIdentity)
+		}
+		participantIdentity = requestedIdentity
+	}
+	if mapped, ok := cfg.room(requestedRoom, participantIdentity); ok {
+		return mapped, participantIdentity, nil
+	}
+	if requestedRoom != "" && requestedRoom != roomName {
+		if !matchesAny(allowedRooms, requestedRoom) {
+			return "", "", fmt.Errorf("%w: room %q", errTargetNotAllowed, requestedRoom)
+		}
+		room = requestedRoom
+	}
+	return room, participantIdentity, nil
+}
+
+// templateIdentity returns the identity -identity-template gives a device
+// with the MAC address and serial number it sent, -identity when there is
+// no template or the device didn't send what it uses.
+func templateIdentity(mac, serial string) (string, bool) {
+	if identityTemplate == "" {
+		return identity, false
+	}
+	if mac != "" {
+		canonical, err := canonicalMAC(mac)
+		if err != nil {
+			return identity, false
+		}
+		mac = strings.ReplaceAll(canonical, ":", "")
+	}
+
+	values := map[string]string{"mac": mac, "serial": serial}
+	missing := false
+	templated := identityTemplateVariable.ReplaceAllStringFunc(identityTemplate, func(variable string) string {
+		value := values[variable[1:len(variable)-1]]
+		missing = missing || value == ""
+		return value
+	})
+	if missing {
+		return identity, false
+	}
+	return templated, true
+}
+
+// identityReservation holds a templated identity from being picked for
+// another session until the one it was picked for is added.
+type identityReservation struct {
+	app                 *App
+	key                 string
+	templated, identity string
+	// takeover are the sessions of the same device that lost their
+	// connection, they use identity as well
+	takeover []string
+}
+
+// reserveIdentity picks templated, suffixed with -2, -3, ... while a
+// session in room already uses it or it is reserved. Sessions with the
+// identity that templated as well and aren't connected are the same device
+// reconnecting, they don't take it but are taken over.
+func (app *App) reserveIdentity(room, templated string) identityReservation {
+	app.sessionsMu.Lock()
+	defer app.sessionsMu.Unlock()
+
+	var takeover []string
+	taken := make(map[string]bool)
+	for _, s := range app.sessions {
+		p := s.currentParticipant()
+		if p.roomName != room {
+			continue
+		}
+		if s.templated == templated && p.identity == templated && !s.connected() {
+			takeover = append(takeover, s.id)
+			continue
+		}
+		taken[p.identity] = true
+	}
+
+	candidate := templated
+	for n := 2; taken[candidate] || app.reservedIdentities[participantKey(room, candidate)]; n++ {
+		candidate = fmt.Sprintf("%s-%d", templated, n)
+	}
+	if candidate != templated {
+		takeover = nil
+	}
+
+	key := participantKey(room, candidate)
+	app.reservedIdentities[key] = true
+	return identityReservation{app: app, key: key, templated: templated, identity: candidate, takeover: takeover}
+}
+
+// release lets the identity be picked again, once the session holds it or
+// creating it failed. It does nothing for identities that weren't reserved.
+func (r identityReservation) release() {
+	if r.app == nil {
+		return
+	}
+
+	r.app.sessionsMu.Lock()
+	defer r.app.sessionsMu.Unlock()
+
+	delete(r.app.reservedIdentities, r.key)
+}
+
+// resolveFanOut returns the rooms other than primary the session audio is
+// also published to. Rooms from the device config are always allowed,
+// requested ones must match -allowed-rooms.
+func resolveFanOut(requested, assigned []string, primary string) ([]string, error) {
+	var rooms []string
+	for _, room := range requested {
+		if room != roomName && !matchesAny(allowedRooms, room) {
+			return nil, fmt.Errorf("%w: room %q", errTargetNotAllowed, room)
+		}
+	}
+	for _, room := range append(slices.Clone(assigned), requested...) {
+		if room != "" && room != primary && !slices.Contains(rooms, room) {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms, nil
+}
+
+var identityTemplateVariable = regexp.MustCompile(`\{[^}]*\}`)
+
+func validateIdentityTemplate(template string) error {
+	for _, variable := range identityTemplateVariable.FindAllString(template, -1) {
+		if variable != "{mac}" && variable != "{serial}" {
+			return fmt.Errorf("unknown variable %q, must be {mac} or {serial}", variable)
+		}
+	}
+	return nil
+}
+
+// matchesAny reports if value matches one of the comma separated glob patterns.
+func matchesAny(patterns, value string) bool {
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if ok, err := path.Match(pattern, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
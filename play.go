@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// maxAnnouncementSize bounds an uploaded announcement, about ten
+	// minutes of 16kHz WAV
+	maxAnnouncementSize = 20 << 20
+	// playFrameDuration is the frame announcements are encoded in, in time
+	// and samples at 48kHz
+	playFrameDuration = 20 * time.Millisecond
+	playFrameSamples  = opusClockRate * 20 / 1000
+	// playLiveTimeout is how long after the last downlink packet a mixed
+	// announcement is sent on its own
+	playLiveTimeout = 3 * playFrameDuration
+	// duckAttack and duckRelease are how fast audio from LiveKit fades
+	// under a mixed announcement and back, in samples at 48kHz
+	duckAttack  = opusClockRate * 50 / 1000
+	duckRelease = opusClockRate * 500 / 1000
+)
+
+var errUnsupportedAnnouncement = errors.New("announcement must be 16-bit PCM WAV or Ogg Opus")
+
+// player plays announcements to a session, replacing the audio from
+// LiveKit or mixed into it for the duration of the announcement.
+type player struct {
+	sessionID string
+	write     func(p *rtp.Packet, inserted bool)
+
+	mu      sync.Mutex
+	decoder opusDecoder
+	encoder opusEncoder
+	buf     []byte
+	pcm     []int16
+	// remaining is the announcement left to play at 48kHz
+	remaining []int16
+	mix       bool
+	playing   bool
+	// queue holds the announcements waiting for the one playing
+	queue []announcement
+	// generation stops the frame timer of an announcement that was
+	// replaced or stopped
+	generation int
+	// last is the header of the packet sent last, generated packets
+	// continue its timestamps
+	last     rtp.Header
+	lastLive time.Time
+	// bitrate is set by -adaptive-bitrate, zero keeps the encoder
+	// settings
+	bitrate int
+	// duckGain is the gain of the audio from LiveKit, ramping down to
+	// -announcement-duck while a mixed announcement plays and back to 1
+	duckGain float64
+}
+
+type announcement struct {
+	pcm []int16
+	mix bool
+}
+
+// playResponse is the body of a started announcement.
+type playResponse struct {
+	DurationMs int64 `json:"duration_ms"`
+}
+
+func newPlayer(sessionID string, write func(p *rtp.Packet, inserted bool)) *player {
+	return &player{sessionID: sessionID, write: write, duckGain: 1}
+}
+
+// forward passes a downlink packet to the session, dropped while an
+// announcement replaces the downlink and ducked with the announcement added
+// while it is mixed in.
+func (pl *player) forward(p *rtp.Packet, inserted bool) {
+	pl.mu.Lock()
+	if !pl.playing && pl.duckGain >= 1 {
+		pl.last = p.Header
+		pl.mu.Unlock()
+		pl.write(p, inserted)
+		return
+	}
+	if !pl.mix {
+		pl.mu.Unlock()
+		return
+	}
+
+	n, err := pl.decoder.Decode(p.Payload, pl.pcm)
+	if err != nil {
+		pl.mu.Unlock()
+		log.Errorw("Failed to decode downlink for announcement", err, "sessionID", pl.sessionID)
+		return
+	}
+	pl.duckLocked(pl.pcm[:n])
+	payload, err := pl.encodeLocked(pl.pcm[:n])
+	if err != nil {
+		pl.mu.Unlock()
+		log.Errorw("Failed to encode announcement", err, "sessionID", pl.sessionID)
+		return
+	}
+	mixed := *p
+	mixed.Payload = payload
+	pl.last, pl.lastLive = p.Header, time.Now()
+	pl.mu.Unlock()
+
+	pl.write(&mixed, inserted)
+}
+
+// duckLocked ramps the gain of pcm from LiveKit towards -announcement-duck
+// while an announcement plays and back to 1 after it.
+func (pl *player) duckLocked(pcm []int16) {
+	ducked := math.Pow(10, -announcementDuckDB/20)
+	target, step := 1.0, (1-ducked)/duckRelease
+	if pl.playing {
+		target, step = ducked, (1-ducked)/duckAttack
+	}
+
+	for i, sample := range pcm {
+		if pl.duckGain > target {
+			pl.duckGain = max(target, pl.duckGain-step)
+		} else if pl.duckGain < target {
+			pl.duckGain = min(target, pl.duckGain+step)
+		}
+		pcm[i] = int16(float64(sample) * pl.duckGain)
+	}
+}
+
+// encodeLocked adds the next samples of the announcement to pcm and
+// encodes it, the announcement ends when it ran out.
+func (pl *player) encodeLocked(pcm []int16) ([]byte, error) {
+	if !pl.playing {
+		return pl.encodePCMLocked(pcm)
+	}
+
+	next := min(len(pcm), len(pl.remaining))
+	for i, sample := range pl.remaining[:next] {
+		pcm[i] = int16(max(math.MinInt16, min(math.MaxInt16, int32(pcm[i])+int32(sample))))
+	}
+	pl.remaining = pl.remaining[next:]
+	if len(pl.remaining) == 0 {
+		log.Infow("Announcement finished", "sessionID", pl.sessionID)
+		if len(pl.queue) > 0 {
+			pl.remaining, pl.mix = pl.queue[0].pcm, pl.queue[0].mix
+			pl.queue = pl.queue[1:]
+		} else {
+			pl.playing = false
+		}
+	}
+
+	return pl.encodePCMLocked(pcm)
+}
+
+func (pl *player) encodePCMLocked(pcm []int16) ([]byte, error) {
+	n, err := pl.encoder.Encode(pcm, pl.buf)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), pl.buf[:n]...), nil
+}
+
+// play starts pcm at 48kHz, replacing the announcements playing and
+// queued.
+func (pl *player) play(pcm []int16, mix bool) (time.Duration, error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if err := pl.initLocked(); err != nil {
+		return 0, err
+	}
+	pl.queue = nil
+	pl.startLocked(pcm, mix)
+
+	duration := announcementDuration(pcm)
+	log.Infow("Playing announcement", "sessionID", pl.sessionID, "duration", duration, "mix", mix)
+	return duration, nil
+}
+
+// enqueue plays pcm at 48kHz after the announcements before it.
+func (pl *player) enqueue(pcm []int16, mix bool) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if err := pl.initLocked(); err != nil {
+		return err
+	}
+	if pl.playing {
+		pl.queue = append(pl.queue, announcement{pcm: pcm, mix: mix})
+		log.Infow("Queued announcement", "sessionID", pl.sessionID, "duration", announcementDuration(pcm), "queued", len(pl.queue))
+		return nil
+	}
+	pl.startLocked(pcm, mix)
+	log.Infow("Playing announcement", "sessionID", pl.sessionID, "duration", announcementDuration(pcm), "mix", mix)
+	return nil
+}
+
+func announcementDuration(pcm []int16) time.Duration {
+	return time.Duration(len(pcm)) * time.Second / opusClockRate
+}
+
+func (pl *player) initLocked() error {
+	if pl.encoder == nil {
+		decoder, err := newOpusDecoder(opusClockRate, 1)
+		if err != nil {
+			return err
+		}
+		encoder, err := newTunedOpusEncoder(opusClockRate, encoderSettings{}.withDefaults())
+		if err != nil {
+			return err
+		}
+		if pl.bitrate != 0 {
+			if err := encoder.SetBitrate(pl.bitrate); err != nil {
+				return err
+			}
+		}
+		pl.decoder, pl.encoder = decoder, encoder
+		pl.buf = make([]byte, maxOpusPacketSize)
+		// 120ms, the longest frame Opus decodes
+		pl.pcm = make([]int16, opusClockRate*120/1000)
+	}
+	return nil
+}
+
+// setBitrate sets the bitrate announcements are encoded at.
+func (pl *player) setBitrate(bitrate int) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if bitrate == pl.bitrate {
+		return
+	}
+	pl.bitrate = bitrate
+	if pl.encoder != nil {
+		if err := pl.encoder.SetBitrate(bitrate); err != nil {
+			log.Errorw("Failed to set announcement bitrate", err, "sessionID", pl.sessionID)
+		}
+	}
+}
+
+func (pl *player) startLocked(pcm []int16, mix bool) {
+	pl.remaining, pl.mix, pl.playing = pcm, mix, len(pcm) > 0
+	pl.generation++
+	go pl.run(pl.generation)
+}
+
+// run sends the announcement every 20ms while nothing from LiveKit
+// carries it.
+func (pl *player) run(generation int) {
+	ticker := time.NewTicker(playFrameDuration)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pl.mu.Lock()
+		if !pl.playing || pl.generation != generation {
+			pl.mu.Unlock()
+			return
+		}
+		if pl.mix && time.Since(pl.lastLive) < playLiveTimeout {
+			pl.mu.Unlock()
+			continue
+		}
+
+		payload, err := pl.encodeLocked(make([]int16, playFrameSamples))
+		if err != nil {
+			pl.mu.Unlock()
+			log.Errorw("Failed to encode announcement", err, "sessionID", pl.sessionID)
+			return
+		}
+		header := pl.last
+		header.Version = 2
+		header.Marker = false
+		header.Timestamp += playFrameSamples
+		pl.last = header
+		pl.mu.Unlock()
+
+		pl.write(&rtp.Packet{Header: header, Payload: payload}, true)
+	}
+}
+
+// stop ends the announcement playing and drops the queued ones.
+func (pl *player) stop() {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.playing = false
+	pl.remaining, pl.queue = nil, nil
+	pl.generation++
+}
+
+// decodeAnnouncement decodes an uploaded WAV or Ogg Opus file to mono PCM
+// at 48kHz.
+func decodeAnnouncement(data []byte) ([]int16, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("RIFF")):
+		return decodeWAV(data)
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return decodeOggOpus(data)
+	}
+	return nil, errUnsupportedAnnouncement
+}
+
+func decodeWAV(data []byte) ([]int16, error) {
+	if len(data) < 12 || string(data[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("invalid WAV file")
+	}
+
+	var (
+		channels, sampleRate, bits int
+		samples                    []byte
+	)
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		body := data[pos+8 : min(len(data), pos+8+size)]
+		switch string(data[pos : pos+4]) {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, fmt.Errorf("invalid WAV fmt chunk")
+			}
+			// PCM or WAVE_FORMAT_EXTENSIBLE
+			if format := binary.LittleEndian.Uint16(body); format != 1 && format != 0xfffe {
+				return nil, errUnsupportedAnnouncement
+			}
+			channels = int(binary.LittleEndian.Uint16(body[2:]))
+			sampleRate = int(binary.LittleEndian.Uint32(body[4:]))
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+		case "data":
+			samples = body
+		}
+		pos += 8 + size + size%2
+	}
+	if bits != 16 || channels < 1 || sampleRate < 8000 || sampleRate > 192000 {
+		return nil, errUnsupportedAnnouncement
+	}
+
+	interleaved := decodeL16(binary.LittleEndian, samples)
+	pcm := make([]int16, len(interleaved)/channels)
+	for i := range pcm {
+		var sum int
+		for c := range channels {
+			sum += int(interleaved[i*channels+c])
+		}
+		pcm[i] = int16(sum / channels)
+	}
+	if sampleRate != opusClockRate {
+		pcm = newResampler(sampleRate, opusClockRate).resample(pcm)
+	}
+	return pcm, nil
+}
+
+func decodeOggOpus(data []byte) ([]int16, error) {
+	packets, err := oggPackets(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(packets) < 2 || len(packets[0]) < 19 || !bytes.HasPrefix(packets[0], []byte("OpusHead")) {
+		return nil, errUnsupportedAnnouncement
+	}
+	preSkip := int(binary.LittleEndian.Uint16(packets[0][10:]))
+
+	decoder, err := newOpusDecoder(opusClockRate, 1)
+	if err != nil {
+		return nil, err
+	}
+	// The first two packets are the OpusHead and OpusTags headers
+	var pcm []int16
+	frame := make([]int16, opusClockRate*120/1000)
+	for _, packet := range packets[2:] {
+		n, err := decoder.Decode(packet, frame)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode Opus: %w", err)
+		}
+		pcm = append(pcm, frame[:n]...)
+	}
+	return pcm[min(preSkip, len(pcm)):], nil
+}
+
+// oggPackets returns the packets of the first logical stream of an Ogg
+// file, joining packets that span pages.
+func oggPackets(data []byte) ([][]byte, error) {
+	var (
+		packets [][]byte
+		packet  []byte
+		serial  uint32
+	)
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 27 || string(data[pos:pos+4]) != "OggS" {
+			return nil, fmt.Errorf("invalid Ogg page")
+		}
+		pageSerial := binary.LittleEndian.Uint32(data[pos+14:])
+		segments := int(data[pos+26])
+		if pos+27+segments > len(data) {
+			return nil, fmt.Errorf("invalid Ogg page")
+		}
+		lacing := data[pos+27 : pos+27+segments]
+		pos += 27 + segments
+
+		if len(packets) == 0 && packet == nil {
+			serial = pageSerial
+		}
+		for _, size := range lacing {
+			if pos+int(size) > len(data) {
+				return nil, fmt.Errorf("invalid Ogg page")
+			}
+			if pageSerial == serial {
+				packet = append(packet, data[pos:pos+int(size)]...)
+				if size < 255 {
+					packets = append(packets, packet)
+					packet = nil
+				}
+			}
+			pos += int(size)
+		}
+	}
+	return packets, nil
+}
+
+// playHandler plays an uploaded announcement to a session, replacing the
+// audio from LiveKit or with ?mode=mix over it. DELETE stops it.
+func (app *App) playHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+	if s.player == nil {
+		writeError(w, r, "Session has no downlink to play to", http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodDelete:
+		s.player.stop()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var mix bool
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "replace":
+	case "mix":
+		mix = true
+	default:
+		writeError(w, r, fmt.Sprintf("unknown mode %q, must be replace or mix", mode), http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxAnnouncementSize+1))
+	if err != nil {
+		writeError(w, r, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxAnnouncementSize {
+		writeError(w, r, "Announcement too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	pcm, err := decodeAnnouncement(data)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	duration, err := s.player.play(pcm, mix)
+	if err != nil {
+		log.Errorw("Failed to play announcement", err, "sessionID", s.id)
+		writeError(w, r, "Failed to play announcement", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(playResponse{DurationMs: duration.Milliseconds()}); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
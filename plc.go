@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pion/rtp"
+)
+
+// maxConcealedFrames is the longest gap concealment fills, longer gaps are
+// the device going away rather than lost packets.
+const maxConcealedFrames = 5
+
+// conceal decodes a frame for every packet lost between the packet at
+// lastSequence and p, and hands it to process under the header of the lost
+// packet. The frame right before p is recovered from the FEC p carries,
+// the others are Opus packet loss concealment.
+func conceal(decoder opusDecoder, lastSequence uint16, lastTimestamp uint32, frameSize int, p *rtp.Packet, pcm []int16, process func(lost *rtp.Packet, frame []int16) error) error {
+	missing := int(p.SequenceNumber-lastSequence) - 1
+	if missing <= 0 || missing > maxConcealedFrames {
+		return nil
+	}
+
+	for i := 1; i <= missing; i++ {
+		var (
+			n   int
+			err error
+		)
+		if i == missing {
+			n, err = decoder.DecodeFEC(p.Payload, pcm[:frameSize])
+		} else {
+			n, err = decoder.Decode(nil, pcm[:frameSize])
+		}
+		if err != nil {
+			return fmt.Errorf("failed to conceal lost Opus: %w", err)
+		}
+
+		lost := rtp.Packet{Header: p.Header}
+		lost.Marker = false
+		lost.SequenceNumber = lastSequence + uint16(i)
+		lost.Timestamp = lastTimestamp + uint32(i*frameSize)
+		if err := process(&lost, pcm[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/sean-der/livekit-microcontroller-bridge/signalingpb"
+)
+
+const protobufContentType = "application/x-protobuf"
+
+var (
+	errSessionNotFound   = errors.New("session not found")
+	errSessionNotAllowed = errors.New("session belongs to another device")
+	errUnexpectedMessage = errors.New("unexpected signaling message")
+)
+
+var websocketUpgrader = websocket.Upgrader{
+	// Devices don't send an Origin, access is controlled by -bearer-token
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// handleSignal processes a protobuf signaling message from a device and
+// returns the reply. The session is returned when the message created one,
+// for device when a paired device sent it.
+func (app *App) handleSignal(msg *signalingpb.SignalMessage, device *registeredDevice) (*signalingpb.SignalMessage, *session, error) {
+	switch m := msg.Message.(type) {
+	case *signalingpb.SignalMessage_Offer:
+		if m.Offer.SessionId == "" {
+			s, err := app.createSession(sessionRequest{
+				Offer:    m.Offer.Sdp,
+				Room:     m.Offer.Room,
+				Identity: m.Offer.Identity,
+				device:   device,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			return answerMessage(s), s, nil
+		}
+
+		s, ok := app.getSession(m.Offer.SessionId)
+		if !ok {
+			return nil, nil, errSessionNotFound
+		}
+		if !s.ownedBy(device) {
+			return nil, nil, errSessionNotAllowed
+		}
+		if err := app.negotiate(s, m.Offer.Sdp); err != nil {
+			return nil, nil, err
+		}
+		return answerMessage(s), nil, nil
+
+	case *signalingpb.SignalMessage_Candidate:
+		s, ok := app.getSession(m.Candidate.SessionId)
+		if !ok {
+			return nil, nil, errSessionNotFound
+		}
+		if !s.ownedBy(device) {
+			return nil, nil, errSessionNotAllowed
+		}
+		if m.Candidate.Candidate != "" {
+			candidate := webrtc.ICECandidateInit{Candidate: m.Candidate.Candidate}
+			if m.Candidate.SdpMid != "" {
+				candidate.SDPMid = &m.Candidate.SdpMid
+			}
+			if err := s.addRemoteCandidate(candidate); err != nil {
+				return nil, nil, fmt.Errorf("%w: %w", errInvalidOffer, err)
+			}
+		}
+		return statusMessage(s.id, s.pc.ICEConnectionState(), nil), nil, nil
+
+	default:
+		return nil, nil, errUnexpectedMessage
+	}
+}
+
+func answerMessage(s *session) *signalingpb.SignalMessage {
+	return &signalingpb.SignalMessage{
+		Message: &signalingpb.SignalMessage_Answer{
+			Answer: &signalingpb.Answer{Sdp: s.answer(), SessionId: s.id},
+		},
+	}
+}
+
+func statusMessage(sessionID string, state webrtc.ICEConnectionState, err error) *signalingpb.SignalMessage {
+	status := &signalingpb.SessionStatus{SessionId: sessionID}
+	switch state {
+	case webrtc.ICEConnectionStateNew:
+		status.State = signalingpb.SessionStatus_STATE_NEW
+	case webrtc.ICEConnectionStateChecking:
+		status.State = signalingpb.SessionStatus_STATE_CHECKING
+	case webrtc.ICEConnectionStateConnected:
+		status.State = signalingpb.SessionStatus_STATE_CONNECTED
+	case webrtc.ICEConnectionStateCompleted:
+		status.State = signalingpb.SessionStatus_STATE_COMPLETED
+	case webrtc.ICEConnectionStateDisconnected:
+		status.State = signalingpb.SessionStatus_STATE_DISCONNECTED
+	case webrtc.ICEConnectionStateFailed:
+		status.State = signalingpb.SessionStatus_STATE_FAILED
+	case webrtc.ICEConnectionStateClosed:
+		status.State = signalingpb.SessionStatus_STATE_CLOSED
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	return &signalingpb.SignalMessage{
+		Message: &signalingpb.SignalMessage_Status{Status: status},
+	}
+}
+
+// protobufHandler serves protobuf signaling over plain HTTP. Offers create
+// a session and are answered with 201 Created like a WHIP offer.
+func (app *App) protobufHandler(w http.ResponseWriter, r *http.Request, device *registeredDevice) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Errorw("Failed to read request body", err)
+		writeError(w, r, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	msg := &signalingpb.SignalMessage{}
+	if err := proto.Unmarshal(body, msg); err != nil {
+		log.Errorw("Failed to decode protobuf signal", err)
+		writeError(w, r, "Invalid protobuf message", http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	reply, s, err := app.handleSignal(msg, device)
+	if err != nil {
+		log.Errorw("Failed to handle protobuf signal", err)
+		status, _, _ = negotiationErrorStatus(err)
+		reply = statusMessage("", webrtc.ICEConnectionStateUnknown, err)
+	} else if s != nil {
+		status = http.StatusCreated
+		w.Header().Set("Location", sessionLocation(r, s.id))
+	}
+
+	raw, err := proto.Marshal(reply)
+	if err != nil {
+		log.Errorw("Failed to encode protobuf signal", err)
+		writeError(w, r, "Failed to encode reply", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", protobufContentType)
+	w.WriteHeader(status)
+	if _, err := w.Write(raw); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
+
+// websocketHandler serves signaling over a WebSocket. Binary frames carry
+// protobuf SignalMessages, text frames a plain SDP offer answered with a
+// plain SDP answer. Sessions created over binary frames report their ICE
+// state changes back on the socket.
+func (app *App) websocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.authorize(w, r) {
+		return
+	}
+	device := app.pairedDevice(requestToken(r))
+
+	conn, err := websocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorw("Failed to upgrade websocket", err)
+		return
+	}
+	defer conn.Close()
+
+	var (
+		writeMu sync.Mutex
+		closed  bool
+	)
+	write := func(messageType int, data []byte) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+
+		if closed {
+			return
+		}
+		if err := conn.WriteMessage(messageType, data); err != nil {
+			log.Errorw("Failed to write websocket message", err)
+		}
+	}
+	defer func() {
+		writeMu.Lock()
+		closed = true
+		writeMu.Unlock()
+	}()
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Infow("Websocket closed", "error", err)
+			}
+			return
+		}
+
+		switch messageType {
+		case websocket.TextMessage:
+			s, err := app.createSession(sessionRequest{Offer: string(data), device: device})
+			if err != nil {
+				log.Errorw("Failed to create session over websocket", err)
+				_, _, message := negotiationErrorStatus(err)
+				write(websocket.TextMessage, []byte(message))
+				continue
+			}
+			write(websocket.TextMessage, []byte(s.answer()))
+
+		case websocket.BinaryMessage:
+			msg := &signalingpb.SignalMessage{}
+			if err := proto.Unmarshal(data, msg); err != nil {
+				log.Errorw("Failed to decode protobuf signal", err)
+				continue
+			}
+
+			reply, s, err := app.handleSignal(msg, device)
+			if err != nil {
+				log.Errorw("Failed to handle protobuf signal", err)
+				reply = statusMessage("", webrtc.ICEConnectionStateUnknown, err)
+			}
+			if s != nil {
+				sessionID := s.id
+				s.onICEState(func(state webrtc.ICEConnectionState) {
+					if raw, err := proto.Marshal(statusMessage(sessionID, state, nil)); err == nil {
+						write(websocket.BinaryMessage, raw)
+					}
+				})
+			}
+
+			raw, err := proto.Marshal(reply)
+			if err != nil {
+				log.Errorw("Failed to encode protobuf signal", err)
+				continue
+			}
+			write(websocket.BinaryMessage, raw)
+		}
+	}
+}
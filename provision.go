@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const provisionSignatureHeader = "X-Bundle-Signature"
+
+// provisionBundle is everything factory flashed firmware needs to connect.
+type provisionBundle struct {
+	Device          string               `json:"device"`
+	SignalingURL    string               `json:"signaling_url"`
+	Room            string               `json:"room"`
+	Identity        string               `json:"identity"`
+	Audio           audioConfig          `json:"audio"`
+	DTLSFingerprint string               `json:"dtls_fingerprint"`
+	ICEServers      []provisionICEServer `json:"ice_servers,omitempty"`
+	IssuedAt        int64                `json:"issued_at"`
+	// Addresses are the IPv4 and IPv6 addresses of the bridge, preferred
+	// family first, for devices that can't resolve its name
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+type provisionICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// provisionHandler serves GET /provision?device=<mac>. The body is signed
+// with HMAC-SHA256 using -provision-secret, the signature is sent base64
+// encoded in the X-Bundle-Signature header.
+func (app *App) provisionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorize(w, r) {
+		return
+	}
+
+	mac, err := canonicalMAC(r.URL.Query().Get("device"))
+	if err != nil {
+		writeError(w, r, "Invalid device", http.StatusBadRequest)
+		return
+	}
+
+	device, ok := cfg.Devices[mac]
+	if !ok {
+		writeError(w, r, "Unknown device", http.StatusNotFound)
+		return
+	}
+
+	bundle := provisionBundle{
+		Device:          mac,
+		SignalingURL:    signalingURL(r),
+		Room:            device.Room,
+		Identity:        device.Identity,
+		Audio:           device.Audio,
+		DTLSFingerprint: app.fingerprint(),
+		IssuedAt:        time.Now().Unix(),
+	}
+	if bundle.Room == "" {
+		bundle.Room = roomName
+	}
+	if bundle.Identity == "" {
+		bundle.Identity = identity
+	}
+	if bundle.Audio.SampleRate == 0 {
+		bundle.Audio.SampleRate = 48000
+	}
+	if bundle.Audio.Channels == 0 {
+		bundle.Audio.Channels = 1
+	}
+	if bundle.Audio.Ptime == 0 {
+		bundle.Audio.Ptime = 20
+	}
+	for _, ip := range localIPs() {
+		bundle.Addresses = append(bundle.Addresses, ip.String())
+	}
+	for _, server := range app.advertisedICEServers(bundle.Identity) {
+		credential, _ := server.Credential.(string)
+		bundle.ICEServers = append(bundle.ICEServers, provisionICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: credential,
+		})
+	}
+
+	body, err := json.Marshal(bundle)
+	if err != nil {
+		log.Errorw("Failed to encode provisioning bundle", err)
+		writeError(w, r, "Failed to encode bundle", http.StatusInternalServerError)
+		return
+	}
+
+	mac256 := hmac.New(sha256.New, []byte(provisionSecret))
+	mac256.Write(body)
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set(provisionSignatureHeader, "hmac-sha256="+base64.StdEncoding.EncodeToString(mac256.Sum(nil)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+
+	log.Infow("Provisioned device", "device", mac, "room", bundle.Room, "identity", bundle.Identity)
+}
+
+// fingerprint returns the DTLS fingerprint devices can pin, formatted like
+// the SDP a=fingerprint attribute.
+func (app *App) fingerprint() string {
+	fingerprints, err := app.certificate.GetFingerprints()
+	if err != nil || len(fingerprints) == 0 {
+		log.Errorw("Failed to get DTLS fingerprint", err)
+		return ""
+	}
+	return fingerprints[0].Algorithm + " " + strings.ToUpper(fingerprints[0].Value)
+}
+
+// signalingURL is the WHIP endpoint as reached by the requesting device.
+func signalingURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + apiPrefix + "/connect"
+}
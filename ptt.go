@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// pttDataChannel is the label of a data channel carrying push-to-talk
+// state. While a device has it open its audio is only published with the
+// button pressed.
+const pttDataChannel = "ptt"
+
+// pttMessage is sent by the device as the button is pressed and released.
+type pttMessage struct {
+	PTT *bool `json:"ptt"`
+}
+
+// onPTTDataChannel gates the audio of the session on the push-to-talk
+// state the device sends, released until the first press.
+func (app *App) onPTTDataChannel(s *session, dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		s.setPTT(false)
+	})
+
+	dc.OnClose(func() {
+		s.setPTT(true)
+	})
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var req pttMessage
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			log.Errorw("Failed to decode ptt message", err, "sessionID", s.id)
+			return
+		}
+		if req.PTT == nil {
+			log.Debugw("Ignored ptt message without ptt", "sessionID", s.id)
+			return
+		}
+		s.setPTT(*req.PTT)
+	})
+}
+
+// setPTT publishes the device audio while pressed, otherwise its audio
+// tracks are muted and its packets dropped.
+func (s *session) setPTT(pressed bool) {
+	if s.pttReleased.Swap(!pressed) == !pressed {
+		return
+	}
+	s.mutePublications(!pressed)
+	log.Infow("Push-to-talk changed", "sessionID", s.id, "pressed", pressed)
+}
+
+// applyPTT mutes audio tracks published while push-to-talk is released.
+func (s *session) applyPTT() {
+	if s.pttReleased.Load() {
+		s.mutePublications(true)
+	}
+}
+
+func (s *session) mutePublications(muted bool) {
+	s.mu.Lock()
+	publications := slices.Clone(s.publications)
+	s.mu.Unlock()
+
+	for _, published := range publications {
+		if published.track.Kind() == webrtc.RTPCodecTypeAudio {
+			published.setMuted(muted)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// qualityInterval is how often the quality of every session is
+	// scored
+	qualityInterval = 5 * time.Second
+	// qualitySmoothing is the weight of the latest interval in the rolling
+	// score, a single lost burst moves it but doesn't define it
+	qualitySmoothing = 0.3
+)
+
+// connectionQuality scores the network between the bridge and a device
+// from the RTP it sends, the receiver reports it sends about the downlink
+// and the ICE round trip time.
+type connectionQuality struct {
+	mu sync.Mutex
+	// uplink are the streams from the device by SSRC
+	uplink map[uint32]*uplinkStream
+	// downlinkLoss and downlinkJitter are from the last receiver report
+	// of the device, rtt from the last one with a round trip time
+	downlinkLoss   float64
+	downlinkJitter time.Duration
+	rtt            time.Duration
+	rttAt          time.Time
+	// receivedBytes and scoredAt are the byte count of the session at
+	// the last interval
+	receivedBytes uint64
+	scoredAt      time.Time
+	scored        bool
+	report        qualityReport
+}
+
+// uplinkStream counts the packets of one stream from the device over the
+// current interval and keeps its RFC 3550 interarrival jitter.
+type uplinkStream struct {
+	clockRate          uint32
+	lastSequence       uint16
+	expected, received uint64
+	transit, jitter    float64
+	started            bool
+}
+
+// qualityReport is the rolling quality of a session. Score is the R factor
+// of the ITU-T G.107 E-model, 0-100 where above 80 is good and below 60
+// poor, MOS the matching mean opinion score 1-4.5.
+type qualityReport struct {
+	Score               float64 `json:"score"`
+	MOS                 float64 `json:"mos"`
+	UplinkLossPercent   float64 `json:"uplink_loss_percent"`
+	DownlinkLossPercent float64 `json:"downlink_loss_percent"`
+	JitterMs            float64 `json:"jitter_ms"`
+	RTTMs               float64 `json:"rtt_ms"`
+	BitrateKbps         float64 `json:"bitrate_kbps"`
+}
+
+// observe records a packet the device sent, arriving at now.
+func (q *connectionQuality) observe(p *rtp.Packet, clockRate uint32, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.uplink == nil {
+		q.uplink = make(map[uint32]*uplinkStream)
+	}
+	stream, ok := q.uplink[p.SSRC]
+	if !ok {
+		stream = &uplinkStream{clockRate: clockRate}
+		q.uplink[p.SSRC] = stream
+	}
+
+	stream.received++
+	if !stream.started {
+		stream.started, stream.lastSequence = true, p.SequenceNumber
+		stream.expected++
+	} else if delta := int16(p.SequenceNumber - stream.lastSequence); delta > 0 {
+		stream.expected += uint64(delta)
+		stream.lastSequence = p.SequenceNumber
+	}
+
+	if stream.clockRate == 0 {
+		return
+	}
+	arrival := float64(now.UnixNano()) * float64(stream.clockRate) / float64(time.Second)
+	transit := arrival - float64(p.Timestamp)
+	if stream.transit != 0 {
+		stream.jitter += (math.Abs(transit-stream.transit) - stream.jitter) / 16
+	}
+	stream.transit = transit
+}
+
+// receiverReport records a report block of the device about the downlink,
+// sent with clockRate and received at now.
+func (q *connectionQuality) receiverReport(block rtcp.ReceptionReport, clockRate uint32, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.downlinkLoss = float64(block.FractionLost) / 256
+	if clockRate != 0 {
+		q.downlinkJitter = time.Duration(block.Jitter) * time.Second / time.Duration(clockRate)
+	}
+	if rtt, ok := roundTripTime(now, block); ok {
+		q.rtt, q.rttAt = rtt, now
+	}
+}
+
+// update scores the interval ending at now and folds it into the rolling
+// report. iceRTT is used while no receiver report has a round trip time.
+func (q *connectionQuality) update(now time.Time, receivedBytes uint64, iceRTT time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var expected, received uint64
+	var uplinkJitter time.Duration
+	for _, stream := range q.uplink {
+		expected += stream.expected
+		received += stream.received
+		stream.expected, stream.received = 0, 0
+		if stream.clockRate != 0 {
+			uplinkJitter = max(uplinkJitter, time.Duration(stream.jitter*float64(time.Second)/float64(stream.clockRate)))
+		}
+	}
+	uplinkLoss := 0.0
+	if expected > received {
+		uplinkLoss = float64(expected-received) / float64(expected)
+	}
+
+	rtt := iceRTT
+	if now.Sub(q.rttAt) < 2*qualityInterval {
+		rtt = q.rtt
+	}
+	bitrate := 0.0
+	if q.scored {
+		bitrate = float64(receivedBytes-q.receivedBytes) * 8 / now.Sub(q.scoredAt).Seconds() / 1000
+	}
+	jitter := max(uplinkJitter, q.downlinkJitter)
+
+	sample := qualityReport{
+		UplinkLossPercent:   uplinkLoss * 100,
+		DownlinkLossPercent: q.downlinkLoss * 100,
+		JitterMs:            float64(jitter) / float64(time.Millisecond),
+		RTTMs:               float64(rtt) / float64(time.Millisecond),
+		BitrateKbps:         bitrate,
+	}
+	sample.Score = rFactor(max(uplinkLoss, q.downlinkLoss), jitter, rtt)
+
+	if q.scored {
+		smooth := func(current, latest float64) float64 {
+			return current + qualitySmoothing*(latest-current)
+		}
+		sample = qualityReport{
+			Score:               smooth(q.report.Score, sample.Score),
+			UplinkLossPercent:   smooth(q.report.UplinkLossPercent, sample.UplinkLossPercent),
+			DownlinkLossPercent: smooth(q.report.DownlinkLossPercent, sample.DownlinkLossPercent),
+			JitterMs:            smooth(q.report.JitterMs, sample.JitterMs),
+			RTTMs:               smooth(q.report.RTTMs, sample.RTTMs),
+			BitrateKbps:         smooth(q.report.BitrateKbps, sample.BitrateKbps),
+		}
+	}
+	sample.MOS = mos(sample.Score)
+
+	q.report, q.receivedBytes, q.scoredAt, q.scored = sample, receivedBytes, now, true
+}
+
+func (q *connectionQuality) current() (qualityReport, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.report, q.scored
+}
+
+// rFactor is the simplified E-model R factor for loss, a fraction, over a
+// path with jitter and rtt. Bitrate isn't part of it, a device using DTX
+// sends next to nothing while it is quiet.
+func rFactor(loss float64, jitter, rtt time.Duration) float64 {
+	// One way delay plus the jitter buffer covering twice the jitter
+	latency := float64(rtt/2+2*jitter)/float64(time.Millisecond) + 10
+	r := 93.2
+	if latency < 160 {
+		r -= latency / 40
+	} else {
+		r -= (latency - 120) / 10
+	}
+	r -= 2.5 * loss * 100
+	return min(max(r, 0), 100)
+}
+
+// mos converts an R factor to a mean opinion score, ITU-T G.107 Annex B.
+func mos(r float64) float64 {
+	if r <= 0 {
+		return 1
+	}
+	return min(1+0.035*r+7e-6*r*(r-60)*(100-r), 4.5)
+}
+
+// iceRoundTripTime is the round trip time of the nominated candidate pair
+// from the ICE consent checks.
+func (s *session) iceRoundTripTime() time.Duration {
+	for _, stats := range s.pc.GetStats() {
+		if pair, ok := stats.(webrtc.ICECandidatePairStats); ok && pair.Nominated {
+			return time.Duration(pair.CurrentRoundTripTime * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// scoreSessions updates the quality of every session each qualityInterval
+// until the app is shut down.
+func (app *App) scoreSessions() {
+	ticker := time.NewTicker(qualityInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, s := range app.sessionList() {
+				s.quality.update(now, s.stats.receivedBytes.Load(), s.iceRoundTripTime())
+			}
+		}
+	}
+}
+
+// readReports reads the RTCP the device sends about the downlink, sent
+// with clockRate, for the session quality, -adaptive-bitrate, the loopback
+// delay and the NACK count. It returns true once the device sent BYE.
+func (s *session) readReports(sender *webrtc.RTPSender, clockRate uint32) bool {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Debugw("Stopped reading downlink RTCP", "sessionID", s.id, "error", err)
+			}
+			return false
+		}
+		if isGoodbye(packets) {
+			return true
+		}
+
+		now := time.Now()
+		for _, packet := range packets {
+			if nack, ok := packet.(*rtcp.TransportLayerNack); ok {
+				for _, pair := range nack.Nacks {
+					s.stats.nacked(len(pair.PacketList()))
+				}
+				continue
+			}
+			report, ok := packet.(*rtcp.ReceiverReport)
+			if !ok {
+				continue
+			}
+			for _, block := range report.Reports {
+				s.quality.receiverReport(block, clockRate, now)
+				s.adaptDownlink(block.FractionLost, now)
+				if rtt, ok := roundTripTime(now, block); ok && s.loopback != nil {
+					s.loopback.setRTT(rtt)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// listenHTTP3 serves handler over QUIC on -h3-addr. Clients find it through
+// the Alt-Svc header added to responses on the TLS listeners.
+func (app *App) listenHTTP3(handler http.Handler) error {
+	conn, err := net.ListenPacket(familyNetwork("udp"), h3Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", h3Addr, err)
+	}
+
+	app.h3 = &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{tlsCertificate}}),
+	}
+	log.Infow("Server listening", "network", "quic", "addr", conn.LocalAddr().String())
+
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		if err := app.h3.Serve(conn); err != nil && app.ctx.Err() == nil {
+			log.Errorw("HTTP/3 server error", err)
+		}
+	}()
+	return nil
+}
+
+// advertiseHTTP3 adds the Alt-Svc header pointing at the HTTP/3 listener to
+// responses sent over TLS.
+func (app *App) advertiseHTTP3(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && r.ProtoMajor < 3 {
+			if err := app.h3.SetQUICHeaders(w.Header()); err != nil {
+				log.Debugw("Failed to set Alt-Svc header", "error", err)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidClaim   = errors.New("invalid or expired claim code")
+	errDeviceNotFound = errors.New("device not found")
+	errTargetTaken    = errors.New("room and identity already assigned to another device")
+)
+
+// deviceAssignment is where a paired device joins LiveKit, whatever its
+// connects ask for. Room defaults to -room-name and Identity to the device ID.
+type deviceAssignment struct {
+	Room     string `json:"room,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	// Grants override the grants of the device in -config
+	Grants tokenGrants `json:"grants,omitzero"`
+}
+
+// registeredDevice is a device that has been paired with the bridge.
+type registeredDevice struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	deviceAssignment
+	// CredentialHash is the hex SHA-256 of the credential issued to the
+	// device, the credential itself is never stored
+	CredentialHash string    `json:"credential_hash"`
+	ClaimedAt      time.Time `json:"claimed_at"`
+}
+
+// claim is a one-time code an operator hands to a device for pairing.
+type claim struct {
+	Code string `json:"code"`
+	// DeviceID is the ID the device is registered with once it redeems
+	// the code
+	DeviceID string `json:"device_id"`
+	Name     string `json:"name,omitempty"`
+	deviceAssignment
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// target returns the room and identity of the device with id.
+func (a deviceAssignment) target(id string) (string, string) {
+	room, participantIdentity := a.Room, a.Identity
+	if room == "" {
+		room = roomName
+	}
+	if participantIdentity == "" {
+		participantIdentity = id
+	}
+	return room, participantIdentity
+}
+
+// target returns the room and identity the device joins.
+func (d *registeredDevice) target() (string, string) {
+	return d.deviceAssignment.target(d.ID)
+}
+
+// deviceRegistry holds the paired devices, persisted as JSON to path when
+// one is set. Claim codes are short-lived and only kept in memory.
+type deviceRegistry struct {
+	path string
+
+	mu      sync.Mutex
+	devices map[string]*registeredDevice
+	claims  map[string]*claim
+}
+
+func loadRegistry(path string) (*deviceRegistry, error) {
+	r := &deviceRegistry{
+		path:    path,
+		devices: make(map[string]*registeredDevice),
+		claims:  make(map[string]*claim),
+	}
+	if path == "" {
+		return r, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read registry: %w", err)
+	}
+
+	var devices []*registeredDevice
+	if err := json.Unmarshal(raw, &devices); err != nil {
+		return nil, fmt.Errorf("failed to parse registry: %w", err)
+	}
+	for _, device := range devices {
+		r.devices[device.ID] = device
+	}
+	return r, nil
+}
+
+// save writes the registry to path. Callers hold mu.
+func (r *deviceRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	devices := make([]*registeredDevice, 0, len(r.devices))
+	for _, device := range r.devices {
+		devices = append(devices, device)
+	}
+	raw, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode registry: %w", err)
+	}
+	if err := writeFileAtomic(r.path, raw); err != nil {
+		return fmt.Errorf("failed to write registry: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so a crash never leaves a truncated file. The file is
+// only readable by the user the bridge runs as.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// newClaim generates a claim code valid for ttl, for a device joining
+// with assignment.
+func (r *deviceRegistry) newClaim(name string, assignment deviceAssignment, ttl time.Duration) (*claim, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for code, c := range r.claims {
+		if time.Now().After(c.ExpiresAt) {
+			delete(r.claims, code)
+		}
+	}
+
+	// Short enough to type, rand.Text is upper case base32
+	code := rand.Text()[:8]
+	c := &claim{
+		Code:             code,
+		DeviceID:         rand.Text(),
+		Name:             name,
+		deviceAssignment: assignment,
+		ExpiresAt:        time.Now().Add(ttl),
+	}
+	if r.takenLocked(c.DeviceID, assignment) {
+		return nil, errTargetTaken
+	}
+	r.claims[code] = c
+	return c, nil
+}
+
+// claimed returns the device a valid claim code registers, so its first
+// session already joins where the registry puts it.
+func (r *deviceRegistry) claimed(code string) (*registeredDevice, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.claims[strings.ToUpper(code)]
+	if !ok || time.Now().After(c.ExpiresAt) {
+		return nil, false
+	}
+	return &registeredDevice{ID: c.DeviceID, Name: c.Name, deviceAssignment: c.deviceAssignment}, true
+}
+
+// redeem consumes a claim code and registers a new device. The returned
+// credential is only known to the device from now on.
+func (r *deviceRegistry) redeem(code string) (*registeredDevice, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.claims[strings.ToUpper(code)]
+	if !ok || time.Now().After(c.ExpiresAt) {
+		return nil, "", errInvalidClaim
+	}
+	delete(r.claims, c.Code)
+
+	credential := rand.Text() + rand.Text()
+	device := &registeredDevice{
+		ID:               c.DeviceID,
+		Name:             c.Name,
+		deviceAssignment: c.deviceAssignment,
+		CredentialHash:   hashCredential(credential),
+		ClaimedAt:        time.Now(),
+	}
+	r.devices[device.ID] = device
+
+	if err := r.save(); err != nil {
+		delete(r.devices, device.ID)
+		return nil, "", err
+	}
+	copied := *device
+	return &copied, credential, nil
+}
+
+// authenticate returns the device a credential was issued to.
+func (r *deviceRegistry) authenticate(credential string) (*registeredDevice, bool) {
+	if credential == "" {
+		return nil, false
+	}
+	hash := hashCredential(credential)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, device := range r.devices {
+		if device.CredentialHash == hash {
+			copied := *device
+			return &copied, true
+		}
+	}
+	return nil, false
+}
+
+// assigned returns the device that joins room as participantIdentity.
+func (r *deviceRegistry) assigned(room, participantIdentity string) (*registeredDevice, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, device := range r.devices {
+		if deviceRoom, deviceIdentity := device.target(); deviceRoom == room && deviceIdentity == participantIdentity {
+			copied := *device
+			return &copied, true
+		}
+	}
+	return nil, false
+}
+
+// takenLocked reports if a device other than id, registered or with a
+// pending claim, joins where assignment would. Callers hold mu.
+func (r *deviceRegistry) takenLocked(id string, assignment deviceAssignment) bool {
+	room, participantIdentity := assignment.target(id)
+	for _, device := range r.devices {
+		if deviceRoom, deviceIdentity := device.target(); device.ID != id && deviceRoom == room && deviceIdentity == participantIdentity {
+			return true
+		}
+	}
+	for _, c := range r.claims {
+		if claimRoom, claimIdentity := c.target(c.DeviceID); c.DeviceID != id && claimRoom == room && claimIdentity == participantIdentity {
+			return true
+		}
+	}
+	return false
+}
+
+// paired reports if any device has been paired.
+func (r *deviceRegistry) paired() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.devices) > 0
+}
+
+// list returns the paired devices sorted by ID.
+func (r *deviceRegistry) list() []registeredDevice {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	devices := make([]registeredDevice, 0, len(r.devices))
+	for _, device := range r.devices {
+		devices = append(devices, *device)
+	}
+	slices.SortFunc(devices, func(a, b registeredDevice) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return devices
+}
+
+// get returns the paired device with id.
+func (r *deviceRegistry) get(id string) (*registeredDevice, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, ok := r.devices[id]
+	if !ok {
+		return nil, false
+	}
+	copied := *device
+	return &copied, true
+}
+
+// assign changes where a paired device joins from its next session on.
+func (r *deviceRegistry) assign(id string, assignment deviceAssignment) (*registeredDevice, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, ok := r.devices[id]
+	if !ok {
+		return nil, errDeviceNotFound
+	}
+	if r.takenLocked(id, assignment) {
+		return nil, errTargetTaken
+	}
+
+	previous := device.deviceAssignment
+	device.deviceAssignment = assignment
+	if err := r.save(); err != nil {
+		device.deviceAssignment = previous
+		return nil, err
+	}
+	copied := *device
+	return &copied, nil
+}
+
+// revoke removes a paired device, its credential is rejected from now on.
+func (r *deviceRegistry) revoke(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, ok := r.devices[id]
+	if !ok {
+		return errDeviceNotFound
+	}
+	delete(r.devices, id)
+	if err := r.save(); err != nil {
+		r.devices[id] = device
+		return err
+	}
+	return nil
+}
+
+func hashCredential(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:])
+}
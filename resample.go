@@ -0,0 +1,89 @@
+package main
+
+import "math"
+
+// resamplerTaps is the filter length per input sample of the slower rate,
+// longer filters have a steeper cutoff.
+const resamplerTaps = 16
+
+// resampler converts mono PCM between two sample rates with a polyphase
+// windowed sinc filter. It keeps its state between calls so audio can be
+// fed in frames of any size.
+type resampler struct {
+	// up and down are the interpolation and decimation factors
+	up, down int
+	// phases holds the filter split into up phases
+	phases [][]float64
+	// history is the tail of the previous input, one filter length
+	history []float64
+	// position is the next output sample in the upsampled stream, relative
+	// to the start of the next input
+	position int
+}
+
+func newResampler(from, to int) *resampler {
+	divisor := gcd(from, to)
+	up, down := to/divisor, from/divisor
+
+	// Low pass at the lower of the two Nyquist frequencies, relative to
+	// the upsampled rate
+	length := resamplerTaps * max(up, down)
+	cutoff := 0.5 / float64(max(up, down))
+	center := float64(length-1) / 2
+
+	tapsPerPhase := (length + up - 1) / up
+	phases := make([][]float64, up)
+	for p := range phases {
+		phases[p] = make([]float64, tapsPerPhase)
+	}
+	for i := 0; i < length; i++ {
+		x := float64(i) - center
+		sinc := 2 * cutoff
+		if x != 0 {
+			sinc = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		// Blackman window
+		window := 0.42 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(length-1)) +
+			0.08*math.Cos(4*math.Pi*float64(i)/float64(length-1))
+		phases[i%up][i/up] = sinc * window * float64(up)
+	}
+
+	return &resampler{
+		up:      up,
+		down:    down,
+		phases:  phases,
+		history: make([]float64, tapsPerPhase-1),
+	}
+}
+
+func (r *resampler) resample(in []int16) []int16 {
+	taps := len(r.history) + 1
+	buf := make([]float64, len(r.history), len(r.history)+len(in))
+	copy(buf, r.history)
+	for _, s := range in {
+		buf = append(buf, float64(s))
+	}
+
+	out := make([]int16, 0, len(in)*r.up/r.down+1)
+	for ; r.position/r.up < len(in); r.position += r.down {
+		newest := r.position/r.up + taps - 1
+		filter := r.phases[r.position%r.up]
+
+		var sum float64
+		for k, h := range filter {
+			sum += h * buf[newest-k]
+		}
+		out = append(out, int16(max(math.MinInt16, min(math.MaxInt16, math.Round(sum)))))
+	}
+
+	r.position -= len(in) * r.up
+	copy(r.history, buf[len(buf)-len(r.history):])
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
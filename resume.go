@@ -0,0 +1,151 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/webrtc/v4"
+)
+
+// parkedSession is a session whose device lost its connection, kept with
+// its participants and tracks for -resume-window so a reconnect picks
+// them up without the room seeing the device leave and join.
+type parkedSession struct {
+	s     *session
+	timer *time.Timer
+}
+
+// park keeps the LiveKit side of a closed session for -resume-window, its
+// tracks muted with -mute-on-loss. The session has already been removed.
+func (app *App) park(s *session) {
+	p := s.currentParticipant()
+	key := participantKey(p.roomName, p.identity)
+	if muteOnLoss {
+		s.mu.Lock()
+		publications := slices.Clone(s.publications)
+		s.mu.Unlock()
+		for _, published := range publications {
+			published.setMuted(true)
+		}
+	}
+
+	app.parkedMu.Lock()
+	previous := app.parked[key]
+	parked := &parkedSession{s: s}
+	parked.timer = time.AfterFunc(resumeWindow, func() {
+		app.parkedMu.Lock()
+		if app.parked[key] != parked {
+			app.parkedMu.Unlock()
+			return
+		}
+		delete(app.parked, key)
+		app.parkedMu.Unlock()
+
+		log.Infow("Session not resumed", "sessionID", s.id, "room", p.roomName, "identity", p.identity)
+		app.releaseSession(s)
+	})
+	app.parked[key] = parked
+	app.parkedMu.Unlock()
+
+	if previous != nil && previous.timer.Stop() {
+		app.releaseSession(previous.s)
+	}
+	log.Infow("Session parked for resume", "sessionID", s.id, "window", resumeWindow)
+}
+
+// resume hands the tracks and agent of a parked session of the same
+// device to s, whose participants are the parked ones.
+func (app *App) resume(s *session) {
+	p := s.currentParticipant()
+	key := participantKey(p.roomName, p.identity)
+
+	app.parkedMu.Lock()
+	parked, ok := app.parked[key]
+	if ok && parked.timer.Stop() {
+		delete(app.parked, key)
+	} else {
+		ok = false
+	}
+	app.parkedMu.Unlock()
+	if !ok {
+		return
+	}
+
+	old := parked.s
+	old.mu.Lock()
+	publications := old.publications
+	old.publications = nil
+	agentRoom := old.agentRoom
+	old.agentRoom = ""
+	old.mu.Unlock()
+
+	// Tracks named after the old session can't be picked up again
+	var resumable []publication
+	for _, published := range publications {
+		if !strings.Contains(published.options.Name, old.id) {
+			resumable = append(resumable, published)
+			continue
+		}
+		if err := published.participant.room.LocalParticipant.UnpublishTrack(published.sid); err != nil {
+			log.Errorw("Failed to unpublish track", err, "sessionID", old.id, "trackSID", published.sid)
+		}
+		published.participant.removeRoute(published.sid)
+	}
+
+	s.mu.Lock()
+	s.resumable = resumable
+	if agentRoom != "" && agentRoom == s.participant.roomName && old.agent == s.agent {
+		s.agentRoom = agentRoom
+		agentRoom = ""
+	}
+	s.mu.Unlock()
+
+	if agentRoom != "" {
+		app.dispatcher.release(agentRoom, old.agent)
+	}
+	app.releaseParticipants(append(old.fanOut, old.currentParticipant()))
+	log.Infow("Session resumed", "sessionID", s.id, "previousSessionID", old.id, "tracks", len(resumable))
+}
+
+// adoptPublication returns the track of a resumed session published in the
+// room of p with options, now owned by s.
+func (s *session) adoptPublication(p *participant, codec webrtc.RTPCodecCapability, options *lksdk.TrackPublicationOptions) *lksdk.LocalTrack {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, published := range s.resumable {
+		if published.participant != p || published.options.Name != options.Name ||
+			!strings.EqualFold(published.track.Codec().MimeType, codec.MimeType) {
+			continue
+		}
+		s.resumable = slices.Delete(s.resumable, i, i+1)
+		s.publications = append(s.publications, published)
+		if muteOnLoss {
+			published.setMuted(false)
+		}
+		log.Infow("Resumed session track", "sessionID", s.id, "room", p.roomName, "trackSID", published.sid, "name", options.Name)
+		return published.track
+	}
+	return nil
+}
+
+// releaseSession unpublishes the tracks of a closed session and releases
+// its agent and participants.
+func (app *App) releaseSession(s *session) {
+	app.unpublishSessionTracks(s)
+	app.undispatchAgent(s)
+	app.releaseParticipants(append(s.fanOut, s.currentParticipant()))
+}
+
+// setMuted marks a published track muted in its room, so a device that
+// lost its connection shows as muted rather than silent.
+func (published publication) setMuted(muted bool) {
+	for _, track := range published.participant.room.LocalParticipant.TrackPublications() {
+		if local, ok := track.(*lksdk.LocalTrackPublication); ok && local.SID() == published.sid {
+			local.SetMuted(muted)
+			return
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// rewriteMaxDropout and rewriteMaxMisorder are how far the sequence
+	// number of a stream may jump ahead or back before it is taken as a
+	// new stream, as in RFC 3550 appendix A.1
+	rewriteMaxDropout  = 3000
+	rewriteMaxMisorder = 100
+	// rewriteMaxGap caps the time a rewritten stream skips ahead of the
+	// one before
+	rewriteMaxGap = time.Minute
+)
+
+// switchedLocked reports whether p starts a different stream than the one
+// written last, another SSRC or the same one restarted. The first stream
+// after packets the bridge inserted, e.g. an announcement, continues them.
+func (t *eventTrack) switchedLocked(p *rtp.Packet) bool {
+	if !t.started {
+		return false
+	}
+	if p.SSRC != t.source {
+		return true
+	}
+	delta := p.SequenceNumber - t.lastSequence
+	return delta > rewriteMaxDropout && delta < 1<<16-rewriteMaxMisorder
+}
+
+// rebaseLocked continues the stream sent with p, the first packet of a new
+// one written at now. Its sequence number follows the packet sent last and
+// its timestamp the time passed since, at least a frame.
+func (t *eventTrack) rebaseLocked(p *rtp.Packet, now time.Time) {
+	clockRate := t.Codec().ClockRate
+	elapsed := uint32(min(now.Sub(t.writtenAt), rewriteMaxGap) * time.Duration(clockRate) / time.Second)
+	timestamp := t.timestamp + t.tsOffset + max(elapsed, clockRate/50)
+
+	t.seqOffset = t.sequence + 1 - p.SequenceNumber
+	t.tsOffset = timestamp - p.Timestamp
+	log.Debugw("Rewrote downlink stream switch", "streamID", t.StreamID(), "from", t.source, "to", p.SSRC)
+}
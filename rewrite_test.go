@@ -0,0 +1,197 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/livekit/protocol/logger"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestEventTrackSwitched(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		started      bool
+		lastSequence uint16
+		ssrc         uint32
+		sequence     uint16
+		want         bool
+	}{
+		{name: "first packet", ssrc: 2, sequence: 500},
+		{name: "next packet", started: true, lastSequence: 10, ssrc: 1, sequence: 11},
+		{name: "sequence wrap", started: true, lastSequence: 65535, ssrc: 1, sequence: 0},
+		{name: "other ssrc", started: true, lastSequence: 10, ssrc: 2, sequence: 11, want: true},
+		{name: "largest dropout", started: true, lastSequence: 10, ssrc: 1, sequence: 10 + rewriteMaxDropout},
+		{name: "restarted ahead", started: true, lastSequence: 10, ssrc: 1, sequence: 11 + rewriteMaxDropout, want: true},
+		{name: "dropout across wrap", started: true, lastSequence: 65000, ssrc: 1, sequence: 65000 + rewriteMaxDropout - 1<<16},
+		{name: "largest misorder", started: true, lastSequence: 10, ssrc: 1, sequence: 1<<16 + 10 - rewriteMaxMisorder},
+		{name: "restarted behind", started: true, lastSequence: 10, ssrc: 1, sequence: 1<<16 + 9 - rewriteMaxMisorder, want: true},
+		{name: "duplicate", started: true, lastSequence: 10, ssrc: 1, sequence: 10},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			track := newTestEventTrack(t)
+			track.started, track.source, track.lastSequence = test.started, 1, test.lastSequence
+
+			p := &rtp.Packet{Header: rtp.Header{SSRC: test.ssrc, SequenceNumber: test.sequence}}
+			if got := track.switchedLocked(p); got != test.want {
+				t.Errorf("switchedLocked() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEventTrackRebase(t *testing.T) {
+	writtenAt := time.Now()
+
+	for _, test := range []struct {
+		name               string
+		sequence           uint16
+		timestamp          uint32
+		tsOffset           uint32
+		elapsed            time.Duration
+		packetSequence     uint16
+		packetTimestamp    uint32
+		wantSequence       uint16
+		wantTimestampAfter uint32
+	}{
+		{
+			name:     "at least a frame",
+			sequence: 100, timestamp: 48000, elapsed: time.Millisecond,
+			packetSequence: 7, packetTimestamp: 123456,
+			wantSequence: 101, wantTimestampAfter: 960,
+		},
+		{
+			name:     "time passed",
+			sequence: 100, timestamp: 48000, tsOffset: 1000, elapsed: 500 * time.Millisecond,
+			packetSequence: 60000, packetTimestamp: 5,
+			wantSequence: 101, wantTimestampAfter: 24000,
+		},
+		{
+			name:     "gap is capped",
+			sequence: 100, timestamp: 48000, elapsed: time.Hour,
+			packetSequence: 7, packetTimestamp: 123456,
+			wantSequence: 101, wantTimestampAfter: uint32(rewriteMaxGap / time.Second * 48000),
+		},
+		{
+			name:     "wraps",
+			sequence: 65535, timestamp: 1<<32 - 480, elapsed: 20 * time.Millisecond,
+			packetSequence: 3000, packetTimestamp: 1 << 31,
+			wantSequence: 0, wantTimestampAfter: 960,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			track := newTestEventTrack(t)
+			track.sequence, track.timestamp, track.tsOffset, track.writtenAt = test.sequence, test.timestamp, test.tsOffset, writtenAt
+
+			p := &rtp.Packet{Header: rtp.Header{SequenceNumber: test.packetSequence, Timestamp: test.packetTimestamp}}
+			track.rebaseLocked(p, writtenAt.Add(test.elapsed))
+
+			if sequence := p.SequenceNumber + track.seqOffset; sequence != test.wantSequence {
+				t.Errorf("sequence = %d, want %d", sequence, test.wantSequence)
+			}
+			if advanced := p.Timestamp + track.tsOffset - (test.timestamp + test.tsOffset); advanced != test.wantTimestampAfter {
+				t.Errorf("timestamp advanced %d, want %d", advanced, test.wantTimestampAfter)
+			}
+		})
+	}
+}
+
+func TestEventTrackWriteRTP(t *testing.T) {
+	track := newTestEventTrack(t)
+	sent := &testRTPWriter{}
+	if _, err := track.Bind(testTrackLocalContext{writer: sent}); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(ssrc uint32, sequence uint16, timestamp uint32) rtp.Header {
+		t.Helper()
+		p := &rtp.Packet{Header: rtp.Header{SSRC: ssrc, SequenceNumber: sequence, Timestamp: timestamp}}
+		if err := track.WriteRTP(p); err != nil {
+			t.Fatal(err)
+		}
+		return sent.headers[len(sent.headers)-1]
+	}
+
+	// The first stream is sent as is, across the sequence number wrap
+	for i, sequence := range []uint16{65534, 65535, 0} {
+		if h := write(1, sequence, 1000+uint32(i)*960); h.SequenceNumber != sequence || h.Timestamp != 1000+uint32(i)*960 || h.Marker {
+			t.Fatalf("packet %d sent as %d/%d, want it unchanged", i, h.SequenceNumber, h.Timestamp)
+		}
+	}
+
+	// A new SSRC continues it
+	h := write(2, 40000, 7)
+	if h.SequenceNumber != 1 || !h.Marker {
+		t.Errorf("switched stream sent as %d marker %v, want 1 with the marker", h.SequenceNumber, h.Marker)
+	}
+	if advanced := h.Timestamp - (1000 + 2*960); advanced < 960 || advanced > 48000 {
+		t.Errorf("switched stream timestamp advanced %d, want about a frame", advanced)
+	}
+	switchedTimestamp := h.Timestamp
+
+	// Reordered packets of the new stream keep their place
+	if h = write(2, 40002, 7+2*960); h.SequenceNumber != 3 || h.Timestamp != switchedTimestamp+2*960 {
+		t.Errorf("packet sent as %d/%d, want 3/%d", h.SequenceNumber, h.Timestamp, switchedTimestamp+2*960)
+	}
+	if h = write(2, 40001, 7+960); h.SequenceNumber != 2 || h.Timestamp != switchedTimestamp+960 {
+		t.Errorf("reordered packet sent as %d/%d, want 2/%d", h.SequenceNumber, h.Timestamp, switchedTimestamp+960)
+	}
+
+	// The same SSRC restarting far ahead is a new stream too, it follows
+	// the newest packet rather than the reordered one
+	if h = write(2, 40002+rewriteMaxDropout+1, 0); h.SequenceNumber != 4 || !h.Marker {
+		t.Errorf("restarted stream sent as %d marker %v, want 4 with the marker", h.SequenceNumber, h.Marker)
+	}
+	if h.Timestamp-(switchedTimestamp+2*960) < 960 {
+		t.Errorf("restarted stream timestamp %d doesn't follow %d", h.Timestamp, switchedTimestamp+2*960)
+	}
+}
+
+func newTestEventTrack(t *testing.T) *eventTrack {
+	t.Helper()
+	log = logger.GetLogger()
+	track, err := newEventTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: opusClockRate, Channels: 2}, "audio", "bridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return track
+}
+
+type testTrackLocalContext struct {
+	writer webrtc.TrackLocalWriter
+}
+
+func (testTrackLocalContext) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: opusClockRate, Channels: 2},
+		PayloadType:        111,
+	}}
+}
+
+func (testTrackLocalContext) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter { return nil }
+func (testTrackLocalContext) SSRC() webrtc.SSRC                                      { return 1234 }
+func (testTrackLocalContext) SSRCRetransmission() webrtc.SSRC                        { return 0 }
+func (testTrackLocalContext) SSRCForwardErrorCorrection() webrtc.SSRC                { return 0 }
+func (c testTrackLocalContext) WriteStream() webrtc.TrackLocalWriter                 { return c.writer }
+func (testTrackLocalContext) ID() string                                             { return "test" }
+func (testTrackLocalContext) RTCPReader() interceptor.RTCPReader                     { return nil }
+
+// testRTPWriter records the headers of the packets a track sends.
+type testRTPWriter struct {
+	headers []rtp.Header
+}
+
+func (w *testRTPWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.headers = append(w.headers, *header)
+	return len(payload), nil
+}
+
+func (w *testRTPWriter) Write(b []byte) (int, error) {
+	p := &rtp.Packet{}
+	if err := p.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return w.WriteRTP(&p.Header, p.Payload)
+}
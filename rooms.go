@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/livekit/protocol/livekit"
+)
+
+// roomServiceTimeout bounds the RoomService API calls.
+const roomServiceTimeout = 5 * time.Second
+
+// ensureRoom creates room with the -room-* options when it doesn't exist
+// yet, rooms already open are left as they are.
+func (app *App) ensureRoom(room string) error {
+	ctx, cancel := context.WithTimeout(app.ctx, roomServiceTimeout)
+	defer cancel()
+
+	rooms, err := app.roomService.ListRooms(ctx, &livekit.ListRoomsRequest{Names: []string{room}})
+	if err != nil {
+		return fmt.Errorf("failed to list rooms: %w", err)
+	}
+	if len(rooms.Rooms) > 0 {
+		return nil
+	}
+
+	if _, err := app.roomService.CreateRoom(ctx, &livekit.CreateRoomRequest{
+		Name:            room,
+		EmptyTimeout:    uint32(roomEmptyTimeout / time.Second),
+		MaxParticipants: uint32(roomMaxParticipants),
+		Metadata:        roomMetadata,
+	}); err != nil {
+		return fmt.Errorf("failed to create room: %w", err)
+	}
+	log.Infow("Created room", "room", room, "emptyTimeout", roomEmptyTimeout, "maxParticipants", roomMaxParticipants)
+	return nil
+}
+
+// scheduleRoomCleanup deletes room after -delete-rooms-after unless a
+// device joins it again meanwhile. The caller holds participantsMu.
+func (app *App) scheduleRoomCleanup(room string) {
+	if deleteRoomsAfter <= 0 {
+		return
+	}
+	for _, p := range app.participants {
+		if p.roomName == room {
+			return
+		}
+	}
+	for _, join := range app.joins {
+		if join.roomName == room {
+			return
+		}
+	}
+
+	if timer, ok := app.roomCleanups[room]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(deleteRoomsAfter, func() {
+		app.participantsMu.Lock()
+		if app.roomCleanups[room] != timer {
+			app.participantsMu.Unlock()
+			return
+		}
+		delete(app.roomCleanups, room)
+		app.participantsMu.Unlock()
+
+		if err := app.deleteEmptyRoom(room); err != nil {
+			log.Errorw("Failed to delete room", err, "room", room)
+		}
+	})
+	app.roomCleanups[room] = timer
+}
+
+// cancelRoomCleanup keeps room open as a device joins it. The caller holds
+// participantsMu.
+func (app *App) cancelRoomCleanup(room string) {
+	if timer, ok := app.roomCleanups[room]; ok {
+		timer.Stop()
+		delete(app.roomCleanups, room)
+	}
+}
+
+// deleteEmptyRoom deletes room unless someone else joined it.
+func (app *App) deleteEmptyRoom(room string) error {
+	if app.ctx.Err() != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(app.ctx, roomServiceTimeout)
+	defer cancel()
+
+	participants, err := app.roomService.ListParticipants(ctx, &livekit.ListParticipantsRequest{Room: room})
+	if err != nil {
+		return fmt.Errorf("failed to list participants: %w", err)
+	}
+	if len(participants.Participants) > 0 {
+		log.Debugw("Kept room with participants", "room", room, "participants", len(participants.Participants))
+		return nil
+	}
+
+	if _, err := app.roomService.DeleteRoom(ctx, &livekit.DeleteRoomRequest{Room: room}); err != nil {
+		return fmt.Errorf("failed to delete room: %w", err)
+	}
+	log.Infow("Deleted empty room", "room", room)
+	return nil
+}
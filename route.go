@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/livekit/protocol/livekit"
+)
+
+// routeRequest is the body of the route resource, the identity of the
+// only participant allowed to hear the session. Empty routes it to the
+// whole room.
+type routeRequest struct {
+	Identity string `json:"identity"`
+}
+
+// setRoute records who may subscribe to track sid, everyone for an empty
+// identity.
+func (p *participant) setRoute(sid, identity string) {
+	p.mu.Lock()
+	p.routes[sid] = identity
+	p.mu.Unlock()
+	p.updatePermissions()
+}
+
+func (p *participant) removeRoute(sid string) {
+	p.mu.Lock()
+	_, ok := p.routes[sid]
+	delete(p.routes, sid)
+	p.mu.Unlock()
+	if ok {
+		p.updatePermissions()
+	}
+}
+
+// updatePermissions sets who may subscribe to the tracks p publishes.
+// Tracks routed to one participant are only open to it, the rest to
+// everyone in the room.
+func (p *participant) updatePermissions() {
+	if standalone() {
+		return
+	}
+
+	var open []string
+	routed := make(map[string][]string)
+	p.mu.Lock()
+	for sid, identity := range p.routes {
+		if identity == "" {
+			open = append(open, sid)
+		} else {
+			routed[identity] = append(routed[identity], sid)
+		}
+	}
+	p.mu.Unlock()
+
+	if len(routed) == 0 {
+		p.room.LocalParticipant.SetSubscriptionPermission(&livekit.SubscriptionPermission{AllParticipants: true})
+		return
+	}
+
+	// Participants are listed by identity, those joining later are added
+	// as they connect
+	identities := make(map[string]bool)
+	for identity := range routed {
+		identities[identity] = true
+	}
+	for _, rp := range p.room.GetRemoteParticipants() {
+		identities[rp.Identity()] = true
+	}
+
+	permission := &livekit.SubscriptionPermission{}
+	for identity := range identities {
+		permission.TrackPermissions = append(permission.TrackPermissions, &livekit.TrackPermission{
+			ParticipantIdentity: identity,
+			TrackSids:           append(slices.Clone(open), routed[identity]...),
+		})
+	}
+	p.room.LocalParticipant.SetSubscriptionPermission(permission)
+	log.Debugw("Updated subscription permissions", "room", p.roomName, "identity", p.identity, "routed", len(routed))
+}
+
+// onParticipantConnected lets a participant joining the room subscribe to
+// the tracks open to everyone.
+func (p *participant) onParticipantConnected() {
+	routed := false
+	p.mu.Lock()
+	for _, identity := range p.routes {
+		routed = routed || identity != ""
+	}
+	p.mu.Unlock()
+
+	if routed {
+		p.updatePermissions()
+	}
+}
+
+// setRouteTo delivers the tracks of the session only to identity, or to
+// everyone when empty.
+func (s *session) setRouteTo(identity string) {
+	s.mu.Lock()
+	s.routeTo = identity
+	publications := slices.Clone(s.publications)
+	s.mu.Unlock()
+
+	for _, published := range publications {
+		published.participant.setRoute(published.sid, identity)
+	}
+	log.Infow("Routed session audio", "sessionID", s.id, "identity", identity)
+}
+
+// routeHandler routes the audio of a session to a single participant with
+// PUT and back to the whole room with DELETE.
+func (app *App) routeHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	var req routeRequest
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		req.Identity = s.routeTo
+		s.mu.Unlock()
+	case http.MethodPut:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		s.setRouteTo(req.Identity)
+	case http.MethodDelete:
+		s.setRouteTo("")
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(req); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/webrtc/v4"
+)
+
+// rpcDataChannel is the label of the data channel a device answers RPCs
+// from the room on.
+const rpcDataChannel = "rpc"
+
+// rpcRequest is sent to the device for every call of an -rpc-methods
+// method on its participant.
+type rpcRequest struct {
+	ID      string `json:"id"`
+	Method  string `json:"method"`
+	Caller  string `json:"caller"`
+	Payload string `json:"payload"`
+}
+
+// rpcResponse is what the device answers a request with, Error fails the
+// call with that message.
+type rpcResponse struct {
+	ID      string `json:"id"`
+	Payload string `json:"payload"`
+	Error   string `json:"error,omitempty"`
+}
+
+// rpcChannel is the rpc data channel of a session with the calls waiting
+// for an answer.
+type rpcChannel struct {
+	dc *webrtc.DataChannel
+
+	mu      sync.Mutex
+	pending map[string]chan rpcResponse
+}
+
+// registerRPCMethods lets room participants call the -rpc-methods on p,
+// answered by the device.
+func (app *App) registerRPCMethods(p *participant) error {
+	for _, method := range strings.Split(rpcMethods, ",") {
+		method = strings.TrimSpace(method)
+		if method == "" {
+			continue
+		}
+		if err := p.room.RegisterRpcMethod(method, func(data lksdk.RpcInvocationData) (string, error) {
+			return app.callDevice(p, method, data)
+		}); err != nil {
+			return fmt.Errorf("failed to register rpc method %q: %w", method, err)
+		}
+	}
+	return nil
+}
+
+// callDevice forwards an RPC to the first device of p with an open rpc
+// data channel and waits for its answer.
+func (app *App) callDevice(p *participant, method string, data lksdk.RpcInvocationData) (string, error) {
+	var channel *rpcChannel
+	app.sessionsMu.RLock()
+	for _, s := range app.sessions {
+		if s.currentParticipant() != p {
+			continue
+		}
+		s.mu.Lock()
+		channel = s.rpc
+		s.mu.Unlock()
+		if channel != nil {
+			break
+		}
+	}
+	app.sessionsMu.RUnlock()
+
+	if channel == nil {
+		return "", lksdk.NewRpcError(lksdk.RpcRecipientDisconnected, "device has no rpc data channel open", nil)
+	}
+
+	response, err := channel.call(rpcRequest{ID: data.RequestID, Method: method, Caller: data.CallerIdentity, Payload: data.Payload}, data.ResponseTimeout)
+	if err != nil {
+		return "", err
+	}
+	if response.Error != "" {
+		return "", lksdk.NewRpcError(lksdk.RpcApplicationError, response.Error, nil)
+	}
+	return response.Payload, nil
+}
+
+func (c *rpcChannel) call(req rpcRequest, timeout time.Duration) (rpcResponse, error) {
+	message, err := json.Marshal(req)
+	if err != nil {
+		return rpcResponse{}, fmt.Errorf("failed to encode rpc request: %w", err)
+	}
+
+	answer := make(chan rpcResponse, 1)
+	c.mu.Lock()
+	c.pending[req.ID] = answer
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+	}()
+
+	if err := c.dc.SendText(string(message)); err != nil {
+		return rpcResponse{}, lksdk.NewRpcError(lksdk.RpcSendFailed, err.Error(), nil)
+	}
+
+	select {
+	case response := <-answer:
+		return response, nil
+	case <-time.After(timeout):
+		return rpcResponse{}, lksdk.NewRpcError(lksdk.RpcResponseTimeout, fmt.Sprintf("device didn't answer within %s", timeout), nil)
+	}
+}
+
+// onRPCDataChannel passes the answers the device sends to the calls
+// waiting for them.
+func (app *App) onRPCDataChannel(s *session, dc *webrtc.DataChannel) {
+	channel := &rpcChannel{dc: dc, pending: make(map[string]chan rpcResponse)}
+
+	dc.OnOpen(func() {
+		s.mu.Lock()
+		s.rpc = channel
+		s.mu.Unlock()
+	})
+
+	dc.OnClose(func() {
+		s.mu.Lock()
+		if s.rpc == channel {
+			s.rpc = nil
+		}
+		s.mu.Unlock()
+	})
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var response rpcResponse
+		if err := json.Unmarshal(msg.Data, &response); err != nil {
+			log.Errorw("Failed to decode rpc response", err, "sessionID", s.id)
+			return
+		}
+
+		channel.mu.Lock()
+		answer, ok := channel.pending[response.ID]
+		channel.mu.Unlock()
+		if !ok {
+			log.Debugw("Dropped rpc response without a waiting call", "sessionID", s.id, "id", response.ID)
+			return
+		}
+		select {
+		case answer <- response:
+		default:
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/rtp"
+)
+
+// subscriptionSelector picks the remote participant whose audio a session
+// hears instead of every subscribed track. All set conditions must match.
+type subscriptionSelector struct {
+	// Identity is a glob pattern of the participant identity
+	Identity string `json:"identity,omitempty" yaml:"identity"`
+	// NamePrefix matches the start of the participant name
+	NamePrefix string `json:"name_prefix,omitempty" yaml:"name_prefix"`
+	// Attribute is key=value, matching participants with that attribute
+	Attribute string `json:"attribute,omitempty" yaml:"attribute"`
+	// Track is a glob pattern of the published track name
+	Track string `json:"track,omitempty" yaml:"track"`
+}
+
+// subscribedTrack is an Opus track the participant is subscribed to.
+type subscribedTrack struct {
+	sid    string
+	name   string
+	remote *lksdk.RemoteParticipant
+}
+
+// selectiveSink receives the audio of the track its selector chose.
+type selectiveSink struct {
+	selector *subscriptionSelector
+	deliver  func(p *rtp.Packet, inserted bool)
+	// selected is the SID of the track forwarded, empty while nothing
+	// matches
+	selected string
+}
+
+func (sel *subscriptionSelector) validate() error {
+	if sel == nil {
+		return nil
+	}
+	if sel.Identity == "" && sel.NamePrefix == "" && sel.Attribute == "" && sel.Track == "" {
+		return fmt.Errorf("subscribe needs identity, name_prefix, attribute or track")
+	}
+	if _, err := path.Match(sel.Identity, ""); err != nil {
+		return fmt.Errorf("invalid subscribe identity %q: %w", sel.Identity, err)
+	}
+	if _, err := path.Match(sel.Track, ""); err != nil {
+		return fmt.Errorf("invalid subscribe track %q: %w", sel.Track, err)
+	}
+	if sel.Attribute != "" && !strings.Contains(sel.Attribute, "=") {
+		return fmt.Errorf("subscribe attribute must be key=value")
+	}
+	return nil
+}
+
+func (sel *subscriptionSelector) matches(track subscribedTrack) bool {
+	rp := track.remote
+	if sel.Track != "" {
+		if ok, _ := path.Match(sel.Track, track.name); !ok {
+			return false
+		}
+	}
+	if sel.Identity != "" {
+		if ok, _ := path.Match(sel.Identity, rp.Identity()); !ok {
+			return false
+		}
+	}
+	if !strings.HasPrefix(rp.Name(), sel.NamePrefix) {
+		return false
+	}
+	if key, value, ok := strings.Cut(sel.Attribute, "="); ok && rp.Attributes()[key] != value {
+		return false
+	}
+	return true
+}
+
+// attachDownlink feeds the downlink of the session from p, with a track
+// per slot, the track its selector picks or everything p receives.
+func (s *session) attachDownlink(p *participant) {
+	if s.slots != nil {
+		p.addMultiSink(s.id, s.selector, s.slots)
+	} else if s.selector != nil {
+		p.addSelectiveSink(s.id, s.selector, s.downlinkSink)
+	} else {
+		p.addSink(s.id, s.downlinkSink)
+	}
+}
+
+// addSelectiveSink feeds deliver with the audio of the first subscribed
+// track selector matches, re-selecting as participants come and go.
+func (p *participant) addSelectiveSink(sessionID string, selector *subscriptionSelector, deliver func(p *rtp.Packet, inserted bool)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.selective[sessionID] = &selectiveSink{selector: selector, deliver: deliver}
+	p.reselectLocked()
+}
+
+// addTrack records a subscribed Opus track for selective sinks.
+func (p *participant) addTrack(sid, name string, rp *lksdk.RemoteParticipant) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tracks = append(p.tracks, subscribedTrack{sid: sid, name: name, remote: rp})
+	p.reselectLocked()
+	p.reassignLocked()
+}
+
+func (p *participant) removeTrack(sid string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, track := range p.tracks {
+		if track.sid == sid {
+			p.tracks = append(p.tracks[:i], p.tracks[i+1:]...)
+			break
+		}
+	}
+	p.reselectLocked()
+	p.reassignLocked()
+}
+
+// reselect picks the tracks again, e.g. after attributes changed.
+func (p *participant) reselect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.reselectLocked()
+	p.reassignLocked()
+}
+
+// reselectLocked keeps the selected track of every selective sink while it
+// still matches, otherwise it picks the first matching one.
+func (p *participant) reselectLocked() {
+	for sessionID, sink := range p.selective {
+		selected := ""
+		for _, track := range p.tracks {
+			if !sink.selector.matches(track) {
+				continue
+			}
+			if track.sid == sink.selected {
+				selected = track.sid
+				break
+			}
+			if selected == "" {
+				selected = track.sid
+			}
+		}
+
+		if selected != sink.selected {
+			sink.selected = selected
+			log.Infow("Selected downlink track", "sessionID", sessionID, "room", p.roomName, "trackSID", selected)
+		}
+	}
+}
+
+// forwardSelected sends a packet of track sid to the selective sinks that
+// selected it.
+func (p *participant) forwardSelected(sid string, rtpPacket *rtp.Packet) {
+	p.mu.Lock()
+	var delivers []func(p *rtp.Packet, inserted bool)
+	for _, sink := range p.selective {
+		if sink.selected == sid {
+			delivers = append(delivers, sink.deliver)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, deliver := range delivers {
+		deliver(rtpPacket, false)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"go.bug.st/serial"
+)
+
+// serialSignaling exchanges offers and answers with a single device over a
+// serial port. Every frame is a 2 byte big endian length followed by the
+// payload, an empty answer frame means the offer was rejected. Media still
+// flows over the device's network interface.
+type serialSignaling struct {
+	app  *App
+	port serial.Port
+
+	// sessionID is the session created by the last offer, a new offer
+	// replaces it since the device has rebooted
+	sessionID string
+}
+
+func (app *App) openSerial() error {
+	port, err := serial.Open(serialPort, &serial.Mode{BaudRate: serialBaud})
+	if err != nil {
+		return fmt.Errorf("failed to open serial port: %w", err)
+	}
+
+	app.serial = &serialSignaling{app: app, port: port}
+	log.Infow("Serial signaling started", "port", serialPort, "baud", serialBaud)
+	return nil
+}
+
+func (s *serialSignaling) serve() {
+	reader := bufio.NewReader(s.port)
+	for {
+		offer, err := readSerialFrame(reader)
+		if err != nil {
+			if s.app.ctx.Err() == nil {
+				log.Errorw("Failed to read serial frame", err)
+			}
+			return
+		}
+
+		if s.sessionID != "" {
+			s.app.closeSession(s.sessionID)
+			s.sessionID = ""
+		}
+
+		var answer string
+		if session, err := s.app.createSession(sessionRequest{Offer: string(offer)}); err != nil {
+			log.Errorw("Failed to create session over serial", err)
+		} else {
+			s.sessionID = session.id
+			answer = session.answer()
+			log.Infow("Successfully handled serial offer", "sessionID", session.id)
+		}
+
+		if err := writeSerialFrame(s.port, []byte(answer)); err != nil {
+			log.Errorw("Failed to write serial frame", err)
+			return
+		}
+	}
+}
+
+func (s *serialSignaling) close() error {
+	return s.port.Close()
+}
+
+func readSerialFrame(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func writeSerialFrame(w io.Writer, payload []byte) error {
+	if len(payload) > 0xFFFF {
+		return fmt.Errorf("frame of %d bytes does not fit the length prefix", len(payload))
+	}
+
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(payload)), uint16(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/livekit/protocol/livekit"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	errInvalidOffer = errors.New("invalid offer")
+	errShuttingDown = errors.New("server shutting down")
+)
+
+// session is a single device connection negotiated over WHIP. It is
+// addressed by the resource URL returned in the Location header.
+type session struct {
+	id string
+	pc *webrtc.PeerConnection
+	// participant is changed by move under mu, read it with
+	// currentParticipant
+	participant *participant
+	createdAt   time.Time
+
+	// templated is the identity -identity-template gave the device, before
+	// any suffix, empty when the identity isn't templated
+	templated string
+	// deviceID is the paired device that created the session, empty when
+	// it connected with a static token or without one
+	deviceID string
+
+	// negotiationMu serializes offer/answer exchanges on pc
+	negotiationMu sync.Mutex
+
+	// monitorTrack carries the device uplink to WHEP viewers
+	monitorTrack *webrtc.TrackLocalStaticRTP
+	viewers      map[string]*webrtc.PeerConnection
+	viewersMu    sync.Mutex
+
+	// dataOnly sessions only carry data channels, no audio is sent to
+	// the device
+	dataOnly bool
+	// downlink is the track carrying LiveKit audio to the device, nil
+	// for data only sessions
+	downlink *eventTrack
+	// downlinkSender sends downlink, downlinkSink feeds it from the
+	// participant when it isn't the participant's own track
+	downlinkSender *webrtc.RTPSender
+	downlinkSink   func(p *rtp.Packet, inserted bool)
+	// slots are the downlink tracks with -multi-downlink, one per remote
+	// participant
+	slots []*eventTrack
+	// jitter paces the downlink with -jitter-buffer
+	jitter *jitterBuffer
+	// player plays announcements on the downlink with -announcements
+	player *player
+	// bitrate adapts the Opus the bridge encodes for the downlink with
+	// -adaptive-bitrate, following estimator with -twcc
+	bitrate   *downlinkBitrate
+	estimator cc.BandwidthEstimator
+	// loopback sends the device audio back to it with -loopback
+	loopback *loopback
+	// stats counts the media of the session, quality scores its network
+	// and drift the clock of the device
+	stats   sessionStats
+	quality connectionQuality
+	drift   clockDrift
+	// pttReleased drops the device audio while push-to-talk is released
+	pttReleased atomic.Bool
+	// fanOut are the participants in other rooms the session audio is
+	// also published to
+	fanOut []*participant
+	// encoder tunes the Opus encoder when the bridge encodes device audio
+	encoder encoderSettings
+	// opusFmtp is merged into the Opus fmtp lines of every answer
+	opusFmtp string
+	// stereo is how stereo audio from the device is published, empty
+	// for mono
+	stereo string
+	// plc conceals lost Opus packets from the device
+	plc bool
+	// groups are the announcement and paging groups of the device,
+	// guarded by mu once the session was added
+	groups []string
+	// selector picks the remote participant the device hears, nil for
+	// everything subscribed
+	selector *subscriptionSelector
+	// trackName and trackSource are what the embedded track of the
+	// session is published as
+	trackName   string
+	trackSource livekit.TrackSource
+	// dataTopics are the glob patterns of the data message topics sent
+	// to the device, all when empty
+	dataTopics string
+	// dataLimiter limits the data messages the device publishes
+	dataLimiter *rateLimiter
+	// agent is dispatched into the room of the session with -agent-name
+	agent string
+
+	// mjpegMu guards mjpeg, the transcoder of a camera board sending
+	// MJPEG
+	mjpegMu sync.Mutex
+	mjpeg   *mjpegTranscoder
+
+	mu             sync.Mutex
+	primaryAudio   bool
+	gainDB         float64
+	level          *uint8
+	targetLUFS     *float64
+	publications   []publication
+	stateListeners []func(webrtc.ICEConnectionState)
+	dataChannels   []*webrtc.DataChannel
+	// resumable are the tracks of the session this one resumed, until
+	// it publishes them again
+	resumable []publication
+	// rpc is the open rpc data channel with -rpc-methods
+	rpc *rpcChannel
+	// agentRoom is where the agent was dispatched, agentClosed is set
+	// once the session closed
+	agentRoom   string
+	agentClosed bool
+	// intercomRoom is the room of the intercom the session is in
+	intercomRoom string
+	// pager mutes the audio from LiveKit while the device is paged
+	pager *pageGate
+	// routeTo is the only participant allowed to subscribe to the tracks
+	// of the session, anyone in the room when empty
+	routeTo string
+
+	// attributes are set on the participant, attributesChanged until
+	// they were sent
+	attributes        map[string]string
+	attributesChanged bool
+
+	// localCandidates are the bridge's gathered candidates, candidatesChanged
+	// is closed and replaced whenever one is added
+	localCandidates   []string
+	gatheringDone     bool
+	candidatesChanged chan struct{}
+}
+
+func newSession(pc *webrtc.PeerConnection, p *participant) (*session, error) {
+	id := rand.Text()
+	monitorTrack, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus},
+		"audio", id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create monitor track: %w", err)
+	}
+
+	return &session{
+		id:           id,
+		pc:           pc,
+		participant:  p,
+		createdAt:    time.Now(),
+		monitorTrack: monitorTrack,
+		viewers:      make(map[string]*webrtc.PeerConnection),
+
+		candidatesChanged: make(chan struct{}),
+	}, nil
+}
+
+// connected reports if ICE is connected to the device.
+func (s *session) connected() bool {
+	switch s.pc.ICEConnectionState() {
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		return true
+	default:
+		return false
+	}
+}
+
+func (app *App) addSession(s *session) {
+	app.sessionsMu.Lock()
+	defer app.sessionsMu.Unlock()
+
+	app.sessions[s.id] = s
+}
+
+func (app *App) getSession(id string) (*session, bool) {
+	app.sessionsMu.RLock()
+	defer app.sessionsMu.RUnlock()
+
+	s, ok := app.sessions[id]
+	return s, ok
+}
+
+// currentParticipant returns the participant the session joins LiveKit
+// as, it changes when the session moves.
+func (s *session) currentParticipant() *participant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.participant
+}
+
+// ownedBy reports if device may signal on the session. A paired device
+// only reaches its own sessions, requests without one, nil, reach all.
+func (s *session) ownedBy(device *registeredDevice) bool {
+	return device == nil || device.ID == s.deviceID
+}
+
+// sessionList returns the current sessions, in no particular order.
+func (app *App) sessionList() []*session {
+	app.sessionsMu.RLock()
+	defer app.sessionsMu.RUnlock()
+
+	sessions := make([]*session, 0, len(app.sessions))
+	for _, s := range app.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (app *App) closeSession(id string) {
+	app.endSession(id, false)
+}
+
+// suspendSession closes a session whose device lost its connection, with
+// -resume-window its LiveKit side is kept for the device to reconnect.
+func (app *App) suspendSession(id string) {
+	app.endSession(id, resumeWindow > 0)
+}
+
+func (app *App) endSession(id string, resumable bool) {
+	app.sessionsMu.Lock()
+	s, exists := app.sessions[id]
+	delete(app.sessions, id)
+	app.sessionsMu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	// Close outside the lock, the PeerConnection fires state change
+	// callbacks that re-enter closeSession.
+	s.sendGoodbye()
+	if err := s.pc.Close(); err != nil {
+		log.Errorw("Failed to close peer connection", err, "sessionID", id)
+	}
+	s.closeViewers()
+	app.leaveIntercom(s)
+	app.stopPagesFrom(s.id)
+	s.currentParticipant().removeSink(s.id)
+	if s.jitter != nil {
+		s.jitter.close()
+	}
+	if s.player != nil {
+		s.player.stop()
+	}
+	s.mjpegMu.Lock()
+	if s.mjpeg != nil {
+		s.mjpeg.close()
+	}
+	s.mjpegMu.Unlock()
+	if resumable {
+		app.park(s)
+	} else {
+		app.releaseSession(s)
+	}
+	log.Infow("Session closed", "sessionID", id)
+}
+
+// sessionRequest is what a device sends to start a session. Room and
+// Identity are optional and default to -room-name and -identity.
+type sessionRequest struct {
+	Offer    string `json:"sdp"`
+	Room     string `json:"room,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	// MAC and Serial identify the device for -identity-template
+	MAC    string `json:"mac,omitempty"`
+	Serial string `json:"serial,omitempty"`
+	// Encoder is used when the bridge encodes the device audio to Opus
+	Encoder encoderSettings `json:"encoder"`
+	// PLC conceals packets lost from the device before publishing
+	PLC bool `json:"plc,omitempty"`
+	// Subscribe picks the remote participant the device hears
+	Subscribe *subscriptionSelector `json:"subscribe,omitempty"`
+	// FanOut are rooms the device audio is published to besides Room
+	FanOut []string `json:"fan_out,omitempty"`
+	// Attributes are set as attributes of the participant
+	Attributes deviceAttributes `json:"attributes"`
+	// Loopback starts the session with the device audio sent back to it
+	Loopback bool `json:"loopback,omitempty"`
+	// RouteTo is the only participant allowed to hear the device
+	RouteTo string `json:"route_to,omitempty"`
+	// DSCP marks the media sent to the device, overriding -dscp
+	DSCP string `json:"dscp,omitempty"`
+
+	// device is the paired device that authenticated the request, its
+	// room and identity replace Room and Identity
+	device *registeredDevice
+}
+
+// createSession creates a PeerConnection for the device offer, wires its
+// media into LiveKit and returns once the answer is ready to be sent.
+func (app *App) createSession(req sessionRequest) (*session, error) {
+	targetRoom, targetIdentity, reservation, err := app.sessionTarget(req)
+	if err != nil {
+		return nil, err
+	}
+	defer reservation.release()
+	// The same device reconnecting takes over its sessions that lost
+	// their connection, so it resumes them rather than joining beside
+	for _, id := range reservation.takeover {
+		app.suspendSession(id)
+	}
+	encoder := req.Encoder.withDefaults()
+	if err := encoder.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidOffer, err)
+	}
+	if req.Loopback && !loopbackTest {
+		return nil, fmt.Errorf("%w: loopback needs the bridge started with -loopback", errInvalidOffer)
+	}
+	answerFmtp := opusFmtp
+	device, _ := cfg.device(targetRoom, targetIdentity)
+	plc := req.PLC || device.PLC
+	if plc && !opusAvailable() {
+		return nil, fmt.Errorf("%w: plc needs the bridge built with -tags opus", errInvalidOffer)
+	}
+	if device.OpusFmtp != "" {
+		if answerFmtp, err = mergeFmtp(answerFmtp, device.OpusFmtp); err != nil {
+			return nil, err
+		}
+	}
+	stereo := stereoMode
+	if device.Stereo != "" {
+		stereo = device.Stereo
+	}
+	if stereo != "" {
+		if answerFmtp, err = mergeFmtp(answerFmtp, "stereo=1"); err != nil {
+			return nil, err
+		}
+	}
+	// -opus-fec wins over fmtp asking the device not to send FEC
+	if opusFEC {
+		if answerFmtp, err = mergeFmtp(answerFmtp, "useinbandfec=1"); err != nil {
+			return nil, err
+		}
+	}
+
+	selector := req.Subscribe
+	if selector == nil {
+		selector = device.Subscribe
+	}
+	if err := selector.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidOffer, err)
+	}
+	fanOutRooms, err := resolveFanOut(req.FanOut, device.FanOut, targetRoom)
+	if err != nil {
+		return nil, err
+	}
+	dscp := req.DSCP
+	if dscp == "" {
+		dscp = device.DSCP
+	}
+	api, err := app.apiFor(dscp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidOffer, err)
+	}
+
+	p, err := app.acquireParticipant(targetRoom, targetIdentity)
+	if err != nil {
+		return nil, err
+	}
+	fanOut, err := app.acquireFanOut(fanOutRooms, targetIdentity)
+	if err != nil {
+		app.releaseParticipant(p)
+		return nil, err
+	}
+
+	pc, estimator, err := newPeerConnection(api, app.peerConnectionConfig())
+	if err != nil {
+		app.releaseParticipants(append(fanOut, p))
+		return nil, fmt.Errorf("failed to create peer connection: %w", err)
+	}
+
+	// Store session for cleanup
+	s, err := newSession(pc, p)
+	if err != nil {
+		_ = pc.Close()
+		app.releaseParticipants(append(fanOut, p))
+		return nil, err
+	}
+	s.templated = reservation.templated
+	if req.device != nil {
+		s.deviceID = req.device.ID
+	}
+	s.fanOut = fanOut
+	s.estimator = estimator
+	s.updateAttributes(req.Attributes)
+	s.encoder = encoder
+	s.opusFmtp = answerFmtp
+	s.stereo = stereo
+	s.plc = plc
+	s.groups = device.Groups
+	s.selector = selector
+	s.trackName, s.trackSource = trackName, sourceOf(trackSource)
+	if device.TrackName != "" {
+		s.trackName = device.TrackName
+	}
+	if device.TrackSource != "" {
+		s.trackSource = sourceOf(device.TrackSource)
+	}
+	s.dataTopics = dataTopics
+	s.routeTo = req.RouteTo
+	if device.DataTopics != "" {
+		s.dataTopics = device.DataTopics
+	}
+	s.dataLimiter = newRateLimiter(dataRate)
+	s.agent = agentName
+	if device.Agent != "" {
+		s.agent = device.Agent
+	}
+	s.gainDB = device.GainDB
+	app.resume(s)
+	app.addSession(s)
+
+	// Setup track handler
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		app.onTrack(s, track)
+
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			if s.readUplinkReports(receiver) {
+				app.goodbye(s)
+			}
+		}()
+	})
+
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		app.onDataChannel(s, dc)
+	})
+
+	// Add track to peer connection
+	s.dataOnly = dataOnlyOffer(req.Offer)
+	if !s.dataOnly {
+		if err = app.addDownlink(s, req.Offer); err != nil {
+			app.closeSession(s.id)
+			return nil, err
+		}
+		if req.Loopback {
+			s.loopback.setEnabled(true)
+		}
+	}
+	s.followEstimate()
+	app.joinIntercom(s)
+
+	pc.OnICECandidate(s.addLocalCandidate)
+
+	// Setup ICE connection state change handler
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Infow("ICE connection state changed", "state", state, "sessionID", s.id)
+		s.notifyICEState(state)
+		// Disconnected is left alone, a roaming device recovers from it
+		// with an ICE restart before ICE fails.
+		if state == webrtc.ICEConnectionStateFailed {
+			app.suspendSession(s.id)
+		} else if state == webrtc.ICEConnectionStateClosed {
+			app.closeSession(s.id)
+		}
+	})
+
+	if err := app.negotiate(s, req.Offer); err != nil {
+		app.closeSession(s.id)
+		return nil, err
+	}
+
+	app.dispatchAgent(s)
+	return s, nil
+}
+
+// newWebRTCAPI builds the API every PeerConnection is created with, the
+// default codecs and interceptors plus L16 for devices without an Opus
+// encoder.
+func newWebRTCAPI(settingEngine webrtc.SettingEngine) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, fmt.Errorf("failed to register codecs: %w", err)
+	}
+	for i, clockRate := range l16ClockRates {
+		if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeL16, ClockRate: clockRate, Channels: 1},
+			PayloadType:        webrtc.PayloadType(118 + i),
+		}, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, fmt.Errorf("failed to register L16: %w", err)
+		}
+	}
+	if nack {
+		configureNACK(mediaEngine)
+	}
+	for i, clockRate := range telephoneEventClockRates {
+		if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeTelephoneEvent, ClockRate: clockRate, SDPFmtpLine: "0-15"},
+			PayloadType:        webrtc.PayloadType(120 + i),
+		}, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, fmt.Errorf("failed to register telephone-event: %w", err)
+		}
+	}
+
+	// The default interceptors, with the bridge's own sender reports
+	interceptors := &interceptor.Registry{}
+	if err := webrtc.ConfigureNack(mediaEngine, interceptors); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+	receiverReports, err := report.NewReceiverInterceptor()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create receiver reports: %w", err)
+	}
+	interceptors.Add(receiverReports)
+	interceptors.Add(senderReportsFactory{interval: senderReportInterval})
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+	if err := webrtc.ConfigureTWCCSender(mediaEngine, interceptors); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+	if twcc {
+		if err := configureTWCC(mediaEngine, interceptors); err != nil {
+			return nil, err
+		}
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(interceptors),
+		webrtc.WithSettingEngine(settingEngine),
+	), nil
+}
+
+func (app *App) peerConnectionConfig() webrtc.Configuration {
+	config := webrtc.Configuration{
+		Certificates: []webrtc.Certificate{*app.certificate},
+	}
+	// Without ICE servers only host candidates are gathered
+	if !hostOnly {
+		config.ICEServers = iceServers
+	}
+	return config
+}
+
+// negotiate applies a device offer to the session and waits until the
+// answer, including candidates, is ready. It is used for the initial offer
+// and for renegotiation.
+func (app *App) negotiate(s *session, offer string) error {
+	s.negotiationMu.Lock()
+	defer s.negotiationMu.Unlock()
+
+	// New ICE credentials in a re-offer restart ICE, pion gathers again
+	// with new local credentials.
+	iceRestart := false
+	if remote := s.pc.RemoteDescription(); remote != nil {
+		oldUfrag, _ := iceCredentials(remote.SDP)
+		if newUfrag, _ := iceCredentials(offer); newUfrag != oldUfrag {
+			iceRestart = true
+			s.resetLocalCandidates()
+		}
+	}
+
+	// Set remote description
+	if err := s.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  filterRemoteCandidates(offer),
+	}); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidOffer, err)
+	}
+
+	// Create answer
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create answer: %w", err)
+	}
+
+	// Set local description
+	if err := s.pc.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+	if iceRestart {
+		log.Infow("ICE restarted", "sessionID", s.id)
+	}
+
+	// Devices fetch the remaining candidates from the candidates resource
+	if earlyAnswers {
+		return nil
+	}
+
+	// Wait for ICE gathering to complete with timeout
+	select {
+	case <-webrtc.GatheringCompletePromise(s.pc):
+		// ICE gathering completed
+	case <-time.After(10 * time.Second):
+		return errors.New("ICE gathering timeout")
+	case <-app.ctx.Done():
+		return errShuttingDown
+	}
+
+	return nil
+}
+
+// onICEState registers f to be called on every ICE connection state change.
+func (s *session) onICEState(f func(webrtc.ICEConnectionState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stateListeners = append(s.stateListeners, f)
+}
+
+func (s *session) notifyICEState(state webrtc.ICEConnectionState) {
+	s.mu.Lock()
+	listeners := append([]func(webrtc.ICEConnectionState){}, s.stateListeners...)
+	s.mu.Unlock()
+
+	for _, f := range listeners {
+		f(state)
+	}
+}
+
+// answer returns the SDP answer that is sent to the device.
+func (s *session) answer() string {
+	answer := orderCandidates(s.localDescription())
+	if minifyAnswers {
+		return minifyAnswer(answer)
+	}
+	return answer
+}
+
+// localDescription is the local description with the session's Opus fmtp
+// applied. pion doesn't allow changing the answer, so it is only changed
+// on the way to the device.
+func (s *session) localDescription() string {
+	local := s.pc.LocalDescription().SDP
+	if s.opusFmtp == "" {
+		return local
+	}
+
+	answer, err := applyOpusFmtp(local, s.opusFmtp)
+	if err != nil {
+		log.Errorw("Failed to apply Opus fmtp", err, "sessionID", s.id)
+		return local
+	}
+	return answer
+}
@@ -0,0 +1,5 @@
+// Package signalingpb contains the protobuf signaling schema shared with
+// device firmware.
+package signalingpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative signaling.proto
@@ -0,0 +1,566 @@
+// Signaling messages exchanged between devices and the bridge.
+//
+// The same schema is used over HTTP (Content-Type: application/x-protobuf)
+// and WebSocket (binary frames on /ws). Firmware can generate its side with
+// nanopb from this file.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: signaling.proto
+
+package signalingpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type SessionStatus_State int32
+
+const (
+	SessionStatus_STATE_UNKNOWN      SessionStatus_State = 0
+	SessionStatus_STATE_NEW          SessionStatus_State = 1
+	SessionStatus_STATE_CHECKING     SessionStatus_State = 2
+	SessionStatus_STATE_CONNECTED    SessionStatus_State = 3
+	SessionStatus_STATE_COMPLETED    SessionStatus_State = 4
+	SessionStatus_STATE_DISCONNECTED SessionStatus_State = 5
+	SessionStatus_STATE_FAILED       SessionStatus_State = 6
+	SessionStatus_STATE_CLOSED       SessionStatus_State = 7
+)
+
+// Enum value maps for SessionStatus_State.
+var (
+	SessionStatus_State_name = map[int32]string{
+		0: "STATE_UNKNOWN",
+		1: "STATE_NEW",
+		2: "STATE_CHECKING",
+		3: "STATE_CONNECTED",
+		4: "STATE_COMPLETED",
+		5: "STATE_DISCONNECTED",
+		6: "STATE_FAILED",
+		7: "STATE_CLOSED",
+	}
+	SessionStatus_State_value = map[string]int32{
+		"STATE_UNKNOWN":      0,
+		"STATE_NEW":          1,
+		"STATE_CHECKING":     2,
+		"STATE_CONNECTED":    3,
+		"STATE_COMPLETED":    4,
+		"STATE_DISCONNECTED": 5,
+		"STATE_FAILED":       6,
+		"STATE_CLOSED":       7,
+	}
+)
+
+func (x SessionStatus_State) Enum() *SessionStatus_State {
+	p := new(SessionStatus_State)
+	*p = x
+	return p
+}
+
+func (x SessionStatus_State) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (SessionStatus_State) Descriptor() protoreflect.EnumDescriptor {
+	return file_signaling_proto_enumTypes[0].Descriptor()
+}
+
+func (SessionStatus_State) Type() protoreflect.EnumType {
+	return &file_signaling_proto_enumTypes[0]
+}
+
+func (x SessionStatus_State) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use SessionStatus_State.Descriptor instead.
+func (SessionStatus_State) EnumDescriptor() ([]byte, []int) {
+	return file_signaling_proto_rawDescGZIP(), []int{4, 0}
+}
+
+type SignalMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Message:
+	//
+	//	*SignalMessage_Offer
+	//	*SignalMessage_Answer
+	//	*SignalMessage_Candidate
+	//	*SignalMessage_Status
+	Message       isSignalMessage_Message `protobuf_oneof:"message"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignalMessage) Reset() {
+	*x = SignalMessage{}
+	mi := &file_signaling_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignalMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignalMessage) ProtoMessage() {}
+
+func (x *SignalMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_signaling_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignalMessage.ProtoReflect.Descriptor instead.
+func (*SignalMessage) Descriptor() ([]byte, []int) {
+	return file_signaling_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SignalMessage) GetMessage() isSignalMessage_Message {
+	if x != nil {
+		return x.Message
+	}
+	return nil
+}
+
+func (x *SignalMessage) GetOffer() *Offer {
+	if x != nil {
+		if x, ok := x.Message.(*SignalMessage_Offer); ok {
+			return x.Offer
+		}
+	}
+	return nil
+}
+
+func (x *SignalMessage) GetAnswer() *Answer {
+	if x != nil {
+		if x, ok := x.Message.(*SignalMessage_Answer); ok {
+			return x.Answer
+		}
+	}
+	return nil
+}
+
+func (x *SignalMessage) GetCandidate() *IceCandidate {
+	if x != nil {
+		if x, ok := x.Message.(*SignalMessage_Candidate); ok {
+			return x.Candidate
+		}
+	}
+	return nil
+}
+
+func (x *SignalMessage) GetStatus() *SessionStatus {
+	if x != nil {
+		if x, ok := x.Message.(*SignalMessage_Status); ok {
+			return x.Status
+		}
+	}
+	return nil
+}
+
+type isSignalMessage_Message interface {
+	isSignalMessage_Message()
+}
+
+type SignalMessage_Offer struct {
+	Offer *Offer `protobuf:"bytes,1,opt,name=offer,proto3,oneof"`
+}
+
+type SignalMessage_Answer struct {
+	Answer *Answer `protobuf:"bytes,2,opt,name=answer,proto3,oneof"`
+}
+
+type SignalMessage_Candidate struct {
+	Candidate *IceCandidate `protobuf:"bytes,3,opt,name=candidate,proto3,oneof"`
+}
+
+type SignalMessage_Status struct {
+	Status *SessionStatus `protobuf:"bytes,4,opt,name=status,proto3,oneof"`
+}
+
+func (*SignalMessage_Offer) isSignalMessage_Message() {}
+
+func (*SignalMessage_Answer) isSignalMessage_Message() {}
+
+func (*SignalMessage_Candidate) isSignalMessage_Message() {}
+
+func (*SignalMessage_Status) isSignalMessage_Message() {}
+
+// Offer starts a session, or renegotiates one when session_id is set.
+type Offer struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Sdp           string                 `protobuf:"bytes,1,opt,name=sdp,proto3" json:"sdp,omitempty"`
+	Room          string                 `protobuf:"bytes,2,opt,name=room,proto3" json:"room,omitempty"`
+	Identity      string                 `protobuf:"bytes,3,opt,name=identity,proto3" json:"identity,omitempty"`
+	SessionId     string                 `protobuf:"bytes,4,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Offer) Reset() {
+	*x = Offer{}
+	mi := &file_signaling_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Offer) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Offer) ProtoMessage() {}
+
+func (x *Offer) ProtoReflect() protoreflect.Message {
+	mi := &file_signaling_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Offer.ProtoReflect.Descriptor instead.
+func (*Offer) Descriptor() ([]byte, []int) {
+	return file_signaling_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Offer) GetSdp() string {
+	if x != nil {
+		return x.Sdp
+	}
+	return ""
+}
+
+func (x *Offer) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *Offer) GetIdentity() string {
+	if x != nil {
+		return x.Identity
+	}
+	return ""
+}
+
+func (x *Offer) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+type Answer struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Sdp           string                 `protobuf:"bytes,1,opt,name=sdp,proto3" json:"sdp,omitempty"`
+	SessionId     string                 `protobuf:"bytes,2,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Answer) Reset() {
+	*x = Answer{}
+	mi := &file_signaling_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Answer) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Answer) ProtoMessage() {}
+
+func (x *Answer) ProtoReflect() protoreflect.Message {
+	mi := &file_signaling_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Answer.ProtoReflect.Descriptor instead.
+func (*Answer) Descriptor() ([]byte, []int) {
+	return file_signaling_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Answer) GetSdp() string {
+	if x != nil {
+		return x.Sdp
+	}
+	return ""
+}
+
+func (x *Answer) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+// IceCandidate trickles a device candidate into an existing session.
+type IceCandidate struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	SessionId string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	// candidate attribute without the "a=" prefix, empty with end_of_candidates
+	Candidate       string `protobuf:"bytes,2,opt,name=candidate,proto3" json:"candidate,omitempty"`
+	SdpMid          string `protobuf:"bytes,3,opt,name=sdp_mid,json=sdpMid,proto3" json:"sdp_mid,omitempty"`
+	EndOfCandidates bool   `protobuf:"varint,4,opt,name=end_of_candidates,json=endOfCandidates,proto3" json:"end_of_candidates,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *IceCandidate) Reset() {
+	*x = IceCandidate{}
+	mi := &file_signaling_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IceCandidate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IceCandidate) ProtoMessage() {}
+
+func (x *IceCandidate) ProtoReflect() protoreflect.Message {
+	mi := &file_signaling_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IceCandidate.ProtoReflect.Descriptor instead.
+func (*IceCandidate) Descriptor() ([]byte, []int) {
+	return file_signaling_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *IceCandidate) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *IceCandidate) GetCandidate() string {
+	if x != nil {
+		return x.Candidate
+	}
+	return ""
+}
+
+func (x *IceCandidate) GetSdpMid() string {
+	if x != nil {
+		return x.SdpMid
+	}
+	return ""
+}
+
+func (x *IceCandidate) GetEndOfCandidates() bool {
+	if x != nil {
+		return x.EndOfCandidates
+	}
+	return false
+}
+
+type SessionStatus struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	SessionId string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	State     SessionStatus_State    `protobuf:"varint,2,opt,name=state,proto3,enum=bridge.signaling.SessionStatus_State" json:"state,omitempty"`
+	// error is set when a request from the device failed
+	Error         string `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SessionStatus) Reset() {
+	*x = SessionStatus{}
+	mi := &file_signaling_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SessionStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SessionStatus) ProtoMessage() {}
+
+func (x *SessionStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_signaling_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SessionStatus.ProtoReflect.Descriptor instead.
+func (*SessionStatus) Descriptor() ([]byte, []int) {
+	return file_signaling_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *SessionStatus) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *SessionStatus) GetState() SessionStatus_State {
+	if x != nil {
+		return x.State
+	}
+	return SessionStatus_STATE_UNKNOWN
+}
+
+func (x *SessionStatus) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+var File_signaling_proto protoreflect.FileDescriptor
+
+const file_signaling_proto_rawDesc = "" +
+	"\n" +
+	"\x0fsignaling.proto\x12\x10bridge.signaling\"\xfa\x01\n" +
+	"\rSignalMessage\x12/\n" +
+	"\x05offer\x18\x01 \x01(\v2\x17.bridge.signaling.OfferH\x00R\x05offer\x122\n" +
+	"\x06answer\x18\x02 \x01(\v2\x18.bridge.signaling.AnswerH\x00R\x06answer\x12>\n" +
+	"\tcandidate\x18\x03 \x01(\v2\x1e.bridge.signaling.IceCandidateH\x00R\tcandidate\x129\n" +
+	"\x06status\x18\x04 \x01(\v2\x1f.bridge.signaling.SessionStatusH\x00R\x06statusB\t\n" +
+	"\amessage\"h\n" +
+	"\x05Offer\x12\x10\n" +
+	"\x03sdp\x18\x01 \x01(\tR\x03sdp\x12\x12\n" +
+	"\x04room\x18\x02 \x01(\tR\x04room\x12\x1a\n" +
+	"\bidentity\x18\x03 \x01(\tR\bidentity\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x04 \x01(\tR\tsessionId\"9\n" +
+	"\x06Answer\x12\x10\n" +
+	"\x03sdp\x18\x01 \x01(\tR\x03sdp\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x02 \x01(\tR\tsessionId\"\x90\x01\n" +
+	"\fIceCandidate\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x01 \x01(\tR\tsessionId\x12\x1c\n" +
+	"\tcandidate\x18\x02 \x01(\tR\tcandidate\x12\x17\n" +
+	"\asdp_mid\x18\x03 \x01(\tR\x06sdpMid\x12*\n" +
+	"\x11end_of_candidates\x18\x04 \x01(\bR\x0fendOfCandidates\"\xa7\x02\n" +
+	"\rSessionStatus\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x01 \x01(\tR\tsessionId\x12;\n" +
+	"\x05state\x18\x02 \x01(\x0e2%.bridge.signaling.SessionStatus.StateR\x05state\x12\x14\n" +
+	"\x05error\x18\x03 \x01(\tR\x05error\"\xa3\x01\n" +
+	"\x05State\x12\x11\n" +
+	"\rSTATE_UNKNOWN\x10\x00\x12\r\n" +
+	"\tSTATE_NEW\x10\x01\x12\x12\n" +
+	"\x0eSTATE_CHECKING\x10\x02\x12\x13\n" +
+	"\x0fSTATE_CONNECTED\x10\x03\x12\x13\n" +
+	"\x0fSTATE_COMPLETED\x10\x04\x12\x16\n" +
+	"\x12STATE_DISCONNECTED\x10\x05\x12\x10\n" +
+	"\fSTATE_FAILED\x10\x06\x12\x10\n" +
+	"\fSTATE_CLOSED\x10\aB@Z>github.com/sean-der/livekit-microcontroller-bridge/signalingpbb\x06proto3"
+
+var (
+	file_signaling_proto_rawDescOnce sync.Once
+	file_signaling_proto_rawDescData []byte
+)
+
+func file_signaling_proto_rawDescGZIP() []byte {
+	file_signaling_proto_rawDescOnce.Do(func() {
+		file_signaling_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_signaling_proto_rawDesc), len(file_signaling_proto_rawDesc)))
+	})
+	return file_signaling_proto_rawDescData
+}
+
+var file_signaling_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_signaling_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_signaling_proto_goTypes = []any{
+	(SessionStatus_State)(0), // 0: bridge.signaling.SessionStatus.State
+	(*SignalMessage)(nil),    // 1: bridge.signaling.SignalMessage
+	(*Offer)(nil),            // 2: bridge.signaling.Offer
+	(*Answer)(nil),           // 3: bridge.signaling.Answer
+	(*IceCandidate)(nil),     // 4: bridge.signaling.IceCandidate
+	(*SessionStatus)(nil),    // 5: bridge.signaling.SessionStatus
+}
+var file_signaling_proto_depIdxs = []int32{
+	2, // 0: bridge.signaling.SignalMessage.offer:type_name -> bridge.signaling.Offer
+	3, // 1: bridge.signaling.SignalMessage.answer:type_name -> bridge.signaling.Answer
+	4, // 2: bridge.signaling.SignalMessage.candidate:type_name -> bridge.signaling.IceCandidate
+	5, // 3: bridge.signaling.SignalMessage.status:type_name -> bridge.signaling.SessionStatus
+	0, // 4: bridge.signaling.SessionStatus.state:type_name -> bridge.signaling.SessionStatus.State
+	5, // [5:5] is the sub-list for method output_type
+	5, // [5:5] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_signaling_proto_init() }
+func file_signaling_proto_init() {
+	if File_signaling_proto != nil {
+		return
+	}
+	file_signaling_proto_msgTypes[0].OneofWrappers = []any{
+		(*SignalMessage_Offer)(nil),
+		(*SignalMessage_Answer)(nil),
+		(*SignalMessage_Candidate)(nil),
+		(*SignalMessage_Status)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_signaling_proto_rawDesc), len(file_signaling_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_signaling_proto_goTypes,
+		DependencyIndexes: file_signaling_proto_depIdxs,
+		EnumInfos:         file_signaling_proto_enumTypes,
+		MessageInfos:      file_signaling_proto_msgTypes,
+	}.Build()
+	File_signaling_proto = out.File
+	file_signaling_proto_goTypes = nil
+	file_signaling_proto_depIdxs = nil
+}
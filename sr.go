@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// senderReports sends RTCP sender reports for the streams a PeerConnection
+// sends, every -sender-report-interval and as soon as a stream starts, so a
+// device can map the RTP clock of the mix, transcoded or forwarded audio to
+// wall clock from its first packets. It replaces the sender reports of the
+// default interceptors, which report a stream before its first packet with
+// an RTP time extrapolated from the zero time.
+type senderReports struct {
+	interceptor.NoOp
+
+	interval time.Duration
+	// started is signalled when a stream sent its first packet
+	started chan struct{}
+	// streams are the reportedStreams by SSRC
+	streams sync.Map
+
+	wg        sync.WaitGroup
+	close     chan struct{}
+	closeOnce sync.Once
+}
+
+// reportedStream maps the RTP time of a stream to wall clock at its latest
+// packet.
+type reportedStream struct {
+	ssrc      uint32
+	clockRate uint32
+
+	mu            sync.Mutex
+	sent          bool
+	lastTimestamp uint32
+	lastSentAt    time.Time
+	packets       uint32
+	octets        uint32
+}
+
+type senderReportsFactory struct {
+	interval time.Duration
+}
+
+func (f senderReportsFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &senderReports{
+		interval: f.interval,
+		started:  make(chan struct{}, 1),
+		close:    make(chan struct{}),
+	}, nil
+}
+
+func (r *senderReports) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.loop(writer)
+	}()
+	return writer
+}
+
+func (r *senderReports) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	stream := &reportedStream{ssrc: info.SSRC, clockRate: info.ClockRate}
+	r.streams.Store(info.SSRC, stream)
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		if stream.sentPacket(header, len(payload), time.Now()) {
+			select {
+			case r.started <- struct{}{}:
+			default:
+			}
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+func (r *senderReports) UnbindLocalStream(info *interceptor.StreamInfo) {
+	r.streams.Delete(info.SSRC)
+}
+
+func (r *senderReports) Close() error {
+	r.closeOnce.Do(func() { close(r.close) })
+	r.wg.Wait()
+	return nil
+}
+
+func (r *senderReports) loop(writer interceptor.RTCPWriter) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+		case <-r.started:
+		}
+
+		now := time.Now()
+		r.streams.Range(func(_, value any) bool {
+			report, ok := value.(*reportedStream).report(now)
+			if !ok {
+				return true
+			}
+			if _, err := writer.Write([]rtcp.Packet{report}, interceptor.Attributes{}); err != nil {
+				log.Debugw("Failed to send sender report", "ssrc", report.SSRC, "error", err)
+			}
+			return true
+		})
+	}
+}
+
+// sentPacket records a packet sent at now and reports whether it was the
+// first of the stream.
+func (s *reportedStream) sentPacket(header *rtp.Header, size int, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	first := !s.sent
+	s.sent = true
+	s.lastTimestamp, s.lastSentAt = header.Timestamp, now
+	s.packets++
+	s.octets += uint32(size)
+	return first
+}
+
+// report is the sender report of the stream at now, false until it sent a
+// packet.
+func (s *reportedStream) report(now time.Time) (*rtcp.SenderReport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.sent {
+		return nil, false
+	}
+	elapsed := now.Sub(s.lastSentAt)
+	return &rtcp.SenderReport{
+		SSRC:        s.ssrc,
+		NTPTime:     ntpTime(now),
+		RTPTime:     s.lastTimestamp + uint32(elapsed*time.Duration(s.clockRate)/time.Second),
+		PacketCount: s.packets,
+		OctetCount:  s.octets,
+	}, true
+}
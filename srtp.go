@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/dtls/v3"
+)
+
+// srtpProfileNames are the SRTP protection profiles pion can protect media
+// with, named as in RFC 5764 and RFC 7714.
+var srtpProfileNames = map[string]dtls.SRTPProtectionProfile{
+	"aead_aes_128_gcm":       dtls.SRTP_AEAD_AES_128_GCM,
+	"aead_aes_256_gcm":       dtls.SRTP_AEAD_AES_256_GCM,
+	"aes128_cm_hmac_sha1_80": dtls.SRTP_AES128_CM_HMAC_SHA1_80,
+}
+
+// parseSRTPProfiles parses -srtp-profiles, the profiles offered in the DTLS
+// handshake in order of preference.
+func parseSRTPProfiles(value string) ([]dtls.SRTPProtectionProfile, error) {
+	var profiles []dtls.SRTPProtectionProfile
+	for _, name := range splitList(value) {
+		profile, ok := srtpProfileNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown SRTP profile %q, must be aead_aes_128_gcm, aead_aes_256_gcm or aes128_cm_hmac_sha1_80", name)
+		}
+		profiles = append(profiles, profile)
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("srtp-profiles must list at least one profile")
+	}
+	return profiles, nil
+}
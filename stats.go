@@ -0,0 +1,232 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sessionStats counts the media of one session.
+type sessionStats struct {
+	// received is what the device sent, published what the session
+	// wrote to its LiveKit tracks after VAD, DTX and transcoding
+	receivedPackets, receivedBytes   atomic.Uint64
+	publishedPackets, publishedBytes atomic.Uint64
+	// lastReceived is the UnixNano time of the last packet received
+	lastReceived atomic.Int64
+	// nackedPackets are the downlink packets the device reported lost
+	// with NACK
+	nackedPackets atomic.Uint64
+}
+
+// sessionStatsResponse is the body of the stats resource.
+type sessionStatsResponse struct {
+	Room             string  `json:"room"`
+	Identity         string  `json:"identity"`
+	UptimeSeconds    float64 `json:"uptime_seconds"`
+	ReceivedPackets  uint64  `json:"received_packets"`
+	ReceivedBytes    uint64  `json:"received_bytes"`
+	PublishedPackets uint64  `json:"published_packets"`
+	PublishedBytes   uint64  `json:"published_bytes"`
+	Publications     int     `json:"publications"`
+	NackedPackets    uint64  `json:"nacked_packets"`
+	// Quality is missing until the session was first scored
+	Quality *qualityReport `json:"quality,omitempty"`
+	// BandwidthEstimate is the estimate of -twcc in bits per second
+	BandwidthEstimate int `json:"bandwidth_estimate,omitempty"`
+	// ClockDriftPPM is missing until the drift of the device clock was
+	// estimated, DriftCorrections are the frames -drift-compensation
+	// dropped or inserted
+	ClockDriftPPM    *float64 `json:"clock_drift_ppm,omitempty"`
+	DriftCorrections int      `json:"drift_corrections,omitempty"`
+}
+
+func (st *sessionStats) received(size int) {
+	st.receivedPackets.Add(1)
+	st.receivedBytes.Add(uint64(size))
+	st.lastReceived.Store(time.Now().UnixNano())
+}
+
+func (st *sessionStats) nacked(packets int) {
+	st.nackedPackets.Add(uint64(packets))
+}
+
+func (st *sessionStats) published(size int) {
+	st.publishedPackets.Add(1)
+	st.publishedBytes.Add(uint64(size))
+}
+
+// statsHandler returns the media counters of a session.
+func (app *App) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	publications := len(s.publications)
+	s.mu.Unlock()
+
+	p := s.currentParticipant()
+	res := sessionStatsResponse{
+		Room:             p.roomName,
+		Identity:         p.identity,
+		UptimeSeconds:    time.Since(s.createdAt).Seconds(),
+		ReceivedPackets:  s.stats.receivedPackets.Load(),
+		ReceivedBytes:    s.stats.receivedBytes.Load(),
+		PublishedPackets: s.stats.publishedPackets.Load(),
+		PublishedBytes:   s.stats.publishedBytes.Load(),
+		Publications:     publications,
+		NackedPackets:    s.stats.nackedPackets.Load(),
+	}
+	if quality, ok := s.quality.current(); ok {
+		res.Quality = &quality
+	}
+	if s.estimator != nil {
+		res.BandwidthEstimate = s.estimator.GetTargetBitrate()
+	}
+	if ppm, ok, corrections := s.drift.estimate(); ok {
+		res.ClockDriftPPM, res.DriftCorrections = &ppm, corrections
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
+
+// sessionSummary is a session in the sessions resource.
+type sessionSummary struct {
+	ID            string         `json:"id"`
+	Room          string         `json:"room"`
+	Identity      string         `json:"identity"`
+	UptimeSeconds float64        `json:"uptime_seconds"`
+	Quality       *qualityReport `json:"quality,omitempty"`
+}
+
+// summaries returns every session, the worst connection quality first and
+// sessions not scored yet last.
+func (app *App) summaries() []sessionSummary {
+	var summaries []sessionSummary
+	for _, s := range app.sessionList() {
+		p := s.currentParticipant()
+		summary := sessionSummary{
+			ID:            s.id,
+			Room:          p.roomName,
+			Identity:      p.identity,
+			UptimeSeconds: time.Since(s.createdAt).Seconds(),
+		}
+		if quality, ok := s.quality.current(); ok {
+			summary.Quality = &quality
+		}
+		summaries = append(summaries, summary)
+	}
+
+	slices.SortFunc(summaries, func(a, b sessionSummary) int {
+		switch {
+		case a.Quality == nil && b.Quality == nil:
+			return cmp.Compare(a.ID, b.ID)
+		case a.Quality == nil:
+			return 1
+		case b.Quality == nil:
+			return -1
+		}
+		return cmp.Compare(a.Quality.Score, b.Quality.Score)
+	})
+	return summaries
+}
+
+// sessionsHandler lists the sessions, the worst connection quality first.
+// limit=5 returns the five worst.
+func (app *App) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	summaries := app.summaries()
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 0 {
+			writeError(w, r, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		summaries = summaries[:min(limit, len(summaries))]
+	}
+	if summaries == nil {
+		summaries = []sessionSummary{}
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(summaries); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
+
+// metricLabels escapes label values for the Prometheus text format.
+var metricLabels = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsHandler exposes the sessions and their connection quality in the
+// Prometheus text format.
+func (app *App) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	summaries := app.summaries()
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP bridge_sessions Device sessions connected to the bridge.\n# TYPE bridge_sessions gauge\nbridge_sessions %d\n", len(summaries))
+
+	for _, metric := range []struct {
+		name, help string
+		value      func(q *qualityReport) float64
+	}{
+		{"bridge_session_quality_score", "E-model R factor of the session, 0-100.", func(q *qualityReport) float64 { return q.Score }},
+		{"bridge_session_mos", "Mean opinion score of the session, 1-4.5.", func(q *qualityReport) float64 { return q.MOS }},
+		{"bridge_session_uplink_loss_percent", "Packets from the device lost.", func(q *qualityReport) float64 { return q.UplinkLossPercent }},
+		{"bridge_session_downlink_loss_percent", "Packets to the device lost, as reported by it.", func(q *qualityReport) float64 { return q.DownlinkLossPercent }},
+		{"bridge_session_jitter_ms", "Interarrival jitter of the session in milliseconds.", func(q *qualityReport) float64 { return q.JitterMs }},
+		{"bridge_session_rtt_ms", "Round trip time to the device in milliseconds.", func(q *qualityReport) float64 { return q.RTTMs }},
+		{"bridge_session_bitrate_kbps", "Bitrate received from the device in kbit/s.", func(q *qualityReport) float64 { return q.BitrateKbps }},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name)
+		for _, summary := range summaries {
+			if summary.Quality == nil {
+				continue
+			}
+			fmt.Fprintf(&b, "%s{session_id=\"%s\",room=\"%s\",identity=\"%s\"} %g\n", metric.name,
+				metricLabels.Replace(summary.ID), metricLabels.Replace(summary.Room), metricLabels.Replace(summary.Identity),
+				metric.value(summary.Quality))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/livekit/protocol/livekit"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Stereo modes of -stereo and the stereo setting of a device. Without one
+// the bridge negotiates mono.
+const (
+	// stereoPassthrough publishes the stereo Opus of the device as is
+	stereoPassthrough = "passthrough"
+	// stereoDownmix mixes the channels to mono for the embedded track
+	stereoDownmix = "downmix"
+	// stereoSplit publishes the left and right channel as two tracks,
+	// e.g. for boards with two microphones
+	stereoSplit = "split"
+)
+
+func validateStereo(mode string) error {
+	switch mode {
+	case "", stereoPassthrough:
+	case stereoDownmix, stereoSplit:
+		if !opusAvailable() {
+			return fmt.Errorf("stereo %s needs the bridge built with -tags opus", mode)
+		}
+	default:
+		return fmt.Errorf("unknown stereo mode %q, must be %s, %s or %s", mode, stereoPassthrough, stereoDownmix, stereoSplit)
+	}
+	return nil
+}
+
+// stereoWriter returns the writer for stereo Opus from a device, nil if
+// the session audio goes to its embedded track.
+func (app *App) stereoWriter(s *session) (func(*rtp.Packet) error, error) {
+	switch s.stereo {
+	case stereoPassthrough:
+		track, err := publishLocalTrack(s, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: opusClockRate, Channels: 2}, &lksdk.TrackPublicationOptions{
+			Name:   "embedded-stereo-" + s.id,
+			Source: livekit.TrackSource_MICROPHONE,
+			Stereo: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return func(p *rtp.Packet) error {
+			if err := track.WriteRTP(p, nil); err != nil {
+				return fmt.Errorf("failed to write RTP packet to stereo track: %w", err)
+			}
+			s.stats.published(len(p.Payload))
+			if err := s.monitorTrack.WriteRTP(p); err != nil {
+				log.Errorw("Failed to write RTP packet to monitor track", err, "sessionID", s.id)
+			}
+			return nil
+		}, nil
+	case stereoSplit:
+		return splitWriter(s)
+	}
+	return nil, nil
+}
+
+// splitWriter decodes stereo Opus and publishes each channel as a mono
+// track of its own. The packets keep the RTP header of the device.
+func splitWriter(s *session) (func(*rtp.Packet) error, error) {
+	decoder, err := newOpusDecoder(opusClockRate, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	type channel struct {
+		track   *lksdk.LocalTrack
+		encoder opusEncoder
+		pcm     []int16
+	}
+	var channels [2]channel
+	for i, name := range []string{"left", "right"} {
+		encoder, err := newTunedOpusEncoder(opusClockRate, s.encoder)
+		if err != nil {
+			return nil, err
+		}
+		track, err := publishLocalTrack(s, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, &lksdk.TrackPublicationOptions{
+			Name:   fmt.Sprintf("embedded-%s-%s", name, s.id),
+			Source: livekit.TrackSource_MICROPHONE,
+		})
+		if err != nil {
+			return nil, err
+		}
+		channels[i] = channel{track: track, encoder: encoder}
+	}
+
+	// 120ms, the longest frame Opus decodes
+	interleaved := make([]int16, 2*opusClockRate*120/1000)
+	buf := make([]byte, maxOpusPacketSize)
+	return func(p *rtp.Packet) error {
+		n, err := decoder.Decode(p.Payload, interleaved)
+		if err != nil {
+			return fmt.Errorf("failed to decode Opus: %w", err)
+		}
+
+		for i := range channels {
+			c := &channels[i]
+			c.pcm = c.pcm[:0]
+			for j := 0; j < n; j++ {
+				c.pcm = append(c.pcm, interleaved[2*j+i])
+			}
+
+			size, err := c.encoder.Encode(c.pcm, buf)
+			if err != nil {
+				return fmt.Errorf("failed to encode Opus: %w", err)
+			}
+			mono := *p
+			mono.Payload = append([]byte(nil), buf[:size]...)
+			if err := c.track.WriteRTP(&mono, nil); err != nil {
+				return fmt.Errorf("failed to write RTP packet to channel track: %w", err)
+			}
+			s.stats.published(len(mono.Payload))
+		}
+		return nil
+	}, nil
+}
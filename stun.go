@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pion/stun/v3"
+)
+
+// stunResponder answers STUN binding requests on -stun-addr, so devices on
+// the LAN learn their reflexive address from the bridge instead of a public
+// STUN server. With -udp-port they are answered on the media port too.
+type stunResponder struct {
+	conn net.PacketConn
+}
+
+func (app *App) listenSTUN() error {
+	conn, err := net.ListenPacket(familyNetwork("udp"), stunAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", stunAddr, err)
+	}
+
+	app.stun = &stunResponder{conn: conn}
+	log.Infow("STUN responder listening", "addr", conn.LocalAddr())
+	return nil
+}
+
+func (r *stunResponder) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		answerBinding(r.conn, buf[:n], from)
+	}
+}
+
+// stunMuxConn answers STUN binding requests arriving on the UDP mux and
+// passes everything else from -remote-cidrs on to ICE.
+type stunMuxConn struct {
+	net.PacketConn
+}
+
+func (c *stunMuxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, from, err
+		}
+		// Peer reflexive candidates are only kept out here
+		if udpAddr, ok := from.(*net.UDPAddr); ok && !remoteCIDRs.empty() && !remoteCIDRs.allowed(udpAddr.IP) {
+			continue
+		}
+		if !answerBinding(c.PacketConn, b[:n], from) {
+			return n, from, nil
+		}
+	}
+}
+
+// answerBinding replies to a STUN binding request with the address it came
+// from, and reports if packet was one. Requests carrying a USERNAME are ICE
+// connectivity checks and left alone.
+func answerBinding(conn net.PacketConn, packet []byte, from net.Addr) bool {
+	if !stun.IsMessage(packet) {
+		return false
+	}
+	req := &stun.Message{Raw: append([]byte(nil), packet...)}
+	if err := req.Decode(); err != nil || req.Type != stun.BindingRequest || req.Contains(stun.AttrUsername) {
+		return false
+	}
+
+	udpAddr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	res, err := stun.Build(req, stun.BindingSuccess,
+		&stun.XORMappedAddress{IP: udpAddr.IP, Port: udpAddr.Port},
+		stun.NewSoftware("livekit-microcontroller-bridge"),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		log.Errorw("Failed to build STUN response", err, "from", from)
+		return true
+	}
+	if _, err := conn.WriteTo(res.Raw, from); err != nil {
+		log.Errorw("Failed to send STUN response", err, "from", from)
+	}
+	return true
+}
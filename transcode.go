@@ -0,0 +1,590 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// srtpOverhead is the most SRTP adds to an RTP packet, the AEAD
+	// GCM tag
+	srtpOverhead = 16
+	// rtpHeaderSize is the header the packetizer adds, without CSRCs or
+	// extensions
+	rtpHeaderSize = 12
+	// maxOpusPacketSize is the buffer size libopus recommends for encoding
+	maxOpusPacketSize = 4000
+	// opusClockRate is the RTP clock rate of Opus at every sample rate
+	opusClockRate = 48000
+	// downlinkFrameMs is the frame size the bridge sends to devices
+	downlinkFrameMs = 20
+	// fecPacketLossPerc is the loss the encoder adds FEC for, Wi-Fi links
+	// to devices routinely see 2-5%
+	fecPacketLossPerc = 5
+
+	mimeTypeL16 = "audio/L16"
+	// pcmDataChannel is the label of a data channel carrying raw PCM
+	pcmDataChannel = "pcm"
+	// pcmSampleRate is used when the pcm data channel has no protocol set
+	pcmSampleRate = 16000
+)
+
+// l16ClockRates are the L16 rates the bridge accepts, libopus encodes them
+// without resampling.
+var l16ClockRates = []uint32{8000, 16000}
+
+// opusEncoder and opusDecoder are implemented by libopus when the bridge
+// is built with -tags opus.
+type opusEncoder interface {
+	Encode(pcm []int16, data []byte) (int, error)
+	SetBitrate(bitrate int) error
+	SetComplexity(complexity int) error
+	SetVBR(vbr bool) error
+	SetInbandFEC(packetLossPerc int) error
+}
+
+type opusDecoder interface {
+	Decode(data []byte, pcm []int16) (int, error)
+	// DecodeFEC recovers the frame lost before data from its FEC
+	DecodeFEC(data []byte, pcm []int16) (int, error)
+}
+
+// encoderSettings tune the Opus encoder for sessions the bridge encodes.
+// Unset values default to the -opus-* flags, a zero bitrate and nil
+// complexity keep the libopus defaults.
+type encoderSettings struct {
+	FrameMs    int   `json:"frame_ms,omitempty"`
+	Bitrate    int   `json:"bitrate,omitempty"`
+	Complexity *int  `json:"complexity,omitempty"`
+	VBR        *bool `json:"vbr,omitempty"`
+	FEC        *bool `json:"fec,omitempty"`
+}
+
+// withDefaults fills the unset values from the -opus-* flags.
+func (e encoderSettings) withDefaults() encoderSettings {
+	if e.FrameMs == 0 {
+		e.FrameMs = opusFrameMs
+	}
+	if e.Bitrate == 0 {
+		e.Bitrate = opusBitrate
+	}
+	if e.Complexity == nil && opusComplexity >= 0 {
+		complexity := opusComplexity
+		e.Complexity = &complexity
+	}
+	if e.VBR == nil {
+		vbr := opusVBR
+		e.VBR = &vbr
+	}
+	if e.FEC == nil {
+		fec := opusFEC
+		e.FEC = &fec
+	}
+	return e
+}
+
+func (e encoderSettings) validate() error {
+	switch e.FrameMs {
+	case 10, 20, 40, 60:
+	default:
+		return fmt.Errorf("frame_ms must be 10, 20, 40 or 60, got %d", e.FrameMs)
+	}
+	if e.Bitrate != 0 && (e.Bitrate < 6000 || e.Bitrate > 510000) {
+		return fmt.Errorf("bitrate must be between 6000 and 510000, got %d", e.Bitrate)
+	}
+	if e.Complexity != nil && (*e.Complexity < 0 || *e.Complexity > 10) {
+		return fmt.Errorf("complexity must be between 0 and 10, got %d", *e.Complexity)
+	}
+	return nil
+}
+
+// transcoder re-encodes RTP audio between a device codec and Opus. Audio
+// is decoded to PCM, buffered and encoded in frames of frameSize samples.
+type transcoder struct {
+	mu         sync.Mutex
+	decode     func(p *rtp.Packet) ([]int16, error)
+	encode     func(pcm []int16) ([]byte, error)
+	packetizer rtp.Packetizer
+	frameSize  int
+	// frameDuration is a frame in units of the output RTP clock
+	frameDuration uint32
+	// sampleBytes is the size of a sample of PCM output, which is split
+	// into packets of at most packetSamples, zero for Opus
+	sampleBytes   int
+	packetSamples int
+	pending       []int16
+}
+
+func isTranscoded(mimeType string) bool {
+	return isG711(mimeType) || strings.EqualFold(mimeType, mimeTypeL16)
+}
+
+// pcmDecoder returns the decoder for audio the bridge encodes to Opus.
+func pcmDecoder(mimeType string) func([]byte) []int16 {
+	if isG711(mimeType) {
+		return func(payload []byte) []int16 {
+			return decodeG711(mimeType, payload)
+		}
+	}
+	return func(payload []byte) []int16 {
+		return decodeL16(binary.BigEndian, payload)
+	}
+}
+
+// decodeL16 decodes 16 bit PCM, L16 over RTP is big endian and the pcm
+// data channel uses the little endian layout of the device.
+func decodeL16(order binary.ByteOrder, payload []byte) []int16 {
+	pcm := make([]int16, len(payload)/2)
+	for i := range pcm {
+		pcm[i] = int16(order.Uint16(payload[2*i:]))
+	}
+	return pcm
+}
+
+func encodeL16(pcm []int16) []byte {
+	payload := make([]byte, 2*len(pcm))
+	for i, s := range pcm {
+		binary.BigEndian.PutUint16(payload[2*i:], uint16(s))
+	}
+	return payload
+}
+
+// newUplinkTranscoder encodes device audio at sampleRate to Opus for
+// LiveKit. With -resample the audio is resampled to 48kHz first, otherwise
+// it is encoded at the device rate.
+func newUplinkTranscoder(decode func([]byte) []int16, sampleRate int, settings encoderSettings) (*transcoder, error) {
+	if resampleAudio && sampleRate != opusClockRate {
+		r := newResampler(sampleRate, opusClockRate)
+		decodeDevice := decode
+		decode = func(payload []byte) []int16 {
+			return r.resample(decodeDevice(payload))
+		}
+		sampleRate = opusClockRate
+	}
+
+	encoder, err := newTunedOpusEncoder(sampleRate, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	frameMs := settings.FrameMs
+	buf := make([]byte, maxOpusPacketSize)
+	return &transcoder{
+		decode: func(p *rtp.Packet) ([]int16, error) {
+			return decode(p.Payload), nil
+		},
+		encode: func(pcm []int16) ([]byte, error) {
+			n, err := encoder.Encode(pcm, buf)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode Opus: %w", err)
+			}
+			return buf[:n], nil
+		},
+		// Payload type and SSRC are rewritten by the track
+		packetizer:    rtp.NewPacketizer(transcodeMTU(), 0, 0, &codecs.OpusPayloader{}, rtp.NewRandomSequencer(), opusClockRate),
+		frameSize:     sampleRate * frameMs / 1000,
+		frameDuration: uint32(opusClockRate * frameMs / 1000),
+	}, nil
+}
+
+// newTunedOpusEncoder returns an encoder configured with settings.
+func newTunedOpusEncoder(sampleRate int, settings encoderSettings) (opusEncoder, error) {
+	encoder, err := newOpusEncoder(sampleRate)
+	if err != nil {
+		return nil, err
+	}
+	if settings.Bitrate != 0 {
+		if err := encoder.SetBitrate(settings.Bitrate); err != nil {
+			return nil, fmt.Errorf("failed to set Opus bitrate: %w", err)
+		}
+	}
+	if settings.Complexity != nil {
+		if err := encoder.SetComplexity(*settings.Complexity); err != nil {
+			return nil, fmt.Errorf("failed to set Opus complexity: %w", err)
+		}
+	}
+	if settings.VBR != nil {
+		if err := encoder.SetVBR(*settings.VBR); err != nil {
+			return nil, fmt.Errorf("failed to set Opus VBR: %w", err)
+		}
+	}
+	if settings.FEC != nil && *settings.FEC {
+		if err := encoder.SetInbandFEC(fecPacketLossPerc); err != nil {
+			return nil, fmt.Errorf("failed to enable Opus FEC: %w", err)
+		}
+	}
+	return encoder, nil
+}
+
+// newDownlinkTranscoder decodes Opus from LiveKit to the codec of a device.
+// With -resample Opus is decoded at 48kHz and downsampled by the bridge.
+func newDownlinkTranscoder(codec webrtc.RTPCodecCapability) (*transcoder, error) {
+	sampleRate := int(codec.ClockRate)
+	decodeRate := sampleRate
+	if resampleAudio {
+		decodeRate = opusClockRate
+	}
+	decoder, err := newOpusDecoder(decodeRate, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var r *resampler
+	if decodeRate != sampleRate {
+		r = newResampler(decodeRate, sampleRate)
+	}
+
+	encode, sampleBytes := encodeL16, 2
+	if isG711(codec.MimeType) {
+		sampleBytes = 1
+		encode = func(pcm []int16) []byte {
+			return encodeG711(codec.MimeType, pcm)
+		}
+	}
+
+	// 120ms, the longest frame Opus decodes
+	buf := make([]int16, decodeRate*120/1000)
+	frameSize := sampleRate * downlinkFrameMs / 1000
+	var (
+		started      bool
+		lastSequence uint16
+	)
+	return &transcoder{
+		decode: func(p *rtp.Packet) ([]int16, error) {
+			var pcm []int16
+			// A single lost packet is recovered from the FEC the
+			// next one carries
+			if started && p.SequenceNumber-lastSequence == 2 {
+				n, err := decoder.DecodeFEC(p.Payload, buf)
+				if err != nil {
+					return nil, fmt.Errorf("failed to decode Opus FEC: %w", err)
+				}
+				pcm = append(pcm, buf[:n]...)
+			}
+			started, lastSequence = true, p.SequenceNumber
+
+			n, err := decoder.Decode(p.Payload, buf)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode Opus: %w", err)
+			}
+			pcm = append(pcm, buf[:n]...)
+			if r != nil {
+				return r.resample(pcm), nil
+			}
+			return pcm, nil
+		},
+		encode: func(pcm []int16) ([]byte, error) {
+			return encode(pcm), nil
+		},
+		packetizer:    rtp.NewPacketizer(transcodeMTU(), 0, 0, &codecs.G711Payloader{}, rtp.NewRandomSequencer(), codec.ClockRate),
+		frameSize:     frameSize,
+		frameDuration: uint32(frameSize),
+		sampleBytes:   sampleBytes,
+		// The clock rate is the sample rate, so the timestamp advances
+		// by the samples of each packet
+		packetSamples: (int(transcodeMTU()) - rtpHeaderSize) / sampleBytes,
+	}, nil
+}
+
+// transcode returns the packets for every complete frame available after
+// adding p.
+func (t *transcoder) transcode(p *rtp.Packet) ([]*rtp.Packet, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pcm, err := t.decode(p)
+	if err != nil {
+		return nil, err
+	}
+	t.pending = append(t.pending, pcm...)
+
+	var packets []*rtp.Packet
+	for len(t.pending) >= t.frameSize {
+		payload, err := t.encode(t.pending[:t.frameSize])
+		if err != nil {
+			return nil, err
+		}
+		t.pending = append(t.pending[:0], t.pending[t.frameSize:]...)
+		packets = append(packets, t.packetize(payload)...)
+	}
+	return packets, nil
+}
+
+// packetize returns the packets of an encoded frame. A PCM frame larger
+// than a packet, e.g. 20ms of 48kHz L16, is split with every packet timed
+// by its first sample rather than all of them by the frame's.
+func (t *transcoder) packetize(payload []byte) []*rtp.Packet {
+	if t.sampleBytes == 0 {
+		return t.packetizer.Packetize(payload, t.frameDuration)
+	}
+
+	var packets []*rtp.Packet
+	for size := t.packetSamples * t.sampleBytes; len(payload) > 0; {
+		n := min(size, len(payload))
+		packets = append(packets, t.packetizer.Packetize(payload[:n], uint32(n/t.sampleBytes))...)
+		payload = payload[n:]
+	}
+	return packets
+}
+
+// transcodeMTU is the RTP packet size transcoded audio is packetized to, so
+// with SRTP it stays within -mtu.
+func transcodeMTU() uint16 {
+	return uint16(mtu - srtpOverhead)
+}
+
+// offerTranscodedCodec returns the G.711 or L16 codec a device offered if
+// it didn't offer Opus, its audio then has to be transcoded.
+func offerTranscodedCodec(offer string) (webrtc.RTPCodecCapability, bool) {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.UnmarshalString(offer); err != nil {
+		return webrtc.RTPCodecCapability{}, false
+	}
+
+	var transcoded *webrtc.RTPCodecCapability
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "audio" {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.ParseUint(format, 10, 8)
+			if err != nil {
+				continue
+			}
+			codec, err := parsed.GetCodecForPayloadType(uint8(payloadType))
+			if err != nil {
+				continue
+			}
+
+			mimeType := "audio/" + codec.Name
+			switch {
+			case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+				return webrtc.RTPCodecCapability{}, false
+			case transcoded != nil || !isTranscoded(mimeType):
+			case isG711(mimeType):
+				transcoded = &webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 8000}
+			case acceptedL16Rate(codec.ClockRate):
+				transcoded = &webrtc.RTPCodecCapability{MimeType: mimeTypeL16, ClockRate: codec.ClockRate, Channels: 1}
+			}
+		}
+	}
+	if transcoded == nil {
+		return webrtc.RTPCodecCapability{}, false
+	}
+	return *transcoded, true
+}
+
+func acceptedL16Rate(clockRate uint32) bool {
+	for _, rate := range l16ClockRates {
+		if rate == clockRate {
+			return true
+		}
+	}
+	return false
+}
+
+// addDownlink adds the track carrying LiveKit audio to the session. Devices
+// that only offer G.711 or L16 get their own track fed by a transcoder, and
+// with -jitter-buffer, -announcements or -loopback every session gets its
+// own track, paced by a jitter buffer, with a player for announcements and
+// switchable to loopback, and with -intercom or -paging to hear other
+// devices. Sessions with a subscription selector get their
+// own track fed with the selected audio, with -multi-downlink Opus offers
+// with several audio m-lines get a track for each.
+func (app *App) addDownlink(s *session, offer string) error {
+	if _, transcoded := offerTranscodedCodec(offer); multiDownlink && !transcoded {
+		if sections := audioSections(offer); sections > 1 {
+			return app.addMultiDownlink(s, sections)
+		}
+	}
+
+	track := s.currentParticipant().downlink
+	var deliver func(p *rtp.Packet, inserted bool)
+	if codec, ok := offerTranscodedCodec(offer); ok {
+		t, err := newDownlinkTranscoder(codec)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidOffer, err)
+		}
+
+		transcodedTrack, err := newEventTrack(codec, "audio", s.id)
+		if err != nil {
+			return fmt.Errorf("failed to create %s track: %w", codec.MimeType, err)
+		}
+		track = transcodedTrack
+
+		deliver = func(p *rtp.Packet, _ bool) {
+			packets, err := t.transcode(p)
+			if err != nil {
+				log.Errorw("Failed to transcode downlink", err, "sessionID", s.id)
+				return
+			}
+			for _, packet := range packets {
+				if err := transcodedTrack.WriteRTP(packet); err != nil {
+					log.Errorw("Failed to write RTP packet to transcoded track", err, "sessionID", s.id)
+				}
+			}
+		}
+		log.Infow("Transcoding session audio", "sessionID", s.id, "codec", codec.MimeType, "clockRate", codec.ClockRate)
+	}
+
+	if (jitterDelay > 0 || announcements || loopbackTest || intercom || paging || s.selector != nil) && deliver == nil {
+		sessionTrack, err := newEventTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", s.id)
+		if err != nil {
+			return fmt.Errorf("failed to create session track: %w", err)
+		}
+		track = sessionTrack
+
+		deliver = func(p *rtp.Packet, inserted bool) {
+			write := sessionTrack.WriteRTP
+			if inserted {
+				write = sessionTrack.insertRTP
+			}
+			if err := write(p); err != nil {
+				log.Errorw("Failed to write RTP packet to session track", err, "sessionID", s.id)
+			}
+		}
+	}
+	if loopbackTest {
+		s.loopback = newLoopback(s.id, track, deliver)
+		deliver = s.loopback.forward
+	}
+	if paging {
+		s.pager = newPageGate(deliver)
+		deliver = s.pager.forward
+	}
+	if announcements {
+		s.player = newPlayer(s.id, deliver)
+		deliver = s.player.forward
+	}
+	if jitterDelay > 0 {
+		s.jitter = newJitterBuffer(opusClockRate, deliver)
+		deliver = s.jitter.push
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			s.jitter.run()
+		}()
+	}
+	if deliver != nil {
+		s.downlinkSink = deliver
+		s.attachDownlink(s.currentParticipant())
+	}
+
+	sender, err := s.pc.AddTrack(track)
+	if err != nil {
+		return fmt.Errorf("failed to add track: %w", err)
+	}
+	if adaptiveBitrate {
+		s.bitrate = newDownlinkBitrate()
+	}
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		if s.readReports(sender, track.Codec().ClockRate) {
+			app.goodbye(s)
+		}
+	}()
+	s.downlink, s.downlinkSender = track, sender
+	return nil
+}
+
+// transcodingWriter wraps write, which takes Opus packets, with an encoder
+// for audio from the device. Noise suppression, loudness normalization and
+// the session gain are applied before encoding,
+// with -vad silent audio is measured on the PCM and not forwarded. The
+// level of the PCM is sent to LiveKit with every packet.
+func transcodingWriter(s *session, decode func([]byte) []int16, sampleRate int, write func(*rtp.Packet) error) (func(*rtp.Packet) error, error) {
+	var v *voiceDetector
+	if vadEnabled {
+		v = newVoiceDetector()
+	}
+	suppressor := newNoiseSuppressor(sampleRate)
+	normalizer := newSessionNormalizer(s, sampleRate)
+
+	t, err := newUplinkTranscoder(func(payload []byte) []int16 {
+		pcm := decode(payload)
+		if suppressor != nil {
+			suppressor.process(pcm)
+		}
+		if v != nil {
+			wasActive := v.active()
+			v.update(pcm, sampleRate)
+			logVoiceChange(s, wasActive, v.active())
+		}
+		if normalizer != nil {
+			normalizer.process(pcm)
+		}
+		pcm = applyGain(pcm, s.gain())
+		s.setAudioLevel(audioLevel(pcm))
+		return pcm
+	}, sampleRate, s.encoder)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(p *rtp.Packet) error {
+		packets, err := t.transcode(p)
+		if err != nil {
+			return err
+		}
+		if v != nil && !v.active() {
+			return nil
+		}
+		for _, packet := range packets {
+			if err := write(packet); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+var errPrimaryAudioTaken = errors.New("session already sends audio")
+
+// onPCMDataChannel encodes raw PCM sent over the pcm data channel. Each
+// message carries 16 bit little endian mono samples at the rate in the
+// channel protocol, 16000 when it is empty.
+func (app *App) onPCMDataChannel(s *session, dc *webrtc.DataChannel) {
+	sampleRate := pcmSampleRate
+	if protocol := dc.Protocol(); protocol != "" {
+		rate, err := strconv.Atoi(protocol)
+		if err != nil || !acceptedL16Rate(uint32(rate)) {
+			log.Errorw("Unsupported PCM sample rate", err, "sessionID", s.id, "protocol", protocol)
+			_ = dc.Close()
+			return
+		}
+		sampleRate = rate
+	}
+
+	var write func(*rtp.Packet) error
+	err := errPrimaryAudioTaken
+	if s.claimPrimaryAudio() {
+		write, err = app.uplinkWriter(s)
+	}
+	if err == nil {
+		write, err = transcodingWriter(s, func(payload []byte) []int16 {
+			return decodeL16(binary.LittleEndian, payload)
+		}, sampleRate, write)
+	}
+	if err != nil {
+		log.Errorw("Failed to setup PCM data channel", err, "sessionID", s.id)
+		_ = dc.Close()
+		return
+	}
+
+	log.Infow("Encoding PCM from data channel", "sessionID", s.id, "sampleRate", sampleRate)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if err := write(&rtp.Packet{Payload: msg.Data}); err != nil {
+			log.Errorw("Failed to forward PCM", err, "sessionID", s.id)
+		}
+	})
+}
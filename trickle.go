@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const trickleICEContentType = "application/trickle-ice-sdpfrag"
+
+// candidatePollTimeout is how long a candidates GET blocks before returning
+// 204 No Content, short enough to stay under common HTTP client timeouts.
+const candidatePollTimeout = 25 * time.Second
+
+// sdpFragment is the subset of an application/trickle-ice-sdpfrag body the
+// bridge acts on.
+type sdpFragment struct {
+	ufrag, pwd      string
+	candidates      []webrtc.ICECandidateInit
+	endOfCandidates bool
+}
+
+// parseSDPFragment parses a trickle-ice-sdpfrag body as defined in RFC 8840.
+// Candidates are associated with the mid of the media section they follow.
+func parseSDPFragment(r io.Reader) (*sdpFragment, error) {
+	frag := &sdpFragment{}
+	var mid *string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "m="):
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			frag.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			frag.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			frag.candidates = append(frag.candidates, webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			})
+		case line == "a=end-of-candidates":
+			frag.endOfCandidates = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sdpfrag: %w", err)
+	}
+	return frag, nil
+}
+
+// iceCredentials returns the first ice-ufrag and ice-pwd found in an SDP.
+func iceCredentials(sdp string) (ufrag, pwd string) {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if ufrag == "" && strings.HasPrefix(line, "a=ice-ufrag:") {
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		}
+		if pwd == "" && strings.HasPrefix(line, "a=ice-pwd:") {
+			pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		}
+	}
+	return ufrag, pwd
+}
+
+// firstMediaSection returns the m= line and mid of the first media section
+// of sdp, which candidate fragments are sent for since media is bundled.
+func firstMediaSection(sdp string) (media, mid string) {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			if media != "" {
+				return media, mid
+			}
+			media = line
+		case media != "" && strings.HasPrefix(line, "a=mid:"):
+			return media, strings.TrimPrefix(line, "a=mid:")
+		}
+	}
+	return media, mid
+}
+
+// etag identifies the ICE session of s, it changes whenever ICE restarts.
+func (s *session) etag() string {
+	ufrag, _ := iceCredentials(s.pc.LocalDescription().SDP)
+	return `"` + ufrag + `"`
+}
+
+// trickleHandler adds the candidates from a PATCH on the session resource to
+// the existing PeerConnection. New ICE credentials restart ICE.
+func (app *App) trickleHandler(w http.ResponseWriter, r *http.Request, s *session) {
+	if s.pc.LocalDescription() == nil || s.pc.RemoteDescription() == nil {
+		writeError(w, r, "Session negotiation in progress", http.StatusConflict)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != trickleICEContentType {
+		writeError(w, r, "Unsupported media type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" && ifMatch != s.etag() {
+		writeError(w, r, "ICE session does not match", http.StatusPreconditionFailed)
+		return
+	}
+
+	frag, err := parseSDPFragment(r.Body)
+	if err != nil {
+		log.Errorw("Failed to parse sdpfrag", err, "sessionID", s.id)
+		writeError(w, r, "Failed to parse sdpfrag", http.StatusBadRequest)
+		return
+	}
+
+	if remoteUfrag, _ := iceCredentials(s.pc.RemoteDescription().SDP); frag.ufrag != "" && frag.ufrag != remoteUfrag {
+		app.restartICEHandler(w, r, s, frag)
+		return
+	}
+
+	for _, candidate := range frag.candidates {
+		if err := s.addRemoteCandidate(candidate); err != nil {
+			log.Errorw("Failed to add ICE candidate", err, "sessionID", s.id, "candidate", candidate.Candidate)
+			writeError(w, r, "Failed to add ICE candidate", http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Debugw("Added trickled ICE candidates", "sessionID", s.id, "count", len(frag.candidates), "endOfCandidates", frag.endOfCandidates)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restartICEHandler restarts ICE with the credentials from an sdpfrag
+// PATCH (RFC 9725 section 4.4.2) and answers with the bridge's new
+// credentials and candidates.
+func (app *App) restartICEHandler(w http.ResponseWriter, r *http.Request, s *session, frag *sdpFragment) {
+	if frag.pwd == "" {
+		writeError(w, r, "ICE restart requires ice-pwd", http.StatusBadRequest)
+		return
+	}
+
+	offer := withICECredentials(s.pc.RemoteDescription().SDP, frag.ufrag, frag.pwd)
+	if err := app.negotiate(s, offer); err != nil {
+		log.Errorw("Failed to restart ICE", err, "sessionID", s.id)
+		writeNegotiationError(w, r, err, "Failed to restart ICE")
+		return
+	}
+
+	for _, candidate := range frag.candidates {
+		if err := s.addRemoteCandidate(candidate); err != nil {
+			log.Errorw("Failed to add ICE candidate", err, "sessionID", s.id, "candidate", candidate.Candidate)
+		}
+	}
+
+	candidates, done, _ := s.localCandidatesAfter(0)
+	writeCandidateFragment(w, s, candidates, done)
+}
+
+// withICECredentials replaces the ICE credentials in sdp and drops the
+// candidates gathered for the old ones.
+func withICECredentials(sdp, ufrag, pwd string) string {
+	var out strings.Builder
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			line = "a=ice-ufrag:" + ufrag
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			line = "a=ice-pwd:" + pwd
+		case strings.HasPrefix(line, "a=candidate:"), line == "a=end-of-candidates":
+			continue
+		}
+		out.WriteString(line + "\r\n")
+	}
+	return out.String()
+}
+
+func (s *session) resetLocalCandidates() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.localCandidates = nil
+	s.gatheringDone = false
+	close(s.candidatesChanged)
+	s.candidatesChanged = make(chan struct{})
+}
+
+// addLocalCandidate records a candidate gathered by the bridge, nil marks
+// the end of gathering.
+func (s *session) addLocalCandidate(c *webrtc.ICECandidate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c == nil {
+		s.gatheringDone = true
+	} else {
+		s.localCandidates = append(s.localCandidates, c.ToJSON().Candidate)
+	}
+	close(s.candidatesChanged)
+	s.candidatesChanged = make(chan struct{})
+}
+
+// localCandidatesAfter returns the gathered candidates past the first n, if
+// gathering is done and a channel that is closed on the next change.
+func (s *session) localCandidatesAfter(n int) ([]string, bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var candidates []string
+	if n < len(s.localCandidates) {
+		candidates = append(candidates, s.localCandidates[n:]...)
+	}
+	return candidates, s.gatheringDone, s.candidatesChanged
+}
+
+// candidatesHandler is a trickle fallback for HTTP clients that can only
+// GET and POST. A GET blocks until the bridge has candidates past the
+// ?after= count the device already has, a POST adds device candidates.
+func (app *App) candidatesHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.authorize(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+	if !app.authorizeSession(w, r, s) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		app.pollCandidatesHandler(w, r, s)
+	case http.MethodPost:
+		app.trickleHandler(w, r, s)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) pollCandidatesHandler(w http.ResponseWriter, r *http.Request, s *session) {
+	after := 0
+	if value := r.URL.Query().Get("after"); value != "" {
+		var err error
+		if after, err = strconv.Atoi(value); err != nil || after < 0 {
+			writeError(w, r, "Invalid after parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	timeout := time.NewTimer(candidatePollTimeout)
+	defer timeout.Stop()
+
+	for {
+		candidates, done, changed := s.localCandidatesAfter(after)
+		if len(candidates) > 0 || done {
+			writeCandidateFragment(w, s, candidates, done)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		case <-app.ctx.Done():
+			writeError(w, r, "Server shutting down", http.StatusServiceUnavailable)
+			return
+		}
+	}
+}
+
+// writeCandidateFragment writes bridge candidates as a trickle-ice-sdpfrag.
+func writeCandidateFragment(w http.ResponseWriter, s *session, candidates []string, done bool) {
+	local := s.pc.LocalDescription().SDP
+	ufrag, pwd := iceCredentials(local)
+	media, mid := firstMediaSection(local)
+
+	var frag strings.Builder
+	fmt.Fprintf(&frag, "a=ice-ufrag:%s\r\na=ice-pwd:%s\r\n%s\r\na=mid:%s\r\n", ufrag, pwd, media, mid)
+	for _, candidate := range candidates {
+		fmt.Fprintf(&frag, "a=%s\r\n", candidate)
+	}
+	if done {
+		frag.WriteString("a=end-of-candidates\r\n")
+	}
+
+	w.Header().Set("Content-Type", trickleICEContentType)
+	w.Header().Set("ETag", s.etag())
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(w, frag.String()); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseSDPFragment(t *testing.T) {
+	mid := func(s string) *string { return &s }
+
+	for _, test := range []struct {
+		name string
+		body string
+		want *sdpFragment
+	}{
+		{
+			name: "empty",
+			body: "",
+			want: &sdpFragment{},
+		},
+		{
+			name: "candidates with mid",
+			body: "a=ice-ufrag:EsAw\r\n" +
+				"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+				"m=audio 9 UDP/TLS/RTP/SAVPF 0\r\n" +
+				"a=mid:0\r\n" +
+				"a=candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host\r\n" +
+				"a=candidate:2 1 udp 1694498815 203.0.113.7 6000 typ srflx raddr 192.168.1.2 rport 5000\r\n",
+			want: &sdpFragment{
+				ufrag: "EsAw",
+				pwd:   "P2uYro0UCOQ4zxjKXaWCBui1",
+				candidates: []webrtc.ICECandidateInit{
+					{Candidate: "candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host", SDPMid: mid("0")},
+					{Candidate: "candidate:2 1 udp 1694498815 203.0.113.7 6000 typ srflx raddr 192.168.1.2 rport 5000", SDPMid: mid("0")},
+				},
+			},
+		},
+		{
+			name: "mid resets per media section",
+			body: "m=audio 9 UDP/TLS/RTP/SAVPF 0\n" +
+				"a=mid:audio\n" +
+				"a=candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host\n" +
+				"m=video 9 UDP/TLS/RTP/SAVPF 96\n" +
+				"a=candidate:3 1 udp 2130706431 192.168.1.2 5002 typ host\n" +
+				"a=mid:video\n" +
+				"a=candidate:4 1 udp 2130706431 192.168.1.2 5004 typ host\n",
+			want: &sdpFragment{
+				candidates: []webrtc.ICECandidateInit{
+					{Candidate: "candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host", SDPMid: mid("audio")},
+					{Candidate: "candidate:3 1 udp 2130706431 192.168.1.2 5002 typ host"},
+					{Candidate: "candidate:4 1 udp 2130706431 192.168.1.2 5004 typ host", SDPMid: mid("video")},
+				},
+			},
+		},
+		{
+			name: "end of candidates",
+			body: "  a=candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host  \r\n\r\na=end-of-candidates\r\n",
+			want: &sdpFragment{
+				candidates:      []webrtc.ICECandidateInit{{Candidate: "candidate:1 1 udp 2130706431 192.168.1.2 5000 typ host"}},
+				endOfCandidates: true,
+			},
+		},
+		{
+			name: "ignores other lines",
+			body: "a=group:BUNDLE 0\r\na=ice-options:trickle\r\na=setup:actpass\r\n",
+			want: &sdpFragment{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseSDPFragment(strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseSDPFragment() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSDPFragmentTooLong(t *testing.T) {
+	body := "a=candidate:" + strings.Repeat("x", 128*1024) + "\r\n"
+	if _, err := parseSDPFragment(strings.NewReader(body)); err == nil {
+		t.Error("parseSDPFragment() succeeded, want an error for an oversized line")
+	}
+}
+
+func TestFirstMediaSection(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		sdp       string
+		wantMedia string
+		wantMid   string
+	}{
+		{
+			name:      "audio",
+			sdp:       "v=0\r\ns=-\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\n",
+			wantMedia: "m=audio 9 UDP/TLS/RTP/SAVPF 0",
+			wantMid:   "0",
+		},
+		{
+			name:      "data channel only",
+			sdp:       "v=0\r\ns=-\r\nm=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\na=mid:data\r\n",
+			wantMedia: "m=application 9 UDP/DTLS/SCTP webrtc-datachannel",
+			wantMid:   "data",
+		},
+		{
+			name:      "first section has no mid",
+			sdp:       "v=0\r\ns=-\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\n",
+			wantMedia: "m=audio 9 UDP/TLS/RTP/SAVPF 0",
+		},
+		{
+			name: "no media",
+			sdp:  "v=0\r\ns=-\r\na=mid:0\r\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			media, mid := firstMediaSection(test.sdp)
+			if media != test.wantMedia || mid != test.wantMid {
+				t.Errorf("firstMediaSection() = %q, %q, want %q, %q", media, mid, test.wantMedia, test.wantMid)
+			}
+		})
+	}
+}
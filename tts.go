@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ttsTimeout bounds a request to -tts-url.
+const ttsTimeout = 30 * time.Second
+
+var ttsClient = &http.Client{Timeout: ttsTimeout}
+
+// ttsRequest is what the bridge posts to -tts-url. The backend answers
+// with the speech as WAV or Ogg Opus.
+type ttsRequest struct {
+	Text  string `json:"text"`
+	Voice string `json:"voice,omitempty"`
+}
+
+// announceRequest is an announcement spoken to one device, a group of
+// devices from -config, or every device in a room.
+type announceRequest struct {
+	Text    string `json:"text"`
+	Voice   string `json:"voice,omitempty"`
+	Session string `json:"session,omitempty"`
+	Group   string `json:"group,omitempty"`
+	Room    string `json:"room,omitempty"`
+	// Mode is replace or mix, as for the play resource
+	Mode string `json:"mode,omitempty"`
+}
+
+type announceResponse struct {
+	Sessions   []string `json:"sessions"`
+	DurationMs int64    `json:"duration_ms"`
+}
+
+func validateTTSURL(rawURL string) error {
+	if rawURL == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("must be an http or https URL")
+	}
+	return nil
+}
+
+// synthesize has -tts-url speak text and returns it as mono PCM at 48kHz.
+func synthesize(ctx context.Context, text, voice string) ([]int16, error) {
+	body, err := json.Marshal(ttsRequest{Text: text, Voice: voice})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ttsURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TTS request: %w", err)
+	}
+	req.Header.Set("Content-Type", jsonContentType)
+	if ttsToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ttsToken)
+	}
+
+	res, err := ttsClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call TTS backend: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("TTS backend returned %s", res.Status)
+	}
+	audio, err := io.ReadAll(io.LimitReader(res.Body, maxAnnouncementSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TTS response: %w", err)
+	}
+	return decodeAnnouncement(audio)
+}
+
+// announcementTargets returns the sessions an announcement goes to.
+func (app *App) announcementTargets(req announceRequest) []*session {
+	app.sessionsMu.RLock()
+	defer app.sessionsMu.RUnlock()
+
+	var targets []*session
+	for _, s := range app.sessions {
+		if s.player == nil {
+			continue
+		}
+		switch {
+		case req.Session != "":
+			if s.id != req.Session {
+				continue
+			}
+		case req.Group != "":
+			if !s.inGroup(req.Group) {
+				continue
+			}
+		case s.currentParticipant().roomName != req.Room:
+			continue
+		}
+		targets = append(targets, s)
+	}
+	return targets
+}
+
+// announceHandler speaks text to devices through -tts-url. Announcements
+// are queued behind the ones still playing on a device.
+func (app *App) announceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	var req announceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Text == "" {
+		writeError(w, r, "text is required", http.StatusBadRequest)
+		return
+	}
+	targets := 0
+	for _, target := range []string{req.Session, req.Group, req.Room} {
+		if target != "" {
+			targets++
+		}
+	}
+	if targets != 1 {
+		writeError(w, r, "exactly one of session, group or room is required", http.StatusBadRequest)
+		return
+	}
+	var mix bool
+	switch req.Mode {
+	case "", "replace":
+	case "mix":
+		mix = true
+	default:
+		writeError(w, r, fmt.Sprintf("unknown mode %q, must be replace or mix", req.Mode), http.StatusBadRequest)
+		return
+	}
+
+	sessions := app.announcementTargets(req)
+	if len(sessions) == 0 {
+		writeError(w, r, "No sessions to announce to", http.StatusNotFound)
+		return
+	}
+
+	pcm, err := synthesize(r.Context(), req.Text, req.Voice)
+	if err != nil {
+		log.Errorw("Failed to synthesize announcement", err)
+		writeError(w, r, "Failed to synthesize announcement", http.StatusBadGateway)
+		return
+	}
+
+	res := announceResponse{Sessions: []string{}, DurationMs: announcementDuration(pcm).Milliseconds()}
+	for _, s := range sessions {
+		if err := s.player.enqueue(pcm, mix); err != nil {
+			log.Errorw("Failed to queue announcement", err, "sessionID", s.id)
+			continue
+		}
+		res.Sessions = append(res.Sessions, s.id)
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+}
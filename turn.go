@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// listenTURN starts the TURN server configured by -turn-addr, devices that
+// can't reach the bridge directly relay through it. Credentials are minted
+// per session from -turn-secret as in the TURN REST API.
+func (app *App) listenTURN() error {
+	conn, err := net.ListenPacket("udp4", turnAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", turnAddr, err)
+	}
+
+	app.turn, err = turn.NewServer(turn.ServerConfig{
+		Realm:       turnRealm,
+		AuthHandler: turn.LongTermTURNRESTAuthHandler(turnSecret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: conn,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP(turnRelayIP),
+				Address:      "0.0.0.0",
+			},
+		}},
+	})
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to start TURN server: %w", err)
+	}
+
+	log.Infow("TURN server listening", "addr", conn.LocalAddr(), "relayIP", turnRelayIP)
+	return nil
+}
+
+// turnServer returns the embedded TURN server with credentials for user,
+// valid for -turn-ttl.
+func (app *App) turnServer(user string) (webrtc.ICEServer, error) {
+	username, credential, err := turn.GenerateLongTermTURNRESTCredentials(turnSecret, user, turnTTL)
+	if err != nil {
+		return webrtc.ICEServer{}, fmt.Errorf("failed to generate TURN credentials: %w", err)
+	}
+
+	_, port, _ := net.SplitHostPort(turnAddr)
+	return webrtc.ICEServer{
+		URLs:       []string{"turn:" + net.JoinHostPort(turnRelayIP, port) + "?transport=udp"},
+		Username:   username,
+		Credential: credential,
+	}, nil
+}
+
+// advertisedICEServers are the ICE servers handed to a device, the
+// embedded TURN server included with credentials for user when set.
+func (app *App) advertisedICEServers(user string) []webrtc.ICEServer {
+	if app.turn == nil || user == "" {
+		return iceServers
+	}
+
+	server, err := app.turnServer(user)
+	if err != nil {
+		log.Errorw("Failed to advertise TURN server", err, "user", user)
+		return iceServers
+	}
+	return append([]webrtc.ICEServer{server}, iceServers...)
+}
+
+// validateTURN checks the -turn flags, generating a secret when none was
+// given.
+func validateTURN() error {
+	if turnAddr == "" {
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(turnAddr)
+	if err == nil {
+		_, err = strconv.Atoi(port)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid turn-addr %q", turnAddr)
+	}
+	if ip := net.ParseIP(turnRelayIP); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("turn-relay-ip must be the IPv4 address devices reach the bridge at")
+	}
+	if turnTTL <= 0 {
+		return fmt.Errorf("turn-ttl must be positive")
+	}
+	if turnSecret == "" {
+		// Credentials only need to outlive this process
+		turnSecret = rand.Text()
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/livekit/protocol/livekit"
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// onTrack forwards a track the device is sending. The first audio track
+// feeds the bridge's LiveKit audio track, any other track (e.g. a camera
+// enabled by renegotiation) is published to LiveKit on its own.
+func (app *App) onTrack(s *session, track *webrtc.TrackRemote) {
+	log.Infow("Track received from peer connection", "sessionID", s.id, "kind", track.Kind(), "codec", track.Codec().MimeType)
+
+	var write func(*rtp.Packet) error
+	// loop is the loopback of the primary audio, talk set when it is
+	// forwarded to the intercom and paged groups
+	var loop *loopback
+	var talk, primary bool
+	if track.Kind() == webrtc.RTPCodecTypeAudio && s.claimPrimaryAudio() {
+		primary = true
+		loop = s.loopback
+		codec := track.Codec()
+		talk = (intercom || paging) && strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus)
+		var err error
+		if !isTranscoded(codec.MimeType) {
+			// Stereo passed through or split gets tracks of its own
+			write, err = app.stereoWriter(s)
+		}
+		if write == nil && err == nil {
+			write, err = app.uplinkWriter(s)
+			if err == nil && isTranscoded(codec.MimeType) {
+				// G.711 and L16 are encoded to Opus before they
+				// reach the embedded track
+				write, err = transcodingWriter(s, pcmDecoder(codec.MimeType), int(codec.ClockRate), write)
+			} else if err == nil {
+				write, err = opusWriter(s, write)
+			}
+		}
+		if err != nil {
+			log.Errorw("Failed to forward audio", err, "sessionID", s.id, "codec", codec.MimeType)
+			return
+		}
+		s.applyPTT()
+	} else {
+		localTrack, err := app.publishSessionTrack(s, track)
+		if err != nil {
+			log.Errorw("Failed to publish track", err, "sessionID", s.id)
+			return
+		}
+		write = func(p *rtp.Packet) error {
+			if err := localTrack.WriteRTP(p, nil); err != nil {
+				return err
+			}
+			s.stats.published(len(p.Payload))
+			return nil
+		}
+	}
+
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		defer log.Infow("Peer connection track reading goroutine terminated", "sessionID", s.id, "kind", track.Kind())
+
+		var dtmf dtmfDetector
+
+		for {
+			select {
+			case <-app.ctx.Done():
+				log.Infow("Context cancelled, stopping peer track reading")
+				return
+			default:
+				rtpPacket, _, rtpErr := track.ReadRTP()
+				if rtpErr != nil {
+					if rtpErr == io.EOF {
+						log.Infow("Peer track ended", "sessionID", s.id)
+					} else {
+						log.Errorw("Failed to read RTP packet from peer", rtpErr, "sessionID", s.id)
+					}
+					return
+				}
+
+				s.stats.received(len(rtpPacket.Payload))
+				s.quality.observe(rtpPacket, track.Codec().ClockRate, time.Now())
+
+				// Keypad presses share the audio SSRC under the
+				// telephone-event payload type
+				if isTelephoneEvent(track.Codec().MimeType) {
+					if digit, ok := dtmf.detect(rtpPacket); ok {
+						forwardDTMF(s, digit)
+					}
+					continue
+				}
+
+				packets := []*rtp.Packet{rtpPacket}
+				if primary {
+					packets = s.drift.compensate(track.Codec(), rtpPacket, time.Now())
+				}
+				for _, rtpPacket := range packets {
+					if primary && s.pttReleased.Load() {
+						continue
+					}
+					if loop != nil && loop.echo(track.Codec(), rtpPacket) {
+						continue
+					}
+					if talk {
+						app.forwardIntercom(s, rtpPacket)
+						app.pageFromSession(s, rtpPacket)
+					}
+
+					if rtpErr = write(rtpPacket); rtpErr != nil {
+						log.Errorw("Failed to forward RTP packet", rtpErr, "sessionID", s.id)
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// uplinkWriter publishes the embedded track of the session, in its room and
+// every fan-out room, and returns the writer for its primary audio. Opus
+// packets are sent to the embedded tracks and WHEP viewers. The audio level
+// extension is added when the session audio is measured.
+func (app *App) uplinkWriter(s *session) (func(*rtp.Packet) error, error) {
+	var uplinks []*lksdk.LocalTrack
+	participants := append([]*participant{s.currentParticipant()}, s.fanOut...)
+	if standalone() {
+		// Only the intercom and WHEP viewers hear the device
+		participants = nil
+	}
+	for _, p := range participants {
+		uplink, err := publishParticipantTrack(s, p, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, &lksdk.TrackPublicationOptions{
+			Name:   s.trackName,
+			Source: s.trackSource,
+		})
+		if err != nil {
+			return nil, err
+		}
+		uplinks = append(uplinks, uplink)
+	}
+
+	return func(p *rtp.Packet) error {
+		var opts *lksdk.SampleWriteOptions
+		if level := s.audioLevel(); level != nil {
+			opts = &lksdk.SampleWriteOptions{AudioLevel: level}
+		}
+		for _, uplink := range uplinks {
+			if err := uplink.WriteRTP(p, opts); err != nil {
+				return fmt.Errorf("failed to write RTP packet to embedded track: %w", err)
+			}
+			s.stats.published(len(p.Payload))
+		}
+
+		if err := s.monitorTrack.WriteRTP(p); err != nil {
+			log.Errorw("Failed to write RTP packet to monitor track", err, "sessionID", s.id)
+		}
+		return nil
+	}, nil
+}
+
+// claimPrimaryAudio returns true for the first audio track of a session.
+func (s *session) claimPrimaryAudio() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.primaryAudio {
+		return false
+	}
+	s.primaryAudio = true
+	return true
+}
+
+// publishSessionTrack publishes a LiveKit track matching the codec of a
+// device track. It is unpublished when the session closes.
+func (app *App) publishSessionTrack(s *session, track *webrtc.TrackRemote) (*lksdk.LocalTrack, error) {
+	var opts []lksdk.LocalTrackOptions
+	source := livekit.TrackSource_UNKNOWN
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		source = livekit.TrackSource_CAMERA
+		forwarder := newKeyframeForwarder(s, track)
+		opts = append(opts, lksdk.WithRTCPHandler(forwarder.forward))
+	}
+
+	return publishLocalTrack(s, track.Codec().RTPCodecCapability, &lksdk.TrackPublicationOptions{
+		Name:   fmt.Sprintf("embedded-%s-%s", track.Kind(), s.id),
+		Source: source,
+	}, opts...)
+}
+
+// trackSources are the sources the embedded track can be published as.
+// LiveKit publishes audio without a source as a microphone.
+var trackSources = map[string]livekit.TrackSource{
+	"microphone":         livekit.TrackSource_MICROPHONE,
+	"screen_share_audio": livekit.TrackSource_SCREEN_SHARE_AUDIO,
+}
+
+func parseTrackSource(source string) (livekit.TrackSource, error) {
+	parsed, ok := trackSources[source]
+	if !ok {
+		return livekit.TrackSource_UNKNOWN, fmt.Errorf("unknown track source %q, must be microphone or screen_share_audio", source)
+	}
+	return parsed, nil
+}
+
+// sourceOf returns a track source validated by parseTrackSource.
+func sourceOf(source string) livekit.TrackSource {
+	parsed, _ := parseTrackSource(source)
+	return parsed
+}
+
+func validateMetadata(metadata string) error {
+	if metadata != "" && !json.Valid([]byte(metadata)) {
+		return fmt.Errorf("metadata must be JSON")
+	}
+	return nil
+}
+
+// publication is a track published by a session in the room of
+// participant.
+type publication struct {
+	participant *participant
+	sid         string
+	// track and options republish it when the session moves
+	track   *lksdk.LocalTrack
+	options lksdk.TrackPublicationOptions
+}
+
+// publishLocalTrack publishes a track owned by the session, it is
+// unpublished when the session closes.
+func publishLocalTrack(s *session, codec webrtc.RTPCodecCapability, publication *lksdk.TrackPublicationOptions, opts ...lksdk.LocalTrackOptions) (*lksdk.LocalTrack, error) {
+	return publishParticipantTrack(s, s.currentParticipant(), codec, publication, opts...)
+}
+
+// publishParticipantTrack publishes a track owned by the session in the
+// room of p, which is the session participant or one of its fan-out.
+func publishParticipantTrack(s *session, p *participant, codec webrtc.RTPCodecCapability, options *lksdk.TrackPublicationOptions, opts ...lksdk.LocalTrackOptions) (*lksdk.LocalTrack, error) {
+	if track := s.adoptPublication(p, codec, options); track != nil {
+		return track, nil
+	}
+
+	localTrack, err := lksdk.NewLocalTrack(codec, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local track: %w", err)
+	}
+
+	published, err := p.room.LocalParticipant.PublishTrack(localTrack, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish track: %w", err)
+	}
+
+	s.mu.Lock()
+	s.publications = append(s.publications, publication{participant: p, sid: published.SID(), track: localTrack, options: *options})
+	routeTo := s.routeTo
+	s.mu.Unlock()
+	p.setRoute(published.SID(), routeTo)
+
+	log.Infow("Published session track", "sessionID", s.id, "room", p.roomName, "trackSID", published.SID(), "name", options.Name)
+	return localTrack, nil
+}
+
+func (app *App) unpublishSessionTracks(s *session) {
+	s.mu.Lock()
+	publications := append(s.publications, s.resumable...)
+	s.publications, s.resumable = nil, nil
+	s.mu.Unlock()
+
+	for _, published := range publications {
+		if err := published.participant.room.LocalParticipant.UnpublishTrack(published.sid); err != nil {
+			log.Errorw("Failed to unpublish track", err, "sessionID", s.id, "trackSID", published.sid)
+		}
+		published.participant.removeRoute(published.sid)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// voiceDetector is an energy based voice activity detector. Audio above
+// the threshold is voice, it stays active for the hangover after the last
+// loud frame so pauses between words aren't cut.
+type voiceDetector struct {
+	// threshold is the RMS amplitude of voice
+	threshold float64
+	hangover  time.Duration
+	// silence is how much quiet audio followed the last voice, it starts
+	// at the hangover so a device that is silent from the start is
+	// suppressed right away
+	silence time.Duration
+}
+
+func newVoiceDetector() *voiceDetector {
+	return &voiceDetector{
+		threshold: math.MaxInt16 * math.Pow(10, vadThreshold/20),
+		hangover:  vadHangover,
+		silence:   vadHangover,
+	}
+}
+
+// update measures a frame of audio at sampleRate.
+func (v *voiceDetector) update(pcm []int16, sampleRate int) {
+	if len(pcm) == 0 {
+		return
+	}
+
+	if rms(pcm) >= v.threshold {
+		v.silence = 0
+		return
+	}
+	v.silence += time.Duration(len(pcm)) * time.Second / time.Duration(sampleRate)
+}
+
+// active reports if audio should be forwarded.
+func (v *voiceDetector) active() bool {
+	return v.silence < v.hangover
+}
+
+func logVoiceChange(s *session, wasActive, active bool) {
+	switch {
+	case wasActive && !active:
+		log.Debugw("Device silent, suppressing audio", "sessionID", s.id)
+	case !wasActive && active:
+		log.Debugw("Device voice detected, forwarding audio", "sessionID", s.id)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	lksdk "github.com/livekit/server-sdk-go/v2"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// staleCheckInterval is how often sessions are checked against
+	// -stale-timeout
+	staleCheckInterval = 2 * time.Second
+	// lifecycleTopic is the LiveKit data topic session lifecycle events
+	// are published on
+	lifecycleTopic = "session-lifecycle"
+)
+
+// lifecycleEvent is published to the room when the bridge ends a session
+// on its own.
+type lifecycleEvent struct {
+	Event       string  `json:"event"`
+	SessionID   string  `json:"session_id"`
+	Identity    string  `json:"identity"`
+	IdleSeconds float64 `json:"idle_seconds"`
+}
+
+// lastHeard is when the device last sent RTP or STUN, consent checks and
+// keepalive responses included, or when the session was created.
+func (s *session) lastHeard() time.Time {
+	last := s.createdAt
+	if received := s.stats.lastReceived.Load(); received != 0 {
+		last = maxTime(last, time.Unix(0, received))
+	}
+	// The selected pair stats of the ICETransport have no timestamps
+	for _, stats := range s.pc.GetStats() {
+		if pair, ok := stats.(webrtc.ICECandidatePairStats); ok {
+			last = maxTime(last, pair.LastRequestReceivedTimestamp.Time())
+			last = maxTime(last, pair.LastResponseTimestamp.Time())
+		}
+	}
+	return last
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// closeStaleSessions ends every session silent for -stale-timeout until
+// the app is shut down, devices that brown out never close their session.
+func (app *App) closeStaleSessions() {
+	ticker := time.NewTicker(staleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, s := range app.sessionList() {
+			idle := time.Since(s.lastHeard())
+			if idle < staleTimeout {
+				continue
+			}
+
+			log.Infow("Closing stale session", "sessionID", s.id, "idle", idle)
+			s.publishLifecycle("stale", idle)
+			app.closeSession(s.id)
+		}
+	}
+}
+
+// publishLifecycle tells the room the session is ending, before its tracks
+// are unpublished.
+func (s *session) publishLifecycle(event string, idle time.Duration) {
+	p := s.currentParticipant()
+	payload, err := json.Marshal(lifecycleEvent{
+		Event:       event,
+		SessionID:   s.id,
+		Identity:    p.identity,
+		IdleSeconds: idle.Seconds(),
+	})
+	if err != nil {
+		log.Errorw("Failed to encode lifecycle event", err, "sessionID", s.id)
+		return
+	}
+
+	if err := p.room.LocalParticipant.PublishDataPacket(
+		lksdk.UserData(payload),
+		lksdk.WithDataPublishTopic(lifecycleTopic),
+		lksdk.WithDataPublishReliable(true),
+	); err != nil {
+		log.Errorw("Failed to publish lifecycle event", err, "sessionID", s.id)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const whepPath = "/whep/"
+
+// whepHandler lets a WHEP client (browser, gstreamer whepsrc) subscribe to
+// the audio a device is publishing, without going through LiveKit.
+func (app *App) whepHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorize(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+	if !app.authorizeSession(w, r, s) {
+		return
+	}
+
+	offer, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Errorw("Failed to read request body", err)
+		writeError(w, r, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	pc, _, err := newPeerConnection(app.api, app.peerConnectionConfig())
+	if err != nil {
+		log.Errorw("Failed to create viewer peer connection", err)
+		writeError(w, r, "Failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	viewerID := rand.Text()
+	closeViewer := func() {
+		s.removeViewer(viewerID)
+	}
+	s.addViewer(viewerID, pc)
+
+	sender, err := pc.AddTrack(s.monitorTrack)
+	if err != nil {
+		log.Errorw("Failed to add monitor track", err, "sessionID", s.id)
+		writeError(w, r, "Failed to add track", http.StatusInternalServerError)
+		closeViewer()
+		return
+	}
+
+	// Read RTCP so interceptors run
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Infow("Viewer ICE connection state changed", "state", state, "sessionID", s.id, "viewerID", viewerID)
+		if state == webrtc.ICEConnectionStateFailed ||
+			state == webrtc.ICEConnectionStateDisconnected ||
+			state == webrtc.ICEConnectionStateClosed {
+			closeViewer()
+		}
+	})
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offer),
+	}); err != nil {
+		log.Errorw("Failed to set viewer remote description", err)
+		writeError(w, r, "Invalid offer", http.StatusBadRequest)
+		closeViewer()
+		return
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		log.Errorw("Failed to create viewer answer", err)
+		writeError(w, r, "Failed to create answer", http.StatusInternalServerError)
+		closeViewer()
+		return
+	}
+
+	if err := pc.SetLocalDescription(answer); err != nil {
+		log.Errorw("Failed to set viewer local description", err)
+		writeError(w, r, "Failed to set local description", http.StatusInternalServerError)
+		closeViewer()
+		return
+	}
+
+	select {
+	case <-webrtc.GatheringCompletePromise(pc):
+	case <-time.After(10 * time.Second):
+		log.Infow("Viewer ICE gathering timeout", "sessionID", s.id)
+		writeError(w, r, "ICE gathering timeout", http.StatusInternalServerError)
+		closeViewer()
+		return
+	case <-app.ctx.Done():
+		writeError(w, r, "Server shutting down", http.StatusServiceUnavailable)
+		closeViewer()
+		return
+	}
+
+	app.setICEServerLinks(w, s.id+"-"+viewerID)
+	w.Header().Set("Content-Type", sdpContentType)
+	location := whepPath + s.id + "/" + viewerID
+	if isVersioned(r) {
+		location = apiPrefix + location
+	}
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+
+	if _, err := io.WriteString(w, pc.LocalDescription().SDP); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+
+	log.Infow("WHEP viewer connected", "sessionID", s.id, "viewerID", viewerID)
+}
+
+// whepViewerHandler tears down a single WHEP viewer.
+func (app *App) whepViewerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.authorize(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if ok && !app.authorizeSession(w, r, s) {
+		return
+	}
+	if !ok || !s.removeViewer(r.PathValue("viewer")) {
+		writeError(w, r, "Viewer not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *session) addViewer(id string, pc *webrtc.PeerConnection) {
+	s.viewersMu.Lock()
+	defer s.viewersMu.Unlock()
+
+	s.viewers[id] = pc
+}
+
+// removeViewer closes and removes a viewer, returning false if it didn't exist.
+func (s *session) removeViewer(id string) bool {
+	s.viewersMu.Lock()
+	pc, ok := s.viewers[id]
+	delete(s.viewers, id)
+	s.viewersMu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if err := pc.Close(); err != nil {
+		log.Errorw("Failed to close viewer peer connection", err, "sessionID", s.id, "viewerID", id)
+	}
+	return true
+}
+
+func (s *session) closeViewers() {
+	s.viewersMu.Lock()
+	ids := make([]string, 0, len(s.viewers))
+	for id := range s.viewers {
+		ids = append(ids, id)
+	}
+	s.viewersMu.Unlock()
+
+	for _, id := range ids {
+		s.removeViewer(id)
+	}
+}
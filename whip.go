@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	sdpContentType  = "application/sdp"
+	jsonContentType = "application/json"
+	sessionPath     = "/session/"
+
+	roomHeader     = "X-LiveKit-Room"
+	identityHeader = "X-LiveKit-Identity"
+	// deviceMACHeader and deviceSerialHeader fill -identity-template
+	deviceMACHeader    = "X-Device-MAC"
+	deviceSerialHeader = "X-Device-Serial"
+
+	// claimHeader carries a claim code on the first connect of a device,
+	// the issued credential is returned in deviceCredentialHeader
+	claimHeader            = "X-Claim-Code"
+	deviceIDHeader         = "X-Device-ID"
+	deviceCredentialHeader = "X-Device-Credential"
+)
+
+// sessionAnswer is the response to an offer sent in a JSON envelope.
+type sessionAnswer struct {
+	Answer    string `json:"sdp"`
+	SessionID string `json:"session_id"`
+}
+
+// connectHandler implements the WHIP endpoint. Devices POST an SDP offer and
+// receive the answer along with a Location header for the session resource.
+func (app *App) connectHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodOptions:
+		app.setICEServerLinks(w, "")
+		w.Header().Set("Accept-Post", strings.Join([]string{sdpContentType, cborContentType, jsonContentType, protobufContentType}, ", "))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// A device pairing with a claim code has no credential yet
+	var device *registeredDevice
+	claimCode := r.Header.Get(claimHeader)
+	if claimCode != "" {
+		var ok bool
+		if device, ok = app.registry.claimed(claimCode); !ok {
+			writeError(w, r, "Invalid claim code", http.StatusForbidden)
+			return
+		}
+	} else if !app.authorize(w, r) {
+		return
+	} else {
+		device = app.pairedDevice(requestToken(r))
+	}
+
+	// Older firmware omits the Content-Type entirely, treat that as SDP
+	mediaType := sdpContentType
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			writeError(w, r, "Unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	if mediaType == protobufContentType {
+		// Only the formats below can carry the issued credential back
+		if claimCode != "" {
+			writeError(w, r, "Claim codes require an SDP, CBOR or JSON offer", http.StatusBadRequest)
+			return
+		}
+		app.protobufHandler(w, r, device)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Errorw("Failed to read request body", err)
+		writeError(w, r, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// The target room and identity come from headers, or the JSON envelope,
+	// unless a paired device connects
+	req := sessionRequest{
+		Room:     r.Header.Get(roomHeader),
+		Identity: r.Header.Get(identityHeader),
+		MAC:      r.Header.Get(deviceMACHeader),
+		Serial:   r.Header.Get(deviceSerialHeader),
+		device:   device,
+	}
+	if loopback := r.URL.Query().Get("loopback"); loopback != "" {
+		if req.Loopback, err = strconv.ParseBool(loopback); err != nil {
+			writeError(w, r, "Invalid loopback parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	switch mediaType {
+	case sdpContentType:
+		req.Offer = string(body)
+	case cborContentType:
+		if req.Offer, err = compactOfferToSDP(body); err != nil {
+			log.Errorw("Failed to decode compact offer", err)
+			writeError(w, r, "Invalid compact offer", http.StatusBadRequest)
+			return
+		}
+	case jsonContentType:
+		if err = json.Unmarshal(body, &req); err != nil {
+			log.Errorw("Failed to decode JSON offer", err)
+			writeError(w, r, "Invalid JSON offer", http.StatusBadRequest)
+			return
+		}
+	default:
+		writeError(w, r, "Unsupported media type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	s, err := app.createSession(req)
+	if err != nil {
+		log.Errorw("Failed to create session", err)
+		writeNegotiationError(w, r, err, "Failed to create session")
+		return
+	}
+
+	// Answer in the same format the offer was sent in
+	answer := []byte(s.answer())
+	switch mediaType {
+	case cborContentType:
+		answer, err = sdpToCompactAnswer(orderCandidates(s.localDescription()))
+	case jsonContentType:
+		answer, err = json.Marshal(sessionAnswer{Answer: s.answer(), SessionID: s.id})
+	}
+	if err != nil {
+		log.Errorw("Failed to encode answer", err, "sessionID", s.id)
+		writeError(w, r, "Failed to encode answer", http.StatusInternalServerError)
+		app.closeSession(s.id)
+		return
+	}
+
+	if claimCode != "" {
+		device, credential, err := app.registry.redeem(claimCode)
+		if err != nil {
+			log.Errorw("Failed to redeem claim code", err, "sessionID", s.id)
+			writeError(w, r, "Invalid claim code", http.StatusForbidden)
+			app.closeSession(s.id)
+			return
+		}
+		w.Header().Set(deviceIDHeader, device.ID)
+		w.Header().Set(deviceCredentialHeader, credential)
+		log.Infow("Device claimed", "deviceID", device.ID, "name", device.Name)
+	}
+
+	app.setICEServerLinks(w, s.id)
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Location", sessionLocation(r, s.id))
+	w.Header().Set("ETag", s.etag())
+	w.Header().Set("Accept-Patch", trickleICEContentType+", "+sdpContentType)
+	w.WriteHeader(http.StatusCreated)
+
+	if _, err := w.Write(answer); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+
+	log.Infow("Successfully handled connect request", "sessionID", s.id)
+}
+
+// sessionHandler serves the per-session resource returned in the Location
+// header of a WHIP answer.
+func (app *App) sessionHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.authorize(w, r) {
+		return
+	}
+
+	s, ok := app.getSession(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+	if !app.authorizeSession(w, r, s) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == sdpContentType {
+			app.renegotiateHandler(w, r, s)
+		} else {
+			app.trickleHandler(w, r, s)
+		}
+	case http.MethodDelete:
+		app.closeSession(s.id)
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// renegotiateHandler applies an updated offer from the device, e.g. when it
+// adds a camera after boot, and returns the new answer.
+func (app *App) renegotiateHandler(w http.ResponseWriter, r *http.Request, s *session) {
+	offer, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Errorw("Failed to read request body", err)
+		writeError(w, r, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.negotiate(s, string(offer)); err != nil {
+		log.Errorw("Failed to renegotiate session", err, "sessionID", s.id)
+		writeNegotiationError(w, r, err, "Failed to renegotiate session")
+		return
+	}
+
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("ETag", s.etag())
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(w, s.answer()); err != nil {
+		log.Errorw("Failed to write response", err)
+	}
+
+	log.Infow("Session renegotiated", "sessionID", s.id)
+}
+
+// writeNegotiationError maps an error from createSession or negotiate to
+// an HTTP status. Client errors carry the underlying error as details.
+func writeNegotiationError(w http.ResponseWriter, r *http.Request, err error, fallback string) {
+	status, code, message := negotiationErrorStatus(err)
+	if message == "" {
+		message = fallback
+	}
+
+	details := ""
+	if status < http.StatusInternalServerError {
+		details = err.Error()
+	}
+	writeAPIError(w, r, status, code, message, details)
+}
+
+// negotiationErrorStatus returns the HTTP status, error code and message
+// for a signaling error. The message is empty for unexpected errors.
+func negotiationErrorStatus(err error) (int, string, string) {
+	switch {
+	case errors.Is(err, errInvalidOffer):
+		return http.StatusBadRequest, "invalid_offer", "Invalid offer"
+	case errors.Is(err, errUnexpectedMessage):
+		return http.StatusBadRequest, "unexpected_message", "Unexpected message"
+	case errors.Is(err, errTargetNotAllowed):
+		return http.StatusForbidden, "target_not_allowed", "Room or identity not allowed"
+	case errors.Is(err, errSessionNotFound):
+		return http.StatusNotFound, "not_found", "Session not found"
+	case errors.Is(err, errSessionNotAllowed):
+		return http.StatusForbidden, "session_not_allowed", "Session belongs to another device"
+	case errors.Is(err, errShuttingDown):
+		return http.StatusServiceUnavailable, "shutting_down", "Server shutting down"
+	default:
+		return http.StatusInternalServerError, "internal_error", ""
+	}
+}
+
+// authorize enforces the Bearer token when one is configured. On failure the
+// response has already been written and false is returned.
+func (app *App) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if !app.authRequired() {
+		return true
+	}
+
+	if !app.validToken(requestToken(r)) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="livekit-microcontroller-bridge"`)
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// authorizeSession rejects the credential of a paired device on the session
+// of another device, static tokens reach every session. It follows
+// authorize, on failure the response has already been written and false is
+// returned.
+func (app *App) authorizeSession(w http.ResponseWriter, r *http.Request, s *session) bool {
+	if !s.ownedBy(app.pairedDevice(requestToken(r))) {
+		writeError(w, r, "Session belongs to another device", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authRequired reports if signaling requests need a credential, either
+// -bearer-token, a token of the config file or, with -registry or once a
+// device was paired, the credential issued to a device.
+func (app *App) authRequired() bool {
+	return bearerToken != "" || len(cfg.Tokens) > 0 || registryFile != "" || app.registry.paired()
+}
+
+// requestToken returns the Bearer token of r, empty when there is none.
+func requestToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return token
+}
+
+func (app *App) validToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, validator := range app.validators {
+		if name, ok := validator.validate(token); ok {
+			log.Debugw("Authorized signaling request", "as", name)
+			return true
+		}
+	}
+	return false
+}
+
+// setICEServerLinks advertises the configured ICE servers using the Link
+// header format from the WHIP specification. The embedded TURN server is
+// only advertised with credentials for user.
+func (app *App) setICEServerLinks(w http.ResponseWriter, user string) {
+	for _, server := range app.advertisedICEServers(user) {
+		for _, url := range server.URLs {
+			link := fmt.Sprintf(`<%s>; rel="ice-server"`, url)
+			if server.Username != "" {
+				link += fmt.Sprintf(`; username="%s"; credential="%s"; credential-type="password"`, server.Username, server.Credential)
+			}
+			w.Header().Add("Link", link)
+		}
+	}
+}
+
+// parseICEServers parses a comma separated list of ICE server URLs. TURN
+// credentials may be supplied inline as turn:username:credential@host:port.
+func parseICEServers(value string) ([]webrtc.ICEServer, error) {
+	var servers []webrtc.ICEServer
+	for _, raw := range strings.Split(value, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		scheme, rest, ok := strings.Cut(raw, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid ice server %q", raw)
+		}
+
+		server := webrtc.ICEServer{}
+		if creds, address, hasCreds := strings.Cut(rest, "@"); hasCreds {
+			username, credential, ok := strings.Cut(creds, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid credentials for ice server %q", raw)
+			}
+			server.Username, server.Credential = username, credential
+			rest = address
+		}
+
+		server.URLs = []string{scheme + ":" + rest}
+		if err := validateICEServerURL(server.URLs[0]); err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// validateICEServerURL checks that url is a STUN or TURN server.
+func validateICEServerURL(url string) error {
+	scheme, _, ok := strings.Cut(url, ":")
+	if !ok {
+		return fmt.Errorf("invalid ice server %q", url)
+	}
+	switch scheme {
+	case "stun", "stuns", "turn", "turns":
+		return nil
+	default:
+		return fmt.Errorf("unsupported ice server scheme %q", scheme)
+	}
+}